@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Stable, machine readable error codes. Messages may change; these don't.
+const (
+	codeInvalidJSON         = "invalid_json"
+	codeInvalidInput        = "invalid_input"
+	codeInvalidIP           = "invalid_ip"
+	codeReservedIP          = "reserved_ip"
+	codeInvalidTimestamp    = "invalid_timestamp"
+	codeInvalidUUID         = "invalid_uuid"
+	codeInvalidLocation     = "invalid_location"
+	codeInvalidQuery        = "invalid_query"
+	codeBodyTooLarge        = "body_too_large"
+	codeUnsupportedEncoding = "unsupported_encoding"
+	codeGeoUnavailable      = "geo_unavailable"
+	codeEventConflict       = "event_conflict"
+	codeOutOfOrder          = "out_of_order"
+	codeNotFound            = "not_found"
+	codeMethodNotAllowed    = "method_not_allowed"
+	codeUnauthorized        = "unauthorized"
+	codeRateLimited         = "rate_limited"
+	codeOverloaded          = "overloaded"
+	codeUnavailable         = "unavailable"
+	codeTimeout             = "timeout"
+	codeInternal            = "internal"
+)
+
+// The body of every error response, e.g. {"error":{"code":"invalid_json","message":"invalid JSON body"}}
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// The code reported for an error returned while reading or evaluating a login
+func errorCode(err error) string {
+	if _, ok := err.(*strictJSONError); ok {
+		return codeInvalidJSON
+	}
+	switch err {
+	case errInvalidJSON:
+		return codeInvalidJSON
+	case errInvalidInputs:
+		return codeInvalidInput
+	case errInvalidIP:
+		return codeInvalidIP
+	case errReservedIP:
+		return codeReservedIP
+	case errInvalidTimestamp:
+		return codeInvalidTimestamp
+	case errInvalidUUID:
+		return codeInvalidUUID
+	case errInvalidLocation:
+		return codeInvalidLocation
+	case errBodyTooLarge:
+		return codeBodyTooLarge
+	case errGeoLookup, errNoGeoLocation:
+		return codeGeoUnavailable
+	case errEventConflict:
+		return codeEventConflict
+	case errOutOfOrder:
+		return codeOutOfOrder
+	}
+	return codeInternal
+}
+
+func newAPIError(err error) *apiError {
+	return &apiError{Code: errorCode(err), Message: err.Error()}
+}
+
+// Writes the error envelope with the given status code
+func writeError(rw http.ResponseWriter, status int, code, msg string) {
+	body, _ := json.Marshal(map[string]apiError{"error": {Code: code, Message: msg}})
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(body)
+}
+
+// Writes v as a JSON response with the given status code, or a 500 if it can't be encoded.
+// The keys are camelCase instead of snake_case when the request asks for ?case=camel.
+func (env *Env) writeJSON(rw http.ResponseWriter, request *http.Request, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err == nil && request.URL.Query().Get("case") == "camel" {
+		body, err = camelCaseKeys(body)
+	}
+	if err != nil {
+		env.logFor(request.Context()).Error("could not encode response", "error", err)
+		writeError(rw, http.StatusInternalServerError, codeInternal, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.WriteHeader(status)
+	if _, err := rw.Write(body); err != nil {
+		// Usually the client has gone away; the status has been sent, so all that's left is to say so
+		env.logFor(request.Context()).Warn("could not write response", "error", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"detector/models"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestErrorCodes(t *testing.T) {
+	valid := `{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "85ad929a-db03-4bf4-9541-8f728fa12e42", "ip_address": "206.81.252.6"}`
+
+	closedDB := newMemoryEnv(t)
+	closedDB.store.Close()
+
+	noGeo := newMemoryEnv(t)
+	noGeo.resolver = nil
+
+	conflict := newMemoryEnv(t)
+	seedLogins(t, conflict, models.Login{Username: "alice", UnixTimestamp: 1514764800, EventUUID: "85ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "206.81.252.6"})
+
+	tiny := newMemoryEnv(t)
+	tiny.MaxBodyBytes = 10
+
+	keyed := newMemoryEnv(t)
+	keyed.APIKeys = []string{"s3cret"}
+
+	tests := []struct {
+		name   string
+		env    *Env
+		method string
+		url    string
+		body   string
+		status int
+		code   string
+	}{
+		{"invalid JSON", newMemoryEnv(t), "POST", "/v1/", `{"username":`, http.StatusBadRequest, codeInvalidJSON},
+		{"reserved ip", newMemoryEnv(t), "POST", "/v1/", `{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000a", "ip_address": "127.0.0.1"}`, http.StatusBadRequest, codeReservedIP},
+		{"missing username", newMemoryEnv(t), "POST", "/v1/", `{"unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000a", "ip_address": "206.81.252.6"}`, http.StatusBadRequest, codeInvalidInput},
+		{"invalid IP", newMemoryEnv(t), "POST", "/v1/", `{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000a", "ip_address": "206.81.252"}`, http.StatusBadRequest, codeInvalidIP},
+		{"invalid timestamp", newMemoryEnv(t), "POST", "/v1/", `{"username": "bob", "unix_timestamp": -1, "event_uuid": "00000000-0000-4000-8000-00000000000a", "ip_address": "206.81.252.6"}`, http.StatusBadRequest, codeInvalidTimestamp},
+		{"invalid uuid", newMemoryEnv(t), "POST", "/v1/", `{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "login-1", "ip_address": "206.81.252.6"}`, http.StatusBadRequest, codeInvalidUUID},
+		{"invalid location", newMemoryEnv(t), "POST", "/v1/", `{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6", "lat": 95, "lon": 0}`, http.StatusBadRequest, codeInvalidLocation},
+		{"invalid query", newMemoryEnv(t), "POST", "/v1/?unit=furlongs", valid, http.StatusBadRequest, codeInvalidQuery},
+		{"body too large", tiny, "POST", "/v1/", valid, http.StatusRequestEntityTooLarge, codeBodyTooLarge},
+		{"GeoIP unavailable", noGeo, "POST", "/v1/", valid, http.StatusInternalServerError, codeGeoUnavailable},
+		{"event conflict", conflict, "POST", "/v1/", valid, http.StatusConflict, codeEventConflict},
+		{"database closed", closedDB, "POST", "/v1/", valid, http.StatusInternalServerError, codeInternal},
+		{"unauthorized", keyed, "POST", "/v1/", valid, http.StatusUnauthorized, codeUnauthorized},
+		{"batch not an array", newMemoryEnv(t), "POST", "/v1/batch", valid, http.StatusBadRequest, codeInvalidJSON},
+		{"no logins", newMemoryEnv(t), "GET", "/v1/logins/nobody", ``, http.StatusNotFound, codeNotFound},
+		{"bad limit", newMemoryEnv(t), "GET", "/v1/logins/bob?limit=none", ``, http.StatusBadRequest, codeInvalidQuery},
+		{"not ready", closedDB, "GET", "/readyz", ``, http.StatusServiceUnavailable, codeUnavailable},
+	}
+
+	for _, tc := range tests {
+		req, err := http.NewRequest(tc.method, tc.url, bytes.NewBufferString(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		tc.env.routes().ServeHTTP(rr, req)
+
+		if rr.Code != tc.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.name, rr.Code, tc.status)
+		}
+		var resp struct {
+			Error apiError `json:"error"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%s: expected an error envelope, got %v", tc.name, rr.Body.String())
+			continue
+		}
+		if resp.Error.Code != tc.code || resp.Error.Message == "" {
+			t.Errorf("%s: unexpected error: got %+v want code %v", tc.name, resp.Error, tc.code)
+		}
+	}
+}
+
+func TestBatchErrorCodes(t *testing.T) {
+	rr := postBatch(t, newMemoryEnv(t), `[
+		{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000a", "ip_address": "206.81.252"},
+		{"username": "bob", "unix_timestamp": "soon"}
+	]`)
+	var results []batchResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	for i, code := range []string{codeInvalidIP, codeInvalidJSON} {
+		if results[i].Error == nil || results[i].Error.Code != code {
+			t.Errorf("result %v: unexpected error: got %+v want code %v", i, results[i].Error, code)
+		}
+	}
+}
+
+// A response writer whose client has gone away
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w brokenWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestWriteJSON(t *testing.T) {
+	var logs bytes.Buffer
+	memEnv := newMemoryEnv(t)
+	memEnv.logger = newLogger(&logs, slog.LevelInfo)
+	req := httptest.NewRequest("GET", "/", nil)
+
+	rr := httptest.NewRecorder()
+	memEnv.writeJSON(rr, req, http.StatusCreated, map[string]int{"deleted": 1})
+	if rr.Code != http.StatusCreated || rr.Body.String() != `{"deleted":1}` || rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected response: got %v %v %q", rr.Code, rr.Header(), rr.Body.String())
+	}
+	if rr.Header().Get("Content-Length") != strconv.Itoa(rr.Body.Len()) {
+		t.Errorf("unexpected Content-Length: got %v want %v", rr.Header().Get("Content-Length"), rr.Body.Len())
+	}
+
+	// NaN has no JSON encoding
+	rr = httptest.NewRecorder()
+	memEnv.writeJSON(rr, req, http.StatusOK, map[string]float64{"speed": math.NaN()})
+	if rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), `"code":"internal"`) {
+		t.Errorf("expected an unencodable value to give a 500, got %v %q", rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(logs.String(), "could not encode response") {
+		t.Errorf("expected the encoding error to be logged, got %q", logs.String())
+	}
+
+	memEnv.writeJSON(brokenWriter{httptest.NewRecorder()}, req, http.StatusOK, map[string]int{"deleted": 1})
+	if !strings.Contains(logs.String(), "could not write response") {
+		t.Errorf("expected the write error to be logged, got %q", logs.String())
+	}
+}
+
+func TestPostContentLength(t *testing.T) {
+	rr := postBetweenNeighbours(t, newMemoryEnv(t))
+	if rr.Header().Get("Content-Length") != strconv.Itoa(rr.Body.Len()) || rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected headers for a %v byte body: got %v", rr.Body.Len(), rr.Header())
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"detector/models"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// Where audit records of suspicious detections are written
+type auditSink interface {
+	Record(ctx context.Context, d models.Detection) error
+	Close() error
+}
+
+// Appends each detection to a file as a line of JSON
+type fileAuditSink struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func newFileAuditSink(path string) (*fileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAuditSink{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (s *fileAuditSink) Record(ctx context.Context, d models.Detection) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.encoder.Encode(d)
+}
+
+func (s *fileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// Saves each detection to the login database's detections table
+type storeAuditSink struct {
+	store models.Store
+}
+
+func (s storeAuditSink) Record(ctx context.Context, d models.Detection) error {
+	return s.store.InsertDetection(ctx, d)
+}
+
+// The store is closed with the rest of the Env
+func (s storeAuditSink) Close() error {
+	return nil
+}
+
+// How many detections can wait to be written before new ones are dropped
+const auditQueueSize = 1024
+
+// Writes detections to a sink in the background, so a slow or broken sink never holds up
+// or fails a response. Failed writes are logged and the detection dropped.
+type auditor struct {
+	sink    auditSink
+	entries chan models.Detection
+	done    chan struct{}
+	logger  *slog.Logger
+	// Guards entries being closed. Handlers can outlive the server's shutdown (a timed out
+	// request's keeps running), so a detection may still be recorded after close.
+	mu     sync.Mutex
+	closed bool
+}
+
+func newAuditor(sink auditSink, logger *slog.Logger) *auditor {
+	a := &auditor{
+		sink:    sink,
+		entries: make(chan models.Detection, auditQueueSize),
+		done:    make(chan struct{}),
+		logger:  logger,
+	}
+	go a.run()
+	return a
+}
+
+func (a *auditor) run() {
+	defer close(a.done)
+	for d := range a.entries {
+		if err := a.sink.Record(context.Background(), d); err != nil {
+			a.logger.Error("could not write audit record", "user", hashUsername(d.Username), "event_uuid", d.EventUUID, "error", err)
+		}
+	}
+}
+
+// Queues a detection to be written. Safe to call on a nil auditor, which discards it.
+func (a *auditor) record(d models.Detection) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		a.logger.Error("audit log closed, dropping record", "user", hashUsername(d.Username), "event_uuid", d.EventUUID)
+		return
+	}
+	select {
+	case a.entries <- d:
+	default:
+		a.logger.Error("audit queue full, dropping record", "user", hashUsername(d.Username), "event_uuid", d.EventUUID)
+	}
+}
+
+// Writes out any queued detections and closes the sink. Detections recorded afterwards are
+// dropped.
+func (a *auditor) close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	a.closed = true
+	close(a.entries)
+	a.mu.Unlock()
+	<-a.done
+	return a.sink.Close()
+}
+
+// Opens the audit sink picked by AuditSink, or returns a nil auditor when auditing is off
+func (env *Env) openAuditor() (*auditor, error) {
+	var sink auditSink
+	switch env.AuditSink {
+	case "":
+		return nil, nil
+	case "db":
+		sink = storeAuditSink{store: env.store}
+	case "file":
+		fileSink, err := newFileAuditSink(env.AuditPath)
+		if err != nil {
+			return nil, err
+		}
+		sink = fileSink
+		if hashed, ok := env.store.(hashedStore); ok {
+			sink = hashedAuditSink{auditSink: fileSink, store: hashed}
+		}
+	}
+	return newAuditor(sink, env.logger), nil
+}
+
+// The audit record of suspicious travel between login and other
+func (env *Env) newDetection(direction string, login, other models.Login, speed, distance float64, opts evalOptions) models.Detection {
+	return models.Detection{
+		Username:           login.Username,
+		Direction:          direction,
+		EventUUID:          login.EventUUID,
+		IPAddr:             login.IPAddr,
+		UnixTimestamp:      login.UnixTimestamp,
+		OtherEventUUID:     other.EventUUID,
+		OtherIPAddr:        other.IPAddr,
+		OtherUnixTimestamp: other.UnixTimestamp,
+		Speed:              speed,
+		Distance:           distance,
+		Unit:               opts.unit.String(),
+		DetectedAt:         env.now().Unix(),
+	}
+}
+
+// Queues an audit record and webhook notification for a detection
+func (env *Env) reportDetection(d models.Detection) {
+	env.audit.record(d)
+	env.webhook.notify(d)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"detector/models"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Posts a login from Baltimore between a login from Austin (55 mph away, not suspicious)
+// and one from Los Angeles a second later (suspicious)
+func postBetweenNeighbours(t *testing.T, e *Env) *httptest.ResponseRecorder {
+	seedLogins(t, e,
+		models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)},
+		models.Login{Username: "bob", UnixTimestamp: 1514764801, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)},
+	)
+	jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`)
+	req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(e.HandlePost).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestFileAuditSink(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.AuditSink = "file"
+	memEnv.AuditPath = filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := memEnv.openAuditor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	memEnv.audit = audit
+
+	postBetweenNeighbours(t, memEnv)
+	if err := memEnv.audit.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(memEnv.AuditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var detections []models.Detection
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var d models.Detection
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			t.Fatal(err)
+		}
+		detections = append(detections, d)
+	}
+
+	// Only the suspicious direction is audited
+	if len(detections) != 1 {
+		t.Fatalf("expected 1 audit record, got %+v", detections)
+	}
+	d := detections[0]
+	if d.Direction != "from" || d.IPAddr != "206.81.252.6" || d.OtherIPAddr != "91.207.175.104" || int(d.Speed) != 8330887 || d.Unit != "mi" {
+		t.Errorf("unexpected audit record: %+v", d)
+	}
+}
+
+func TestStoreAuditSink(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.AuditSink = "db"
+	memEnv.clock = newFakeClock(1600000000)
+	audit, err := memEnv.openAuditor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	memEnv.audit = audit
+
+	postBetweenNeighbours(t, memEnv)
+	memEnv.audit.close()
+
+	detections, err := memEnv.store.DetectionsByUsername(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detections) != 1 || detections[0].Direction != "from" || detections[0].OtherEventUUID != "00000000-0000-4000-8000-00000000000c" || detections[0].DetectedAt != 1600000000 {
+		t.Errorf("unexpected audit records: %+v", detections)
+	}
+}
+
+func TestHomeGeofenceAudited(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.AuditSink = "db"
+	audit, err := memEnv.openAuditor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	memEnv.audit = audit
+	// Baltimore is 1337 miles from a home in Austin, and the user has no other logins
+	if err := memEnv.store.SetHome(context.Background(), models.Home{Username: "bob", Lat: 30.3773, Lon: -97.71, Radius: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	lr := loginRecord{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6"}
+	result, err := memEnv.Evaluate(context.Background(), lr, evalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	memEnv.audit.close()
+	if !result.Suspicious {
+		t.Fatalf("expected the login outside the geofence to be suspicious, got %+v", result)
+	}
+
+	detections, err := memEnv.store.DetectionsByUsername(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detections) != 1 {
+		t.Fatalf("expected 1 audit record, got %+v", detections)
+	}
+	d := detections[0]
+	if d.Direction != "home" || d.EventUUID != lr.EventUUID || d.OtherEventUUID != "" || d.Speed != 0 || int(d.Distance) != 1337 {
+		t.Errorf("unexpected audit record: %+v", d)
+	}
+}
+
+type failingAuditSink struct{ calls int }
+
+func (s *failingAuditSink) Record(ctx context.Context, d models.Detection) error {
+	s.calls++
+	return errors.New("disk full")
+}
+
+func (s *failingAuditSink) Close() error { return nil }
+
+func TestAuditSinkErrorDoesNotFailResponse(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	sink := &failingAuditSink{}
+	memEnv.audit = newAuditor(sink, memEnv.logger)
+
+	rr := postBetweenNeighbours(t, memEnv)
+	memEnv.audit.close()
+
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"suspicious":true`) {
+		t.Errorf("unexpected response: %v %v", rr.Code, rr.Body.String())
+	}
+	if sink.calls != 1 {
+		t.Errorf("expected the sink to be tried once, got %v", sink.calls)
+	}
+}
+
+func TestAuditRecordAfterClose(t *testing.T) {
+	sink := &failingAuditSink{}
+	audit := newAuditor(sink, env.logger)
+
+	// Like a timed out request's handler still running as the server shuts down
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				audit.record(models.Detection{Username: "bob", EventUUID: "00000000-0000-4000-8000-00000000000b"})
+			}
+		}()
+	}
+	if err := audit.close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	audit.record(models.Detection{Username: "bob", EventUUID: "00000000-0000-4000-8000-00000000000c"})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Reports whether the request carries one of the configured API keys as
+// "Authorization: Bearer <key>". Every key is compared in constant time so the response
+// time doesn't give away how much of a guess was right.
+func (env *Env) validAPIKey(request *http.Request) bool {
+	header := request.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	given := []byte(strings.TrimPrefix(header, "Bearer "))
+
+	valid := 0
+	for _, key := range env.APIKeys {
+		valid |= subtle.ConstantTimeCompare(given, []byte(key))
+	}
+	return valid == 1
+}
+
+// Middleware that answers 401 Unauthorized unless the request has a valid API key. With
+// no keys configured, or on a public endpoint (protected false), requests pass straight through.
+func (env *Env) withAuth(protected bool, next http.HandlerFunc) http.HandlerFunc {
+	if len(env.APIKeys) == 0 || !protected {
+		return next
+	}
+	return func(rw http.ResponseWriter, request *http.Request) {
+		if !env.validAPIKey(request) {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(rw, http.StatusUnauthorized, codeUnauthorized, "missing or invalid API key")
+			return
+		}
+		next(rw, request)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIKeyAuth(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.APIKeys = []string{"first-key", "second-key"}
+	router := memEnv.routes()
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"first key", "Bearer first-key", http.StatusOK},
+		{"second key", "Bearer second-key", http.StatusOK},
+		{"wrong key", "Bearer third-key", http.StatusUnauthorized},
+		{"prefix of a key", "Bearer first", http.StatusUnauthorized},
+		{"not a bearer token", "Basic Zmlyc3Qta2V5", http.StatusUnauthorized},
+		{"missing", "", http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000a", "ip_address": "10.0.0.1"}`)
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != tc.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.name, rr.Code, tc.status)
+		}
+		if tc.status == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s: expected a WWW-Authenticate challenge", tc.name)
+		}
+	}
+}
+
+func TestAPIKeyAuthReadEndpoints(t *testing.T) {
+	tests := []struct {
+		name              string
+		authReads, health bool
+		path              string
+		status            int
+	}{
+		{"public history", false, false, "/v1/logins/bob", http.StatusNotFound},
+		{"protected history", true, false, "/v1/logins/bob", http.StatusUnauthorized},
+		{"public health", false, false, "/healthz", http.StatusOK},
+		{"protected health", false, true, "/healthz", http.StatusUnauthorized},
+		{"protected readiness", false, true, "/readyz", http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		memEnv.APIKeys = []string{"first-key"}
+		memEnv.AuthReads, memEnv.AuthHealth = tc.authReads, tc.health
+
+		rr := getPath(t, memEnv, tc.path)
+		if rr.Code != tc.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.name, rr.Code, tc.status)
+		}
+	}
+
+	// Deleting is a write, so it always needs a key
+	memEnv := newMemoryEnv(t)
+	memEnv.APIKeys = []string{"first-key"}
+	req, err := http.NewRequest("DELETE", "/v1/logins/bob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	memEnv.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("delete without a key: got status %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+}
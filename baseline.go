@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"detector/models"
+	"detector/travel"
+)
+
+// Which earlier login the travel to a new one is measured from
+const (
+	// The login immediately before it
+	baselineAdjacent = "adjacent"
+	// The most recent one from somewhere else, see distinctBaseline
+	baselineDistinct = "distinct"
+)
+
+// How many of the user's earlier logins are searched for one from a distinct location
+const distinctLookback = 100
+
+// The user's most recent located login before loginRow that's more than DistinctDistance
+// miles from it, so a run of logins from one city can't hide a jump from somewhere else.
+// prevLogin is returned when it's already that far away, and when none of the earlier
+// logins are, so the login is still compared with its neighbour.
+func (env *Env) distinctBaseline(ctx context.Context, loginRow, prevLogin models.Login, opts evalOptions) (models.Login, error) {
+	if env.distinct(loginRow, prevLogin, opts) {
+		return prevLogin, nil
+	}
+	before, _, err := env.store.NeighborLogins(ctx, loginRow, distinctLookback)
+	if err != nil {
+		return prevLogin, err
+	}
+	for _, login := range before {
+		if onEarth(login.Lat, login.Lon) && env.distinct(loginRow, *login, opts) {
+			return *login, nil
+		}
+	}
+	return prevLogin, nil
+}
+
+func (env *Env) distinct(a, b models.Login, opts evalOptions) bool {
+	return travel.Miles.FromMeters(opts.formula.Distance(a.Lat, a.Lon, b.Lat, b.Lon)) > env.DistinctDistance
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Outcome of a single record in a batch request. Exactly one of Result or Error is set.
+type batchResult struct {
+	Index  int          `json:"index"`
+	Result *loginResult `json:"result,omitempty"`
+	Error  *apiError    `json:"error,omitempty"`
+}
+
+// Handles POST /v1/batch. Takes a JSON array of login records and runs each one through
+// the detector in order. A bad record doesn't stop the rest of the batch: the response
+// is an array of per-record results, sent as a 207 if any of the records failed.
+func (env *Env) HandleBatch(rw http.ResponseWriter, request *http.Request) {
+	records, ok := env.decodeRecords(rw, request)
+	if !ok {
+		return
+	}
+	opts, err := parseEvalOptions(request)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+
+	status := http.StatusOK
+	results := make([]batchResult, len(records))
+	for i, raw := range records {
+		results[i].Index = i
+		ctx, s := env.startSpan(request.Context(), "evaluate", trace.WithAttributes(attribute.Int("index", i)))
+		_, result, err := env.evaluateJSON(ctx, raw, opts)
+		setSpanError(s, err)
+		s.SetAttributes(attribute.Bool("suspicious", result.Suspicious))
+		s.End()
+		if err != nil {
+			results[i].Error = newAPIError(err)
+			status = http.StatusMultiStatus
+			continue
+		}
+		results[i].Result = &result
+	}
+
+	env.writeJSON(rw, request, status, results)
+}
+
+// Reads a request body that's a JSON array of login records, each left to be decoded on its
+// own. If it isn't one the error response is written and ok is false.
+func (env *Env) decodeRecords(rw http.ResponseWriter, request *http.Request) (records []json.RawMessage, ok bool) {
+	if err := env.decodeBody(request.Body, &records); err != nil {
+		if _, ok := err.(*strictJSONError); ok || err == errBodyTooLarge {
+			writeError(rw, invalidStatus(err), errorCode(err), err.Error())
+			return nil, false
+		}
+		writeError(rw, http.StatusBadRequest, codeInvalidJSON, "invalid JSON body, expected an array of login records")
+		return nil, false
+	}
+	return records, true
+}
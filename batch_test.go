@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"detector/models"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func postBatch(t *testing.T, e *Env, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "/v1/batch", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	e.routes().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestBatchAllValid(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+
+	rr := postBatch(t, memEnv, `[
+		{"username": "bob", "unix_timestamp": 1514677279, "event_uuid": "25ad929a-db03-4bf4-9541-8f728fa12e42", "ip_address": "24.242.71.20"},
+		{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "35ad929a-db03-4bf4-9541-8f728fa12e42", "ip_address": "206.81.252.6"}
+	]`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	expected := `[{"index":0,"result":{"current_geo":{"lat":30.3773,"lon":-97.71,"radius":5,"city":"Austin","subdivision":"Texas","country":"United States","country_iso":"US","time_zone":"America/Chicago","local_time":"2017-12-30T17:41:19-06:00"},"geo_unavailable":false,"trusted_network":false,"preceding_ip_access":null,"subsequent_ip_access":null,"travel_to_current_geo_suspicious":null,"travel_from_current_geo_suspicious":null,"fastest_window_ip_access":null,"travel_within_window_suspicious":null,"concurrent_distant_login":null,"outside_home_geofence":null,"evaluated":false,"reason":"no_adjacent_logins","suspicious":false,"severity":"none","unit":"mi"}},` +
+		`{"index":1,"result":{"current_geo":{"lat":39.2293,"lon":-76.6907,"radius":10,"city":"Halethorpe","subdivision":"Maryland","country":"United States","country_iso":"US","time_zone":"America/New_York","local_time":"2017-12-31T19:00:00-05:00"},"geo_unavailable":false,"trusted_network":false,"preceding_ip_access":{"ip":"24.242.71.20","speed":55.00021047466064,"distance":1337.131505820215,"lat":30.3773,"lon":-97.71,"radius":5,"city":"Austin","country":"United States","unix_timestamp":1514677279,"time_zone":"America/Chicago","local_time":"2017-12-30T17:41:19-06:00"},"subsequent_ip_access":null,"travel_to_current_geo_suspicious":false,"travel_from_current_geo_suspicious":null,"fastest_window_ip_access":null,"travel_within_window_suspicious":null,"concurrent_distant_login":null,"outside_home_geofence":null,"evaluated":true,"suspicious":false,"severity":"none","unit":"mi"}}]`
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+}
+
+func TestBatchMixedResults(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+
+	rr := postBatch(t, memEnv, `[
+		{"username": "bob", "unix_timestamp": 1514677279, "event_uuid": "25ad929a-db03-4bf4-9541-8f728fa12e42", "ip_address": "24.242.71.20"},
+		{"username": "", "unix_timestamp": 1514677280, "event_uuid": "55ad929a-db03-4bf4-9541-8f728fa12e42", "ip_address": "24.242.71.20"},
+		{"username": "bob", "unix_timestamp": "soon"},
+		{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "35ad929a-db03-4bf4-9541-8f728fa12e42", "ip_address": "206.81.252.6"}
+	]`)
+	if rr.Code != http.StatusMultiStatus {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusMultiStatus)
+	}
+
+	var results []batchResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %v", len(results))
+	}
+	for i, failed := range []bool{false, true, true, false} {
+		if results[i].Index != i {
+			t.Errorf("result %v has index %v", i, results[i].Index)
+		}
+		if failed && (results[i].Error == nil || results[i].Result != nil) {
+			t.Errorf("expected result %v to fail, got %+v", i, results[i])
+		}
+		if !failed && (results[i].Error != nil || results[i].Result == nil) {
+			t.Errorf("expected result %v to succeed, got %+v", i, results[i])
+		}
+	}
+	if results[3].Result == nil || results[3].Result.PrecedingIpAccess == nil {
+		t.Errorf("expected the last record to be compared against the first, got %+v", results[3].Result)
+	}
+
+	logins, err := memEnv.store.LoginsByUsername(context.Background(), "bob", models.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 2 {
+		t.Errorf("expected only the 2 valid records to be saved, got %v", len(logins))
+	}
+}
+
+func TestBatchNotAnArray(t *testing.T) {
+	rr := postBatch(t, newMemoryEnv(t), `{"username": "bob"}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// Middleware that stops reading the request body after MaxBodyBytes, so a client can't
+// exhaust memory by streaming an enormous JSON document
+func (env *Env) withBodyLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, request *http.Request) {
+		request.Body = http.MaxBytesReader(rw, request.Body, env.MaxBodyBytes)
+		next(rw, request)
+	}
+}
+
+// Maps an error from decoding a request body to the one reported to the client
+func decodeError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return errBodyTooLarge
+	}
+	return errInvalidJSON
+}
+
+// The status code to reject an invalid request body with
+func invalidStatus(err error) int {
+	if err == errBodyTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// A body that's valid JSON but that strict decoding rejects, e.g. for a misspelt field. It's
+// reported as invalid_json like any other unreadable body, but says what was wrong.
+type strictJSONError struct {
+	reason string
+}
+
+func (e *strictJSONError) Error() string {
+	return "invalid JSON body: " + e.reason
+}
+
+// Decodes a JSON request body into v. With StrictJSON set, fields v doesn't have and anything
+// after the JSON value are errors rather than ignored.
+func (env *Env) decodeBody(body io.Reader, v interface{}) error {
+	decoder := json.NewDecoder(body)
+	if !env.StrictJSON {
+		if err := decoder.Decode(v); err != nil {
+			return decodeError(err)
+		}
+		return nil
+	}
+
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		// The decoder has no error type for these
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return &strictJSONError{"unknown field " + field}
+		}
+		return decodeError(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		if err = decodeError(err); err == errBodyTooLarge {
+			return err
+		}
+		return &strictJSONError{"unexpected data after the JSON value"}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyTooLarge(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.MaxBodyBytes = 200
+	router := memEnv.routes()
+
+	login := `{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000a", "ip_address": "10.0.0.1"}`
+	padded := `{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000a", "ip_address": "10.0.0.1", "padding": "` + strings.Repeat("x", 200) + `"}`
+	tests := []struct {
+		path, body string
+		status     int
+	}{
+		{"/v1/", login, http.StatusOK},
+		{"/v1/", padded, http.StatusRequestEntityTooLarge},
+		{"/v1/batch", "[" + login + "]", http.StatusOK},
+		{"/v1/batch", "[" + login + "," + login + "," + login + "]", http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range tests {
+		req, err := http.NewRequest("POST", tc.path, bytes.NewBufferString(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != tc.status {
+			t.Errorf("%s with a %d byte body: got status %v want %v", tc.path, len(tc.body), rr.Code, tc.status)
+		}
+		if tc.status == http.StatusRequestEntityTooLarge && rr.Body.String() != `{"error":{"code":"body_too_large","message":"request body too large"}}` {
+			t.Errorf("%s: unexpected body: %v", tc.path, rr.Body.String())
+		}
+	}
+}
+
+func TestStrictJSON(t *testing.T) {
+	login := `{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000a", "ip_address": "10.0.0.1"`
+	tests := []struct {
+		name, path, body string
+		message          string
+	}{
+		{"unknown field", "/v1/", login + `, "ip_adress": "10.0.0.2"}`, `invalid JSON body: unknown field \"ip_adress\"`},
+		{"trailing data", "/v1/", login + `} garbage`, "invalid JSON body: unexpected data after the JSON value"},
+		{"second object", "/v1/", login + `} {}`, "invalid JSON body: unexpected data after the JSON value"},
+		{"trailing data after a batch", "/v1/batch", "[" + login + "}] garbage", "invalid JSON body: unexpected data after the JSON value"},
+	}
+
+	for _, tc := range tests {
+		for _, strict := range []bool{false, true} {
+			memEnv := newMemoryEnv(t)
+			memEnv.StrictJSON = strict
+			req, err := http.NewRequest("POST", tc.path, bytes.NewBufferString(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			memEnv.routes().ServeHTTP(rr, req)
+
+			// By default whatever follows the login, and fields it doesn't have, are ignored
+			if !strict {
+				if rr.Code != http.StatusOK {
+					t.Errorf("%s: expected a 200 when not strict, got %v %s", tc.name, rr.Code, rr.Body.String())
+				}
+				continue
+			}
+			if rr.Code != http.StatusBadRequest || rr.Body.String() != `{"error":{"code":"invalid_json","message":"`+tc.message+`"}}` {
+				t.Errorf("%s: got %v %s want 400 %v", tc.name, rr.Code, rr.Body.String(), tc.message)
+			}
+		}
+	}
+
+	// Each record of a batch is decoded strictly too
+	memEnv := newMemoryEnv(t)
+	memEnv.StrictJSON = true
+	rr := postBatch(t, memEnv, "["+login+`}, `+login+`, "ip_adress": "10.0.0.2"}]`)
+	if rr.Code != http.StatusMultiStatus || !strings.Contains(rr.Body.String(), `{"index":1,"error":{"code":"invalid_json","message":"invalid JSON body: unknown field \"ip_adress\""}}`) {
+		t.Errorf("expected the second record to be rejected, got %v %s", rr.Code, rr.Body.String())
+	}
+}
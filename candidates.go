@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Body of POST /v1/candidates: IPs to check against one user's stored logins
+type candidatesRequest struct {
+	Username   string      `json:"username"`
+	Candidates []candidate `json:"candidates"`
+}
+
+type candidate struct {
+	IPAddr string `json:"ip_address"`
+	// When the login would happen, or now when zero
+	UnixTimestamp int64 `json:"unix_timestamp"`
+}
+
+// Handles POST /v1/candidates. Each candidate is evaluated as a dry run against the user's
+// stored logins, so none of them are saved or checked against each other. The response is
+// an array with a result or error per candidate, like a batch's.
+func (env *Env) HandleCandidates(rw http.ResponseWriter, request *http.Request) {
+	var body candidatesRequest
+	if err := env.decodeBody(request.Body, &body); err != nil {
+		writeError(rw, invalidStatus(err), errorCode(err), err.Error())
+		return
+	}
+	body.Username = env.normalizeUsername(body.Username)
+	if body.Username == "" {
+		writeError(rw, http.StatusBadRequest, codeInvalidInput, "username is required")
+		return
+	}
+	opts, err := parseEvalOptions(request)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+	opts.dryRun = true
+
+	status := http.StatusOK
+	now := env.now().Unix()
+	results := make([]batchResult, len(body.Candidates))
+	for i, c := range body.Candidates {
+		results[i].Index = i
+		lr := loginRecord{
+			Username:      body.Username,
+			UnixTimestamp: c.UnixTimestamp,
+			// Never saved, but mustn't match a stored login or it would be excluded as itself
+			EventUUID: newUUID(),
+			IPAddr:    c.IPAddr,
+		}
+		if lr.UnixTimestamp == 0 {
+			lr.UnixTimestamp = now
+		}
+
+		ctx, s := env.startSpan(request.Context(), "evaluate", trace.WithAttributes(attribute.Int("index", i)))
+		err := env.validateRecord(lr)
+		var result loginResult
+		if err == nil {
+			result, err = env.Evaluate(ctx, lr, opts)
+		}
+		setSpanError(s, err)
+		s.SetAttributes(attribute.Bool("suspicious", result.Suspicious))
+		s.End()
+		if err != nil {
+			results[i].Error = newAPIError(err)
+			status = http.StatusMultiStatus
+			continue
+		}
+		results[i].Result = &result
+	}
+
+	env.writeJSON(rw, request, status, results)
+}
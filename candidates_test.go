@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"detector/models"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func postCandidates(t *testing.T, e *Env, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "/v1/candidates", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	e.routes().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCandidates(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)})
+
+	rr := postCandidates(t, memEnv, `{"username": "bob", "candidates": [
+		{"ip_address": "206.81.252.6", "unix_timestamp": 1514764800},
+		{"ip_address": "91.207.175.104", "unix_timestamp": 1514677280},
+		{"ip_address": "206.81.252", "unix_timestamp": 1514764800},
+		{"ip_address": "206.81.252.6"}
+	]}`)
+	if rr.Code != http.StatusMultiStatus {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusMultiStatus, rr.Body.String())
+	}
+	var results []batchResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("expected a result per candidate, got %+v", results)
+	}
+
+	// Each is checked against the stored Austin login only, not the candidates before it
+	if r := results[0].Result; r == nil || r.Suspicious || r.PrecedingIpAccess == nil || int(r.PrecedingIpAccess.Speed) != 55 {
+		t.Errorf("expected Baltimore a day later not to be suspicious, got %+v", results[0])
+	}
+	if r := results[1].Result; r == nil || !r.Suspicious || r.PrecedingIpAccess == nil || r.PrecedingIpAccess.IP != "24.242.71.20" {
+		t.Errorf("expected Los Angeles a second later to be suspicious, got %+v", results[1])
+	}
+	if e := results[2].Error; e == nil || e.Code != codeInvalidIP {
+		t.Errorf("expected an invalid ip error, got %+v", results[2])
+	}
+	// Without a timestamp the candidate is checked as if it were happening now
+	if r := results[3].Result; r == nil || r.Suspicious || r.PrecedingIpAccess == nil || r.PrecedingIpAccess.IP != "24.242.71.20" {
+		t.Errorf("expected a login from Baltimore now not to be suspicious, got %+v", results[3])
+	}
+
+	logins, err := memEnv.store.AllLogins(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 1 {
+		t.Errorf("expected no candidates to be saved, got %+v", logins)
+	}
+}
+
+func TestCandidatesInvalid(t *testing.T) {
+	tests := []struct {
+		body string
+		code string
+	}{
+		{`{"candidates": [{"ip_address": "206.81.252.6"}]}`, codeInvalidInput},
+		{`{"username": "bob", "candidates": "206.81.252.6"}`, codeInvalidJSON},
+	}
+
+	for _, tc := range tests {
+		rr := postCandidates(t, newMemoryEnv(t), tc.body)
+		var resp struct {
+			Error apiError `json:"error"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		if rr.Code != http.StatusBadRequest || resp.Error.Code != tc.code {
+			t.Errorf("%s: got %v %s want 400 %v", tc.body, rr.Code, rr.Body.String(), tc.code)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import "time"
+
+// Where the detector gets the current time from, so tests can fix it
+type Clock interface {
+	Now() time.Time
+}
+
+// The system clock
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// The current time by env's clock, or the system's when it has none
+func (env *Env) now() time.Time {
+	if env.clock == nil {
+		return time.Now()
+	}
+	return env.clock.Now()
+}
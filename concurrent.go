@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"detector/models"
+	"detector/travel"
+	"time"
+)
+
+// Whether another of the user's logins within ConcurrentWindow of login came from more than
+// ConcurrentDistance miles away, or nil when the check is off or there are no such logins to
+// compare with. Sessions open in two far apart places at once point to a shared or stolen
+// account however the logins are ordered, so this doesn't depend on the speed threshold.
+// A distant login comes with the audit record to report.
+func (env *Env) concurrentDistant(ctx context.Context, login models.Login, opts evalOptions) (*bool, *models.Detection, error) {
+	if env.ConcurrentWindow <= 0 {
+		return nil, nil, nil
+	}
+	window := int64(env.ConcurrentWindow / time.Second)
+	logins, err := env.store.LoginsByUsername(ctx, login.Username, models.ListOptions{
+		Since: login.UnixTimestamp - window,
+		Until: login.UnixTimestamp + window,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var concurrent *bool
+	for _, other := range logins {
+		if other.EventUUID == login.EventUUID || !other.HasLocation() {
+			continue
+		}
+		distance := opts.formula.Distance(other.Lat, other.Lon, login.Lat, login.Lon)
+		distant := travel.Miles.FromMeters(distance) > env.ConcurrentDistance
+		if concurrent == nil || distant {
+			concurrent = &distant
+		}
+		if distant {
+			// The logins may share a timestamp, so no speed is recorded
+			d := env.newDetection("concurrent", login, *other, 0, opts.unit.FromMeters(distance), opts)
+			return concurrent, &d, nil
+		}
+	}
+	return concurrent, nil, nil
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"detector/models"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Runtime settings for the detector. Each value can be overridden with a SUPERMAN_* environment variable.
+type Config struct {
+	// Speed (mph) above which travel between two logins is flagged as suspicious
+	SpeedThreshold int
+	// Overrides SpeedThreshold for travel to the current login (from the preceding one) and
+	// from it (to the subsequent one). Zero uses SpeedThreshold.
+	SpeedThresholdTo   int
+	SpeedThresholdFrom int
+	// Speed (mph) beyond any airliner, above which flagged travel is reported with severity
+	// "impossible" rather than "suspicious"
+	ImpossibleSpeed int
+	// Distance (miles) travel must cover before it can be flagged, however fast it was, so GeoIP
+	// jitter between logins in the same metro area isn't taken for movement. Zero checks all travel.
+	MinDistance float64
+	// Which earlier login travel to a new one is measured from: "adjacent" (the default), the one
+	// immediately before it, or "distinct", the most recent one more than DistinctDistance miles away
+	Baseline         string
+	DistinctDistance float64
+	// Reject request bodies with fields the endpoint doesn't know, e.g. a misspelt "ip_adress",
+	// or anything after the JSON value, rather than ignoring them
+	StrictJSON bool
+	// Take the client IP from X-Forwarded-For / X-Real-IP instead of the request body
+	TrustProxyHeaders bool
+	// Our own proxies, whose hops in X-Forwarded-For are skipped to find the client
+	TrustedProxies []*net.IPNet
+	// How far (in seconds) ahead of the server clock a login's unix_timestamp may be
+	MaxFutureSeconds int
+	// What to do with a login older than the user's newest stored one by more than
+	// OutOfOrderGrace: "accept" it (the default) fitting it in by its timestamp, or "reject" it
+	OutOfOrderPolicy string
+	OutOfOrderGrace  time.Duration
+	// Minimum level written to the log: debug, info, warn or error
+	LogLevel slog.Level
+	// How long to wait for in-flight requests to finish when shutting down, e.g. "10s"
+	ShutdownTimeout time.Duration
+	// Address the server binds to, as host:port. An empty host listens on all interfaces.
+	ListenAddr string
+	// Address the pprof profiling endpoints are served on, e.g. "localhost:6060". Empty turns them off.
+	PprofAddr string
+	// Path of the SQLite login database, created if it doesn't exist
+	DBPath string
+	// Path of the MaxMind GeoLite2/GeoIP2 City database
+	GeoPath string
+	// Path of an optional MaxMind GeoLite2/GeoIP2 ASN database. Empty disables ASN lookups.
+	ASNPath string
+	// How old the GeoIP database may be, going by when it was built, before it's stale. Stale
+	// data is logged and reported by /readyz, which fails too under the "unready" GeoStalePolicy.
+	// Zero never treats it as stale.
+	GeoMaxAge      time.Duration
+	GeoStalePolicy string
+	// Distance (miles) a login's client-provided lat/lon may be from its address's GeoIP location
+	// before the response flags the mismatch. Zero doesn't look the address up at all.
+	MismatchDistance float64
+	// Decimal places stored lat/lon are rounded to before the login is saved and its travel is
+	// checked, e.g. 2 for about a kilometre. Zero keeps them at full precision.
+	CoordinateDecimals int
+	// What to do with a public address the GeoIP database returns 0,0 for: save the login
+	// "unlocated" (the default) without checking its travel, or fail it with an "error"
+	GeoNoLocation string
+	// Take the logins' GeoIP accuracy radii off the distance between them before working out
+	// the speed, so only travel that's too fast even in the best case is flagged
+	SubtractAccuracyRadius bool
+	// Largest request body accepted, in bytes. Bigger bodies get a 413.
+	MaxBodyBytes int64
+	// Requests per second each client may make to the write endpoints. Zero turns rate limiting off.
+	RateLimit float64
+	// How many requests a client may make at once before being limited to RateLimit
+	RateBurst int
+	// Most api requests handled at once, across all clients; the rest get a 503. Zero is no limit.
+	MaxInFlight int
+	// API keys accepted as "Authorization: Bearer <key>". Writes need one of them; with none
+	// configured every endpoint is open.
+	APIKeys []string
+	// Steps applied to every username before it's stored or looked up: "trim" surrounding
+	// whitespace and/or "lower" case it, in the order given. Empty compares usernames as sent.
+	NormalizeUsernames []string
+	// Secret to store usernames as their HMAC-SHA256 under, rather than in plaintext. Empty
+	// stores them as they are.
+	UsernameHashKey string
+	// Also require an API key to read login history
+	AuthReads bool
+	// Also require an API key for the health checks and metrics
+	AuthHealth bool
+	// Origins browsers may call the api from, or "*" for any. Empty turns CORS off.
+	CORSOrigins []string
+	// Networks such as corporate VPN egress ranges whose logins are saved but never
+	// flagged as suspicious
+	TrustedNetworks []*net.IPNet
+	// Where to keep an audit record of each suspicious detection: "db" for the login
+	// database's detections table, "file" for AuditPath, or empty for nowhere
+	AuditSink string
+	// JSON lines file written by the "file" audit sink
+	AuditPath string
+	// Upper bound on each login database query, e.g. "5s"
+	QueryTimeout time.Duration
+	// How long a request may take to be answered before it's abandoned with a 503
+	RequestTimeout time.Duration
+	// Longest the server spends reading a request, headers and body
+	ReadTimeout time.Duration
+	// Longest the server spends writing a response. Exports extend it for each page they stream.
+	WriteTimeout time.Duration
+	// How long a keep-alive connection is kept open waiting for its next request
+	IdleTimeout time.Duration
+	// How long logins are kept, e.g. "2160h" for 90 days. Unset keeps them forever.
+	Retention time.Duration
+	// How often logins older than Retention are deleted
+	RetentionInterval time.Duration
+	// Most logins kept per user: saving another deletes their oldest. Zero keeps them all.
+	MaxUserLogins int
+	// How long a SQLite write waits for the database lock before failing
+	SQLiteBusyTimeout time.Duration
+	// SQLite journal mode: WAL, DELETE, TRUNCATE, PERSIST, MEMORY or OFF
+	SQLiteJournalMode string
+	// Login database connection pool limits. Zero leaves the database's defaults, see
+	// models.Options.
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+	// Also check travel to every login this close in time to the current one, not just the
+	// adjacent ones. Zero checks the adjacent logins only.
+	NeighborWindow time.Duration
+	// How many of the user's nearest logins in time on each side of the current one to check
+	// travel to. The default, 1, checks the adjacent logins only.
+	NeighborCount int
+	// How close in time (e.g. "60s") another login must be to the current one to count as
+	// concurrent, and how far away (miles) a concurrent login must be to be flagged. With no
+	// window set the check is off.
+	ConcurrentWindow   time.Duration
+	ConcurrentDistance float64
+	// URL each suspicious detection is POSTed to. Empty turns webhooks off.
+	WebhookURL string
+	// Shared secret the webhook payload is signed with, so receivers can check it came from us
+	WebhookSecret string
+	// How many times a webhook delivery is tried before the detection is dropped
+	WebhookMaxAttempts int
+	// After a user is alerted about, how long further suspicious logins of theirs go unreported.
+	// The logins are still saved. Zero alerts on every suspicious login.
+	AlertCooldown time.Duration
+	// What the cooldown suppresses: "all" (the default) clears the response's suspicious flag as
+	// well as skipping the audit record and webhook, "notifications" skips only those
+	CooldownSuppresses string
+	// Base URL of an OpenTelemetry collector spans are sent to over OTLP/HTTP, e.g.
+	// "http://localhost:4318". Empty turns tracing off.
+	OTLPEndpoint string
+	// What the process runs: "http" (the default), "consumer" or "both"
+	Mode string
+	// NATS server logins are consumed from in consumer mode, e.g. "nats://localhost:4222", or
+	// "tls://localhost:4222" to require TLS
+	NATSURL string
+	// Subject login records are read from and the one their results are published to
+	NATSSubject       string
+	NATSResultSubject string
+}
+
+func defaultConfig() Config {
+	return Config{
+		SpeedThreshold:     500,
+		ImpossibleSpeed:    2000,
+		MaxFutureSeconds:   300,
+		OutOfOrderPolicy:   outOfOrderAccept,
+		GeoNoLocation:      geoNoLocationUnlocated,
+		GeoStalePolicy:     geoStaleWarn,
+		Baseline:           baselineAdjacent,
+		DistinctDistance:   50,
+		OutOfOrderGrace:    5 * time.Minute,
+		LogLevel:           slog.LevelInfo,
+		ShutdownTimeout:    10 * time.Second,
+		ListenAddr:         ":8080",
+		DBPath:             "./data.db",
+		GeoPath:            "./geo/GeoLite2-City.mmdb",
+		QueryTimeout:       5 * time.Second,
+		RequestTimeout:     30 * time.Second,
+		ReadTimeout:        10 * time.Second,
+		WriteTimeout:       60 * time.Second,
+		IdleTimeout:        2 * time.Minute,
+		RetentionInterval:  time.Hour,
+		SQLiteBusyTimeout:  models.DefaultBusyTimeout,
+		SQLiteJournalMode:  "WAL",
+		RateBurst:          20,
+		MaxBodyBytes:       1 << 20,
+		AuditPath:          "./audit.jsonl",
+		WebhookMaxAttempts: 5,
+		CooldownSuppresses: cooldownSuppressAll,
+		NeighborCount:      1,
+		ConcurrentDistance: 500,
+		Mode:               modeHTTP,
+		NATSSubject:        "logins",
+		NATSResultSubject:  "logins.results",
+	}
+}
+
+// Builds the config from the environment, keeping the defaults for any unset variables
+func loadConfig(getenv func(string) string) (Config, error) {
+	cfg := defaultConfig()
+
+	if err := positiveIntVar(getenv, "SUPERMAN_SPEED_THRESHOLD", &cfg.SpeedThreshold); err != nil {
+		return cfg, err
+	}
+	if err := positiveIntVar(getenv, "SUPERMAN_SPEED_THRESHOLD_TO", &cfg.SpeedThresholdTo); err != nil {
+		return cfg, err
+	}
+	if err := positiveIntVar(getenv, "SUPERMAN_SPEED_THRESHOLD_FROM", &cfg.SpeedThresholdFrom); err != nil {
+		return cfg, err
+	}
+	if err := positiveIntVar(getenv, "SUPERMAN_IMPOSSIBLE_SPEED", &cfg.ImpossibleSpeed); err != nil {
+		return cfg, err
+	}
+	if cfg.ImpossibleSpeed < cfg.SpeedThreshold {
+		// A threshold over the default shouldn't stop a config that predates this setting loading
+		if getenv("SUPERMAN_IMPOSSIBLE_SPEED") != "" {
+			return cfg, fmt.Errorf("SUPERMAN_IMPOSSIBLE_SPEED must be at least SUPERMAN_SPEED_THRESHOLD (%v), got %v", cfg.SpeedThreshold, cfg.ImpossibleSpeed)
+		}
+		cfg.ImpossibleSpeed = cfg.SpeedThreshold
+	}
+	if err := positiveFloatVar(getenv, "SUPERMAN_MIN_DISTANCE", &cfg.MinDistance); err != nil {
+		return cfg, err
+	}
+	switch v := getenv("SUPERMAN_BASELINE"); v {
+	case "":
+	case baselineAdjacent, baselineDistinct:
+		cfg.Baseline = v
+	default:
+		return cfg, fmt.Errorf("SUPERMAN_BASELINE must be adjacent or distinct, got %q", v)
+	}
+	if err := positiveFloatVar(getenv, "SUPERMAN_DISTINCT_DISTANCE", &cfg.DistinctDistance); err != nil {
+		return cfg, err
+	}
+	if err := boolVar(getenv, "SUPERMAN_STRICT_JSON", &cfg.StrictJSON); err != nil {
+		return cfg, err
+	}
+	if err := boolVar(getenv, "SUPERMAN_TRUST_PROXY_HEADERS", &cfg.TrustProxyHeaders); err != nil {
+		return cfg, err
+	}
+	if err := boolVar(getenv, "SUPERMAN_SUBTRACT_ACCURACY_RADIUS", &cfg.SubtractAccuracyRadius); err != nil {
+		return cfg, err
+	}
+	if err := positiveIntVar(getenv, "SUPERMAN_MAX_FUTURE_SECONDS", &cfg.MaxFutureSeconds); err != nil {
+		return cfg, err
+	}
+	switch v := getenv("SUPERMAN_OUT_OF_ORDER_POLICY"); v {
+	case "":
+	case outOfOrderAccept, outOfOrderReject:
+		cfg.OutOfOrderPolicy = v
+	default:
+		return cfg, fmt.Errorf("SUPERMAN_OUT_OF_ORDER_POLICY must be accept or reject, got %q", v)
+	}
+	if err := durationVar(getenv, "SUPERMAN_OUT_OF_ORDER_GRACE", &cfg.OutOfOrderGrace); err != nil {
+		return cfg, err
+	}
+	if err := durationVar(getenv, "SUPERMAN_SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout); err != nil {
+		return cfg, err
+	}
+	if err := durationVar(getenv, "SUPERMAN_QUERY_TIMEOUT", &cfg.QueryTimeout); err != nil {
+		return cfg, err
+	}
+	if err := durationVar(getenv, "SUPERMAN_REQUEST_TIMEOUT", &cfg.RequestTimeout); err != nil {
+		return cfg, err
+	}
+	if err := durationVar(getenv, "SUPERMAN_READ_TIMEOUT", &cfg.ReadTimeout); err != nil {
+		return cfg, err
+	}
+	if err := durationVar(getenv, "SUPERMAN_WRITE_TIMEOUT", &cfg.WriteTimeout); err != nil {
+		return cfg, err
+	}
+	// Otherwise the connection is cut before a timed out request's 503 can be written
+	if cfg.WriteTimeout <= cfg.RequestTimeout {
+		return cfg, fmt.Errorf("SUPERMAN_WRITE_TIMEOUT must be longer than SUPERMAN_REQUEST_TIMEOUT (%v), got %v", cfg.RequestTimeout, cfg.WriteTimeout)
+	}
+	if err := durationVar(getenv, "SUPERMAN_IDLE_TIMEOUT", &cfg.IdleTimeout); err != nil {
+		return cfg, err
+	}
+	if err := durationVar(getenv, "SUPERMAN_RETENTION", &cfg.Retention); err != nil {
+		return cfg, err
+	}
+	if err := durationVar(getenv, "SUPERMAN_RETENTION_INTERVAL", &cfg.RetentionInterval); err != nil {
+		return cfg, err
+	}
+	if err := durationVar(getenv, "SUPERMAN_NEIGHBOR_WINDOW", &cfg.NeighborWindow); err != nil {
+		return cfg, err
+	}
+	if err := positiveIntVar(getenv, "SUPERMAN_NEIGHBOR_COUNT", &cfg.NeighborCount); err != nil {
+		return cfg, err
+	}
+	if err := durationVar(getenv, "SUPERMAN_CONCURRENT_WINDOW", &cfg.ConcurrentWindow); err != nil {
+		return cfg, err
+	}
+	if err := positiveFloatVar(getenv, "SUPERMAN_CONCURRENT_DISTANCE", &cfg.ConcurrentDistance); err != nil {
+		return cfg, err
+	}
+	if err := positiveFloatVar(getenv, "SUPERMAN_COORDINATE_MISMATCH_DISTANCE", &cfg.MismatchDistance); err != nil {
+		return cfg, err
+	}
+	if err := positiveIntVar(getenv, "SUPERMAN_COORDINATE_DECIMALS", &cfg.CoordinateDecimals); err != nil {
+		return cfg, err
+	}
+	if cfg.CoordinateDecimals > maxCoordinateDecimals {
+		return cfg, fmt.Errorf("SUPERMAN_COORDINATE_DECIMALS must be at most %d, got %d", maxCoordinateDecimals, cfg.CoordinateDecimals)
+	}
+	if err := durationVar(getenv, "SUPERMAN_SQLITE_BUSY_TIMEOUT", &cfg.SQLiteBusyTimeout); err != nil {
+		return cfg, err
+	}
+	if err := positiveIntVar(getenv, "SUPERMAN_DB_MAX_OPEN_CONNS", &cfg.DBMaxOpenConns); err != nil {
+		return cfg, err
+	}
+	if err := positiveIntVar(getenv, "SUPERMAN_DB_MAX_IDLE_CONNS", &cfg.DBMaxIdleConns); err != nil {
+		return cfg, err
+	}
+	if err := durationVar(getenv, "SUPERMAN_DB_CONN_MAX_LIFETIME", &cfg.DBConnMaxLifetime); err != nil {
+		return cfg, err
+	}
+	if v := getenv("SUPERMAN_SQLITE_JOURNAL_MODE"); v != "" {
+		switch mode := strings.ToUpper(v); mode {
+		case "WAL", "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "OFF":
+			cfg.SQLiteJournalMode = mode
+		default:
+			return cfg, fmt.Errorf("SUPERMAN_SQLITE_JOURNAL_MODE must be WAL, DELETE, TRUNCATE, PERSIST, MEMORY or OFF, got %q", v)
+		}
+	}
+	maxBodyBytes := int(cfg.MaxBodyBytes)
+	if err := positiveIntVar(getenv, "SUPERMAN_MAX_BODY_BYTES", &maxBodyBytes); err != nil {
+		return cfg, err
+	}
+	cfg.MaxBodyBytes = int64(maxBodyBytes)
+	if err := positiveFloatVar(getenv, "SUPERMAN_RATE_LIMIT", &cfg.RateLimit); err != nil {
+		return cfg, err
+	}
+	if err := positiveIntVar(getenv, "SUPERMAN_RATE_BURST", &cfg.RateBurst); err != nil {
+		return cfg, err
+	}
+	if err := positiveIntVar(getenv, "SUPERMAN_MAX_IN_FLIGHT", &cfg.MaxInFlight); err != nil {
+		return cfg, err
+	}
+	if err := positiveIntVar(getenv, "SUPERMAN_MAX_LOGINS_PER_USER", &cfg.MaxUserLogins); err != nil {
+		return cfg, err
+	}
+	cfg.APIKeys = listVar(getenv, "SUPERMAN_API_KEYS")
+	cfg.CORSOrigins = listVar(getenv, "SUPERMAN_CORS_ORIGINS")
+	cfg.NormalizeUsernames = listVar(getenv, "SUPERMAN_USERNAME_NORMALIZE")
+	for _, step := range cfg.NormalizeUsernames {
+		if step != normalizeTrim && step != normalizeLower {
+			return cfg, fmt.Errorf("SUPERMAN_USERNAME_NORMALIZE must be a comma separated list of trim and lower, got %q", step)
+		}
+	}
+	// Short keys are easy to brute force, and with them every stored username
+	if v := getenv("SUPERMAN_USERNAME_HASH_KEY"); v != "" {
+		if len(v) < minUsernameHashKey {
+			return cfg, fmt.Errorf("SUPERMAN_USERNAME_HASH_KEY must be at least %d characters, got %d", minUsernameHashKey, len(v))
+		}
+		cfg.UsernameHashKey = v
+	}
+	for _, cidr := range listVar(getenv, "SUPERMAN_TRUSTED_CIDRS") {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return cfg, fmt.Errorf("SUPERMAN_TRUSTED_CIDRS must be a comma separated list of CIDRs, got %q", cidr)
+		}
+		cfg.TrustedNetworks = append(cfg.TrustedNetworks, network)
+	}
+	for _, cidr := range listVar(getenv, "SUPERMAN_TRUSTED_PROXIES") {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return cfg, fmt.Errorf("SUPERMAN_TRUSTED_PROXIES must be a comma separated list of CIDRs, got %q", cidr)
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, network)
+	}
+	if err := boolVar(getenv, "SUPERMAN_AUTH_READS", &cfg.AuthReads); err != nil {
+		return cfg, err
+	}
+	if err := boolVar(getenv, "SUPERMAN_AUTH_HEALTH", &cfg.AuthHealth); err != nil {
+		return cfg, err
+	}
+	if v := getenv("SUPERMAN_LISTEN_ADDR"); v != "" {
+		if err := validateListenAddr(v); err != nil {
+			return cfg, fmt.Errorf("SUPERMAN_LISTEN_ADDR %v", err)
+		}
+		cfg.ListenAddr = v
+	}
+	if v := getenv("SUPERMAN_PPROF_ADDR"); v != "" {
+		if err := validateListenAddr(v); err != nil {
+			return cfg, fmt.Errorf("SUPERMAN_PPROF_ADDR %v", err)
+		}
+		cfg.PprofAddr = v
+	}
+	if v := getenv("SUPERMAN_DB_PATH"); v != "" {
+		cfg.DBPath = v
+	}
+	if v := getenv("SUPERMAN_GEO_PATH"); v != "" {
+		cfg.GeoPath = v
+	}
+	cfg.ASNPath = getenv("SUPERMAN_ASN_PATH")
+	switch v := getenv("SUPERMAN_GEO_NO_LOCATION"); v {
+	case "":
+	case geoNoLocationUnlocated, geoNoLocationError:
+		cfg.GeoNoLocation = v
+	default:
+		return cfg, fmt.Errorf("SUPERMAN_GEO_NO_LOCATION must be unlocated or error, got %q", v)
+	}
+	if err := durationVar(getenv, "SUPERMAN_GEO_MAX_AGE", &cfg.GeoMaxAge); err != nil {
+		return cfg, err
+	}
+	switch v := getenv("SUPERMAN_GEO_STALE_POLICY"); v {
+	case "":
+	case geoStaleWarn, geoStaleUnready:
+		cfg.GeoStalePolicy = v
+	default:
+		return cfg, fmt.Errorf("SUPERMAN_GEO_STALE_POLICY must be warn or unready, got %q", v)
+	}
+	switch v := getenv("SUPERMAN_AUDIT_SINK"); v {
+	case "", "db", "file":
+		cfg.AuditSink = v
+	default:
+		return cfg, fmt.Errorf("SUPERMAN_AUDIT_SINK must be db or file, got %q", v)
+	}
+	if v := getenv("SUPERMAN_AUDIT_PATH"); v != "" {
+		cfg.AuditPath = v
+	}
+	if v := getenv("SUPERMAN_WEBHOOK_URL"); v != "" {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return cfg, fmt.Errorf("SUPERMAN_WEBHOOK_URL must be an http or https url, got %q", v)
+		}
+		cfg.WebhookURL = v
+	}
+	cfg.WebhookSecret = getenv("SUPERMAN_WEBHOOK_SECRET")
+	if err := positiveIntVar(getenv, "SUPERMAN_WEBHOOK_MAX_ATTEMPTS", &cfg.WebhookMaxAttempts); err != nil {
+		return cfg, err
+	}
+	if err := durationVar(getenv, "SUPERMAN_ALERT_COOLDOWN", &cfg.AlertCooldown); err != nil {
+		return cfg, err
+	}
+	switch v := getenv("SUPERMAN_ALERT_COOLDOWN_SUPPRESSES"); v {
+	case "":
+	case cooldownSuppressAll, cooldownSuppressNotifications:
+		cfg.CooldownSuppresses = v
+	default:
+		return cfg, fmt.Errorf("SUPERMAN_ALERT_COOLDOWN_SUPPRESSES must be all or notifications, got %q", v)
+	}
+	if v := getenv("SUPERMAN_OTLP_ENDPOINT"); v != "" {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return cfg, fmt.Errorf("SUPERMAN_OTLP_ENDPOINT must be an http or https url, got %q", v)
+		}
+		cfg.OTLPEndpoint = v
+	}
+	switch v := getenv("SUPERMAN_MODE"); v {
+	case "":
+	case modeHTTP, modeConsumer, modeBoth:
+		cfg.Mode = v
+	default:
+		return cfg, fmt.Errorf("SUPERMAN_MODE must be http, consumer or both, got %q", v)
+	}
+	if v := getenv("SUPERMAN_NATS_URL"); v != "" {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" {
+			return cfg, fmt.Errorf("SUPERMAN_NATS_URL must be a nats:// or tls:// url, got %q", v)
+		}
+		cfg.NATSURL = v
+	}
+	if cfg.Mode != modeHTTP && cfg.NATSURL == "" {
+		return cfg, fmt.Errorf("SUPERMAN_NATS_URL is required with SUPERMAN_MODE=%v", cfg.Mode)
+	}
+	if v := getenv("SUPERMAN_NATS_SUBJECT"); v != "" {
+		cfg.NATSSubject = v
+	}
+	if v := getenv("SUPERMAN_NATS_RESULT_SUBJECT"); v != "" {
+		cfg.NATSResultSubject = v
+	}
+	if v := getenv("SUPERMAN_LOG_LEVEL"); v != "" {
+		if err := cfg.LogLevel.UnmarshalText([]byte(v)); err != nil {
+			return cfg, fmt.Errorf("SUPERMAN_LOG_LEVEL must be debug, info, warn or error, got %q", v)
+		}
+	}
+	return cfg, nil
+}
+
+// Reads a positive integer from the named environment variable into dst if it is set
+func positiveIntVar(getenv func(string) string, name string, dst *int) error {
+	v := getenv(name)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("%s must be a positive integer, got %q", name, v)
+	}
+	*dst = n
+	return nil
+}
+
+// Reads a positive number from the named environment variable into dst if it is set
+func positiveFloatVar(getenv func(string) string, name string, dst *float64) error {
+	v := getenv(name)
+	if v == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f <= 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		return fmt.Errorf("%s must be a positive number, got %q", name, v)
+	}
+	*dst = f
+	return nil
+}
+
+// Reads a comma separated list from the named environment variable, dropping empty entries
+func listVar(getenv func(string) string, name string) []string {
+	var list []string
+	for _, item := range strings.Split(getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Reads a boolean (true/false, 1/0) from the named environment variable into dst if it is set
+func boolVar(getenv func(string) string, name string, dst *bool) error {
+	v := getenv(name)
+	if v == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("%s must be true or false, got %q", name, v)
+	}
+	*dst = b
+	return nil
+}
+
+// Reads a positive duration such as "30s" or "2m" from the named environment variable into dst if it is set
+func durationVar(getenv func(string) string, name string, dst *time.Duration) error {
+	v := getenv(name)
+	if v == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("%s must be a positive duration like 30s, got %q", name, v)
+	}
+	*dst = d
+	return nil
+}
+
+// Checks addr is a host:port pair with a valid port, e.g. ":8080" or "127.0.0.1:9000"
+func validateListenAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("must be host:port, got %q", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("has an invalid port in %q", addr)
+	}
+	return nil
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"detector/travel"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func fakeEnv(vars map[string]string) func(string) string {
+	return func(name string) string { return vars[name] }
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SpeedThreshold != 500 {
+		t.Errorf("unexpected default speed threshold: got %v want %v", cfg.SpeedThreshold, 500)
+	}
+}
+
+func TestLoadConfigSpeedThreshold(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_SPEED_THRESHOLD": "120"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SpeedThreshold != 120 {
+		t.Errorf("unexpected speed threshold: got %v want %v", cfg.SpeedThreshold, 120)
+	}
+
+	for _, v := range []string{"0", "-5", "fast", "1.5"} {
+		if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_SPEED_THRESHOLD": v})); err == nil {
+			t.Errorf("expected SUPERMAN_SPEED_THRESHOLD=%q to be rejected", v)
+		}
+	}
+}
+
+func TestLoadConfigLogLevel(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_LOG_LEVEL": "debug"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LogLevel != slog.LevelDebug {
+		t.Errorf("unexpected log level: got %v want %v", cfg.LogLevel, slog.LevelDebug)
+	}
+
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_LOG_LEVEL": "chatty"})); err == nil {
+		t.Errorf("expected an unknown log level to be rejected")
+	}
+}
+
+func TestLoadConfigListenAddr(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ListenAddr != ":8080" {
+		t.Errorf("unexpected default listen address: got %v want %v", cfg.ListenAddr, ":8080")
+	}
+
+	for _, addr := range []string{":9000", "127.0.0.1:8081", "[::1]:8082", "localhost:0"} {
+		cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_LISTEN_ADDR": addr}))
+		if err != nil {
+			t.Errorf("expected %q to be accepted: %v", addr, err)
+		}
+		if cfg.ListenAddr != addr {
+			t.Errorf("unexpected listen address: got %v want %v", cfg.ListenAddr, addr)
+		}
+	}
+
+	for _, addr := range []string{"8080", "localhost", ":http-alt", ":70000", "::1:8080"} {
+		if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_LISTEN_ADDR": addr})); err == nil {
+			t.Errorf("expected SUPERMAN_LISTEN_ADDR=%q to be rejected", addr)
+		}
+	}
+}
+
+func TestLoadConfigQueryTimeout(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_QUERY_TIMEOUT": "250ms"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.QueryTimeout != 250*time.Millisecond {
+		t.Errorf("unexpected query timeout: got %v want %v", cfg.QueryTimeout, 250*time.Millisecond)
+	}
+
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_QUERY_TIMEOUT": "soon"})); err == nil {
+		t.Errorf("expected an invalid query timeout to be rejected")
+	}
+}
+
+func TestLoadConfigDirectionalThresholds(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_SPEED_THRESHOLD_FROM": "200"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Env{Config: cfg}
+	if to := e.speedThreshold(evalOptions{unit: travel.Miles}, "to"); to != 500 {
+		t.Errorf("unset direction should use SUPERMAN_SPEED_THRESHOLD: got %v want %v", to, 500)
+	}
+	if from := e.speedThreshold(evalOptions{unit: travel.Miles}, "from"); from != 200 {
+		t.Errorf("unexpected from threshold: got %v want %v", from, 200)
+	}
+
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_SPEED_THRESHOLD_TO": "-1"})); err == nil {
+		t.Errorf("expected a negative SUPERMAN_SPEED_THRESHOLD_TO to be rejected")
+	}
+}
+
+func TestLoadConfigRateLimit(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_RATE_LIMIT": "0.5", "SUPERMAN_RATE_BURST": "5"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RateLimit != 0.5 || cfg.RateBurst != 5 {
+		t.Errorf("unexpected rate limit: got %v burst %v want %v burst %v", cfg.RateLimit, cfg.RateBurst, 0.5, 5)
+	}
+
+	for _, v := range []string{"0", "-1", "lots", "NaN"} {
+		if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_RATE_LIMIT": v})); err == nil {
+			t.Errorf("expected SUPERMAN_RATE_LIMIT=%q to be rejected", v)
+		}
+	}
+}
+
+func TestLoadConfigAPIKeys(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_API_KEYS": "first-key, second-key,,"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.APIKeys) != 2 || cfg.APIKeys[0] != "first-key" || cfg.APIKeys[1] != "second-key" {
+		t.Errorf("unexpected API keys: got %q", cfg.APIKeys)
+	}
+}
+
+func TestLoadConfigWebhook(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_WEBHOOK_URL": "https://hooks.example.com/superman", "SUPERMAN_WEBHOOK_SECRET": "s3cret"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.WebhookURL != "https://hooks.example.com/superman" || cfg.WebhookSecret != "s3cret" || cfg.WebhookMaxAttempts != 5 {
+		t.Errorf("unexpected webhook config: got %q %q %v", cfg.WebhookURL, cfg.WebhookSecret, cfg.WebhookMaxAttempts)
+	}
+
+	for _, v := range []string{"hooks.example.com", "ftp://hooks.example.com", "https://"} {
+		if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_WEBHOOK_URL": v})); err == nil {
+			t.Errorf("expected SUPERMAN_WEBHOOK_URL=%q to be rejected", v)
+		}
+	}
+}
+
+func TestLoadConfigNeighborCount(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.NeighborCount != 1 {
+		t.Errorf("expected the adjacent logins only by default, got %v", cfg.NeighborCount)
+	}
+	cfg, err = loadConfig(fakeEnv(map[string]string{"SUPERMAN_NEIGHBOR_COUNT": "3"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.NeighborCount != 3 {
+		t.Errorf("unexpected neighbour count: got %v want 3", cfg.NeighborCount)
+	}
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_NEIGHBOR_COUNT": "0"})); err == nil {
+		t.Errorf("expected a zero neighbour count to be rejected")
+	}
+}
+
+func TestLoadConfigMinDistance(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_MIN_DISTANCE": "31.5"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MinDistance != 31.5 {
+		t.Errorf("unexpected minimum distance: got %v want 31.5", cfg.MinDistance)
+	}
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_MIN_DISTANCE": "-1"})); err == nil {
+		t.Errorf("expected a negative minimum distance to be rejected")
+	}
+}
+
+func TestLoadConfigConcurrent(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ConcurrentWindow != 0 || cfg.ConcurrentDistance != 500 {
+		t.Errorf("expected the concurrent check to be off by default, got %v, %v", cfg.ConcurrentWindow, cfg.ConcurrentDistance)
+	}
+	cfg, err = loadConfig(fakeEnv(map[string]string{"SUPERMAN_CONCURRENT_WINDOW": "60s", "SUPERMAN_CONCURRENT_DISTANCE": "1000"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ConcurrentWindow != time.Minute || cfg.ConcurrentDistance != 1000 {
+		t.Errorf("unexpected concurrent settings: got %v, %v", cfg.ConcurrentWindow, cfg.ConcurrentDistance)
+	}
+}
+
+func TestLoadConfigRetention(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Retention != 0 || cfg.RetentionInterval != time.Hour {
+		t.Errorf("expected logins to be kept forever by default, got %v every %v", cfg.Retention, cfg.RetentionInterval)
+	}
+	cfg, err = loadConfig(fakeEnv(map[string]string{"SUPERMAN_RETENTION": "2160h", "SUPERMAN_RETENTION_INTERVAL": "10m"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Retention != 2160*time.Hour || cfg.RetentionInterval != 10*time.Minute {
+		t.Errorf("unexpected retention settings: got %v every %v", cfg.Retention, cfg.RetentionInterval)
+	}
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_RETENTION_INTERVAL": "0s"})); err == nil {
+		t.Errorf("expected a zero retention interval to be rejected")
+	}
+}
+
+func TestLoadConfigServerTimeouts(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_READ_TIMEOUT": "5s", "SUPERMAN_WRITE_TIMEOUT": "2m", "SUPERMAN_IDLE_TIMEOUT": "30s"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ReadTimeout != 5*time.Second || cfg.WriteTimeout != 2*time.Minute || cfg.IdleTimeout != 30*time.Second {
+		t.Errorf("unexpected timeouts: got read %v write %v idle %v", cfg.ReadTimeout, cfg.WriteTimeout, cfg.IdleTimeout)
+	}
+
+	for _, env := range []map[string]string{
+		{"SUPERMAN_IDLE_TIMEOUT": "0s"},
+		// Leaves no time to write the 503 for a request that timed out
+		{"SUPERMAN_WRITE_TIMEOUT": "30s"},
+		{"SUPERMAN_WRITE_TIMEOUT": "2m", "SUPERMAN_REQUEST_TIMEOUT": "5m"},
+	} {
+		if _, err := loadConfig(fakeEnv(env)); err == nil {
+			t.Errorf("%v: expected the timeouts to be rejected", env)
+		}
+	}
+}
+
+func TestLoadConfigImpossibleSpeed(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_IMPOSSIBLE_SPEED": "1900"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ImpossibleSpeed != 1900 {
+		t.Errorf("unexpected impossible speed: got %v want 1900", cfg.ImpossibleSpeed)
+	}
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_IMPOSSIBLE_SPEED": "400"})); err == nil {
+		t.Errorf("expected an impossible speed under the threshold to be rejected")
+	}
+	cfg, err = loadConfig(fakeEnv(map[string]string{"SUPERMAN_SPEED_THRESHOLD": "2500"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ImpossibleSpeed != 2500 {
+		t.Errorf("expected the default to be raised to the threshold, got %v", cfg.ImpossibleSpeed)
+	}
+}
+
+func TestLoadConfigOTLP(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_OTLP_ENDPOINT": "http://localhost:4318"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.OTLPEndpoint != "http://localhost:4318" {
+		t.Errorf("unexpected OTLP endpoint: got %q", cfg.OTLPEndpoint)
+	}
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_OTLP_ENDPOINT": "localhost:4318"})); err == nil {
+		t.Errorf("expected an OTLP endpoint without a scheme to be rejected")
+	}
+}
+
+func TestLoadConfigConsumer(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Mode != modeHTTP || cfg.NATSSubject != "logins" || cfg.NATSResultSubject != "logins.results" {
+		t.Errorf("unexpected consumer defaults: got %v %v %v", cfg.Mode, cfg.NATSSubject, cfg.NATSResultSubject)
+	}
+
+	cfg, err = loadConfig(fakeEnv(map[string]string{"SUPERMAN_MODE": "both", "SUPERMAN_NATS_URL": "tls://localhost:4222", "SUPERMAN_NATS_SUBJECT": "auth.logins"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Mode != modeBoth || cfg.NATSURL != "tls://localhost:4222" || cfg.NATSSubject != "auth.logins" {
+		t.Errorf("unexpected consumer config: got %v %v %v", cfg.Mode, cfg.NATSURL, cfg.NATSSubject)
+	}
+
+	for _, vars := range []map[string]string{
+		{"SUPERMAN_MODE": "kafka"},
+		{"SUPERMAN_MODE": "consumer"},
+		{"SUPERMAN_MODE": "consumer", "SUPERMAN_NATS_URL": "http://localhost:4222"},
+	} {
+		if _, err := loadConfig(fakeEnv(vars)); err == nil {
+			t.Errorf("expected %v to be rejected", vars)
+		}
+	}
+}
+
+func TestLoadConfigDBPool(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_DB_MAX_OPEN_CONNS": "20", "SUPERMAN_DB_MAX_IDLE_CONNS": "10", "SUPERMAN_DB_CONN_MAX_LIFETIME": "5m"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DBMaxOpenConns != 20 || cfg.DBMaxIdleConns != 10 || cfg.DBConnMaxLifetime != 5*time.Minute {
+		t.Errorf("unexpected pool settings: got %v %v %v", cfg.DBMaxOpenConns, cfg.DBMaxIdleConns, cfg.DBConnMaxLifetime)
+	}
+
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_DB_MAX_OPEN_CONNS": "0"})); err == nil {
+		t.Errorf("expected a zero pool size to be rejected")
+	}
+}
+
+func TestLoadConfigSQLite(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SQLiteBusyTimeout != 5*time.Second || cfg.SQLiteJournalMode != "WAL" {
+		t.Errorf("unexpected SQLite defaults: got %v %v", cfg.SQLiteBusyTimeout, cfg.SQLiteJournalMode)
+	}
+
+	cfg, err = loadConfig(fakeEnv(map[string]string{"SUPERMAN_SQLITE_BUSY_TIMEOUT": "250ms", "SUPERMAN_SQLITE_JOURNAL_MODE": "delete"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SQLiteBusyTimeout != 250*time.Millisecond || cfg.SQLiteJournalMode != "DELETE" {
+		t.Errorf("unexpected SQLite config: got %v %v", cfg.SQLiteBusyTimeout, cfg.SQLiteJournalMode)
+	}
+
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_SQLITE_JOURNAL_MODE": "fast"})); err == nil {
+		t.Errorf("expected an unknown journal mode to be rejected")
+	}
+}
+
+func TestLoadConfigAlertCooldown(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_ALERT_COOLDOWN": "15m", "SUPERMAN_ALERT_COOLDOWN_SUPPRESSES": "notifications"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AlertCooldown != 15*time.Minute || cfg.CooldownSuppresses != cooldownSuppressNotifications {
+		t.Errorf("unexpected cooldown: got %v, %v", cfg.AlertCooldown, cfg.CooldownSuppresses)
+	}
+
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_ALERT_COOLDOWN_SUPPRESSES": "webhooks"})); err == nil {
+		t.Errorf("expected an unknown SUPERMAN_ALERT_COOLDOWN_SUPPRESSES to be rejected")
+	}
+}
+
+func TestLoadConfigPprofAddr(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PprofAddr != "" {
+		t.Errorf("expected profiling to be off by default, got %q", cfg.PprofAddr)
+	}
+
+	cfg, err = loadConfig(fakeEnv(map[string]string{"SUPERMAN_PPROF_ADDR": "localhost:6060"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PprofAddr != "localhost:6060" {
+		t.Errorf("unexpected profiling address: got %q", cfg.PprofAddr)
+	}
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_PPROF_ADDR": "6060"})); err == nil {
+		t.Errorf("expected a profiling address without a port to be rejected")
+	}
+}
+
+func TestLoadConfigOutOfOrder(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_OUT_OF_ORDER_POLICY": "reject", "SUPERMAN_OUT_OF_ORDER_GRACE": "1m"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.OutOfOrderPolicy != outOfOrderReject || cfg.OutOfOrderGrace != time.Minute {
+		t.Errorf("unexpected out-of-order policy: got %v, %v", cfg.OutOfOrderPolicy, cfg.OutOfOrderGrace)
+	}
+
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_OUT_OF_ORDER_POLICY": "drop"})); err == nil {
+		t.Errorf("expected an unknown SUPERMAN_OUT_OF_ORDER_POLICY to be rejected")
+	}
+}
+
+func TestLoadConfigUsernameNormalize(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_USERNAME_NORMALIZE": "trim, lower"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.NormalizeUsernames) != 2 || cfg.NormalizeUsernames[0] != normalizeTrim || cfg.NormalizeUsernames[1] != normalizeLower {
+		t.Errorf("unexpected username normalization: got %q", cfg.NormalizeUsernames)
+	}
+
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_USERNAME_NORMALIZE": "trim,nfkc"})); err == nil {
+		t.Errorf("expected an unknown SUPERMAN_USERNAME_NORMALIZE step to be rejected")
+	}
+}
+
+func TestLoadConfigBaseline(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_BASELINE": "distinct", "SUPERMAN_DISTINCT_DISTANCE": "20"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Baseline != baselineDistinct || cfg.DistinctDistance != 20 {
+		t.Errorf("unexpected baseline: got %v %v", cfg.Baseline, cfg.DistinctDistance)
+	}
+
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_BASELINE": "nearest"})); err == nil {
+		t.Errorf("expected an unknown SUPERMAN_BASELINE to be rejected")
+	}
+}
+
+func TestLoadConfigGeoMaxAge(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_GEO_MAX_AGE": "336h", "SUPERMAN_GEO_STALE_POLICY": "unready"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GeoMaxAge != 336*time.Hour || cfg.GeoStalePolicy != geoStaleUnready {
+		t.Errorf("unexpected GeoIP age settings: got %v %v", cfg.GeoMaxAge, cfg.GeoStalePolicy)
+	}
+
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_GEO_STALE_POLICY": "fail"})); err == nil {
+		t.Errorf("expected an unknown SUPERMAN_GEO_STALE_POLICY to be rejected")
+	}
+}
+
+func TestLoadConfigUsernameHashKey(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_USERNAME_HASH_KEY": "0123456789abcdef"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.UsernameHashKey != "0123456789abcdef" {
+		t.Errorf("unexpected username hash key: got %q", cfg.UsernameHashKey)
+	}
+
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_USERNAME_HASH_KEY": "secret"})); err == nil {
+		t.Errorf("expected a short SUPERMAN_USERNAME_HASH_KEY to be rejected")
+	}
+}
+
+func TestLoadConfigGeoNoLocation(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_GEO_NO_LOCATION": "error"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GeoNoLocation != geoNoLocationError {
+		t.Errorf("unexpected empty GeoIP record policy: got %v", cfg.GeoNoLocation)
+	}
+
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_GEO_NO_LOCATION": "ignore"})); err == nil {
+		t.Errorf("expected an unknown SUPERMAN_GEO_NO_LOCATION to be rejected")
+	}
+}
+
+func TestLoadConfigCoordinateMismatch(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_COORDINATE_MISMATCH_DISTANCE": "250"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MismatchDistance != 250 {
+		t.Errorf("unexpected mismatch distance: got %v", cfg.MismatchDistance)
+	}
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_COORDINATE_MISMATCH_DISTANCE": "-1"})); err == nil {
+		t.Errorf("expected a negative distance to be rejected")
+	}
+}
+
+func TestLoadConfigCoordinateDecimals(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_COORDINATE_DECIMALS": "3"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CoordinateDecimals != 3 {
+		t.Errorf("expected 3 decimal places, got %v", cfg.CoordinateDecimals)
+	}
+
+	for _, v := range []string{"0", "9", "two"} {
+		if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_COORDINATE_DECIMALS": v})); err == nil {
+			t.Errorf("expected %q decimal places to be rejected", v)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Values of Config.Mode
+const (
+	modeHTTP     = "http"
+	modeConsumer = "consumer"
+	modeBoth     = "both"
+)
+
+// A message broker login events are consumed from and results published to
+type messageQueue interface {
+	// Calls handle with each message sent to subject, one at a time, until ctx is done
+	// (returning nil) or the connection fails
+	subscribe(ctx context.Context, subject string, handle func(data []byte)) error
+	publish(subject string, data []byte) error
+	close() error
+}
+
+// What's published for each consumed login: the result POST /v1/ would have returned, or
+// the error it would have answered with. Exactly one of Result or Error is set.
+type consumerResult struct {
+	EventUUID string       `json:"event_uuid,omitempty"`
+	Result    *loginResult `json:"result,omitempty"`
+	Error     *apiError    `json:"error,omitempty"`
+}
+
+// Evaluates each login record sent to the in subject and publishes its result to out, until
+// ctx is cancelled or the queue connection fails. Messages are handled in the order they
+// arrive, so a user's logins are checked against each other as they would be over HTTP.
+func (env *Env) consume(ctx context.Context, queue messageQueue, in, out string) error {
+	// A message that's being evaluated when ctx is cancelled is still finished and published
+	msgCtx := context.WithoutCancel(ctx)
+	return queue.subscribe(ctx, in, func(data []byte) {
+		result := env.consumeMessage(msgCtx, data)
+		body, _ := json.Marshal(result)
+		if err := queue.publish(out, body); err != nil {
+			env.logFor(ctx).Error("could not publish result", "event_uuid", result.EventUUID, "error", err)
+		}
+	})
+}
+
+func (env *Env) consumeMessage(ctx context.Context, data []byte) consumerResult {
+	ctx, s := env.startSpan(ctx, "consume")
+	defer s.End()
+	lr, result, err := env.evaluateJSON(ctx, data, evalOptions{})
+	setSpanError(s, err)
+	if err != nil {
+		return consumerResult{EventUUID: lr.EventUUID, Error: newAPIError(err)}
+	}
+	s.SetAttributes(attribute.Bool("suspicious", result.Suspicious))
+	return consumerResult{EventUUID: lr.EventUUID, Result: &result}
+}
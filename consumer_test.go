@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"detector/models"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// A queue that delivers a fixed list of messages and records what's published
+type memoryQueue struct {
+	messages  []string
+	published map[string][][]byte
+	failWith  error
+}
+
+func (q *memoryQueue) subscribe(ctx context.Context, subject string, handle func(data []byte)) error {
+	for _, m := range q.messages {
+		if ctx.Err() != nil {
+			return nil
+		}
+		handle([]byte(m))
+	}
+	return q.failWith
+}
+
+func (q *memoryQueue) publish(subject string, data []byte) error {
+	if q.published == nil {
+		q.published = map[string][][]byte{}
+	}
+	q.published[subject] = append(q.published[subject], data)
+	return nil
+}
+
+func (q *memoryQueue) close() error {
+	return nil
+}
+
+func TestConsumer(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)})
+	queue := &memoryQueue{messages: []string{
+		`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`,
+		`{"username": "bob", "unix_timestamp": 1514764801, "event_uuid": "00000000-0000-4000-8000-00000000000c", "ip_address": "91.207.175.104"}`,
+		`{"username": "bob", "unix_timestamp": 1514764802, "event_uuid": "00000000-0000-4000-8000-00000000000d", "ip_address": "206.81.252"}`,
+		`{"username":`,
+	}}
+
+	if err := memEnv.consume(context.Background(), queue, "logins", "logins.results"); err != nil {
+		t.Fatal(err)
+	}
+
+	published := queue.published["logins.results"]
+	if len(published) != 4 {
+		t.Fatalf("expected a result for every message, got %v", len(published))
+	}
+	results := make([]consumerResult, len(published))
+	for i, body := range published {
+		if err := json.Unmarshal(body, &results[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Consumed logins are saved and checked against each other like POSTed ones
+	if r := results[0]; r.EventUUID != "00000000-0000-4000-8000-00000000000b" || r.Result == nil || r.Result.Suspicious || int(r.Result.PrecedingIpAccess.Speed) != 55 {
+		t.Errorf("unexpected first result: got %+v", r)
+	}
+	if r := results[1]; r.EventUUID != "00000000-0000-4000-8000-00000000000c" || r.Result == nil || !r.Result.Suspicious || int(r.Result.PrecedingIpAccess.Speed) != 8330887 {
+		t.Errorf("unexpected second result: got %+v", r)
+	}
+	if r := results[2]; r.EventUUID != "00000000-0000-4000-8000-00000000000d" || r.Error == nil || r.Error.Code != codeInvalidIP {
+		t.Errorf("expected an invalid ip error, got %+v", r)
+	}
+	if r := results[3]; r.Error == nil || r.Error.Code != codeInvalidJSON {
+		t.Errorf("expected an invalid json error, got %+v", r)
+	}
+}
+
+func TestConsumerConnectionFailure(t *testing.T) {
+	lost := errors.New("connection lost")
+	queue := &memoryQueue{failWith: lost}
+	if err := newMemoryEnv(t).consume(context.Background(), queue, "logins", "logins.results"); err != lost {
+		t.Errorf("expected the queue error to stop the consumer, got %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"detector/models"
+	"time"
+)
+
+// Values of Config.CooldownSuppresses
+const (
+	cooldownSuppressAll           = "all"
+	cooldownSuppressNotifications = "notifications"
+)
+
+// Reports a suspicious result's detections and starts the user's alert cooldown. A user
+// already in one isn't alerted about again until it's over, so a compromised account
+// logging in over and over doesn't flood the webhook. Only a result with detections to
+// report starts one, so a cooldown always follows an alert someone received. Dry runs
+// never touch the cooldown. Retried events only read it: the event that started it is
+// never suppressed by it, so while it lasts a retry answers as its first attempt did.
+func (env *Env) alert(ctx context.Context, login models.Login, result *loginResult, opts evalOptions) error {
+	if !result.Suspicious || len(result.detections) == 0 || opts.dryRun {
+		return nil
+	}
+	now := env.now()
+	if env.AlertCooldown > 0 {
+		last, err := env.store.LastAlert(ctx, login.Username)
+		if err != nil {
+			return err
+		}
+		if last != nil && last.EventUUID != login.EventUUID && now.Sub(time.Unix(last.At, 0)) < env.AlertCooldown {
+			result.AlertSuppressed = true
+			if env.CooldownSuppresses != cooldownSuppressNotifications {
+				result.Suspicious = false
+				result.Severity = severityNone
+			}
+			return nil
+		}
+	}
+	// A retried event was reported, and started any cooldown, the first time round
+	if opts.retry {
+		return nil
+	}
+	if env.AlertCooldown > 0 {
+		if err := env.store.SetLastAlert(ctx, models.Alert{Username: login.Username, At: now.Unix(), EventUUID: login.EventUUID}); err != nil {
+			return err
+		}
+	}
+	for _, d := range result.detections {
+		env.reportDetection(d)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"detector/models"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAlertCooldown(t *testing.T) {
+	tests := []struct {
+		suppresses string
+		// Whether a login during the cooldown is still flagged in the response
+		flagged bool
+	}{
+		{cooldownSuppressAll, false},
+		{cooldownSuppressNotifications, true},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		memEnv.AuditSink = "db"
+		memEnv.AlertCooldown = time.Hour
+		memEnv.CooldownSuppresses = tc.suppresses
+		clock := newFakeClock(1514764800)
+		memEnv.clock = clock
+		audit, err := memEnv.openAuditor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		memEnv.audit = audit
+		seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514764700, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)})
+
+		// Alternates between Los Angeles and Austin, a second apart
+		post := func(n int, ip string) loginResult {
+			rr := postBatch(t, memEnv, fmt.Sprintf(`[{"username": "bob", "unix_timestamp": %d, "event_uuid": "00000000-0000-4000-8000-00000000000%x", "ip_address": %q}]`, 1514764800+n, 10+n, ip))
+			var results []batchResult
+			if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || len(results) != 1 || results[0].Result == nil {
+				t.Fatalf("%s: unexpected response %v %s", tc.suppresses, rr.Code, rr.Body.String())
+			}
+			return *results[0].Result
+		}
+
+		if r := post(1, "91.207.175.104"); !r.Suspicious || r.AlertSuppressed {
+			t.Errorf("%s: expected the first suspicious login to alert, got %+v", tc.suppresses, r)
+		}
+		// A retry of the event that started the cooldown gets the same answer
+		if r := post(1, "91.207.175.104"); !r.Suspicious || r.AlertSuppressed || r.Severity == severityNone {
+			t.Errorf("%s: expected a retried event not to be suppressed by its own cooldown, got %+v", tc.suppresses, r)
+		}
+		clock.advance(30 * time.Minute)
+		if r := post(2, "24.242.71.20"); r.Suspicious != tc.flagged || !r.AlertSuppressed {
+			t.Errorf("%s: expected a suspicious login during the cooldown to be suppressed, got %+v", tc.suppresses, r)
+		}
+		// As is a retry of it, which doesn't restart the cooldown
+		if r := post(2, "24.242.71.20"); r.Suspicious != tc.flagged || !r.AlertSuppressed {
+			t.Errorf("%s: expected a retried suppressed event to be suppressed again, got %+v", tc.suppresses, r)
+		}
+		clock.advance(time.Hour)
+		if r := post(3, "91.207.175.104"); !r.Suspicious || r.AlertSuppressed {
+			t.Errorf("%s: expected a suspicious login after the cooldown to alert, got %+v", tc.suppresses, r)
+		}
+		memEnv.audit.close()
+
+		// Every login is saved, but only the ones alerted about are audited
+		logins, err := memEnv.store.LoginsByUsername(context.Background(), "bob", models.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(logins) != 4 {
+			t.Errorf("%s: expected every login to be saved, got %+v", tc.suppresses, logins)
+		}
+		detections, err := memEnv.store.DetectionsByUsername(context.Background(), "bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(detections) != 2 || detections[0].EventUUID != "00000000-0000-4000-8000-00000000000b" || detections[1].EventUUID != "00000000-0000-4000-8000-00000000000d" {
+			t.Errorf("%s: expected only the logins outside the cooldown to be audited, got %+v", tc.suppresses, detections)
+		}
+	}
+}
+
+func TestAlertCooldownAfterGeofence(t *testing.T) {
+	receiver := &webhookReceiver{}
+	memEnv := newMemoryEnv(t)
+	memEnv.webhook = newTestWebhook(t, receiver, 3)
+	memEnv.AlertCooldown = time.Hour
+	memEnv.clock = newFakeClock(1514764800)
+	// Baltimore is 1337 miles from a home in Austin
+	if err := memEnv.store.SetHome(context.Background(), models.Home{Username: "bob", Lat: 30.3773, Lon: -97.71, Radius: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The user's first login is only outside the geofence, the next one impossibly far from it
+	baltimore := loginRecord{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6"}
+	r, err := memEnv.Evaluate(context.Background(), baltimore, evalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Suspicious || r.AlertSuppressed || r.OutsideHomeGeofence == nil || !*r.OutsideHomeGeofence {
+		t.Errorf("expected the login outside the geofence to alert, got %+v", r)
+	}
+	la := loginRecord{Username: "bob", UnixTimestamp: 1514764801, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "91.207.175.104"}
+	r, err = memEnv.Evaluate(context.Background(), la, evalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.AlertSuppressed {
+		t.Errorf("expected the impossible travel during the cooldown to be suppressed, got %+v", r)
+	}
+	memEnv.webhook.close(time.Minute)
+
+	// The cooldown was started by an alert that was sent, so nothing was suppressed unseen
+	if len(receiver.bodies) != 1 {
+		t.Fatalf("expected the geofence alert to be delivered, got %v notifications", len(receiver.bodies))
+	}
+	var d models.Detection
+	if err := json.Unmarshal(receiver.bodies[0], &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Direction != "home" || d.EventUUID != baltimore.EventUUID {
+		t.Errorf("unexpected notification: got %+v", d)
+	}
+}
+
+func TestAlertCooldownSkipsDryRuns(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.AlertCooldown = time.Hour
+	seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514764700, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)})
+
+	body := `{"username": "bob", "candidates": [{"ip_address": "91.207.175.104", "unix_timestamp": 1514764801}]}`
+	for i := 0; i < 2; i++ {
+		var results []batchResult
+		rr := postCandidates(t, memEnv, body)
+		if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || len(results) != 1 || results[0].Result == nil {
+			t.Fatalf("unexpected response %v %s", rr.Code, rr.Body.String())
+		}
+		if r := results[0].Result; !r.Suspicious || r.AlertSuppressed {
+			t.Errorf("expected dry runs never to be suppressed, got %+v", r)
+		}
+	}
+	if alert, err := memEnv.store.LastAlert(context.Background(), "bob"); err != nil || alert != nil {
+		t.Errorf("expected a dry run not to start a cooldown, got %+v, %v", alert, err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+)
+
+const (
+	corsAllowMethods  = "GET, POST, DELETE, OPTIONS"
+	corsAllowHeaders  = "Authorization, Content-Type, Content-Encoding, X-Request-ID"
+	corsExposeHeaders = "X-Request-ID, Retry-After"
+)
+
+// Reports whether browsers on origin may call the api. "*" in CORSOrigins allows any origin.
+func (env *Env) allowedOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, allowed := range env.CORSOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware that lets browser-based clients on an allowed origin read the response
+func (env *Env) withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, request *http.Request) {
+		// The header depends on the request's origin, so caches mustn't share responses across origins
+		rw.Header().Add("Vary", "Origin")
+		if origin := request.Header.Get("Origin"); env.allowedOrigin(origin) {
+			rw.Header().Set("Access-Control-Allow-Origin", origin)
+			rw.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		}
+		next.ServeHTTP(rw, request)
+	})
+}
+
+// Answers CORS preflight (OPTIONS) requests. Requests from origins that aren't allowed
+// get no CORS headers, so the browser won't send the real request.
+func (env *Env) HandlePreflight(rw http.ResponseWriter, request *http.Request) {
+	if env.allowedOrigin(request.Header.Get("Origin")) {
+		rw.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+		rw.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		rw.Header().Set("Access-Control-Max-Age", "600")
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func corsRequest(t *testing.T, e *Env, method, origin string) *httptest.ResponseRecorder {
+	body := bytes.NewBufferString(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000a", "ip_address": "10.0.0.1"}`)
+	req, err := http.NewRequest(method, "/v1/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", origin)
+	if method == "OPTIONS" {
+		req.Header.Set("Access-Control-Request-Method", "POST")
+	}
+	rr := httptest.NewRecorder()
+	e.routes().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCORSPreflight(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.CORSOrigins = []string{"https://dashboard.example.com"}
+
+	rr := corsRequest(t, memEnv, "OPTIONS", "https://dashboard.example.com")
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("preflight returned wrong status code: got %v want %v", rr.Code, http.StatusNoContent)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "https://dashboard.example.com" {
+		t.Errorf("unexpected Access-Control-Allow-Origin: %q", got)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Methods"); got != corsAllowMethods {
+		t.Errorf("unexpected Access-Control-Allow-Methods: %q", got)
+	}
+
+	rr = corsRequest(t, memEnv, "OPTIONS", "https://evil.example.com")
+	if rr.Header().Get("Access-Control-Allow-Origin") != "" || rr.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Errorf("denied origin got CORS headers: %v", rr.Header())
+	}
+}
+
+func TestCORSOrigins(t *testing.T) {
+	tests := []struct {
+		name     string
+		origins  []string
+		origin   string
+		expected string
+	}{
+		{"allowed origin", []string{"https://dashboard.example.com"}, "https://dashboard.example.com", "https://dashboard.example.com"},
+		{"denied origin", []string{"https://dashboard.example.com"}, "https://evil.example.com", ""},
+		{"any origin", []string{"*"}, "https://evil.example.com", "https://evil.example.com"},
+		{"CORS off", nil, "https://dashboard.example.com", ""},
+	}
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		memEnv.CORSOrigins = tc.origins
+
+		rr := corsRequest(t, memEnv, "POST", tc.origin)
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.name, rr.Code, http.StatusOK)
+		}
+		if got := rr.Header().Get("Access-Control-Allow-Origin"); got != tc.expected {
+			t.Errorf("%s: unexpected Access-Control-Allow-Origin: got %q want %q", tc.name, got, tc.expected)
+		}
+	}
+
+	// Without CORS, preflights aren't answered at all
+	if rr := corsRequest(t, newMemoryEnv(t), "OPTIONS", "https://dashboard.example.com"); rr.Code == http.StatusNoContent {
+		t.Errorf("preflight should not be handled when CORS is off")
+	}
+}
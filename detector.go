@@ -1,20 +1,28 @@
 package main
 
 import (
-	"database/sql"
-	"detector/geo"
+	"bytes"
+	"context"
 	"detector/models"
 	"detector/travel"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/oschwald/geoip2-golang"
-	"io"
-	"log"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
-	"regexp"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // Main detector app file
@@ -24,35 +32,196 @@ type loginRecord struct {
 	UnixTimestamp int64  `json:"unix_timestamp"`
 	EventUUID     string `json:"event_uuid"`
 	IPAddr        string `json:"ip_address"`
+	// Where the login happened when the client already knows, e.g. from a phone's GPS. Used
+	// instead of looking up IPAddr; lat and lon come together, and radius (km) is optional.
+	Lat    *float64 `json:"lat,omitempty"`
+	Lon    *float64 `json:"lon,omitempty"`
+	Radius *uint16  `json:"radius,omitempty"`
 }
 
 type currentGeo struct {
-	Lat    float64 `json:"lat"`
-	Lon    float64 `json:"lon"`
-	Radius  uint16  `json:"radius"`
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+	// Null when the GeoIP database has no accuracy radius for the address
+	Radius *uint16 `json:"radius"`
+	// English names from the GeoIP record, empty when it doesn't have them
+	City        string `json:"city"`
+	Subdivision string `json:"subdivision"`
+	Country     string `json:"country"`
+	CountryISO  string `json:"country_iso"`
+	// IANA time zone, and the login's time there in RFC 3339 format; both empty when the
+	// GeoIP record has no time zone
+	TimeZone  string `json:"time_zone"`
+	LocalTime string `json:"local_time"`
+	// Only set when an ASN database is configured and knows the address
+	ASN uint   `json:"asn,omitempty"`
+	Org string `json:"org,omitempty"`
 }
 
 type ipAccess struct {
-	IP    	       string   `json:"ip"`
-	Speed          int      `json:"speed"`
-	Lat            float64  `json:"lat"`
-	Lon            float64  `json:"lon"`
-	Radius         uint16   `json:"radius"`
-	Timestamp      int64    `json:"unix_timestamp"`
+	IP string `json:"ip"`
+	// In the result's unit per hour, unrounded
+	Speed    float64 `json:"speed"`
+	Distance float64 `json:"distance,omitempty"`
+	Lat      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+	Radius   *uint16 `json:"radius"`
+	// Where the login was located, empty when it isn't known or it was saved before names were
+	City      string `json:"city"`
+	Country   string `json:"country"`
+	Timestamp int64  `json:"unix_timestamp"`
+	TimeZone  string `json:"time_zone"`
+	LocalTime string `json:"local_time"`
 }
 
-type Env struct {
-	loginDB *sql.DB
-	geoDB *geoip2.Reader
+func newIPAccess(login models.Login, speed, distance float64) *ipAccess {
+	return &ipAccess{
+		IP:        login.IPAddr,
+		Speed:     speed,
+		Distance:  distance,
+		Lat:       login.Lat,
+		Lon:       login.Lon,
+		Radius:    login.Radius,
+		City:      login.City,
+		Country:   login.Country,
+		Timestamp: login.UnixTimestamp,
+		TimeZone:  login.TimeZone,
+		LocalTime: localTime(login.UnixTimestamp, login.TimeZone),
+	}
 }
 
+// The response to a login. Every field is always present: the neighbour and suspicious
+// fields are null when there is no such login, and current_geo is null when the login's
+// address couldn't be located.
+type loginResult struct {
+	CurrentGeo     *currentGeo `json:"current_geo"`
+	GeoUnavailable bool        `json:"geo_unavailable"`
+	// The login came from a trusted network, so it's saved but its travel isn't checked
+	TrustedNetwork bool `json:"trusted_network"`
+	// The user's logins immediately before and after this one
+	PrecedingIpAccess  *ipAccess `json:"preceding_ip_access"`
+	SubsequentIpAccess *ipAccess `json:"subsequent_ip_access"`
+	// Whether travel from the preceding login / to the subsequent one was too fast
+	TravelToCurrentGeoSuspicious   *bool `json:"travel_to_current_geo_suspicious"`
+	TravelFromCurrentGeoSuspicious *bool `json:"travel_from_current_geo_suspicious"`
+	// With NeighborWindow or NeighborCount set, the wider neighbour that needed the fastest travel,
+	// and whether that was too fast
+	FastestWindowIpAccess        *ipAccess `json:"fastest_window_ip_access"`
+	TravelWithinWindowSuspicious *bool     `json:"travel_within_window_suspicious"`
+	// With ConcurrentWindow set, whether another login that close in time came from further
+	// than ConcurrentDistance away, or null when there was none to compare with
+	ConcurrentDistantLogin *bool `json:"concurrent_distant_login"`
+	// Whether the login is outside the user's home geofence, or null when they have no home set
+	OutsideHomeGeofence *bool `json:"outside_home_geofence"`
+	// False when there was nothing to check the login against, with Reason saying why. A login
+	// that wasn't evaluated is never suspicious, but that doesn't mean it was checked and safe.
+	Evaluated bool   `json:"evaluated"`
+	Reason    string `json:"reason,omitempty"`
+	// True if travel in any direction was suspicious, or any of the other checks flagged the login
+	Suspicious bool `json:"suspicious"`
+	// The login was suspicious, but the user was already alerted about within AlertCooldown so no
+	// audit record or webhook was sent. Unless the cooldown only suppresses those, suspicious
+	// is false too. Left out when false.
+	AlertSuppressed bool `json:"alert_suppressed,omitempty"`
+	// "accept" when the login is older than one of the user's stored logins by more than
+	// OutOfOrderGrace and was let in anyway. Left out for logins in order.
+	OutOfOrder string `json:"out_of_order,omitempty"`
+	// Parts of the check that couldn't be done, e.g. "subsequent_ip_access_unavailable" when
+	// that login couldn't be loaded. The rest of the result stands. Left out when empty.
+	Warnings []string `json:"warnings,omitempty"`
+	// The client gave the login's lat/lon, which were used, but its address's GeoIP location
+	// is more than MismatchDistance miles from them, so they may be spoofed. Left out otherwise.
+	CoordinateMismatch bool `json:"coordinate_source_mismatch,omitempty"`
+	// How bad it is: severityNone when the login isn't suspicious, severityImpossible when
+	// flagged travel was faster than ImpossibleSpeed, and severitySuspicious otherwise
+	Severity string `json:"severity"`
+	Unit     string `json:"unit"`
+
+	// Suspicious travel to report once the cooldown has been checked
+	detections []models.Detection
+}
+
+// Values of loginResult.Severity
+const (
+	severityNone       = "none"
+	severitySuspicious = "suspicious"
+	severityImpossible = "impossible"
+)
+
+// Why a login wasn't evaluated
+const (
+	reasonGeoUnavailable   = "geo_unavailable"
+	reasonNoGeoData        = "no_geo_data"
+	reasonNoAdjacentLogins = "no_adjacent_logins"
+	// There may be adjacent logins, but none of them could be loaded
+	reasonLoginsUnavailable = "adjacent_logins_unavailable"
+	reasonTrustedNetwork    = "trusted_network"
+)
+
+// Added to "preceding" or "subsequent" for the warning that the login on that side couldn't
+// be loaded, or was stored with a location that isn't on Earth
+const warningUnavailable = "_ip_access_unavailable"
 
+type Env struct {
+	Config
+	store models.Store
+	// Guards resolver, which is swapped out when the GeoIP databases are reloaded
+	geoMu    sync.RWMutex
+	resolver GeoResolver
+	metrics  *metrics
+	logger   *slog.Logger
+	// Nil means the system clock
+	clock Clock
+	// Nil when rate limiting is turned off
+	limiter *rateLimiter
+	// Nil when auditing is turned off
+	audit *auditor
+	// Nil when no webhook is configured
+	webhook *webhookNotifier
+	// Exports spans to the OTLP endpoint when one is configured, and is a no-op provider
+	// otherwise. Nil is treated as a no-op provider too.
+	traceProvider trace.TracerProvider
+	// Goroutines started by goBackground, and how to stop them
+	background     sync.WaitGroup
+	stopBackground []context.CancelFunc
+}
+
+// Accepts IPv4 and IPv6 addresses, including IPv4-mapped IPv6 (::ffff:192.0.2.1)
 func isValidIP(ip string) bool {
-	matched, err := regexp.Match(`^(?:(?:^|\.)(?:2(?:5[0-5]|[0-4]\d)|1?\d?\d)){4}$`, []byte(ip))
-	if err != nil {
-		panic(err)
+	return net.ParseIP(ip) != nil
+}
+
+// Ranges no login can really come from. Private ranges aren't here: logins from them are
+// saved, just without a location.
+var reservedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",   // "this" network
+	"240.0.0.0/4", // reserved for future use, and the broadcast address
+)
+
+// Reports whether ip could be a login's source address: not unspecified, loopback,
+// link-local, multicast or otherwise reserved
+func isRoutableIP(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
 	}
-	return matched
+	return networks
 }
 
 func validateInputs(lr loginRecord) bool {
@@ -60,133 +229,813 @@ func validateInputs(lr loginRecord) bool {
 	return isValidIP && len(lr.Username) > 0 && len(lr.EventUUID) > 0
 }
 
-func parsePostBody(reqBody io.ReadCloser) loginRecord {
-	var lr loginRecord
-	decoder := json.NewDecoder(reqBody)
-	err := decoder.Decode(&lr)
+var (
+	errInvalidJSON      = errors.New("invalid JSON body")
+	errInvalidInputs    = errors.New("invalid inputs, please check format of post request and try again")
+	errInvalidIP        = errors.New("invalid ip_address, it must be an IPv4 or IPv6 address")
+	errReservedIP       = errors.New("invalid ip_address, it is a loopback, link-local, multicast or reserved address")
+	errInvalidTimestamp = errors.New("invalid unix_timestamp, it must be positive and not in the future")
+	errInvalidUUID      = errors.New("invalid event_uuid, it must be a UUID such as 85ad929a-db03-4bf4-9541-8f728fa12e42")
+	errInvalidLocation  = errors.New("invalid lat/lon, they must be given together with lat between -90 and 90 and lon between -180 and 180")
+)
 
-	if err != nil {
-		fmt.Println("Could not parse post request. Please check json formatting: ")
-		panic(err)
+// A zero, negative or future timestamp would make the travel speed math meaningless.
+// Up to MaxFutureSeconds of clock skew is tolerated.
+func (env *Env) validTimestamp(ts int64) bool {
+	return ts > 0 && ts <= env.now().Unix()+int64(env.MaxFutureSeconds)
+}
+
+// Checks a decoded login record, returning the error to report back to the client
+func (env *Env) validateRecord(lr loginRecord) error {
+	if !isValidIP(lr.IPAddr) {
+		return errInvalidIP
+	}
+	if !isRoutableIP(net.ParseIP(lr.IPAddr)) {
+		return errReservedIP
 	}
 	if !validateInputs(lr) {
-		panic("Invalid inputs. Please check format of post request and try again")
+		return errInvalidInputs
+	}
+	if !isValidUUID(lr.EventUUID) {
+		return errInvalidUUID
+	}
+	if !env.validTimestamp(lr.UnixTimestamp) {
+		return errInvalidTimestamp
+	}
+	if !validLocation(lr) {
+		return errInvalidLocation
 	}
-	return lr
+	return nil
 }
 
-// Calculates the speed 'traveled' given two login structs
-func getTravelSpeed(postLogin, prevLogin  models.Login) int {
-	//Calc distance between prev login and current
-	dist := travel.Distance(postLogin.Lat,postLogin.Lon,prevLogin.Lat,prevLogin.Lon)
-	speed := travel.Speed(dist, prevLogin.UnixTimestamp, postLogin.UnixTimestamp)
-	return speed
+// A record either leaves its location to GeoIP or gives a lat and lon on Earth
+func validLocation(lr loginRecord) bool {
+	if lr.Lat == nil && lr.Lon == nil {
+		return lr.Radius == nil
+	}
+	return lr.Lat != nil && lr.Lon != nil && onEarth(*lr.Lat, *lr.Lon)
 }
 
+// Whether lat/lon are real coordinates; NaN isn't
+func onEarth(lat, lon float64) bool {
+	return math.Abs(lat) <= 90 && math.Abs(lon) <= 180
+}
 
-// The main method handle for the post req. Takes the req body, parses into json and
-// saved the needed infomation.
-func (env *Env) HandlePost(rw http.ResponseWriter, request *http.Request) {
-	//Parse and validate post query input values
-	var lr = parsePostBody(request.Body)
+// Past this many decimal places a degree is finer than GeoIP data could ever be
+const maxCoordinateDecimals = 8
 
-	ip := net.ParseIP(lr.IPAddr)
-	record, err := env.geoDB.City(ip)
+// Rounds a location's lat/lon to CoordinateDecimals places, so what's saved and measured
+// doesn't claim more precision than the data has
+func (env *Env) roundCoordinates(cg *currentGeo) {
+	if env.CoordinateDecimals == 0 {
+		return
+	}
+	scale := math.Pow(10, float64(env.CoordinateDecimals))
+	cg.Lat = math.Round(cg.Lat*scale) / scale
+	cg.Lon = math.Round(cg.Lon*scale) / scale
+}
+
+func (env *Env) parsePostBody(request *http.Request) (loginRecord, error) {
+	var lr loginRecord
+	if err := env.decodeBody(request.Body, &lr); err != nil {
+		return lr, err
+	}
+	if env.TrustProxyHeaders {
+		if ip := env.proxyClientIP(request); ip != "" {
+			lr.IPAddr = ip
+		} else if len(lr.IPAddr) == 0 {
+			lr.IPAddr = remoteIP(request)
+		}
+	}
+	lr.Username = env.normalizeUsername(lr.Username)
+	return lr, env.validateRecord(lr)
+}
+
+// Decodes, validates and evaluates one login record, as each entry of a batch and each
+// consumed message is. Records are counted and logged like POSTed ones. The decoded record
+// is returned as far as it could be read.
+func (env *Env) evaluateJSON(ctx context.Context, raw []byte, opts evalOptions) (loginRecord, loginResult, error) {
+	env.metrics.request()
+	var lr loginRecord
+	if err := env.decodeBody(bytes.NewReader(raw), &lr); err != nil {
+		env.metrics.validationError()
+		if _, ok := err.(*strictJSONError); !ok {
+			err = errInvalidJSON
+		}
+		return lr, loginResult{}, err
+	}
+	lr.Username = env.normalizeUsername(lr.Username)
+	if err := env.validateRecord(lr); err != nil {
+		env.metrics.validationError()
+		return lr, loginResult{}, err
+	}
+	result, err := env.Evaluate(ctx, lr, opts)
+	env.logOutcome(ctx, lr, result, err)
+	return lr, result, err
+}
+
+// Returns the distance between two logins, in either order, and the speed needed to travel
+// it over the time between them: miles and mph or km and km/h depending on unit. With
+// SubtractAccuracyRadius set the accuracy radii are taken off the distance first, so the
+// speed is a lower bound.
+func (env *Env) getTravelSpeed(a, b models.Login, opts evalOptions) (float64, float64) {
+	dist := opts.formula.Distance(a.Lat, a.Lon, b.Lat, b.Lon)
+	travelled := dist
+	if env.SubtractAccuracyRadius {
+		// Accuracy radii are in kilometers
+		travelled = math.Max(0, dist-(radiusKm(a.Radius)+radiusKm(b.Radius))*1000)
+	}
+	speed := travel.FractionalSpeedIn(opts.unit, travelled, a.UnixTimestamp, b.UnixTimestamp)
+	return opts.unit.FromMeters(dist), speed
+}
+
+// Per-request settings for Evaluate
+type evalOptions struct {
+	// Unit the reported speeds (and the threshold they're compared against) are in
+	unit travel.Unit
+	// How the distance between logins is measured
+	formula travel.Formula
+	// Check the login against the stored ones without saving it
+	dryRun bool
+	// The user's own speed threshold (mph), or zero for the configured ones. Set by Evaluate.
+	userThreshold int
+	// The event was already saved by an earlier request, which reported its detections. Set
+	// by Evaluate.
+	retry bool
+}
+
+// Reads the evaluate options from the request's query string, e.g. ?unit=km&formula=vincenty&dry_run=true
+func parseEvalOptions(request *http.Request) (evalOptions, error) {
+	var opts evalOptions
+	query := request.URL.Query()
+	unit, err := travel.ParseUnit(query.Get("unit"))
 	if err != nil {
-		panic(err)
+		return opts, err
+	}
+	opts.unit = unit
+	formula, err := travel.ParseFormula(query.Get("formula"))
+	if err != nil {
+		return opts, err
+	}
+	opts.formula = formula
+	if v := query.Get("case"); v != "" && v != "snake" && v != "camel" {
+		return opts, fmt.Errorf("case must be snake or camel, got %q", v)
+	}
+	if v := query.Get("dry_run"); v != "" {
+		if opts.dryRun, err = strconv.ParseBool(v); err != nil {
+			return opts, fmt.Errorf("dry_run must be true or false, got %q", v)
+		}
+	}
+	return opts, nil
+}
+
+// The speed threshold (mph) for travel "to" or "from" the current login, converted to the
+// unit speeds are reported in. A user's own threshold overrides the configured ones.
+func (env *Env) speedThreshold(opts evalOptions, direction string) float64 {
+	mph := env.SpeedThreshold
+	if direction == "to" && env.SpeedThresholdTo != 0 {
+		mph = env.SpeedThresholdTo
+	}
+	if direction == "from" && env.SpeedThresholdFrom != 0 {
+		mph = env.SpeedThresholdFrom
+	}
+	if opts.userThreshold != 0 {
+		mph = opts.userThreshold
+	}
+	// Converting there and back can come out a fraction under e.g. 200
+	unit := opts.unit
+	if unit == travel.Miles {
+		return float64(mph)
+	}
+	return unit.FromMiles(float64(mph))
+}
+
+// Whether travel at speed over distance (both in opts' unit) "to" or "from" the current login
+// is flagged: it must be over the speed threshold and cover at least MinDistance
+func (env *Env) travelSuspicious(speed, distance float64, opts evalOptions, direction string) bool {
+	return speed > env.speedThreshold(opts, direction) && distance >= opts.unit.FromMiles(env.MinDistance)
+}
+
+// Grades a result whose checks have all been made
+func (env *Env) severity(result loginResult, unit travel.Unit) string {
+	if !result.Suspicious {
+		return severityNone
+	}
+	impossible := float64(env.ImpossibleSpeed)
+	if unit != travel.Miles {
+		impossible = unit.FromMiles(impossible)
+	}
+	flagged := []struct {
+		suspicious *bool
+		access     *ipAccess
+	}{
+		{result.TravelToCurrentGeoSuspicious, result.PrecedingIpAccess},
+		{result.TravelFromCurrentGeoSuspicious, result.SubsequentIpAccess},
+		{result.TravelWithinWindowSuspicious, result.FastestWindowIpAccess},
+	}
+	for _, f := range flagged {
+		if f.suspicious != nil && *f.suspicious && f.access.Speed > impossible {
+			return severityImpossible
+		}
+	}
+	return severitySuspicious
+}
+
+var (
+	errGeoLookup     = errors.New("geo lookup failed")
+	errNoGeoLocation = errors.New("the GeoIP database has no location for ip_address")
+	errInternal      = errors.New(http.StatusText(http.StatusInternalServerError))
+	errEventConflict = errors.New("event_uuid has already been used by another user")
+)
+
+// The status code to report an error returned by Evaluate with
+func errorStatus(err error) int {
+	if err == errEventConflict || err == errOutOfOrder {
+		return http.StatusConflict
 	}
+	if err == errNoGeoLocation {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
 
+// What locate does with a public address the GeoIP database has no location for
+const (
+	geoNoLocationUnlocated = "unlocated"
+	geoNoLocationError     = "error"
+)
+
+// Looks up where ip is. The bool is false when it has no location: private and reserved
+// addresses aren't looked up, and addresses missing from the database come back as an
+// empty record rather than an error. Under the "error" GeoNoLocation policy the latter
+// are errNoGeoLocation instead.
+func (env *Env) locate(ctx context.Context, ip net.IP) (currentGeo, bool, error) {
+	if !isPublicIP(ip) {
+		return currentGeo{}, false, nil
+	}
+	logger := env.logFor(ctx)
+	result, err := env.resolve(ip)
+	if err != nil {
+		logger.Error("GeoIP lookup failed", "error", err)
+		// The address is only logged when debugging, along with the rest of what went wrong
+		logger.Debug("GeoIP lookup failed", "ip", ip.String(), "error", err)
+		env.metrics.geoError()
+		return currentGeo{}, false, errGeoLookup
+	}
+	// Taken as a location, an empty record would put the login at 0,0 in the Gulf of Guinea
+	if result.Lat == 0 && result.Lon == 0 {
+		logger.Debug("GeoIP record has no location", "ip", ip.String(), "record", result)
+		if env.GeoNoLocation == geoNoLocationError {
+			return currentGeo{}, false, errNoGeoLocation
+		}
+	}
 	cg := currentGeo{
-		Lat:    record.Location.Latitude,
-		Lon:    record.Location.Longitude,
-		Radius: record.Location.AccuracyRadius,
+		Lat:         result.Lat,
+		Lon:         result.Lon,
+		Radius:      accuracyRadius(result.Radius),
+		City:        result.City,
+		Subdivision: result.Subdivision,
+		Country:     result.Country,
+		CountryISO:  result.CountryISO,
+		TimeZone:    result.TimeZone,
+		ASN:         result.ASN,
+		Org:         result.Org,
 	}
+	return cg, cg.Lat != 0 || cg.Lon != 0, nil
+}
+
+// Runs a validated login through the detector: resolves its location, saves it and
+// checks the travel speed to and from the adjacent logins for the same user. It knows
+// nothing of HTTP; the handlers, batch requests and the queue consumer all wrap it.
+func (env *Env) Evaluate(ctx context.Context, lr loginRecord, opts evalOptions) (loginResult, error) {
+	logger := env.logFor(ctx)
+	result := loginResult{Severity: severityNone, Unit: opts.unit.String()}
+
+	// Store the canonical spelling, so "2001:0db8::0001" and "2001:db8::1" are the same address
+	ip := net.ParseIP(lr.IPAddr)
+	lr.IPAddr = ip.String()
+	// Likewise for the event, so it's found whichever case it's looked up or retried in
+	lr.EventUUID = strings.ToLower(lr.EventUUID)
+	result.TrustedNetwork = env.isTrustedIP(ip)
+	var cg currentGeo
+	var geoAvailable bool
+	var err error
+	if lr.Lat != nil {
+		// The client already knows where the login is, so there's nothing to look up
+		var radius uint16
+		if lr.Radius != nil {
+			radius = *lr.Radius
+		}
+		cg, geoAvailable = currentGeo{Lat: *lr.Lat, Lon: *lr.Lon, Radius: accuracyRadius(radius)}, true
+		if env.MismatchDistance > 0 {
+			result.CoordinateMismatch = env.coordinateMismatch(ctx, ip, cg, opts)
+		}
+	} else {
+		_, geoSpan := env.startSpan(ctx, "geoip.lookup")
+		cg, geoAvailable, err = env.locate(ctx, ip)
+		setSpanError(geoSpan, err)
+		geoSpan.End()
+		if err != nil {
+			return result, err
+		}
+	}
+	// Before the login is saved, so its travel is measured from the same coordinates as it will be later
+	env.roundCoordinates(&cg)
 
 	loginRow := models.Login{
-		Username: lr.Username,
+		Username:      lr.Username,
 		UnixTimestamp: lr.UnixTimestamp,
-		EventUUID: lr.EventUUID,
-		IPAddr: lr.IPAddr,
-		Lat: cg.Lat,
-		Lon: cg.Lon,
-		Radius: cg.Radius,
+		EventUUID:     lr.EventUUID,
+		IPAddr:        lr.IPAddr,
+		Lat:           cg.Lat,
+		Lon:           cg.Lon,
+		Radius:        cg.Radius,
+		TimeZone:      cg.TimeZone,
+		CountryISO:    cg.CountryISO,
+		City:          cg.City,
+		Country:       cg.Country,
 	}
 
-	// Add this login entry to the datastore
-	models.InsertLogin(env.loginDB, loginRow)
-	allLogins, err := models.LoginsByUsername(env.loginDB, loginRow.Username)
-
+	// Checked before saving, so a rejected event isn't stored
+	result.OutOfOrder, err = env.checkOrder(ctx, loginRow)
+	if err == errOutOfOrder {
+		return result, err
+	}
 	if err != nil {
-		http.Error(rw, http.StatusText(500), 500)
-		panic(err)
+		logger.Error("could not load logins", "user", hashUsername(lr.Username), "error", err)
+		return result, errInternal
+	}
+
+	// Add this login entry to the datastore, unless it's only being checked
+	if !opts.dryRun {
+		_, insertSpan := env.startSpan(ctx, "db.insert_login")
+		err = env.store.InsertLogin(ctx, loginRow)
+		setSpanError(insertSpan, err)
+		insertSpan.End()
+	}
+	duplicate := err == models.ErrDuplicateLogin
+	if err != nil && !duplicate {
+		logger.Error("could not save login", "event_uuid", lr.EventUUID, "error", err)
+		return result, errInternal
+	}
+	if !opts.dryRun && !duplicate {
+		env.trimLogins(ctx, loginRow.Username)
+	}
+
+	// A retried event is answered from the login that was saved the first time round
+	if duplicate {
+		opts.retry = true
+		stored, err := env.store.LoginByEventUUID(ctx, loginRow.EventUUID)
+		if err != nil {
+			logger.Error("could not load login", "event_uuid", lr.EventUUID, "error", err)
+			return result, errInternal
+		}
+		if stored == nil || !env.isStoredUsername(stored.Username, loginRow.Username) {
+			return result, errEventConflict
+		}
+		stored.Username = loginRow.Username
+		loginRow = *stored
+		// The subdivision and ASN aren't stored, so like the names they come from this request's lookup
+		cg.Lat, cg.Lon, cg.Radius, cg.TimeZone = stored.Lat, stored.Lon, stored.Radius, stored.TimeZone
+		geoAvailable = stored.HasLocation()
+	}
+
+	// Without a location there's nothing to measure travel from, so skip the speed checks
+	if !geoAvailable {
+		result.GeoUnavailable = true
+		result.Reason = reasonGeoUnavailable
+		// A public address was looked up, but the database knows nothing of it
+		if isPublicIP(ip) {
+			result.Reason = reasonNoGeoData
+		}
+		return result, nil
+	}
+
+	cg.LocalTime = localTime(loginRow.UnixTimestamp, cg.TimeZone)
+	result.CurrentGeo = &cg
+	if result.TrustedNetwork {
+		result.Reason = reasonTrustedNetwork
+		return result, nil
+	}
+
+	if opts.userThreshold, err = env.userThreshold(ctx, loginRow.Username); err != nil {
+		logger.Error("could not load speed threshold", "user", hashUsername(lr.Username), "error", err)
+		return result, errInternal
+	}
+	var flagged *models.Detection
+	if result.OutsideHomeGeofence, flagged, err = env.outsideHome(ctx, loginRow, opts); err != nil {
+		logger.Error("could not load home location", "user", hashUsername(lr.Username), "error", err)
+		return result, errInternal
+	}
+	if flagged != nil {
+		result.detections = append(result.detections, *flagged)
+	}
+	if result.ConcurrentDistantLogin, flagged, err = env.concurrentDistant(ctx, loginRow, opts); err != nil {
+		logger.Error("could not load concurrent logins", "user", hashUsername(lr.Username), "error", err)
+		return result, errInternal
+	}
+	if flagged != nil {
+		result.detections = append(result.detections, *flagged)
 	}
 
 	//Get preceding and subsequent logins if applicable
-	prevLogin, postLogin := models.GetAdjacentLogins(allLogins, loginRow)
+	_, adjacentSpan := env.startSpan(ctx, "db.adjacent_logins")
+	prevLogin, postLogin, err := env.store.AdjacentLogins(ctx, loginRow)
+	setSpanError(adjacentSpan, err)
+	adjacentSpan.End()
+	// With one side missing the other is still checked, and the response says what's missing
+	var sideErr *models.AdjacentError
+	if errors.As(err, &sideErr) && ctx.Err() == nil {
+		logger.Error("could not load adjacent login", "side", sideErr.Side, "user", hashUsername(lr.Username), "error", sideErr.Err)
+		result.Warnings = append(result.Warnings, sideErr.Side+warningUnavailable)
+	} else if err != nil {
+		logger.Error("could not load logins", "user", hashUsername(lr.Username), "error", err)
+		return result, errInternal
+	}
+	// A neighbour whose stored location is corrupt would give a meaningless speed
+	if len(prevLogin.Username) != 0 && !onEarth(prevLogin.Lat, prevLogin.Lon) {
+		logger.Error("adjacent login has an invalid location", "side", "preceding", "event_uuid", prevLogin.EventUUID)
+		result.Warnings = append(result.Warnings, "preceding"+warningUnavailable)
+		prevLogin = models.Login{}
+	}
+	if len(postLogin.Username) != 0 && !onEarth(postLogin.Lat, postLogin.Lon) {
+		logger.Error("adjacent login has an invalid location", "side", "subsequent", "event_uuid", postLogin.EventUUID)
+		result.Warnings = append(result.Warnings, "subsequent"+warningUnavailable)
+		postLogin = models.Login{}
+	}
 
-	repOutput := map[string]interface{}{
-		"currentGeo": cg,
+	if env.Baseline == baselineDistinct && len(prevLogin.Username) != 0 {
+		if prevLogin, err = env.distinctBaseline(ctx, loginRow, prevLogin, opts); err != nil {
+			logger.Error("could not load logins", "user", hashUsername(lr.Username), "error", err)
+			return result, errInternal
+		}
 	}
 
 	// Check to see if there are any subsequent or preceding logins in the db
 	if len(prevLogin.Username) != 0 {
-		speed := getTravelSpeed(prevLogin, loginRow)
-		if speed > 500 {
-			repOutput["travelToCurrentGeoSuspicious"] = true
-		} else {
-			repOutput["travelToCurrentGeoSuspicious"] = false
+		distance, speed := env.getTravelSpeed(prevLogin, loginRow, opts)
+		suspicious := env.travelSuspicious(speed, distance, opts, "to")
+		if suspicious {
+			if !opts.retry {
+				env.metrics.suspiciousTravel("to")
+			}
+			result.detections = append(result.detections, env.newDetection("to", loginRow, prevLogin, speed, distance, opts))
 		}
+		result.TravelToCurrentGeoSuspicious = &suspicious
+		result.PrecedingIpAccess = newIPAccess(prevLogin, speed, distance)
+	}
 
-		repOutput["precedingIpAccess"] = ipAccess{
-			IP: prevLogin.IPAddr,
-			Speed: speed,
-			Lat: prevLogin.Lat,
-			Lon: prevLogin.Lon,
-			Radius: prevLogin.Radius,
-			Timestamp: prevLogin.UnixTimestamp,
+	if len(postLogin.Username) != 0 {
+		distance, speed := env.getTravelSpeed(postLogin, loginRow, opts)
+		suspicious := env.travelSuspicious(speed, distance, opts, "from")
+		if suspicious {
+			if !opts.retry {
+				env.metrics.suspiciousTravel("from")
+			}
+			result.detections = append(result.detections, env.newDetection("from", loginRow, postLogin, speed, distance, opts))
 		}
+		result.TravelFromCurrentGeoSuspicious = &suspicious
+		result.SubsequentIpAccess = newIPAccess(postLogin, speed, distance)
 	}
 
-	if len(postLogin.Username) != 0 {
-		speed := getTravelSpeed(postLogin, loginRow)
-		if speed > 500 {
-			repOutput["travelFromCurrentGeoSuspicious"] = true
-		} else {
-			repOutput["travelFromCurrentGeoSuspicious"] = false
+	if env.NeighborWindow > 0 || env.NeighborCount > 1 {
+		if err := env.checkNeighbours(ctx, loginRow, prevLogin, postLogin, opts, &result); err != nil {
+			logger.Error("could not load logins", "user", hashUsername(lr.Username), "error", err)
+			return result, errInternal
+		}
+	}
+
+	result.Suspicious = (result.TravelToCurrentGeoSuspicious != nil && *result.TravelToCurrentGeoSuspicious) ||
+		(result.TravelFromCurrentGeoSuspicious != nil && *result.TravelFromCurrentGeoSuspicious) ||
+		(result.TravelWithinWindowSuspicious != nil && *result.TravelWithinWindowSuspicious) ||
+		(result.ConcurrentDistantLogin != nil && *result.ConcurrentDistantLogin) ||
+		(result.OutsideHomeGeofence != nil && *result.OutsideHomeGeofence)
+	result.Severity = env.severity(result, opts.unit)
+	result.Evaluated = result.TravelToCurrentGeoSuspicious != nil || result.TravelFromCurrentGeoSuspicious != nil ||
+		result.TravelWithinWindowSuspicious != nil || result.ConcurrentDistantLogin != nil || result.OutsideHomeGeofence != nil
+	if !result.Evaluated {
+		result.Reason = reasonNoAdjacentLogins
+		if len(result.Warnings) > 0 {
+			result.Reason = reasonLoginsUnavailable
+		}
+	}
+	if err := env.alert(ctx, loginRow, &result, opts); err != nil {
+		logger.Error("could not check alert cooldown", "user", hashUsername(lr.Username), "error", err)
+		return result, errInternal
+	}
+	return result, nil
+}
+
+// Checks travel between loginRow and every located login within NeighborWindow of it, and
+// its NeighborCount nearest logins on each side. When logins arrive out of order, or a login
+// in between is spoofed, the adjacent ones aren't always the ones that give the user away.
+// The fastest of them that's at least MinDistance away is reported; prev and post were
+// already checked and reported.
+func (env *Env) checkNeighbours(ctx context.Context, loginRow, prevLogin, postLogin models.Login, opts evalOptions, result *loginResult) error {
+	var logins []*models.Login
+	if env.NeighborWindow > 0 {
+		window := int64(env.NeighborWindow / time.Second)
+		inWindow, err := env.store.LoginsByUsername(ctx, loginRow.Username, models.ListOptions{
+			Since: loginRow.UnixTimestamp - window,
+			Until: loginRow.UnixTimestamp + window,
+		})
+		if err != nil {
+			return err
+		}
+		logins = append(logins, inWindow...)
+	}
+	if env.NeighborCount > 1 {
+		before, after, err := env.store.NeighborLogins(ctx, loginRow, env.NeighborCount)
+		if err != nil {
+			return err
+		}
+		logins = append(append(logins, before...), after...)
+	}
+
+	var fastest *models.Login
+	var fastestSpeed, fastestDistance float64
+	for _, login := range logins {
+		if login.EventUUID == loginRow.EventUUID || !login.HasLocation() {
+			continue
+		}
+		distance, speed := env.getTravelSpeed(*login, loginRow, opts)
+		// Logins closer than MinDistance can't be flagged, so they only count when nothing
+		// further away was found
+		far := distance >= opts.unit.FromMiles(env.MinDistance)
+		fastestFar := fastest != nil && fastestDistance >= opts.unit.FromMiles(env.MinDistance)
+		if fastest == nil || (far && !fastestFar) || (far == fastestFar && speed > fastestSpeed) {
+			fastest, fastestSpeed, fastestDistance = login, speed, distance
 		}
+	}
+	if fastest == nil {
+		return nil
+	}
 
-		repOutput["subsequentIpAccess"] = ipAccess{
-			IP: postLogin.IPAddr,
-			Speed: speed,
-			Lat: postLogin.Lat,
-			Lon: postLogin.Lon,
-			Radius: postLogin.Radius,
-			Timestamp: postLogin.UnixTimestamp,
+	direction := "to"
+	if fastest.UnixTimestamp > loginRow.UnixTimestamp {
+		direction = "from"
+	}
+	suspicious := env.travelSuspicious(fastestSpeed, fastestDistance, opts, direction)
+	adjacent := fastest.EventUUID == prevLogin.EventUUID || fastest.EventUUID == postLogin.EventUUID
+	if suspicious && !adjacent {
+		if !opts.retry {
+			env.metrics.suspiciousTravel(direction)
 		}
+		result.detections = append(result.detections, env.newDetection(direction, loginRow, *fastest, fastestSpeed, fastestDistance, opts))
 	}
+	result.TravelWithinWindowSuspicious = &suspicious
+	result.FastestWindowIpAccess = newIPAccess(*fastest, fastestSpeed, fastestDistance)
+	return nil
+}
 
+// The main method handle for the post req. Takes the req body, parses into json and
+// saved the needed infomation.
+func (env *Env) HandlePost(rw http.ResponseWriter, request *http.Request) {
+	env.metrics.request()
 
-	jsonOutput, err := json.Marshal(repOutput)
-	rw.Header().Set("Content-Type", "application/json")
-	rw.Write(jsonOutput)
+	//Parse and validate post query input values
+	lr, err := env.parsePostBody(request)
+	if err != nil {
+		env.metrics.validationError()
+		env.logFor(request.Context()).Info("login rejected", "outcome", "invalid", "error", err.Error())
+		writeError(rw, invalidStatus(err), errorCode(err), err.Error())
+		return
+	}
+	opts, err := parseEvalOptions(request)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+
+	result, err := env.Evaluate(request.Context(), lr, opts)
+	env.logOutcome(request.Context(), lr, result, err)
+	if err != nil {
+		writeError(rw, errorStatus(err), errorCode(err), err.Error())
+		return
+	}
+	trace.SpanFromContext(request.Context()).SetAttributes(attribute.Bool("suspicious", result.Suspicious))
+
+	env.writeResult(rw, request, result)
 }
 
-func main() {
-	loginDB, err1 := models.NewDB("./data.db")
-	geoDB, err2 := geo.NewGeo("./geo/GeoLite2-City.mmdb")
+// Reads the optional ?since= (unix timestamp, inclusive), ?limit= and ?offset= query
+// parameters of a listing
+func parseListOptions(request *http.Request) (models.ListOptions, error) {
+	query := request.URL.Query()
+	var opts models.ListOptions
+
+	if v := query.Get("since"); v != "" {
+		var err error
+		if opts.Since, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return opts, errors.New("since must be a unix timestamp")
+		}
+	}
 
-	if err1 != nil {
-		log.Panic(err1)
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if opts.Limit, err = strconv.Atoi(v); err != nil || opts.Limit <= 0 {
+			return opts, errors.New("limit must be a positive integer")
+		}
+	}
+
+	if v := query.Get("offset"); v != "" {
+		var err error
+		if opts.Offset, err = strconv.Atoi(v); err != nil || opts.Offset < 0 {
+			return opts, errors.New("offset must be a non-negative integer")
+		}
+	}
+	return opts, nil
+}
+
+// Returns the logins stored for a username ordered by timestamp. Supports optional
+// ?since= (unix timestamp, inclusive), ?limit= and ?offset= query parameters.
+func (env *Env) HandleGetLogins(rw http.ResponseWriter, request *http.Request) {
+	username := env.usernameVar(request)
+	opts, err := parseListOptions(request)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
 	}
-	if err2 != nil {
-		log.Panic(err2)
+
+	logins, err := env.store.LoginsByUsername(request.Context(), username, opts)
+	if err != nil {
+		env.logFor(request.Context()).Error("could not load logins", "user", hashUsername(username), "error", err)
+		writeError(rw, http.StatusInternalServerError, codeInternal, http.StatusText(http.StatusInternalServerError))
+		return
 	}
 
-	env := &Env{ loginDB: loginDB, geoDB: geoDB	}
+	if len(logins) == 0 {
+		writeError(rw, http.StatusNotFound, codeNotFound, "no logins found for user")
+		return
+	}
 
+	env.writeJSON(rw, request, http.StatusOK, logins)
+}
+
+// The response to an erasure: the logins deleted, as it's always been, and what each of
+// the user's tables lost
+type deleteResponse struct {
+	Deleted        int64              `json:"deleted"`
+	DeletedByTable models.DeletedUser `json:"deleted_by_table"`
+}
+
+// Erases everything stored for a user. Deleting a user with nothing stored succeeds with
+// counts of 0, so erasure requests can safely be retried.
+func (env *Env) HandleDeleteLogins(rw http.ResponseWriter, request *http.Request) {
+	username := env.usernameVar(request)
+
+	deleted, err := env.store.DeleteUser(request.Context(), username)
+	if err != nil {
+		env.logFor(request.Context()).Error("could not delete user", "user", hashUsername(username), "error", err)
+		writeError(rw, http.StatusInternalServerError, codeInternal, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	env.logFor(request.Context()).Info("deleted user", "user", hashUsername(username), "logins", deleted.Logins,
+		"detections", deleted.Detections, "homes", deleted.Homes, "alerts", deleted.Alerts, "thresholds", deleted.Thresholds)
+
+	env.writeJSON(rw, request, http.StatusOK, deleteResponse{Deleted: deleted.Logins, DeletedByTable: deleted})
+}
+
+func (env *Env) routes() *mux.Router {
 	router := mux.NewRouter()
-	router.HandleFunc("/v1/", env.HandlePost).Methods("POST")
-	fmt.Println("Running server")
-	log.Fatal(http.ListenAndServe(":8080", router))
+	router.Use(env.withRequestLogger)
+	router.Use(env.withGzip)
+	router.Use(env.withConcurrencyLimit)
+	router.Use(env.withTimeout)
+	router.HandleFunc("/v1/", env.withTracing("POST /v1/", env.withRateLimit(env.withAuth(true, env.withBodyLimit(env.HandlePost))))).Methods("POST")
+	router.HandleFunc("/v1/batch", env.withTracing("POST /v1/batch", env.withRateLimit(env.withAuth(true, env.withBodyLimit(env.HandleBatch))))).Methods("POST")
+	router.HandleFunc("/v1/candidates", env.withTracing("POST /v1/candidates", env.withRateLimit(env.withAuth(env.AuthReads, env.withBodyLimit(env.HandleCandidates))))).Methods("POST")
+	router.HandleFunc("/v1/simulate", env.withTracing("POST /v1/simulate", env.withRateLimit(env.withAuth(env.AuthReads, env.withBodyLimit(env.HandleSimulate))))).Methods("POST")
+	router.HandleFunc("/v1/logins/{username}", env.withAuth(env.AuthReads, env.HandleGetLogins)).Methods("GET")
+	router.HandleFunc("/v1/logins/{username}", env.withAuth(true, env.HandleDeleteLogins)).Methods("DELETE")
+	router.HandleFunc("/v1/schema", env.withAuth(env.AuthReads, env.HandleSchema)).Methods("GET")
+	router.HandleFunc("/v1/event/{uuid}", env.withAuth(env.AuthReads, env.HandleGetEvent)).Methods("GET")
+	router.HandleFunc("/v1/users", env.withAuth(true, env.HandleUsers)).Methods("GET")
+	router.HandleFunc("/v1/export/{username}", env.withAuth(true, env.HandleExport)).Methods("GET")
+	router.HandleFunc("/v1/stats/{username}", env.withAuth(env.AuthReads, env.HandleStats)).Methods("GET")
+	router.HandleFunc("/v1/users/{username}/home", env.withAuth(env.AuthReads, env.HandleGetHome)).Methods("GET")
+	router.HandleFunc("/v1/users/{username}/home", env.withAuth(true, env.withBodyLimit(env.HandlePutHome))).Methods("PUT")
+	router.HandleFunc("/v1/users/{username}/threshold", env.withAuth(env.AuthReads, env.HandleGetThreshold)).Methods("GET")
+	router.HandleFunc("/v1/users/{username}/threshold", env.withAuth(true, env.withBodyLimit(env.HandlePutThreshold))).Methods("PUT")
+	router.HandleFunc("/v1/version", env.withAuth(env.AuthHealth, env.HandleVersion)).Methods("GET")
+	router.HandleFunc("/healthz", env.withAuth(env.AuthHealth, env.HandleHealthz)).Methods("GET")
+	router.HandleFunc("/readyz", env.withAuth(env.AuthHealth, env.HandleReadyz)).Methods("GET")
+	if len(env.CORSOrigins) > 0 {
+		router.Use(env.withCORS)
+		router.Methods("OPTIONS").HandlerFunc(env.HandlePreflight)
+	}
+	router.MethodNotAllowedHandler = env.withRequestLogger(methodNotAllowed(router))
+	router.NotFoundHandler = env.withRequestLogger(http.HandlerFunc(notFound))
+	return router
+}
+
+// Methods tried when working out which ones a path supports
+var routeMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// Answers a request for a path that exists but not with the request's method: a 405 with
+// an Allow header listing the methods the path does support
+func methodNotAllowed(router *mux.Router) http.HandlerFunc {
+	return func(rw http.ResponseWriter, request *http.Request) {
+		var allowed []string
+		for _, method := range routeMethods {
+			probe := request.Clone(request.Context())
+			probe.Method = method
+			var match mux.RouteMatch
+			if router.Match(probe, &match) && match.MatchErr == nil {
+				allowed = append(allowed, method)
+			}
+		}
+		rw.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(rw, http.StatusMethodNotAllowed, codeMethodNotAllowed, request.Method+" is not allowed on "+request.URL.Path)
+	}
 }
 
+// Answers a request for a path the api doesn't have with the usual JSON error envelope
+func notFound(rw http.ResponseWriter, request *http.Request) {
+	writeError(rw, http.StatusNotFound, codeNotFound, "no such path "+strconv.Quote(request.URL.Path))
+}
+
+func main() {
+	cfg, err := loadConfig(os.Getenv)
+	if err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	logger := newLogger(os.Stdout, cfg.LogLevel)
+
+	// "detector import logins.csv" backfills historical logins instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runImport(cfg, logger, os.Args[2:]))
+	}
+
+	env, err := openEnv(cfg, logger)
+	if err != nil {
+		logger.Error("could not start", "error", err)
+		os.Exit(1)
+	}
+	env.metrics = newMetrics(prometheus.DefaultRegisterer)
+	env.recordGeoBuild()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// SIGHUP picks up a new GeoIP database without a restart
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go env.reloadGeoOnSignal(hup)
+
+	if cfg.Retention > 0 {
+		env.goBackground(ctx, env.runRetention)
+	}
+
+	if cfg.PprofAddr != "" {
+		pprofListener, err := net.Listen("tcp", cfg.PprofAddr)
+		if err != nil {
+			logger.Error("could not listen for profiling", "addr", cfg.PprofAddr, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("serving pprof", "addr", pprofListener.Addr().String())
+		env.goBackground(ctx, func(ctx context.Context) { env.servePprof(ctx, pprofListener) })
+	}
+
+	if cfg.Mode != modeHTTP {
+		queue, err := dialNATS(cfg.NATSURL, logger)
+		if err != nil {
+			logger.Error("could not connect to NATS", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("consuming logins", "subject", cfg.NATSSubject, "results", cfg.NATSResultSubject)
+		if cfg.Mode == modeConsumer {
+			err := env.consume(ctx, queue, cfg.NATSSubject, cfg.NATSResultSubject)
+			queue.close()
+			env.close()
+			if err != nil {
+				logger.Error("consumer stopped", "error", err)
+				os.Exit(1)
+			}
+			logger.Info("consumer stopped")
+			return
+		}
+		env.goBackground(ctx, func(ctx context.Context) {
+			if err := env.consume(ctx, queue, cfg.NATSSubject, cfg.NATSResultSubject); err != nil {
+				logger.Error("consumer stopped", "error", err)
+			}
+			queue.close()
+			// Rather than carry on serving without it, shut down so the process is restarted
+			stop()
+		})
+	}
+
+	listener, err := listen(cfg)
+	if err != nil {
+		logger.Error("could not listen", "addr", cfg.ListenAddr, "error", err)
+		os.Exit(1)
+	}
+
+	logger.Info("running server", "addr", listener.Addr().String())
+	if err := run(ctx, env, listener, env.handler()); err != nil {
+		logger.Error("server stopped", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("server stopped")
+}
@@ -2,13 +2,24 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
-	"detector/geo"
+	"detector/models"
+	"detector/travel"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	_ "github.com/lib/pq"
 	"gopkg.in/testfixtures.v2"
@@ -22,26 +33,23 @@ func TestMain(m *testing.M) {
 	var err error
 	// Open connection with the test database.
 	// Existing data would be deleted
-	db, err := sql.Open("sqlite3", "./dataTest.db")
+	db, err = models.NewDB("./dataTest.db")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	statement, err := db.Prepare("CREATE TABLE IF NOT EXISTS logins (id INTEGER PRIMARY KEY, username TEXT, tStamp TEXT, uuid TEXT, ipAddr TEXT, lat TEXT, lon TEXT, radius TEXT)")
-	statement.Exec()
-
+	// creating the context that hold the fixtures
+	// see about all compatible databases in this page below
+	fixtures, err = testfixtures.NewFiles(db, &testfixtures.SQLite{}, "testData/fixtures/fullNegative/logins.yml")
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	// creating the context that hold the fixtures
-	// see about all compatible databases in this page below
-	fixtures, err = testfixtures.NewFiles(db, &testfixtures.SQLite{}, "testdata/fixtures/fullNegative/logins.yml")
+	logger := newLogger(io.Discard, slog.LevelInfo)
+	resolver, err := newMaxMindResolver("./geo/GeoLite2-City.mmdb", "", logger)
 	if err != nil {
 		log.Fatal(err)
 	}
-	geoDB, _ := geo.NewGeo("./geo/GeoLite2-City.mmdb")
-	env = &Env{ loginDB: db, geoDB: geoDB	}
+	env = &Env{Config: defaultConfig(), store: models.NewSQLiteStore(db, models.Options{}), resolver: resolver, logger: logger}
 
 	os.Exit(m.Run())
 }
@@ -53,7 +61,7 @@ func prepareTestDatabase() {
 }
 
 func clearTestDatabase() {
-	statement, err := env.loginDB.Prepare("delete from logins")
+	statement, err := db.Prepare("delete from logins")
 	statement.Exec()
 
 	if err != nil {
@@ -78,7 +86,7 @@ func TestSingleResult(t *testing.T) {
 	}
 
 	// Check the response body is what we expect.
-	expected := `{"currentGeo":{"lat":34.0549,"lon":-118.2578,"radius":200}}`
+	expected := `{"current_geo":{"lat":34.0549,"lon":-118.2578,"radius":200,"city":"Los Angeles","subdivision":"California","country":"United States","country_iso":"US","time_zone":"America/Los_Angeles","local_time":"2018-01-01T16:00:00-08:00"},"geo_unavailable":false,"trusted_network":false,"preceding_ip_access":null,"subsequent_ip_access":null,"travel_to_current_geo_suspicious":null,"travel_from_current_geo_suspicious":null,"fastest_window_ip_access":null,"travel_within_window_suspicious":null,"concurrent_distant_login":null,"outside_home_geofence":null,"evaluated":false,"reason":"no_adjacent_logins","suspicious":false,"severity":"none","unit":"mi"}`
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v",
 			rr.Body.String(), expected)
@@ -102,9 +110,1444 @@ func TestFullNegativeResult(t *testing.T) {
 	}
 
 	// Check the response body is what we expect.
-	expected := `{"currentGeo":{"lat":39.2293,"lon":-76.6907,"radius":10},"precedingIpAccess":{"ip":"24.242.71.20","speed":55,"lat":30.3773,"lon":-97.71,"radius":5,"unix_timestamp":1514677279},"subsequentIpAccess":{"ip":"91.207.175.104","speed":8330887,"lat":34.0549,"lon":-118.2578,"radius":200,"unix_timestamp":1514764801},"travelFromCurrentGeoSuspicious":true,"travelToCurrentGeoSuspicious":false}`
+	expected := `{"current_geo":{"lat":39.2293,"lon":-76.6907,"radius":10,"city":"Halethorpe","subdivision":"Maryland","country":"United States","country_iso":"US","time_zone":"America/New_York","local_time":"2017-12-31T19:00:00-05:00"},"geo_unavailable":false,"trusted_network":false,"preceding_ip_access":{"ip":"24.242.71.20","speed":55.00021047466064,"distance":1337.131505820215,"lat":30.3773,"lon":-97.71,"radius":5,"city":"","country":"","unix_timestamp":1514677279,"time_zone":"","local_time":""},"subsequent_ip_access":{"ip":"91.207.175.104","speed":8330887.185968684,"distance":2314.1353294357455,"lat":34.0549,"lon":-118.2578,"radius":200,"city":"","country":"","unix_timestamp":1514764801,"time_zone":"","local_time":""},"travel_to_current_geo_suspicious":false,"travel_from_current_geo_suspicious":true,"fastest_window_ip_access":null,"travel_within_window_suspicious":null,"concurrent_distant_login":null,"outside_home_geofence":null,"evaluated":true,"suspicious":true,"severity":"impossible","unit":"mi"}`
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+}
+
+func TestResponseShape(t *testing.T) {
+	austin := models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)}
+	losAngeles := models.Login{Username: "bob", UnixTimestamp: 1514764801, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)}
+	current := `"current_geo":{"lat":39.2293,"lon":-76.6907,"radius":10,"city":"Halethorpe","subdivision":"Maryland","country":"United States","country_iso":"US","time_zone":"America/New_York","local_time":"2017-12-31T19:00:00-05:00"},"geo_unavailable":false,"trusted_network":false,`
+	preceding := `{"ip":"24.242.71.20","speed":55.00021047466064,"distance":1337.131505820215,"lat":30.3773,"lon":-97.71,"radius":5,"city":"","country":"","unix_timestamp":1514677279,"time_zone":"","local_time":""}`
+	subsequent := `{"ip":"91.207.175.104","speed":8330887.185968684,"distance":2314.1353294357455,"lat":34.0549,"lon":-118.2578,"radius":200,"city":"","country":"","unix_timestamp":1514764801,"time_zone":"","local_time":""}`
+
+	tests := []struct {
+		name     string
+		seed     []models.Login
+		expected string
+	}{
+		{"no neighbours", nil,
+			`{` + current + `"preceding_ip_access":null,"subsequent_ip_access":null,"travel_to_current_geo_suspicious":null,"travel_from_current_geo_suspicious":null,"fastest_window_ip_access":null,"travel_within_window_suspicious":null,"concurrent_distant_login":null,"outside_home_geofence":null,"evaluated":false,"reason":"no_adjacent_logins","suspicious":false,"severity":"none","unit":"mi"}`},
+		{"preceding only", []models.Login{austin},
+			`{` + current + `"preceding_ip_access":` + preceding + `,"subsequent_ip_access":null,"travel_to_current_geo_suspicious":false,"travel_from_current_geo_suspicious":null,"fastest_window_ip_access":null,"travel_within_window_suspicious":null,"concurrent_distant_login":null,"outside_home_geofence":null,"evaluated":true,"suspicious":false,"severity":"none","unit":"mi"}`},
+		{"both neighbours", []models.Login{austin, losAngeles},
+			`{` + current + `"preceding_ip_access":` + preceding + `,"subsequent_ip_access":` + subsequent + `,"travel_to_current_geo_suspicious":false,"travel_from_current_geo_suspicious":true,"fastest_window_ip_access":null,"travel_within_window_suspicious":null,"concurrent_distant_login":null,"outside_home_geofence":null,"evaluated":true,"suspicious":true,"severity":"impossible","unit":"mi"}`},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		seedLogins(t, memEnv, tc.seed...)
+
+		jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`)
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+
+		if rr.Body.String() != tc.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v", tc.name, rr.Body.String(), tc.expected)
+		}
+	}
+}
+
+func TestIsValidIP(t *testing.T) {
+	tests := []struct {
+		ip    string
+		valid bool
+	}{
+		{"206.81.252.6", true},
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"2001:db8::1", true},
+		{"2001:0db8:0000:0000:0000:0000:0000:0001", true},
+		{"::ffff:192.0.2.1", true},
+		{"", false},
+		{"not an ip", false},
+		{"256.1.1.1", false},
+		{"1.2.3", false},
+		{"2001:db8:::1", false},
+		{"2001:db8::g", false},
+		{"1:2:3:4:5:6:7:8:9", false},
+	}
+
+	for _, tc := range tests {
+		if got := isValidIP(tc.ip); got != tc.valid {
+			t.Errorf("isValidIP(%q) = %v, want %v", tc.ip, got, tc.valid)
+		}
+	}
+}
+
+func TestIsRoutableIP(t *testing.T) {
+	tests := []struct {
+		ip       string
+		routable bool
+	}{
+		{"206.81.252.6", true},
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		// Private addresses are kept, just not located
+		{"10.0.0.1", true},
+		{"192.168.1.1", true},
+		{"fd00::1", true},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"127.0.0.1", false},
+		{"127.255.255.254", false},
+		{"169.254.0.1", false},
+		{"169.254.169.254", false},
+		{"224.0.0.1", false},
+		{"239.255.255.250", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:206.81.252.6", true},
+	}
+
+	for _, tc := range tests {
+		if got := isRoutableIP(net.ParseIP(tc.ip)); got != tc.routable {
+			t.Errorf("isRoutableIP(%q) = %v, want %v", tc.ip, got, tc.routable)
+		}
+	}
+}
+
+func TestValidateInputs(t *testing.T) {
+	valid := loginRecord{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "85ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "2001:db8::1"}
+	if !validateInputs(valid) {
+		t.Errorf("expected %+v to be valid", valid)
+	}
+
+	for _, ip := range []string{"", "garbage", "::ffff:999.0.2.1"} {
+		lr := valid
+		lr.IPAddr = ip
+		if validateInputs(lr) {
+			t.Errorf("expected ip %q to be rejected", ip)
+		}
+	}
+}
+
+func TestBadRequestBodies(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"empty body", ``, `{"error":{"code":"invalid_json","message":"invalid JSON body"}}`},
+		{"non-JSON body", `username=bob`, `{"error":{"code":"invalid_json","message":"invalid JSON body"}}`},
+		{"truncated JSON", `{"username": "bob", "unix_timestamp": 15147`, `{"error":{"code":"invalid_json","message":"invalid JSON body"}}`},
+		{"missing username", `{"unix_timestamp": 1514764800, "event_uuid": "85ad929a-db03-4bf4-9541-8f728fa12e42", "ip_address": "206.81.252.6"}`, `{"error":{"code":"invalid_input","message":"invalid inputs, please check format of post request and try again"}}`},
+		{"bad IP", `{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "85ad929a-db03-4bf4-9541-8f728fa12e42", "ip_address": "206.81.252"}`, `{"error":{"code":"invalid_ip","message":"invalid ip_address, it must be an IPv4 or IPv6 address"}}`},
+	}
+
+	for _, tc := range tests {
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBufferString(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(env.HandlePost).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.name, status, http.StatusBadRequest)
+		}
+		if rr.Body.String() != tc.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v", tc.name, rr.Body.String(), tc.expected)
+		}
+	}
+}
+
+func TestLowSpeedThresholdFlagsTravel(t *testing.T) {
+	prepareTestDatabase()
+
+	lowEnv := &Env{Config: env.Config, store: env.store, resolver: env.resolver, logger: env.logger}
+	lowEnv.SpeedThreshold = 50
+
+	jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "45ad929a-db03-4bf4-9541-8f728fa12e42", "ip_address": "206.81.252.6"}`)
+	req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(lowEnv.HandlePost).ServeHTTP(rr, req)
+
+	// The 55 mph trip from the preceding login is benign under the default threshold
+	expected := `"travel_to_current_geo_suspicious":true`
+	if !strings.Contains(rr.Body.String(), expected) {
+		t.Errorf("handler returned unexpected body: got %v want it to contain %v",
+			rr.Body.String(), expected)
+	}
+}
+
+func TestDirectionalThresholds(t *testing.T) {
+	// 55 mph from Austin, then 96 mph on to Los Angeles
+	tests := []struct {
+		to, from int
+		expected []string
+	}{
+		{0, 0, []string{`"travel_from_current_geo_suspicious":false`, `"travel_to_current_geo_suspicious":false`}},
+		{50, 0, []string{`"travel_from_current_geo_suspicious":false`, `"travel_to_current_geo_suspicious":true`}},
+		{0, 90, []string{`"travel_from_current_geo_suspicious":true`, `"travel_to_current_geo_suspicious":false`}},
+		{100, 50, []string{`"travel_from_current_geo_suspicious":true`, `"travel_to_current_geo_suspicious":false`}},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		memEnv.SpeedThresholdTo, memEnv.SpeedThresholdFrom = tc.to, tc.from
+		seedLogins(t, memEnv,
+			models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)},
+			models.Login{Username: "bob", UnixTimestamp: 1514851200, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)},
+		)
+
+		jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`)
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+
+		for _, expected := range tc.expected {
+			if !strings.Contains(rr.Body.String(), expected) {
+				t.Errorf("to %v from %v: handler returned unexpected body: got %v want it to contain %v", tc.to, tc.from, rr.Body.String(), expected)
+			}
+		}
+	}
+}
+
+// Returns an Env backed by a fresh in-memory SQLite database
+func newMemoryEnv(t *testing.T) *Env {
+	memDB, err := models.NewDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: gets its own database, so keep to a single one
+	memDB.SetMaxOpenConns(1)
+	return &Env{Config: defaultConfig(), store: models.NewSQLiteStore(memDB, models.Options{}), resolver: env.resolver, logger: env.logger}
+}
+
+func seedLogins(t *testing.T, e *Env, logins ...models.Login) {
+	for _, login := range logins {
+		if err := e.store.InsertLogin(context.Background(), login); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGetLogins(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	seedLogins(t, memEnv,
+		models.Login{Username: "alice", UnixTimestamp: 300, EventUUID: "c", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)},
+		models.Login{Username: "alice", UnixTimestamp: 100, EventUUID: "a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)},
+		models.Login{Username: "alice", UnixTimestamp: 200, EventUUID: "b", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: accuracyRadius(10)},
+		models.Login{Username: "bob", UnixTimestamp: 150, EventUUID: "d", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: accuracyRadius(10)},
+	)
+
+	tests := []struct {
+		url      string
+		status   int
+		expected []string
+	}{
+		{"/v1/logins/alice", http.StatusOK, []string{"a", "b", "c"}},
+		{"/v1/logins/alice?since=200", http.StatusOK, []string{"b", "c"}},
+		{"/v1/logins/alice?limit=2", http.StatusOK, []string{"a", "b"}},
+		{"/v1/logins/alice?since=150&limit=1", http.StatusOK, []string{"b"}},
+		{"/v1/logins/alice?limit=1&offset=1", http.StatusOK, []string{"b"}},
+		{"/v1/logins/alice?offset=3", http.StatusNotFound, nil},
+		{"/v1/logins/alice?offset=-1", http.StatusBadRequest, nil},
+		{"/v1/logins/alice?since=301", http.StatusNotFound, nil},
+		{"/v1/logins/carol", http.StatusNotFound, nil},
+		{"/v1/logins/alice?limit=0", http.StatusBadRequest, nil},
+		{"/v1/logins/alice?since=yesterday", http.StatusBadRequest, nil},
+	}
+
+	router := memEnv.routes()
+	for _, tc := range tests {
+		req, err := http.NewRequest("GET", tc.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != tc.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.url, rr.Code, tc.status)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			if !strings.HasPrefix(rr.Body.String(), `{"error":{"code":`) {
+				t.Errorf("%s: expected a JSON error body, got %v", tc.url, rr.Body.String())
+			}
+			continue
+		}
+
+		var logins []models.Login
+		if err := json.Unmarshal(rr.Body.Bytes(), &logins); err != nil {
+			t.Fatal(err)
+		}
+		uuids := make([]string, 0, len(logins))
+		for _, login := range logins {
+			uuids = append(uuids, login.EventUUID)
+		}
+		if strings.Join(uuids, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("%s: unexpected logins: got %v want %v", tc.url, uuids, tc.expected)
+		}
+	}
+}
+
+func TestDeleteLogins(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	seedLogins(t, memEnv,
+		models.Login{Username: "alice", UnixTimestamp: 100, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)},
+		models.Login{Username: "alice", UnixTimestamp: 200, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: accuracyRadius(10)},
+		models.Login{Username: "bob", UnixTimestamp: 150, EventUUID: "00000000-0000-4000-8000-00000000000d", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: accuracyRadius(10)},
+	)
+	router := memEnv.routes()
+
+	do := func(method, url string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if err := memEnv.store.SetHome(context.Background(), models.Home{Username: "alice", Lat: 30.3773, Lon: -97.71, Radius: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := memEnv.store.InsertDetection(context.Background(), models.Detection{Username: "alice", Direction: "home", EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second delete finds nothing left but still succeeds
+	for _, expected := range []string{
+		`{"deleted":2,"deleted_by_table":{"logins":2,"detections":1,"homes":1,"alerts":0,"thresholds":0}}`,
+		`{"deleted":0,"deleted_by_table":{"logins":0,"detections":0,"homes":0,"alerts":0,"thresholds":0}}`,
+	} {
+		rr := do("DELETE", "/v1/logins/alice")
+		if rr.Code != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		if rr.Body.String() != expected {
+			t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+		}
+	}
+
+	if rr := do("GET", "/v1/logins/alice"); rr.Code != http.StatusNotFound {
+		t.Errorf("deleted user's logins should be gone: got status %v want %v", rr.Code, http.StatusNotFound)
+	}
+	if rr := do("GET", "/v1/logins/bob"); rr.Code != http.StatusOK {
+		t.Errorf("other users' logins should be kept: got status %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestKilometerUnit(t *testing.T) {
+	prepareTestDatabase()
+
+	jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "55ad929a-db03-4bf4-9541-8f728fa12e42", "ip_address": "206.81.252.6"}`)
+	req, err := http.NewRequest("POST", "/v1/?unit=km", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(env.HandlePost).ServeHTTP(rr, req)
+
+	// 55 mph to the preceding login is 88 km/h, still well under the 804 km/h threshold
+	expected := `{"current_geo":{"lat":39.2293,"lon":-76.6907,"radius":10,"city":"Halethorpe","subdivision":"Maryland","country":"United States","country_iso":"US","time_zone":"America/New_York","local_time":"2017-12-31T19:00:00-05:00"},"geo_unavailable":false,"trusted_network":false,"preceding_ip_access":{"ip":"24.242.71.20","speed":88.51442856053663,"distance":2151.9086950129795,"lat":30.3773,"lon":-97.71,"radius":5,"city":"","country":"","unix_timestamp":1514677279,"time_zone":"","local_time":""},"subsequent_ip_access":{"ip":"91.207.175.104","speed":13407289.032249196,"distance":3724.2469534025545,"lat":34.0549,"lon":-118.2578,"radius":200,"city":"","country":"","unix_timestamp":1514764801,"time_zone":"","local_time":""},"travel_to_current_geo_suspicious":false,"travel_from_current_geo_suspicious":true,"fastest_window_ip_access":null,"travel_within_window_suspicious":null,"concurrent_distant_login":null,"outside_home_geofence":null,"evaluated":true,"suspicious":true,"severity":"impossible","unit":"km"}`
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v",
 			rr.Body.String(), expected)
 	}
-}
\ No newline at end of file
+
+	req, err = http.NewRequest("POST", "/v1/?unit=parsecs", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(env.HandlePost).ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestResponseDistance(t *testing.T) {
+	for unit, expected := range map[string]float64{"mi": 1337, "km": 2152} {
+		memEnv := newMemoryEnv(t)
+		seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)})
+
+		jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`)
+		req, err := http.NewRequest("POST", "/v1/?unit="+unit, bytes.NewBuffer(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+
+		var resp struct {
+			PrecedingIpAccess struct {
+				Distance *float64 `json:"distance"`
+			} `json:"preceding_ip_access"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		// Austin to Baltimore is roughly 1337 miles / 2152 km
+		if d := resp.PrecedingIpAccess.Distance; d == nil || math.Abs(*d-expected) > 5 {
+			t.Errorf("unit %s: unexpected distance in %v, want about %v", unit, rr.Body.String(), expected)
+		}
+	}
+}
+
+func TestDistanceFormula(t *testing.T) {
+	austin := models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)}
+	tests := []struct {
+		query    string
+		expected float64
+	}{
+		{"", travel.Miles.FromMeters(travel.Distance(39.2293, -76.6907, austin.Lat, austin.Lon))},
+		{"?formula=haversine", travel.Miles.FromMeters(travel.Distance(39.2293, -76.6907, austin.Lat, austin.Lon))},
+		{"?formula=vincenty", travel.Miles.FromMeters(travel.Vincenty(39.2293, -76.6907, austin.Lat, austin.Lon))},
+		{"?formula=rhumb", travel.Miles.FromMeters(travel.Rhumb(austin.Lat, austin.Lon, 39.2293, -76.6907))},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		seedLogins(t, memEnv, austin)
+
+		jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`)
+		req, err := http.NewRequest("POST", "/v1/"+tc.query, bytes.NewBuffer(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+
+		var resp struct {
+			PrecedingIpAccess struct {
+				Distance float64 `json:"distance"`
+			} `json:"preceding_ip_access"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.PrecedingIpAccess.Distance != tc.expected {
+			t.Errorf("%q: unexpected distance: got %v want %v", tc.query, resp.PrecedingIpAccess.Distance, tc.expected)
+		}
+	}
+
+	req, err := http.NewRequest("POST", "/v1/?formula=flat", bytes.NewBufferString(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000c", "ip_address": "206.81.252.6"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(newMemoryEnv(t).HandlePost).ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSubtractAccuracyRadius(t *testing.T) {
+	// About 510 miles in an hour between two imprecise locations, each with a 1000km radius
+	for subtract, expected := range map[bool]string{false: `"travel_to_current_geo_suspicious":true`, true: `"travel_to_current_geo_suspicious":false`} {
+		memEnv := newMemoryEnv(t)
+		memEnv.SubtractAccuracyRadius = subtract
+		seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514761200, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "192.0.2.10", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(1000)})
+
+		jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "8.8.8.8"}`)
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("subtract %v: handler returned unexpected body: got %v want it to contain %v", subtract, rr.Body.String(), expected)
+		}
+	}
+}
+
+func TestEqualTimestamps(t *testing.T) {
+	tests := []struct {
+		name     string
+		ip       string
+		expected string
+	}{
+		{"somewhere else", "24.242.71.20", `"speed":2147483647,`},
+		{"same place", "206.81.252.6", `"speed":0,`},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: accuracyRadius(10)})
+
+		jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "` + tc.ip + `"}`)
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+
+		if !strings.Contains(rr.Body.String(), tc.expected) {
+			t.Errorf("%s: handler returned unexpected body: got %v want it to contain %v", tc.name, rr.Body.String(), tc.expected)
+		}
+	}
+}
+
+func TestGeoUnavailable(t *testing.T) {
+	tests := []struct {
+		name   string
+		ip     string
+		reason string
+	}{
+		{"10.0.0.0/8", "10.12.0.1", reasonGeoUnavailable},
+		{"172.16.0.0/12", "172.20.4.2", reasonGeoUnavailable},
+		{"192.168.0.0/16", "192.168.1.20", reasonGeoUnavailable},
+		{"missing from the database", "192.0.2.1", reasonNoGeoData},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)})
+
+		jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514677280, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "` + tc.ip + `"}`)
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+
+		expected := `{"current_geo":null,"geo_unavailable":true,"trusted_network":false,"preceding_ip_access":null,"subsequent_ip_access":null,"travel_to_current_geo_suspicious":null,"travel_from_current_geo_suspicious":null,"fastest_window_ip_access":null,"travel_within_window_suspicious":null,"concurrent_distant_login":null,"outside_home_geofence":null,"evaluated":false,"reason":"` + tc.reason + `","suspicious":false,"severity":"none","unit":"mi"}`
+		if rr.Body.String() != expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v", tc.name, rr.Body.String(), expected)
+		}
+
+		// The next login should be compared against the last located one, not the unlocated login
+		jsonBody = []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000c", "ip_address": "206.81.252.6"}`)
+		req, err = http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+
+		expected = `"preceding_ip_access":{"ip":"24.242.71.20","speed":55.00021047466064,`
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("%s: handler returned unexpected body: got %v want it to contain %v", tc.name, rr.Body.String(), expected)
+		}
+	}
+}
+
+func TestTimestampValidation(t *testing.T) {
+	const now = 1514764800
+	tests := []struct {
+		name      string
+		timestamp int64
+		status    int
+	}{
+		{"zero", 0, http.StatusBadRequest},
+		{"negative", -1514764800, http.StatusBadRequest},
+		{"far future", now + 86400*365, http.StatusBadRequest},
+		{"just past the allowed skew", now + 3600, http.StatusBadRequest},
+		{"within the allowed skew", now + 60, http.StatusOK},
+		{"reasonable", 1514000000, http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		memEnv.clock = newFakeClock(now)
+		jsonBody := []byte(fmt.Sprintf(`{"username": "bob", "unix_timestamp": %d, "event_uuid": "85ad929a-db03-4bf4-9541-8f728fa12e42", "ip_address": "206.81.252.6"}`, tc.timestamp))
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+
+		if rr.Code != tc.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.name, rr.Code, tc.status)
+		}
+		if tc.status == http.StatusBadRequest && rr.Body.String() != `{"error":{"code":"invalid_timestamp","message":"`+errInvalidTimestamp.Error()+`"}}` {
+			t.Errorf("%s: handler returned unexpected body: got %v", tc.name, rr.Body.String())
+		}
+	}
+}
+
+func TestTimestampValidationFollowsClock(t *testing.T) {
+	clock := newFakeClock(1514764800)
+	memEnv := &Env{Config: defaultConfig(), clock: clock}
+	ts := int64(1514764800 + 3600)
+	if memEnv.validTimestamp(ts) {
+		t.Errorf("expected a timestamp an hour ahead to be rejected")
+	}
+	// Once the clock catches up it's no longer in the future
+	clock.advance(time.Hour)
+	if !memEnv.validTimestamp(ts) {
+		t.Errorf("expected the timestamp to be accepted once it's now")
+	}
+}
+
+func TestDuplicateEventIsIdempotent(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)})
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+		return rr
+	}
+
+	body := `{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "35ad929a-db03-4bf4-9541-8f728fa12e42", "ip_address": "206.81.252.6"}`
+	first := post(body)
+	second := post(body)
+
+	if first.Code != http.StatusOK || second.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status codes: got %v and %v want %v", first.Code, second.Code, http.StatusOK)
+	}
+	if first.Body.String() != second.Body.String() {
+		t.Errorf("retried event returned a different body: got %v want %v", second.Body.String(), first.Body.String())
+	}
+
+	logins, err := memEnv.store.LoginsByUsername(context.Background(), "bob", models.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 2 {
+		t.Errorf("expected the retried event to be stored once, got %v logins", len(logins))
+	}
+
+	// The same event_uuid can't be claimed by a different user
+	conflict := post(`{"username": "alice", "unix_timestamp": 1514764800, "event_uuid": "35ad929a-db03-4bf4-9541-8f728fa12e42", "ip_address": "206.81.252.6"}`)
+	if conflict.Code != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", conflict.Code, http.StatusConflict)
+	}
+
+	// A suspicious event is only audited and sent to the webhook the first time
+	receiver := &webhookReceiver{}
+	memEnv.webhook = newTestWebhook(t, receiver, 1)
+	memEnv.AuditSink = "db"
+	if memEnv.audit, err = memEnv.openAuditor(); err != nil {
+		t.Fatal(err)
+	}
+	body = `{"username": "bob", "unix_timestamp": 1514677280, "event_uuid": "00000000-0000-4000-8000-00000000000c", "ip_address": "91.207.175.104"}`
+	first, second = post(body), post(body)
+	if !strings.Contains(first.Body.String(), `"suspicious":true`) || first.Body.String() != second.Body.String() {
+		t.Errorf("expected the same suspicious body twice, got %v and %v", first.Body.String(), second.Body.String())
+	}
+	memEnv.audit.close()
+	memEnv.webhook.close(time.Minute)
+	detections, err := memEnv.store.DetectionsByUsername(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detections) != 1 || receiver.attempts != 1 {
+		t.Errorf("expected one audit record and one webhook call, got %v and %v", len(detections), receiver.attempts)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)})
+
+	jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`)
+	req, err := http.NewRequest("POST", "/v1/?dry_run=true", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// The stored login is still used as a neighbour
+	var resp loginResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.PrecedingIpAccess == nil || int(resp.PrecedingIpAccess.Speed) != 55 {
+		t.Errorf("unexpected preceding access: got %+v", resp.PrecedingIpAccess)
+	}
+
+	logins, err := memEnv.store.LoginsByUsername(context.Background(), "bob", models.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 1 {
+		t.Errorf("expected the dry run not to be stored, got %v logins", len(logins))
+	}
+
+	req, err = http.NewRequest("POST", "/v1/?dry_run=maybe", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCanonicalIP(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	spellings := []struct {
+		ip        string
+		canonical string
+	}{
+		{"2001:db8::1", "2001:db8::1"},
+		{"2001:0db8:0:0:0:0:0:1", "2001:db8::1"},
+		{"2001:DB8::0001", "2001:db8::1"},
+		{"2001:db8:0000::1", "2001:db8::1"},
+		{"::ffff:206.81.252.6", "206.81.252.6"},
+	}
+	for i, tc := range spellings {
+		body := fmt.Sprintf(`{"username": "bob", "unix_timestamp": %d, "event_uuid": "00000000-0000-4000-800e-%012d", "ip_address": %q}`, 1514764800+i, i, tc.ip)
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%v: handler returned wrong status code: got %v want %v", tc.ip, rr.Code, http.StatusOK)
+		}
+	}
+
+	logins, err := memEnv.store.LoginsByUsername(context.Background(), "bob", models.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != len(spellings) {
+		t.Fatalf("unexpected number of logins: got %v want %v", len(logins), len(spellings))
+	}
+	for i, login := range logins {
+		if login.IPAddr != spellings[i].canonical {
+			t.Errorf("%v: stored as %v, want %v", spellings[i].ip, login.IPAddr, spellings[i].canonical)
+		}
+	}
+}
+
+func TestNeighborWindow(t *testing.T) {
+	// A login from Los Angeles, then one from Baltimore an hour later that only arrives after
+	// the next Baltimore login has been posted. The new login's adjacent neighbour is the late
+	// Baltimore one, no distance away, so only the window sees the trip from Los Angeles.
+	la := models.Login{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)}
+	late := models.Login{Username: "bob", UnixTimestamp: 1514768300, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: accuracyRadius(10)}
+	body := `{"username": "bob", "unix_timestamp": 1514768400, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`
+
+	post := func(e *Env) loginResult {
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(e.HandlePost).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		var resp loginResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	adjacentOnly := newMemoryEnv(t)
+	seedLogins(t, adjacentOnly, late, la)
+	resp := post(adjacentOnly)
+	if resp.Suspicious || resp.FastestWindowIpAccess != nil || resp.TravelWithinWindowSuspicious != nil {
+		t.Errorf("expected only the adjacent logins to be checked by default, got %+v", resp)
+	}
+
+	windowed := newMemoryEnv(t)
+	windowed.NeighborWindow = 2 * time.Hour
+	seedLogins(t, windowed, late, la)
+	resp = post(windowed)
+	if resp.PrecedingIpAccess == nil || resp.PrecedingIpAccess.IP != "206.81.252.6" || *resp.TravelToCurrentGeoSuspicious {
+		t.Errorf("unexpected preceding access: got %+v", resp.PrecedingIpAccess)
+	}
+	if resp.FastestWindowIpAccess == nil || resp.FastestWindowIpAccess.IP != "91.207.175.104" || int(resp.FastestWindowIpAccess.Speed) != 2314 {
+		t.Errorf("unexpected fastest window access: got %+v", resp.FastestWindowIpAccess)
+	}
+	if !resp.Suspicious || resp.TravelWithinWindowSuspicious == nil || !*resp.TravelWithinWindowSuspicious {
+		t.Errorf("expected travel within the window to be suspicious, got %+v", resp)
+	}
+
+	// Logins outside the window are ignored
+	narrow := newMemoryEnv(t)
+	narrow.NeighborWindow = 30 * time.Minute
+	seedLogins(t, narrow, late, la)
+	resp = post(narrow)
+	if resp.Suspicious || resp.FastestWindowIpAccess == nil || resp.FastestWindowIpAccess.IP != "206.81.252.6" {
+		t.Errorf("expected only the late Baltimore login in the window, got %+v", resp.FastestWindowIpAccess)
+	}
+}
+
+func TestUnknownAccuracyRadius(t *testing.T) {
+	if accuracyRadius(0) != nil {
+		t.Errorf("expected a zero GeoIP accuracy radius to be unknown")
+	}
+	if r := accuracyRadius(10); r == nil || *r != 10 {
+		t.Errorf("unexpected accuracy radius: got %v want 10", r)
+	}
+
+	// A neighbour without a radius has a null one in the response
+	memEnv := newMemoryEnv(t)
+	seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71})
+
+	jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`)
+	req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+
+	expected := `"preceding_ip_access":{"ip":"24.242.71.20","speed":55.00021047466064,"distance":1337.131505820215,"lat":30.3773,"lon":-97.71,"radius":null,`
+	if !strings.Contains(rr.Body.String(), expected) {
+		t.Errorf("handler returned unexpected body: got %v want it to contain %v", rr.Body.String(), expected)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{"GET", "/v1/", "POST"},
+		{"PUT", "/v1/", "POST"},
+		{"DELETE", "/v1/", "POST"},
+		{"GET", "/v1/batch", "POST"},
+		{"PUT", "/v1/logins/bob", "GET, DELETE"},
+		{"POST", "/healthz", "GET"},
+	}
+
+	router := newMemoryEnv(t).routes()
+	for _, tc := range tests {
+		req, err := http.NewRequest(tc.method, tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%v %v: handler returned wrong status code: got %v want %v", tc.method, tc.path, rr.Code, http.StatusMethodNotAllowed)
+		}
+		if allow := rr.Header().Get("Allow"); allow != tc.allow {
+			t.Errorf("%v %v: unexpected Allow header: got %q want %q", tc.method, tc.path, allow, tc.allow)
+		}
+		if !strings.HasPrefix(rr.Body.String(), `{"error":{"code":"method_not_allowed",`) {
+			t.Errorf("%v %v: expected a JSON error body, got %v", tc.method, tc.path, rr.Body.String())
+		}
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	for _, path := range []string{"/v2/", "/v1/logins", "/v1/users/bob/away"} {
+		rr := getPath(t, newMemoryEnv(t), path)
+		if rr.Code != http.StatusNotFound || rr.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%v: expected a JSON 404, got %v %v", path, rr.Code, rr.Header())
+		}
+		expected := `{"error":{"code":"not_found","message":"no such path \"` + path + `\""}}`
+		if rr.Body.String() != expected {
+			t.Errorf("%v: unexpected body: got %v want %v", path, rr.Body.String(), expected)
+		}
+	}
+}
+
+func TestTravelSpeedIsSymmetric(t *testing.T) {
+	austin := models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)}
+	baltimore := models.Login{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: accuracyRadius(10)}
+
+	for _, subtract := range []bool{false, true} {
+		memEnv := &Env{Config: defaultConfig(), logger: env.logger}
+		memEnv.SubtractAccuracyRadius = subtract
+		for _, opts := range []evalOptions{{unit: travel.Miles}, {unit: travel.Kilometers, formula: travel.VincentyFormula}} {
+			forwardDistance, forward := memEnv.getTravelSpeed(austin, baltimore, opts)
+			backwardDistance, backward := memEnv.getTravelSpeed(baltimore, austin, opts)
+			if forward <= 0 || forward != backward || forwardDistance != backwardDistance {
+				t.Errorf("subtract %v, %+v: expected the same positive speed both ways, got %v and %v", subtract, opts, forward, backward)
+			}
+		}
+	}
+}
+
+func TestHomeGeofence(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	put := func(username, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PUT", "/v1/users/"+username+"/home", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		memEnv.routes().ServeHTTP(rr, req)
+		return rr
+	}
+
+	for _, body := range []string{`{"lat": 91, "lon": 0, "radius": 10}`, `{"lat": 0, "lon": -181, "radius": 10}`, `{"lat": 0, "lon": 0, "radius": 0}`, `{"lat":`} {
+		if rr := put("bob", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+	if rr := getPath(t, memEnv, "/v1/users/bob/home"); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// Bob lives in Austin; Alice lives near Baltimore
+	if rr := put("bob", `{"lat": 30.3773, "lon": -97.71, "radius": 100}`); rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	put("alice", `{"lat": 39.2293, "lon": -76.6907, "radius": 100}`)
+	rr := getPath(t, memEnv, "/v1/users/bob/home")
+	if expected := `{"username":"bob","lat":30.3773,"lon":-97.71,"radius":100}`; rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+
+	tests := []struct {
+		username   string
+		outside    string
+		suspicious bool
+	}{
+		{"bob", `"concurrent_distant_login":null,"outside_home_geofence":true`, true},
+		{"alice", `"concurrent_distant_login":null,"outside_home_geofence":false`, false},
+		{"carol", `"concurrent_distant_login":null,"outside_home_geofence":null`, false},
+	}
+	for _, tc := range tests {
+		jsonBody := []byte(`{"username": "` + tc.username + `", "unix_timestamp": 1514764800, "event_uuid": "` + newUUID() + `", "ip_address": "206.81.252.6"}`)
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+
+		if !strings.Contains(rr.Body.String(), tc.outside) {
+			t.Errorf("%s: handler returned unexpected body: got %v want it to contain %v", tc.username, rr.Body.String(), tc.outside)
+		}
+		var result loginResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Suspicious != tc.suspicious {
+			t.Errorf("%s: expected suspicious to be %v", tc.username, tc.suspicious)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	austin := models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)}
+	losAngeles := models.Login{Username: "bob", UnixTimestamp: 1514764799, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)}
+
+	tests := []struct {
+		name       string
+		seed       []models.Login
+		evaluated  bool
+		suspicious bool
+		speed      int
+	}{
+		{"no neighbours", nil, false, false, 0},
+		{"slow travel", []models.Login{austin}, true, false, 55},
+		{"fast travel", []models.Login{losAngeles}, true, true, 8330887},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		seedLogins(t, memEnv, tc.seed...)
+
+		lr := loginRecord{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6"}
+		result, err := memEnv.Evaluate(context.Background(), lr, evalOptions{})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if result.CurrentGeo == nil || result.CurrentGeo.City != "Halethorpe" {
+			t.Errorf("%s: expected the login to be located, got %+v", tc.name, result.CurrentGeo)
+		}
+		if result.Evaluated != tc.evaluated || result.Suspicious != tc.suspicious {
+			t.Errorf("%s: got evaluated %v suspicious %v want %v %v", tc.name, result.Evaluated, result.Suspicious, tc.evaluated, tc.suspicious)
+		}
+		if tc.speed != 0 && (result.PrecedingIpAccess == nil || int(result.PrecedingIpAccess.Speed) != tc.speed) {
+			t.Errorf("%s: unexpected preceding login: got %+v want speed %v", tc.name, result.PrecedingIpAccess, tc.speed)
+		}
+
+		// The login was saved for later ones to be checked against
+		logins, err := memEnv.store.LoginsByUsername(context.Background(), "bob", models.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved := false
+		for _, login := range logins {
+			saved = saved || login.EventUUID == "00000000-0000-4000-8000-00000000000b"
+		}
+		if !saved {
+			t.Errorf("%s: expected the login to be saved", tc.name)
+		}
+	}
+}
+
+func TestNeighborCount(t *testing.T) {
+	// Two hours before the new Baltimore login the user was in Los Angeles, but a spoofed
+	// login from Baltimore a minute before it hides the trip from the adjacent check
+	la := models.Login{Username: "bob", UnixTimestamp: 1514761200, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)}
+	spoofed := models.Login{Username: "bob", UnixTimestamp: 1514768340, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: accuracyRadius(10)}
+	spoofedAgain := models.Login{Username: "bob", UnixTimestamp: 1514768370, EventUUID: "00000000-0000-4000-8000-00000000000d", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: accuracyRadius(10)}
+	lr := loginRecord{Username: "bob", UnixTimestamp: 1514768400, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6"}
+
+	tests := []struct {
+		name       string
+		count      int
+		seed       []models.Login
+		suspicious bool
+		fastest    string
+	}{
+		{"adjacent only", 1, []models.Login{la, spoofed}, false, ""},
+		{"nearest two", 2, []models.Login{la, spoofed}, true, "91.207.175.104"},
+		{"beyond the nearest two", 2, []models.Login{la, spoofed, spoofedAgain}, false, "206.81.252.6"},
+		{"nearest three", 3, []models.Login{la, spoofed, spoofedAgain}, true, "91.207.175.104"},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		memEnv.NeighborCount = tc.count
+		seedLogins(t, memEnv, tc.seed...)
+
+		result, err := memEnv.Evaluate(context.Background(), lr, evalOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Suspicious != tc.suspicious || (result.TravelToCurrentGeoSuspicious != nil && *result.TravelToCurrentGeoSuspicious) {
+			t.Errorf("%s: expected suspicious %v from the wider neighbours only, got %+v", tc.name, tc.suspicious, result)
+		}
+		if tc.fastest == "" {
+			if result.FastestWindowIpAccess != nil {
+				t.Errorf("%s: expected no wider neighbours to be checked, got %+v", tc.name, result.FastestWindowIpAccess)
+			}
+			continue
+		}
+		if result.FastestWindowIpAccess == nil || result.FastestWindowIpAccess.IP != tc.fastest {
+			t.Errorf("%s: unexpected fastest neighbour: got %+v want %v", tc.name, result.FastestWindowIpAccess, tc.fastest)
+		}
+	}
+}
+
+func TestDistinctBaseline(t *testing.T) {
+	// Two hours before the new Baltimore login the user was in Los Angeles, with logins from
+	// Baltimore either side of the trip
+	earlier := models.Login{Username: "bob", UnixTimestamp: 1514757600, EventUUID: "00000000-0000-4000-8000-00000000000e", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: accuracyRadius(10)}
+	la := models.Login{Username: "bob", UnixTimestamp: 1514761200, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)}
+	same := models.Login{Username: "bob", UnixTimestamp: 1514768340, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: accuracyRadius(10)}
+	nearby := models.Login{Username: "bob", UnixTimestamp: 1514768370, EventUUID: "00000000-0000-4000-8000-00000000000d", IPAddr: "206.81.252.7", Lat: 39.2493, Lon: -76.6907, Radius: accuracyRadius(10)}
+	lr := loginRecord{Username: "bob", UnixTimestamp: 1514768400, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6"}
+
+	tests := []struct {
+		name       string
+		baseline   string
+		seed       []models.Login
+		suspicious bool
+		preceding  int64
+	}{
+		{"adjacent", baselineAdjacent, []models.Login{earlier, la, same}, false, same.UnixTimestamp},
+		{"distinct", baselineDistinct, []models.Login{earlier, la, same}, true, la.UnixTimestamp},
+		{"distinct past the same metro area", baselineDistinct, []models.Login{earlier, la, same, nearby}, true, la.UnixTimestamp},
+		{"adjacent already distinct", baselineDistinct, []models.Login{earlier, la}, true, la.UnixTimestamp},
+		// With nowhere else to compare with, the adjacent login is used
+		{"nothing distinct", baselineDistinct, []models.Login{earlier, same, nearby}, false, nearby.UnixTimestamp},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		memEnv.Baseline = tc.baseline
+		seedLogins(t, memEnv, tc.seed...)
+
+		result, err := memEnv.Evaluate(context.Background(), lr, evalOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Suspicious != tc.suspicious || result.PrecedingIpAccess == nil || result.PrecedingIpAccess.Timestamp != tc.preceding {
+			t.Errorf("%s: expected suspicious %v compared with %v, got %+v (preceding %+v)", tc.name, tc.suspicious, tc.preceding, result, result.PrecedingIpAccess)
+		}
+	}
+}
+
+func TestMinDistance(t *testing.T) {
+	// GeoIP jitter puts a login two seconds earlier about 1.4 miles away, which works out at
+	// thousands of mph
+	jitter := models.Login{Username: "bob", UnixTimestamp: 1514764798, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "206.81.252.7", Lat: 39.2493, Lon: -76.6907, Radius: accuracyRadius(10)}
+	la := models.Login{Username: "bob", UnixTimestamp: 1514757600, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)}
+	lr := loginRecord{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6"}
+
+	tests := []struct {
+		name        string
+		minDistance float64
+		seed        []models.Login
+		suspicious  bool
+	}{
+		{"no floor", 0, []models.Login{jitter}, true},
+		{"jitter under the floor", 31, []models.Login{jitter}, false},
+		{"travel over the floor", 31, []models.Login{la}, true},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		memEnv.MinDistance = tc.minDistance
+		seedLogins(t, memEnv, tc.seed...)
+
+		result, err := memEnv.Evaluate(context.Background(), lr, evalOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Suspicious != tc.suspicious || result.PrecedingIpAccess == nil || result.PrecedingIpAccess.Speed <= 500 {
+			t.Errorf("%s: expected suspicious %v at over 500 mph, got %+v", tc.name, tc.suspicious, result)
+		}
+	}
+
+	// A faster login under the floor doesn't hide a slower one over it from the wider check
+	memEnv := newMemoryEnv(t)
+	memEnv.MinDistance = 31
+	memEnv.NeighborCount = 2
+	seedLogins(t, memEnv, la, jitter)
+	result, err := memEnv.Evaluate(context.Background(), lr, evalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Suspicious || *result.TravelToCurrentGeoSuspicious || result.FastestWindowIpAccess == nil || result.FastestWindowIpAccess.IP != la.IPAddr {
+		t.Errorf("expected the trip from Los Angeles to be flagged, got %+v (fastest %+v)", result, result.FastestWindowIpAccess)
+	}
+}
+
+func TestConcurrentDistantLogin(t *testing.T) {
+	// Thirty seconds before the Baltimore login the user logged in from London, and from
+	// across town ten seconds before
+	london := models.Login{Username: "bob", UnixTimestamp: 1514764770, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "81.2.69.142", Lat: 51.5142, Lon: -0.0931, Radius: accuracyRadius(10)}
+	nearby := models.Login{Username: "bob", UnixTimestamp: 1514764790, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "206.81.252.7", Lat: 39.2493, Lon: -76.6907, Radius: accuracyRadius(10)}
+	lr := loginRecord{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6"}
+	yes, no := true, false
+
+	tests := []struct {
+		name   string
+		window time.Duration
+		seed   []models.Login
+		want   *bool
+	}{
+		{"check off", 0, []models.Login{london}, nil},
+		{"other continent", time.Minute, []models.Login{london}, &yes},
+		{"same city", time.Minute, []models.Login{nearby}, &no},
+		{"other continent and same city", time.Minute, []models.Login{nearby, london}, &yes},
+		{"outside the window", 20 * time.Second, []models.Login{london}, nil},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		memEnv.ConcurrentWindow = tc.window
+		// High enough that only the concurrent check can flag the login
+		memEnv.SpeedThreshold = 1000000
+		seedLogins(t, memEnv, tc.seed...)
+
+		result, err := memEnv.Evaluate(context.Background(), lr, evalOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := result.ConcurrentDistantLogin
+		if (got == nil) != (tc.want == nil) || (got != nil && *got != *tc.want) {
+			t.Errorf("%s: unexpected concurrentDistantLogin: got %v want %v", tc.name, got, tc.want)
+		}
+		if result.Suspicious != (tc.want != nil && *tc.want) {
+			t.Errorf("%s: expected suspicious to follow the concurrent check, got %+v", tc.name, result)
+		}
+	}
+}
+
+func TestSeverity(t *testing.T) {
+	// An hour before the Baltimore login the user was in Austin, 1337 miles away
+	austin := models.Login{Username: "bob", UnixTimestamp: 1514761200, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)}
+	lr := loginRecord{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6"}
+
+	tests := []struct {
+		name       string
+		threshold  int
+		impossible int
+		unit       travel.Unit
+		severity   string
+	}{
+		{"under the threshold", 2000, 3000, travel.Miles, severityNone},
+		{"under the impossible speed", 500, 1338, travel.Miles, severitySuspicious},
+		// The fraction of a mph over counts
+		{"over the impossible speed", 500, 1337, travel.Miles, severityImpossible},
+		// 1338 mph is 2153.3 km/h, over the 2151.9 km/h travelled, and 1337 mph is 2151.7 km/h
+		{"under the impossible speed in km", 500, 1338, travel.Kilometers, severitySuspicious},
+		{"over the impossible speed in km", 500, 1337, travel.Kilometers, severityImpossible},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		memEnv.SpeedThreshold, memEnv.ImpossibleSpeed = tc.threshold, tc.impossible
+		seedLogins(t, memEnv, austin)
+
+		result, err := memEnv.Evaluate(context.Background(), lr, evalOptions{unit: tc.unit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Severity != tc.severity || result.Suspicious != (tc.severity != severityNone) {
+			t.Errorf("%s: got severity %q (suspicious %v, speed %v) want %q", tc.name, result.Severity, result.Suspicious, result.PrecedingIpAccess.Speed, tc.severity)
+		}
+	}
+
+	// Being outside the home geofence is suspicious, never impossible
+	memEnv := newMemoryEnv(t)
+	if err := memEnv.store.SetHome(context.Background(), models.Home{Username: "bob", Lat: 30.3773, Lon: -97.71, Radius: 100}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := memEnv.Evaluate(context.Background(), lr, evalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Severity != severitySuspicious {
+		t.Errorf("expected a login away from home to be suspicious, got %q", result.Severity)
+	}
+
+	memEnv = newMemoryEnv(t)
+	result, err = memEnv.Evaluate(context.Background(), loginRecord{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "10.0.0.1"}, evalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Severity != severityNone {
+		t.Errorf("expected a login that couldn't be located to have no severity, got %q", result.Severity)
+	}
+}
+
+func TestFractionalSpeed(t *testing.T) {
+	// A day before, about 7 miles north of the Baltimore login
+	nearby := models.Login{Username: "bob", UnixTimestamp: 1514678400, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 39.3293, Lon: -76.6907, Radius: accuracyRadius(5)}
+	memEnv := newMemoryEnv(t)
+	seedLogins(t, memEnv, nearby)
+
+	rr := postBatch(t, memEnv, `[{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}]`)
+	var results []struct {
+		Result struct {
+			PrecedingIpAccess struct {
+				Speed    float64 `json:"speed"`
+				Distance float64 `json:"distance"`
+			} `json:"preceding_ip_access"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || len(results) != 1 {
+		t.Fatalf("unexpected response: %v %s", err, rr.Body.String())
+	}
+	// Under 1 mph, which used to be truncated to 0
+	preceding := results[0].Result.PrecedingIpAccess
+	if want := preceding.Distance / 24; preceding.Speed <= 0 || preceding.Speed >= 1 || math.Abs(preceding.Speed-want) > 1e-9 {
+		t.Errorf("expected the fractional speed %v to be kept, got %v", want, preceding.Speed)
+	}
+
+	// Fractions over the threshold count too: Austin to Baltimore is 55.0002 mph
+	memEnv = newMemoryEnv(t)
+	memEnv.SpeedThreshold = 55
+	seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)})
+	result, err := memEnv.Evaluate(context.Background(), loginRecord{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6"}, evalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Suspicious {
+		t.Errorf("expected %v mph to be over a 55 mph threshold", result.PrecedingIpAccess.Speed)
+	}
+}
+
+func TestProvidedLocation(t *testing.T) {
+	// An hour before, from Baltimore
+	baltimore := models.Login{Username: "bob", UnixTimestamp: 1514761200, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: accuracyRadius(10)}
+
+	tests := []struct {
+		name string
+		// Added to a login from a Los Angeles address
+		location   string
+		suspicious bool
+		lat, lon   float64
+		radius     *uint16
+		// Whether the coordinates are flagged as far from the address's GeoIP location
+		mismatch bool
+	}{
+		// GPS puts the login a few miles from the last one, whatever the address says
+		{"provided", `, "lat": 39.29, "lon": -76.61, "radius": 1`, false, 39.29, -76.61, accuracyRadius(1), true},
+		{"provided without a radius", `, "lat": 39.29, "lon": -76.61`, false, 39.29, -76.61, nil, true},
+		{"provided near the address", `, "lat": 34.1, "lon": -118.3`, true, 34.1, -118.3, nil, false},
+		{"looked up", ``, true, 34.0549, -118.2578, accuracyRadius(200), false},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		memEnv.MismatchDistance = 100
+		seedLogins(t, memEnv, baltimore)
+		rr := postBatch(t, memEnv, `[{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "91.207.175.104"`+tc.location+`}]`)
+		var results []batchResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || len(results) != 1 || results[0].Result == nil {
+			t.Fatalf("%s: unexpected response %v %s", tc.name, rr.Code, rr.Body.String())
+		}
+		result := results[0].Result
+		if result.Suspicious != tc.suspicious || result.CurrentGeo == nil || result.CurrentGeo.Lat != tc.lat || result.CurrentGeo.Lon != tc.lon {
+			t.Errorf("%s: unexpected result %+v", tc.name, result)
+		}
+		if result.CoordinateMismatch != tc.mismatch {
+			t.Errorf("%s: got coordinate_source_mismatch %v want %v", tc.name, result.CoordinateMismatch, tc.mismatch)
+		}
+
+		login, err := memEnv.store.LoginByEventUUID(context.Background(), "00000000-0000-4000-8000-00000000000b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if login == nil || login.Lat != tc.lat || login.Lon != tc.lon || radiusKm(login.Radius) != radiusKm(tc.radius) {
+			t.Errorf("%s: expected the login to be saved where it was located, got %+v", tc.name, login)
+		}
+	}
+}
+
+// The address isn't looked up to compare unless a mismatch distance is set
+func TestCoordinateMismatchOff(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.resolver = staticResolver{err: errors.New("unexpected lookup")}
+	rr := postBatch(t, memEnv, `[{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "91.207.175.104", "lat": 39.29, "lon": -76.61}]`)
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "coordinate_source_mismatch") {
+		t.Errorf("expected no mismatch to be reported, got %v %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestProvidedLocationValidation(t *testing.T) {
+	tests := []string{
+		`"lat": 39.29`,
+		`"lon": -76.61`,
+		`"radius": 1`,
+		`"lat": 90.5, "lon": -76.61`,
+		`"lat": 39.29, "lon": -180.5`,
+	}
+
+	for _, location := range tests {
+		rr := postBatch(t, newMemoryEnv(t), `[{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "91.207.175.104", `+location+`}]`)
+		if !strings.Contains(rr.Body.String(), `"code":"`+codeInvalidLocation+`"`) {
+			t.Errorf("%s: expected an invalid_location error, got %s", location, rr.Body.String())
+		}
+	}
+}
+
+// A store that can't read the login after the current one
+type brokenSubsequentStore struct {
+	models.Store
+}
+
+func (s brokenSubsequentStore) AdjacentLogins(ctx context.Context, cLogin models.Login) (models.Login, models.Login, error) {
+	prev, _, err := s.Store.AdjacentLogins(ctx, cLogin)
+	if err != nil {
+		return prev, models.Login{}, err
+	}
+	return prev, models.Login{}, &models.AdjacentError{Side: "subsequent", Err: errors.New("corrupt row")}
+}
+
+func TestPartialResults(t *testing.T) {
+	tests := []struct {
+		name string
+		// Stored for the login a day after the current one
+		lat    string
+		broken bool
+	}{
+		{"not on Earth", "340.549", false},
+		{"unreadable", "34.0549", true},
+	}
+
+	for _, tc := range tests {
+		memDB, err := models.NewDB(":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		memDB.SetMaxOpenConns(1)
+		memEnv := &Env{Config: defaultConfig(), store: models.NewSQLiteStore(memDB, models.Options{}), resolver: env.resolver, logger: env.logger}
+		if tc.broken {
+			memEnv.store = brokenSubsequentStore{memEnv.store}
+		}
+		seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)})
+		// Written around the store, which would never save it
+		if _, err := memDB.Exec("INSERT INTO logins (username,tStamp,uuid,ipAddr,lat,lon,radius) VALUES ('bob','1514851200','00000000-0000-4000-8000-00000000000c','91.207.175.104',?,'-118.2578','200')", tc.lat); err != nil {
+			t.Fatal(err)
+		}
+
+		jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`)
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v: %s", tc.name, rr.Code, http.StatusOK, rr.Body.String())
+		}
+
+		// The preceding login is still checked
+		var result loginResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.PrecedingIpAccess == nil || result.PrecedingIpAccess.Speed != 55.00021047466064 || result.TravelToCurrentGeoSuspicious == nil || !result.Evaluated {
+			t.Errorf("%s: expected the preceding login to be checked, got %s", tc.name, rr.Body.String())
+		}
+		if result.SubsequentIpAccess != nil || result.TravelFromCurrentGeoSuspicious != nil {
+			t.Errorf("%s: expected no subsequent login, got %s", tc.name, rr.Body.String())
+		}
+		if len(result.Warnings) != 1 || result.Warnings[0] != "subsequent_ip_access_unavailable" {
+			t.Errorf("%s: unexpected warnings: got %q", tc.name, result.Warnings)
+		}
+	}
+}
+
+func TestCoordinateDecimals(t *testing.T) {
+	baltimore := loginRecord{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "206.81.252.6"}
+	la := loginRecord{Username: "bob", UnixTimestamp: 1514768400, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "91.207.175.104"}
+
+	var results [2]loginResult
+	var logins []*models.Login
+	for i, decimals := range []int{0, 2} {
+		memEnv := newMemoryEnv(t)
+		memEnv.CoordinateDecimals = decimals
+		if _, err := memEnv.Evaluate(context.Background(), baltimore, evalOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		result, err := memEnv.Evaluate(context.Background(), la, evalOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		results[i] = result
+		if logins, err = memEnv.store.AllLogins(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, login := range logins {
+		for _, v := range []float64{login.Lat, login.Lon} {
+			if math.Abs(v*100-math.Round(v*100)) > 1e-6 {
+				t.Errorf("expected the stored coordinates to be rounded to 2 places, got %v,%v", login.Lat, login.Lon)
+			}
+		}
+	}
+	if cg := results[1].CurrentGeo; cg == nil || cg.Lat != 34.05 || cg.Lon != -118.26 {
+		t.Errorf("expected the response to show the rounded location, got %+v", cg)
+	}
+
+	// A kilometre or so either way barely moves a speed measured across the country
+	full, rounded := results[0].PrecedingIpAccess, results[1].PrecedingIpAccess
+	if full == nil || rounded == nil || results[0].Suspicious != results[1].Suspicious || math.Abs(full.Speed-rounded.Speed) > full.Speed*0.01 {
+		t.Errorf("expected rounding not to change the result, got %+v and %+v", full, rounded)
+	}
+}
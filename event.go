@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/rand"
+	"detector/models"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Reports whether s is a UUID in its canonical 8-4-4-4-12 hex form, in either case
+func isValidUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return false
+			}
+		case '0' <= c && c <= '9', 'a' <= c && c <= 'f', 'A' <= c && c <= 'F':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// A random (version 4) UUID
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Body of GET /v1/event/{uuid}
+type eventResponse struct {
+	Login *models.Login `json:"login"`
+	// The audit records of the travel flagged for the login, so null unless they're kept in
+	// the login database and empty when it wasn't suspicious
+	Detections []*models.Detection `json:"detections"`
+}
+
+// Handles GET /v1/event/{uuid}, returning the login saved for an event with its location
+func (env *Env) HandleGetEvent(rw http.ResponseWriter, request *http.Request) {
+	eventUUID := mux.Vars(request)["uuid"]
+	if !isValidUUID(eventUUID) {
+		writeError(rw, http.StatusBadRequest, codeInvalidUUID, "event_uuid must be a UUID")
+		return
+	}
+	// Events are stored in lowercase
+	eventUUID = strings.ToLower(eventUUID)
+
+	login, err := env.store.LoginByEventUUID(request.Context(), eventUUID)
+	if err != nil {
+		env.logFor(request.Context()).Error("could not load login", "event_uuid", eventUUID, "error", err)
+		writeError(rw, http.StatusInternalServerError, codeInternal, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	if login == nil {
+		writeError(rw, http.StatusNotFound, codeNotFound, "no login found for event")
+		return
+	}
+
+	body := eventResponse{Login: login}
+	if env.AuditSink == "db" {
+		detections, err := env.store.DetectionsByUsername(request.Context(), login.Username)
+		if err != nil {
+			env.logFor(request.Context()).Error("could not load audit records", "user", hashUsername(login.Username), "error", err)
+			writeError(rw, http.StatusInternalServerError, codeInternal, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		body.Detections = make([]*models.Detection, 0)
+		for _, d := range detections {
+			if d.EventUUID == eventUUID {
+				body.Detections = append(body.Detections, d)
+			}
+		}
+	}
+	env.writeJSON(rw, request, http.StatusOK, body)
+}
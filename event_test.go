@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"detector/models"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetEvent(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.AuditSink = "db"
+	audit, err := memEnv.openAuditor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	memEnv.audit = audit
+
+	seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514764801, EventUUID: "15ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)})
+	jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "35ad929a-db03-4bf4-9541-8f728fa12e42", "ip_address": "206.81.252.6"}`)
+	req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	memEnv.routes().ServeHTTP(httptest.NewRecorder(), req)
+	memEnv.audit.close()
+
+	rr := getPath(t, memEnv, "/v1/event/35ad929a-db03-4bf4-9541-8f728fa12e42")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var body eventResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if l := body.Login; l == nil || l.Username != "bob" || l.Lat != 39.2293 || l.Lon != -76.6907 || l.TimeZone != "America/New_York" || l.CountryISO != "US" {
+		t.Errorf("unexpected login: got %+v", body.Login)
+	}
+	if len(body.Detections) != 1 || body.Detections[0].Direction != "from" || body.Detections[0].OtherEventUUID != "15ad929a-db03-4bf4-9541-8f728fa12e42" {
+		t.Errorf("expected the travel to Los Angeles to be in the detections, got %+v", body.Detections)
+	}
+
+	// A login that wasn't flagged itself has no detections, rather than null ones
+	rr = getPath(t, memEnv, "/v1/event/15ad929a-db03-4bf4-9541-8f728fa12e42")
+	if rr.Code != http.StatusOK || !bytes.Contains(rr.Body.Bytes(), []byte(`"detections":[]`)) {
+		t.Errorf("unexpected response for the neighbour: got %v %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestGetEventErrors(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "35ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "206.81.252.6"})
+
+	tests := []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{"/v1/event/45ad929a-db03-4bf4-9541-8f728fa12e42", http.StatusNotFound, codeNotFound},
+		{"/v1/event/not-a-uuid", http.StatusBadRequest, codeInvalidUUID},
+		{"/v1/event/35ad929a-db03-4bf4-9541-8f728fa12e4", http.StatusBadRequest, codeInvalidUUID},
+		{"/v1/event/35ad929a_db03_4bf4_9541_8f728fa12e42", http.StatusBadRequest, codeInvalidUUID},
+	}
+	for _, tc := range tests {
+		rr := getPath(t, memEnv, tc.path)
+		var resp struct {
+			Error apiError `json:"error"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		if rr.Code != tc.status || resp.Error.Code != tc.code {
+			t.Errorf("%s: got %v %s want %v %v", tc.path, rr.Code, rr.Body.String(), tc.status, tc.code)
+		}
+	}
+
+	// Without audit records in the database there are no detections to report
+	rr := getPath(t, memEnv, "/v1/event/35ad929a-db03-4bf4-9541-8f728fa12e42")
+	if rr.Code != http.StatusOK || !bytes.Contains(rr.Body.Bytes(), []byte(`"detections":null`)) {
+		t.Errorf("unexpected response: got %v %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestIsValidUUID(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"85ad929a-db03-4bf4-9541-8f728fa12e42", true},
+		{"85AD929A-DB03-4BF4-9541-8F728FA12E42", true},
+		{"85ad929adb034bf495418f728fa12e42", false},
+		{"{85ad929a-db03-4bf4-9541-8f728fa12e42}", false},
+		{"85ad929g-db03-4bf4-9541-8f728fa12e42", false},
+		{"", false},
+	}
+	for _, tc := range tests {
+		if got := isValidUUID(tc.s); got != tc.want {
+			t.Errorf("%q: got %v want %v", tc.s, got, tc.want)
+		}
+	}
+
+	if id := newUUID(); !isValidUUID(id) || id[14] != '4' || !strings.ContainsRune("89ab", rune(id[19])) {
+		t.Errorf("expected a version 4 UUID, got %q", id)
+	}
+}
+
+func TestEventUUIDValidation(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	post := func(eventUUID string) *httptest.ResponseRecorder {
+		jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "` + eventUUID + `", "ip_address": "206.81.252.6"}`)
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		memEnv.routes().ServeHTTP(rr, req)
+		return rr
+	}
+
+	for _, eventUUID := range []string{"b", "85ad929a-db03-4bf4-9541", "85ad929a-db03-4bf4-9541-8f728fa12e42-1", "zzad929a-db03-4bf4-9541-8f728fa12e42"} {
+		if rr := post(eventUUID); rr.Code != http.StatusBadRequest || !bytes.Contains(rr.Body.Bytes(), []byte(`"code":"invalid_uuid"`)) {
+			t.Errorf("%q: expected an invalid_uuid error, got %v %s", eventUUID, rr.Code, rr.Body.String())
+		}
+	}
+
+	// Uppercase is accepted but stored in lowercase, so retries in either case are the same event
+	if rr := post("85AD929A-DB03-4BF4-9541-8F728FA12E42"); rr.Code != http.StatusOK {
+		t.Fatalf("expected an uppercase UUID to be accepted, got %v %s", rr.Code, rr.Body.String())
+	}
+	if rr := post("85ad929a-db03-4bf4-9541-8f728fa12e42"); rr.Code != http.StatusOK {
+		t.Errorf("expected a lowercase retry to be answered as a duplicate, got %v %s", rr.Code, rr.Body.String())
+	}
+	logins, err := memEnv.store.AllLogins(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 1 || logins[0].EventUUID != "85ad929a-db03-4bf4-9541-8f728fa12e42" {
+		t.Errorf("expected one login saved with a lowercase UUID, got %+v", logins)
+	}
+	if rr := getPath(t, memEnv, "/v1/event/85AD929A-DB03-4BF4-9541-8F728FA12E42"); rr.Code != http.StatusOK {
+		t.Errorf("expected the event to be found by its uppercase UUID, got %v %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"detector/models"
+	"encoding/csv"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How many logins an export reads from the database at a time
+const exportPageSize = 500
+
+// Columns of a CSV export, in order
+var exportCSVHeader = []string{"username", "unix_timestamp", "event_uuid", "ip_address", "lat", "lon", "radius", "time_zone", "country_iso", "city", "country"}
+
+// Handles GET /v1/export/{username}, streaming every stored login of the user oldest first
+// for a data-portability request: as JSON lines by default, or CSV with ?format=csv. Logins
+// are read a page at a time and each page is flushed as it's written, so a long history is
+// never held in memory. A database error part way through aborts the response, so a
+// truncated export can't be mistaken for a complete one.
+func (env *Env) HandleExport(rw http.ResponseWriter, request *http.Request) {
+	username := env.usernameVar(request)
+	format := request.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = "ndjson"
+	case "ndjson", "csv":
+	default:
+		writeError(rw, http.StatusBadRequest, codeInvalidQuery, "format must be ndjson or csv")
+		return
+	}
+
+	ctx := request.Context()
+	opts := models.ListOptions{Limit: exportPageSize}
+	logins, err := env.store.LoginsByUsername(ctx, username, opts)
+	if err != nil {
+		env.logFor(ctx).Error("could not load logins", "user", hashUsername(username), "error", err)
+		writeError(rw, http.StatusInternalServerError, codeInternal, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	if len(logins) == 0 {
+		writeError(rw, http.StatusNotFound, codeNotFound, "no logins found for user")
+		return
+	}
+
+	contentType := "application/x-ndjson"
+	if format == "csv" {
+		contentType = "text/csv; charset=utf-8"
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": username + "-logins." + format}))
+	rw.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(rw)
+	writer := csv.NewWriter(rw)
+	if format == "csv" {
+		writer.Write(exportCSVHeader)
+	}
+	controller := http.NewResponseController(rw)
+	exported := 0
+	for {
+		// The write timeout is for the whole response, so it's renewed for each page or
+		// long histories would be cut off part way through
+		controller.SetWriteDeadline(time.Now().Add(env.WriteTimeout))
+		for _, login := range logins {
+			if format == "csv" {
+				err = writer.Write(exportCSVRow(login))
+			} else {
+				err = encoder.Encode(login)
+			}
+			if err != nil {
+				// The client has gone away
+				return
+			}
+		}
+		writer.Flush()
+		controller.Flush()
+		exported += len(logins)
+		if len(logins) < exportPageSize {
+			break
+		}
+
+		// Carry on from the last login exported, after any others at the same time
+		last := logins[len(logins)-1]
+		opts.Since, opts.AfterID = last.UnixTimestamp, last.Id
+		if logins, err = env.store.LoginsByUsername(ctx, username, opts); err != nil {
+			env.logFor(ctx).Error("could not load logins", "user", hashUsername(username), "exported", exported, "error", err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	env.logFor(ctx).Info("exported logins", "user", hashUsername(username), "exported", exported)
+}
+
+func exportCSVRow(login *models.Login) []string {
+	var radius string
+	if login.Radius != nil {
+		radius = strconv.Itoa(int(*login.Radius))
+	}
+	return []string{
+		login.Username,
+		strconv.FormatInt(login.UnixTimestamp, 10),
+		login.EventUUID,
+		login.IPAddr,
+		strconv.FormatFloat(login.Lat, 'f', -1, 64),
+		strconv.FormatFloat(login.Lon, 'f', -1, 64),
+		radius,
+		login.TimeZone,
+		login.CountryISO,
+		login.City,
+		login.Country,
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"detector/models"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	seedLogins(t, memEnv,
+		models.Login{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: accuracyRadius(10), TimeZone: "America/New_York", CountryISO: "US", City: "Halethorpe", Country: "United States"},
+		models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)},
+		models.Login{Username: "bob", UnixTimestamp: 1514700000, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "10.0.0.1"},
+		models.Login{Username: "alice", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000d", IPAddr: "206.81.252.6"},
+	)
+
+	rr := getPath(t, memEnv, "/v1/export/bob")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if rr.Header().Get("Content-Type") != "application/x-ndjson" || rr.Header().Get("Content-Disposition") != `attachment; filename=bob-logins.ndjson` {
+		t.Errorf("unexpected headers: got %v", rr.Header())
+	}
+	var logins []models.Login
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var login models.Login
+		if err := json.Unmarshal(scanner.Bytes(), &login); err != nil {
+			t.Fatalf("%s: %v", scanner.Text(), err)
+		}
+		logins = append(logins, login)
+	}
+	if len(logins) != 3 || logins[0].EventUUID != "00000000-0000-4000-8000-00000000000a" || logins[2].City != "Halethorpe" || logins[1].Radius != nil {
+		t.Errorf("expected bob's logins oldest first, got %+v", logins)
+	}
+
+	rr = getPath(t, memEnv, "/v1/export/bob?format=csv")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/csv; charset=utf-8" || rr.Header().Get("Content-Disposition") != `attachment; filename=bob-logins.csv` {
+		t.Fatalf("unexpected CSV response: got %v %v", rr.Code, rr.Header())
+	}
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"bob", "1514764800", "00000000-0000-4000-8000-00000000000b", "206.81.252.6", "39.2293", "-76.6907", "10", "America/New_York", "US", "Halethorpe", "United States"}
+	if len(records) != 4 || fmt.Sprint(records[0]) != fmt.Sprint(exportCSVHeader) || fmt.Sprint(records[3]) != fmt.Sprint(want) || records[2][6] != "" {
+		t.Errorf("unexpected CSV export: got %q", records)
+	}
+
+	if rr := getPath(t, memEnv, "/v1/export/nobody"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected a user with no logins to be a 404, got %v", rr.Code)
+	}
+	if rr := getPath(t, memEnv, "/v1/export/bob?format=xml"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown format to be rejected, got %v", rr.Code)
+	}
+}
+
+// Longer histories are read a page at a time, resuming after logins that share a timestamp
+func TestExportPages(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	rows := make([]models.Login, 2*exportPageSize+1)
+	for i := range rows {
+		rows[i] = models.Login{Username: "bob", UnixTimestamp: 1514764800 + int64(i/3), EventUUID: fmt.Sprintf("00000000-0000-4000-8000-%012d", i), IPAddr: "206.81.252.6"}
+	}
+	if _, err := memEnv.store.InsertLogins(context.Background(), rows); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := getPath(t, memEnv, "/v1/export/bob")
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var login models.Login
+		if err := json.Unmarshal(scanner.Bytes(), &login); err != nil {
+			t.Fatal(err)
+		}
+		if seen[login.EventUUID] {
+			t.Fatalf("%v was exported twice", login.EventUUID)
+		}
+		seen[login.EventUUID] = true
+	}
+	if len(seen) != len(rows) {
+		t.Errorf("expected all %v logins to be exported, got %v", len(rows), len(seen))
+	}
+}
+
+func TestExportNeedsAPIKey(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.APIKeys = []string{"first-key"}
+	if rr := getPath(t, memEnv, "/v1/export/bob"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected a request without a key to be refused, got %v", rr.Code)
+	}
+}
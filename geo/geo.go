@@ -1,15 +1,29 @@
 package geo
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/oschwald/geoip2-golang"
 )
 
 func NewGeo(dataSourceName string) (*geoip2.Reader, error) {
+	// Check up front so a missing file gets a clearer error than the reader's open failure
+	if _, err := os.Stat(dataSourceName); err != nil {
+		return nil, fmt.Errorf("GeoIP database %q not found: %v", dataSourceName, err)
+	}
 	db, err := geoip2.Open(dataSourceName)
 	if err != nil {
-		if err != nil {
-			return nil, err
-		}
+		return nil, fmt.Errorf("opening GeoIP database %q: %v", dataSourceName, err)
 	}
 	return db, nil
-}
\ No newline at end of file
+}
+
+// Opens the optional ASN database. An empty path means ASN lookups are turned off, and
+// returns a nil reader.
+func NewASN(dataSourceName string) (*geoip2.Reader, error) {
+	if dataSourceName == "" {
+		return nil, nil
+	}
+	return NewGeo(dataSourceName)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// What readiness does once the GeoIP database is older than GeoMaxAge
+const (
+	// Stays ready, reporting the database as stale and logging a warning
+	geoStaleWarn = "warn"
+	// Reports not ready until a newer database is loaded
+	geoStaleUnready = "unready"
+)
+
+// Implemented by resolvers whose data was built at a known time, like MaxMind databases
+type geoBuildDater interface {
+	BuildTime() time.Time
+}
+
+// When the City database was built, from its metadata
+func (r *maxmindResolver) BuildTime() time.Time {
+	return time.Unix(int64(r.city.Metadata().BuildEpoch), 0)
+}
+
+// When the current resolver's data was built. The bool is false when it doesn't say, or
+// there's no resolver open.
+func (env *Env) geoBuildTime() (time.Time, bool) {
+	env.geoMu.RLock()
+	defer env.geoMu.RUnlock()
+
+	dater, ok := env.resolver.(geoBuildDater)
+	if !ok {
+		return time.Time{}, false
+	}
+	return dater.BuildTime(), true
+}
+
+// Whether the GeoIP data is older than GeoMaxAge. Unset, or with no build time, it never is.
+func (env *Env) geoStale(built time.Time) bool {
+	return env.GeoMaxAge > 0 && env.now().Sub(built) > env.GeoMaxAge
+}
+
+// Sets the GeoIP build time gauge from the current resolver, and warns if it's stale. Called
+// when the database is opened and each time it's reloaded.
+func (env *Env) recordGeoBuild() {
+	built, ok := env.geoBuildTime()
+	if !ok {
+		return
+	}
+	env.metrics.geoBuilt(built)
+	if env.geoStale(built) {
+		env.logFor(context.Background()).Warn("GeoIP database is stale", "path", env.GeoPath, "built", built.UTC().Format(time.RFC3339), "max_age", env.GeoMaxAge.String())
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"detector/geo"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Returned by lookups once the GeoIP database has been closed
+var errNoGeoDB = errors.New("GeoIP database is not open")
+
+// Where an IP address is, as far as a GeoResolver knows. Zero values are unknown: an
+// address it has no record of comes back as an empty result, not an error.
+type GeoResult struct {
+	Lat    float64
+	Lon    float64
+	Radius uint16 // km
+	// English names
+	City        string
+	Subdivision string
+	Country     string
+	CountryISO  string
+	TimeZone    string // IANA name
+	// The autonomous system the address belongs to, when the provider knows it
+	ASN uint
+	Org string
+}
+
+// Looks up IP addresses' locations. MaxMind databases are the default provider; others
+// (another database format, a remote API, a fixed table in tests) only need this.
+type GeoResolver interface {
+	// Errors are for failed lookups, not unknown addresses
+	Resolve(ip net.IP) (GeoResult, error)
+	Close() error
+}
+
+// Resolves addresses from a MaxMind City database, and an optional ASN database
+type maxmindResolver struct {
+	city *geoip2.Reader
+	// Nil when no ASN database is configured
+	asn    *geoip2.Reader
+	logger *slog.Logger
+}
+
+// Opens the MaxMind databases at cityPath and, unless it's empty, asnPath. The City
+// database must pass selfTestGeo, so a truncated or wrong file is caught when it's opened
+// rather than on the first login.
+func newMaxMindResolver(cityPath, asnPath string, logger *slog.Logger) (*maxmindResolver, error) {
+	city, err := geo.NewGeo(cityPath)
+	if err != nil {
+		return nil, err
+	}
+	asn, err := geo.NewASN(asnPath)
+	if err != nil {
+		city.Close()
+		return nil, err
+	}
+	r := &maxmindResolver{city: city, asn: asn, logger: logger}
+	if err := selfTestGeo(r); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("GeoIP database %q failed its self-test: %v", cityPath, err)
+	}
+	return r, nil
+}
+
+// Checks r places readinessProbeIP, which any real City database knows, somewhere on Earth
+func selfTestGeo(r GeoResolver) error {
+	result, err := r.Resolve(readinessProbeIP)
+	if err != nil {
+		return fmt.Errorf("could not resolve %v: %v", readinessProbeIP, err)
+	}
+	if result.Lat == 0 && result.Lon == 0 {
+		return fmt.Errorf("no location for %v", readinessProbeIP)
+	}
+	if math.Abs(result.Lat) > 90 || math.Abs(result.Lon) > 180 {
+		return fmt.Errorf("implausible location %v,%v for %v", result.Lat, result.Lon, readinessProbeIP)
+	}
+	return nil
+}
+
+func (r *maxmindResolver) Resolve(ip net.IP) (GeoResult, error) {
+	record, err := r.city.City(ip)
+	if err != nil {
+		return GeoResult{}, err
+	}
+	result := GeoResult{
+		Lat:        record.Location.Latitude,
+		Lon:        record.Location.Longitude,
+		Radius:     record.Location.AccuracyRadius,
+		City:       record.City.Names["en"],
+		Country:    record.Country.Names["en"],
+		CountryISO: record.Country.IsoCode,
+		TimeZone:   record.Location.TimeZone,
+	}
+	if len(record.Subdivisions) > 0 {
+		result.Subdivision = record.Subdivisions[0].Names["en"]
+	}
+	if r.asn != nil {
+		// The location is what matters, so a failed ASN lookup just leaves the fields out
+		if asn, err := r.asn.ASN(ip); err != nil {
+			// Logged without the address, which identifies the user
+			r.logger.Debug("ASN lookup failed", "error", err)
+		} else {
+			result.ASN, result.Org = asn.AutonomousSystemNumber, asn.AutonomousSystemOrganization
+		}
+	}
+	return result, nil
+}
+
+func (r *maxmindResolver) Close() error {
+	if r.asn != nil {
+		r.asn.Close()
+	}
+	return r.city.Close()
+}
+
+// Looks ip up with the current resolver. The read lock is held for the whole lookup, so a
+// reload can't close the resolver while it's in use.
+func (env *Env) resolve(ip net.IP) (GeoResult, error) {
+	env.geoMu.RLock()
+	defer env.geoMu.RUnlock()
+
+	if env.resolver == nil {
+		return GeoResult{}, errNoGeoDB
+	}
+	return env.resolver.Resolve(ip)
+}
+
+// Reopens the MaxMind databases from GeoPath and ASNPath and swaps them in, closing the
+// old resolver once no lookups are using it. If either new file can't be opened the
+// current one is kept.
+func (env *Env) reloadGeo() error {
+	resolver, err := newMaxMindResolver(env.GeoPath, env.ASNPath, env.logger)
+	if err != nil {
+		return err
+	}
+
+	env.geoMu.Lock()
+	old := env.resolver
+	env.resolver = resolver
+	env.geoMu.Unlock()
+	env.recordGeoBuild()
+
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// Reloads the GeoIP database each time a signal (SIGHUP) arrives
+func (env *Env) reloadGeoOnSignal(signals <-chan os.Signal) {
+	logger := env.logFor(context.Background())
+	for range signals {
+		if err := env.reloadGeo(); err != nil {
+			logger.Error("could not reload GeoIP database", "path", env.GeoPath, "error", err)
+			continue
+		}
+		logger.Info("reloaded GeoIP database", "path", env.GeoPath)
+	}
+}
+
+// GeoIP records report a missing accuracy radius as 0, which is kept as unknown (nil)
+// rather than a radius of zero
+func accuracyRadius(km uint16) *uint16 {
+	if km == 0 {
+		return nil
+	}
+	return &km
+}
+
+// An unknown radius counts as zero
+func radiusKm(radius *uint16) float64 {
+	if radius == nil {
+		return 0
+	}
+	return float64(*radius)
+}
+
+// Loaded *time.Location values by IANA name, so each zone's rules are only read once
+var locations sync.Map
+
+// Formats ts as RFC 3339 in the named time zone, or returns "" when the zone is empty or
+// not in the system's time zone database
+func localTime(ts int64, zone string) string {
+	if zone == "" {
+		return ""
+	}
+	loc, ok := locations.Load(zone)
+	if !ok {
+		l, err := time.LoadLocation(zone)
+		if err != nil {
+			return ""
+		}
+		loc, _ = locations.LoadOrStore(zone, l)
+	}
+	return time.Unix(ts, 0).In(loc.(*time.Location)).Format(time.RFC3339)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"detector/geo"
+	"detector/models"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Lookups running while the database is reloaded should all succeed, whichever reader
+// they end up using
+func TestReloadGeoMidFlight(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	resolver, err := newMaxMindResolver("./geo/GeoLite2-City.mmdb", "", memEnv.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reloading closes the resolver, so don't share the one the other tests use
+	memEnv.resolver = resolver
+	memEnv.GeoPath = "./geo/GeoLite2-City.mmdb"
+	defer memEnv.close()
+
+	ip := net.ParseIP("8.8.8.8")
+	done := make(chan struct{})
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				result, err := memEnv.resolve(ip)
+				if err == nil && result.Lat != 37.751 {
+					err = errNoGeoDB
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := memEnv.reloadGeo(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("lookup failed during reload: %v", err)
+	}
+}
+
+func TestReloadGeoKeepsReaderOnError(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	resolver, err := newMaxMindResolver("./geo/GeoLite2-City.mmdb", "", memEnv.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memEnv.resolver = resolver
+	memEnv.GeoPath = "./geo/missing.mmdb"
+	defer memEnv.close()
+
+	if err := memEnv.reloadGeo(); err == nil {
+		t.Errorf("expected reloading a missing file to fail")
+	}
+	if _, err := memEnv.resolve(net.ParseIP("8.8.8.8")); err != nil {
+		t.Errorf("the existing resolver should still be usable: %v", err)
+	}
+}
+
+func TestSelfTestGeo(t *testing.T) {
+	tests := []struct {
+		name   string
+		result GeoResult
+		ok     bool
+	}{
+		{"plausible", GeoResult{Lat: 37.751, Lon: -97.822}, true},
+		{"no location", GeoResult{}, false},
+		{"out of range", GeoResult{Lat: 91, Lon: 10}, false},
+	}
+
+	for _, tc := range tests {
+		r := staticResolver{results: map[string]GeoResult{readinessProbeIP.String(): tc.result}}
+		if err := selfTestGeo(r); (err == nil) != tc.ok {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+	if err := selfTestGeo(staticResolver{err: errors.New("corrupt")}); err == nil {
+		t.Errorf("expected a failed lookup to fail the self-test")
+	}
+}
+
+// The fixture ASN database maps 8.8.8.0/24 to AS15169 GOOGLE, 1.1.1.0/24 to AS13335
+// CLOUDFLARENET and 206.81.252.0/24 to AS6939 HURRICANE
+const testASNPath = "./testData/GeoLite2-ASN-Test.mmdb"
+
+func TestASNEnrichment(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	resolver, err := newMaxMindResolver("./geo/GeoLite2-City.mmdb", testASNPath, memEnv.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memEnv.resolver = resolver
+	defer resolver.Close()
+
+	jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000a", "ip_address": "8.8.8.8"}`)
+	req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+
+	expected := `"current_geo":{"lat":37.751,"lon":-97.822,"radius":1000,"city":"","subdivision":"","country":"United States","country_iso":"US","time_zone":"America/Chicago","local_time":"2017-12-31T18:00:00-06:00","asn":15169,"org":"GOOGLE"}`
+	if !strings.Contains(rr.Body.String(), expected) {
+		t.Errorf("handler returned unexpected body: got %v want it to contain %v", rr.Body.String(), expected)
+	}
+
+	// Addresses the ASN database doesn't know are still answered, just without the fields
+	if result, err := memEnv.resolve(net.ParseIP("24.242.71.20")); err != nil || result.ASN != 0 || result.Org != "" {
+		t.Errorf("unexpected ASN for an unknown address: got %+v, %v", result, err)
+	}
+}
+
+func TestNewASNOptional(t *testing.T) {
+	asnDB, err := geo.NewASN("")
+	if asnDB != nil || err != nil {
+		t.Errorf("an empty path should disable ASN lookups: got %v, %v", asnDB, err)
+	}
+	if _, err := geo.NewASN("./geo/missing.mmdb"); err == nil {
+		t.Errorf("expected a missing ASN database to be an error")
+	}
+}
+
+func TestLocationNames(t *testing.T) {
+	tests := []struct {
+		ip                                     string
+		city, subdivision, country, countryISO string
+	}{
+		{"206.81.252.6", "Halethorpe", "Maryland", "United States", "US"},
+		// Only known to country level
+		{"8.8.8.8", "", "", "United States", "US"},
+	}
+
+	for _, tc := range tests {
+		cg, _, err := env.locate(context.Background(), net.ParseIP(tc.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cg.City != tc.city || cg.Subdivision != tc.subdivision || cg.Country != tc.country || cg.CountryISO != tc.countryISO {
+			t.Errorf("%s: unexpected names: got %q, %q, %q, %q", tc.ip, cg.City, cg.Subdivision, cg.Country, cg.CountryISO)
+		}
+	}
+}
+
+func TestLocalTime(t *testing.T) {
+	tests := []struct {
+		ts   int64
+		zone string
+		want string
+	}{
+		{1514764800, "America/New_York", "2017-12-31T19:00:00-05:00"},
+		// Daylight saving time
+		{1530403200, "America/New_York", "2018-06-30T20:00:00-04:00"},
+		{1514764800, "Asia/Kolkata", "2018-01-01T05:30:00+05:30"},
+		{1514764800, "UTC", "2018-01-01T00:00:00Z"},
+		{1514764800, "", ""},
+		{1514764800, "Mars/Olympus_Mons", ""},
+	}
+
+	for _, tc := range tests {
+		if got := localTime(tc.ts, tc.zone); got != tc.want {
+			t.Errorf("%v in %q: got %q want %q", tc.ts, tc.zone, got, tc.want)
+		}
+	}
+}
+
+// Resolves addresses from a fixed table, or fails every lookup with err
+type staticResolver struct {
+	results map[string]GeoResult
+	err     error
+}
+
+func (r staticResolver) Resolve(ip net.IP) (GeoResult, error) {
+	if r.err != nil {
+		return GeoResult{}, r.err
+	}
+	return r.results[ip.String()], nil
+}
+
+func (r staticResolver) Close() error { return nil }
+
+func TestStaticResolver(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.resolver = staticResolver{results: map[string]GeoResult{
+		"198.51.100.1": {Lat: 51.5074, Lon: -0.1278, Radius: 10, City: "London", Country: "United Kingdom", CountryISO: "GB", TimeZone: "Europe/London", ASN: 64500, Org: "EXAMPLE"},
+		"203.0.113.1":  {Lat: -33.8688, Lon: 151.2093, Radius: 10, City: "Sydney", Country: "Australia", CountryISO: "AU", TimeZone: "Australia/Sydney"},
+	}}
+
+	rr := postBatch(t, memEnv, `[
+		{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000a", "ip_address": "198.51.100.1"},
+		{"username": "bob", "unix_timestamp": 1514768400, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "203.0.113.1"},
+		{"username": "bob", "unix_timestamp": 1514772000, "event_uuid": "00000000-0000-4000-8000-00000000000c", "ip_address": "192.0.2.1"}
+	]`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	for _, expected := range []string{
+		`"current_geo":{"lat":51.5074,"lon":-0.1278,"radius":10,"city":"London","subdivision":"","country":"United Kingdom","country_iso":"GB","time_zone":"Europe/London","local_time":"2018-01-01T00:00:00Z","asn":64500,"org":"EXAMPLE"}`,
+		// London to Sydney in an hour
+		`"travel_to_current_geo_suspicious":true`,
+		// Addresses the resolver doesn't know have no location
+		`"geo_unavailable":true`,
+	} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("handler returned unexpected body: got %v want it to contain %v", rr.Body.String(), expected)
+		}
+	}
+}
+
+// An address the database has only an empty record for is saved unlocated, not at 0,0
+func TestEmptyGeoRecord(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.resolver = staticResolver{results: map[string]GeoResult{
+		"206.81.252.6":   {Lat: 39.2293, Lon: -76.6907, Radius: 10, City: "Halethorpe", Country: "United States", CountryISO: "US"},
+		"91.207.175.104": {Country: "United States", CountryISO: "US"},
+	}}
+	seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)})
+
+	rr := postBatch(t, memEnv, `[
+		{"username": "bob", "unix_timestamp": 1514677280, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "91.207.175.104"},
+		{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000c", "ip_address": "206.81.252.6"}
+	]`)
+	var results []batchResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || len(results) != 2 {
+		t.Fatalf("unexpected batch response: %s", rr.Body.String())
+	}
+	if r := results[0].Result; r == nil || !r.GeoUnavailable || r.Reason != reasonNoGeoData || r.CurrentGeo != nil || r.Suspicious {
+		t.Errorf("expected the empty record to leave the login unlocated, got %+v", results[0])
+	}
+	// Austin to Baltimore, skipping the unlocated login rather than measuring from the Gulf of Guinea
+	if r := results[1].Result; r == nil || r.PrecedingIpAccess == nil || r.PrecedingIpAccess.IP != "24.242.71.20" || r.Suspicious {
+		t.Errorf("expected the next login to be checked against Austin, got %+v", results[1])
+	}
+	stored, err := memEnv.store.LoginByEventUUID(context.Background(), "00000000-0000-4000-8000-00000000000b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == nil || stored.HasLocation() || stored.CountryISO != "US" {
+		t.Errorf("expected the login to be saved without a location, got %+v", stored)
+	}
+
+	// Or turned away, when empty records are errors
+	memEnv.GeoNoLocation = geoNoLocationError
+	rr = postBatch(t, memEnv, `[{"username": "bob", "unix_timestamp": 1514764801, "event_uuid": "00000000-0000-4000-8000-00000000000d", "ip_address": "91.207.175.104"}]`)
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || len(results) != 1 {
+		t.Fatalf("unexpected batch response: %s", rr.Body.String())
+	}
+	if e := results[0].Error; e == nil || e.Code != codeGeoUnavailable {
+		t.Errorf("expected a geo_unavailable error, got %+v", results[0])
+	}
+	if stored, _ := memEnv.store.LoginByEventUUID(context.Background(), "00000000-0000-4000-8000-00000000000d"); stored != nil {
+		t.Errorf("expected the login not to be saved, got %+v", stored)
+	}
+	if status := errorStatus(errNoGeoLocation); status != http.StatusUnprocessableEntity {
+		t.Errorf("expected a 422, got %v", status)
+	}
+}
+
+func TestNeighbourLocationNames(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.resolver = staticResolver{results: map[string]GeoResult{
+		"198.51.100.1": {Lat: 51.5074, Lon: -0.1278, Radius: 10, City: "London", Country: "United Kingdom", CountryISO: "GB"},
+		"203.0.113.1":  {Lat: 35.6762, Lon: 139.6503, Radius: 10, City: "Tokyo", Country: "Japan", CountryISO: "JP"},
+	}}
+
+	rr := postBatch(t, memEnv, `[
+		{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000a", "ip_address": "198.51.100.1"},
+		{"username": "bob", "unix_timestamp": 1514768400, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "203.0.113.1"},
+		{"username": "bob", "unix_timestamp": 1514764000, "event_uuid": "00000000-0000-4000-8000-00000000000c", "ip_address": "203.0.113.1"}
+	]`)
+	var results []batchResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || len(results) != 3 {
+		t.Fatalf("unexpected response: %v %s", rr.Code, rr.Body.String())
+	}
+	// The names are the ones saved with the neighbours, not looked up again
+	if p := results[1].Result.PrecedingIpAccess; p == nil || p.City != "London" || p.Country != "United Kingdom" {
+		t.Errorf("expected the preceding login to be in London, got %+v", p)
+	}
+	if s := results[2].Result.SubsequentIpAccess; s == nil || s.City != "London" || s.Country != "United Kingdom" {
+		t.Errorf("expected the subsequent login to be in London, got %+v", s)
+	}
+}
+
+func TestResolverError(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.resolver = staticResolver{err: errors.New("provider unreachable")}
+
+	jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000a", "ip_address": "198.51.100.1"}`)
+	req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+	if rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), `"code":"`+codeGeoUnavailable+`"`) {
+		t.Errorf("expected a failed lookup to be a geo_unavailable error, got %v %s", rr.Code, rr.Body.String())
+	}
+	if rr := getPath(t, memEnv, "/readyz"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected not to be ready while lookups fail, got %v", rr.Code)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Middleware that decompresses request bodies sent with "Content-Encoding: gzip" and
+// gzips responses for clients that send "Accept-Encoding: gzip". Requests and responses
+// without the headers are passed through as they are.
+func (env *Env) withGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, request *http.Request) {
+		switch encoding := strings.ToLower(strings.TrimSpace(request.Header.Get("Content-Encoding"))); encoding {
+		case "", "identity":
+		case "gzip":
+			body, err := gzip.NewReader(request.Body)
+			if err != nil {
+				writeError(rw, http.StatusBadRequest, codeInvalidJSON, "invalid gzip body")
+				return
+			}
+			defer body.Close()
+			// The body limit is applied after this, so it counts decompressed bytes
+			request.Body = body
+			request.Header.Del("Content-Encoding")
+			request.ContentLength = -1
+		default:
+			writeError(rw, http.StatusUnsupportedMediaType, codeUnsupportedEncoding, "unsupported Content-Encoding "+strconv.Quote(encoding)+", only gzip is")
+			return
+		}
+
+		// The response depends on Accept-Encoding, so caches mustn't share it across encodings
+		rw.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(request.Header.Get("Accept-Encoding")) || request.Method == "HEAD" {
+			next.ServeHTTP(rw, request)
+			return
+		}
+		gz := &gzipWriter{ResponseWriter: rw}
+		defer gz.close()
+		next.ServeHTTP(gz, request)
+	})
+}
+
+// Reports whether an Accept-Encoding header allows gzip, e.g. "gzip, deflate" but not "gzip;q=0"
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := strings.TrimSpace(params)
+		if v, ok := strings.CutPrefix(q, "q="); ok {
+			if weight, err := strconv.ParseFloat(v, 64); err == nil && weight == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Compresses whatever the handler writes. The headers are set once the status is known,
+// so bodiless responses aren't marked as gzipped.
+type gzipWriter struct {
+	http.ResponseWriter
+	writer      *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if status != http.StatusNoContent && status != http.StatusNotModified {
+		w.Header().Set("Content-Encoding", "gzip")
+		// Set for the uncompressed body
+		w.Header().Del("Content-Length")
+		w.writer = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.writer == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.writer.Write(b)
+}
+
+// Sends what's been written so far, so streamed responses reach the client as they're written
+func (w *gzipWriter) Flush() {
+	if w.writer != nil {
+		w.writer.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Lets http.ResponseController reach the connection, e.g. to set write deadlines
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipWriter) close() error {
+	if w.writer == nil {
+		return nil
+	}
+	return w.writer.Close()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"detector/models"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, s string) *bytes.Buffer {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func gunzipped(t *testing.T, rr *httptest.ResponseRecorder) []byte {
+	if rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a gzipped response, got headers %v", rr.Header())
+	}
+	gz, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestGzipPost(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	req, err := http.NewRequest("POST", "/v1/", gzipped(t, `{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	rr := httptest.NewRecorder()
+	memEnv.routes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if rr.Header().Get("Content-Length") != "" {
+		t.Errorf("expected the uncompressed Content-Length to be dropped, got %v", rr.Header().Get("Content-Length"))
+	}
+	var result loginResult
+	if err := json.Unmarshal(gunzipped(t, rr), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.CurrentGeo == nil || result.CurrentGeo.City != "Halethorpe" {
+		t.Errorf("unexpected result: got %+v", result)
+	}
+}
+
+func TestGzipBatchAndHistory(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	req, err := http.NewRequest("POST", "/v1/batch", gzipped(t, `[
+		{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000a", "ip_address": "206.81.252.6"},
+		{"username": "bob", "unix_timestamp": 1514764801, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "91.207.175.104"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	memEnv.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("expected a plain 200 without Accept-Encoding, got %v %v", rr.Code, rr.Header())
+	}
+
+	req, err = http.NewRequest("GET", "/v1/logins/bob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	memEnv.routes().ServeHTTP(rr, req)
+	var logins []models.Login
+	if err := json.Unmarshal(gunzipped(t, rr), &logins); err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 2 {
+		t.Errorf("expected both batched logins in the history, got %+v", logins)
+	}
+}
+
+func TestGzipRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		body     *bytes.Buffer
+		status   int
+		code     string
+	}{
+		{"not gzip", "gzip", bytes.NewBufferString(`{"username": "bob"}`), http.StatusBadRequest, codeInvalidJSON},
+		{"other encoding", "br", bytes.NewBufferString(`{"username": "bob"}`), http.StatusUnsupportedMediaType, codeUnsupportedEncoding},
+		// Decompressed, the body is over the limit
+		{"too large once decompressed", "gzip", gzipped(t, `{"username": "`+strings.Repeat("a", 4096)+`"}`), http.StatusRequestEntityTooLarge, codeBodyTooLarge},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		memEnv.MaxBodyBytes = 1024
+		req, err := http.NewRequest("POST", "/v1/", tc.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Encoding", tc.encoding)
+		rr := httptest.NewRecorder()
+		memEnv.routes().ServeHTTP(rr, req)
+		if rr.Code != tc.status || !strings.Contains(rr.Body.String(), `"code":"`+tc.code+`"`) {
+			t.Errorf("%s: got %v %s want %v %v", tc.name, rr.Code, rr.Body.String(), tc.status, tc.code)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"gzip", true},
+		{"deflate, GZIP;q=0.5", true},
+		{"*", true},
+		{"gzip;q=0", false},
+		{"deflate, br", false},
+		{"", false},
+	}
+
+	for _, tc := range tests {
+		if got := acceptsGzip(tc.header); got != tc.want {
+			t.Errorf("%q: got %v want %v", tc.header, got, tc.want)
+		}
+	}
+}
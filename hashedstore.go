@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"detector/models"
+	"encoding/hex"
+)
+
+// Shortest UsernameHashKey accepted
+const minUsernameHashKey = 16
+
+// A Store that saves a keyed hash (HMAC-SHA256) of each username in place of the username
+// itself. Lookups for a user hash the username they're given the same way, and what they
+// read back carries that username again, so callers never see the hashes. Reads that span
+// users (AllLogins, LoginByEventUUID, DistinctUsernames) can only return the hashes.
+type hashedStore struct {
+	models.Store
+	key []byte
+}
+
+// The username as it's stored: the hex HMAC-SHA256 of it under the key
+func (s hashedStore) hash(username string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(username))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Whether stored, a username read back by a lookup that spans users, is username. From a
+// hashedStore it's the hash.
+func (env *Env) isStoredUsername(stored, username string) bool {
+	if hashed, ok := env.store.(hashedStore); ok {
+		return stored == hashed.hash(username)
+	}
+	return stored == username
+}
+
+// Puts username back on logins read for it
+func withUsername(logins []*models.Login, username string) []*models.Login {
+	for _, login := range logins {
+		login.Username = username
+	}
+	return logins
+}
+
+func (s hashedStore) InsertLogin(ctx context.Context, row models.Login) error {
+	row.Username = s.hash(row.Username)
+	return s.Store.InsertLogin(ctx, row)
+}
+
+func (s hashedStore) InsertLogins(ctx context.Context, rows []models.Login) (int64, error) {
+	hashed := make([]models.Login, len(rows))
+	for i, row := range rows {
+		row.Username = s.hash(row.Username)
+		hashed[i] = row
+	}
+	return s.Store.InsertLogins(ctx, hashed)
+}
+
+func (s hashedStore) LoginsByUsername(ctx context.Context, username string, opts models.ListOptions) ([]*models.Login, error) {
+	logins, err := s.Store.LoginsByUsername(ctx, s.hash(username), opts)
+	return withUsername(logins, username), err
+}
+
+func (s hashedStore) AdjacentLogins(ctx context.Context, cLogin models.Login) (models.Login, models.Login, error) {
+	username := cLogin.Username
+	cLogin.Username = s.hash(username)
+	prevLogin, postLogin, err := s.Store.AdjacentLogins(ctx, cLogin)
+	// A side without a neighbour is left as a zero Login
+	if len(prevLogin.Username) != 0 {
+		prevLogin.Username = username
+	}
+	if len(postLogin.Username) != 0 {
+		postLogin.Username = username
+	}
+	return prevLogin, postLogin, err
+}
+
+func (s hashedStore) NeighborLogins(ctx context.Context, cLogin models.Login, n int) ([]*models.Login, []*models.Login, error) {
+	username := cLogin.Username
+	cLogin.Username = s.hash(username)
+	before, after, err := s.Store.NeighborLogins(ctx, cLogin, n)
+	return withUsername(before, username), withUsername(after, username), err
+}
+
+func (s hashedStore) DeleteUser(ctx context.Context, username string) (models.DeletedUser, error) {
+	return s.Store.DeleteUser(ctx, s.hash(username))
+}
+
+func (s hashedStore) TrimLogins(ctx context.Context, username string, keep int) (int64, error) {
+	return s.Store.TrimLogins(ctx, s.hash(username), keep)
+}
+
+func (s hashedStore) InsertDetection(ctx context.Context, d models.Detection) error {
+	d.Username = s.hash(d.Username)
+	return s.Store.InsertDetection(ctx, d)
+}
+
+func (s hashedStore) DetectionsByUsername(ctx context.Context, username string) ([]*models.Detection, error) {
+	detections, err := s.Store.DetectionsByUsername(ctx, s.hash(username))
+	for _, d := range detections {
+		d.Username = username
+	}
+	return detections, err
+}
+
+func (s hashedStore) UserStats(ctx context.Context, username string) (models.UserStats, error) {
+	return s.Store.UserStats(ctx, s.hash(username))
+}
+
+func (s hashedStore) LastAlert(ctx context.Context, username string) (*models.Alert, error) {
+	alert, err := s.Store.LastAlert(ctx, s.hash(username))
+	if alert != nil {
+		alert.Username = username
+	}
+	return alert, err
+}
+
+func (s hashedStore) SetLastAlert(ctx context.Context, alert models.Alert) error {
+	alert.Username = s.hash(alert.Username)
+	return s.Store.SetLastAlert(ctx, alert)
+}
+
+func (s hashedStore) SetHome(ctx context.Context, home models.Home) error {
+	home.Username = s.hash(home.Username)
+	return s.Store.SetHome(ctx, home)
+}
+
+func (s hashedStore) HomeByUsername(ctx context.Context, username string) (*models.Home, error) {
+	home, err := s.Store.HomeByUsername(ctx, s.hash(username))
+	if home != nil {
+		home.Username = username
+	}
+	return home, err
+}
+
+func (s hashedStore) SetThreshold(ctx context.Context, threshold models.Threshold) error {
+	threshold.Username = s.hash(threshold.Username)
+	return s.Store.SetThreshold(ctx, threshold)
+}
+
+func (s hashedStore) ThresholdByUsername(ctx context.Context, username string) (*models.Threshold, error) {
+	threshold, err := s.Store.ThresholdByUsername(ctx, s.hash(username))
+	if threshold != nil {
+		threshold.Username = username
+	}
+	return threshold, err
+}
+
+// Writes audit records to a sink outside the store with their usernames hashed as the
+// store hashes them
+type hashedAuditSink struct {
+	auditSink
+	store hashedStore
+}
+
+func (s hashedAuditSink) Record(ctx context.Context, d models.Detection) error {
+	d.Username = s.store.hash(d.Username)
+	return s.auditSink.Record(ctx, d)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"detector/models"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHashedUsernames(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	raw := memEnv.store
+	memEnv.store = hashedStore{Store: raw, key: []byte("0123456789abcdef")}
+	ctx := context.Background()
+
+	seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)})
+	// Baltimore a day after Austin is fine, Los Angeles a second after that isn't
+	for _, tc := range []struct {
+		lr         loginRecord
+		suspicious bool
+	}{
+		{loginRecord{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6"}, false},
+		{loginRecord{Username: "bob", UnixTimestamp: 1514764801, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "91.207.175.104"}, true},
+	} {
+		result, err := memEnv.Evaluate(ctx, tc.lr, evalOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Suspicious != tc.suspicious || result.PrecedingIpAccess == nil {
+			t.Errorf("%s: expected suspicious %v against the preceding login, got %+v", tc.lr.IPAddr, tc.suspicious, result)
+		}
+	}
+
+	// A retry is found by its event_uuid, which is stored as it is, and answered the same
+	result, err := memEnv.Evaluate(ctx, loginRecord{Username: "bob", UnixTimestamp: 1514764801, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "91.207.175.104"}, evalOptions{})
+	if err != nil || !result.Suspicious {
+		t.Errorf("expected the retried login to be suspicious again, got %+v %v", result, err)
+	}
+	if _, err := memEnv.Evaluate(ctx, loginRecord{Username: "alice", UnixTimestamp: 1514764801, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "91.207.175.104"}, evalOptions{}); err != errEventConflict {
+		t.Errorf("expected another user's event_uuid to conflict, got %v", err)
+	}
+
+	stored, err := raw.AllLogins(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 3 {
+		t.Fatalf("expected all three logins to be saved, got %+v", stored)
+	}
+	want := memEnv.store.(hashedStore).hash("bob")
+	for _, login := range stored {
+		if login.Username != want || len(login.Username) != 64 {
+			t.Errorf("expected the stored username to be its HMAC, got %q", login.Username)
+		}
+	}
+	if other := (hashedStore{key: []byte("fedcba9876543210")}).hash("bob"); other == want {
+		t.Errorf("expected a different key to give a different hash")
+	}
+
+	// The history reads back with the username the client asked for
+	rr := getPath(t, memEnv, "/v1/logins/bob")
+	var logins []models.Login
+	if err := json.Unmarshal(rr.Body.Bytes(), &logins); err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 3 || logins[0].Username != "bob" {
+		t.Errorf("unexpected history: %v %s", rr.Code, rr.Body.String())
+	}
+
+	req, err := http.NewRequest("DELETE", "/v1/logins/bob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	memEnv.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"deleted":3,"deleted_by_table":{"logins":3,"detections":0,"homes":0,"alerts":0,"thresholds":0}}` {
+		t.Errorf("unexpected delete response: %v %s", rr.Code, rr.Body.String())
+	}
+	if stored, err := raw.AllLogins(ctx); err != nil || len(stored) != 0 {
+		t.Errorf("expected the hashed logins to be deleted, got %+v %v", stored, err)
+	}
+}
+
+func TestHashedUsernamesPerUserSettings(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.store = hashedStore{Store: memEnv.store, key: []byte("0123456789abcdef")}
+	ctx := context.Background()
+
+	if err := memEnv.store.SetHome(ctx, models.Home{Username: "bob", Lat: 30.3773, Lon: -97.71, Radius: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if rr := getPath(t, memEnv, "/v1/users/bob/home"); rr.Body.String() != `{"username":"bob","lat":30.3773,"lon":-97.71,"radius":100}` {
+		t.Errorf("unexpected home: %v %s", rr.Code, rr.Body.String())
+	}
+	if err := memEnv.store.SetThreshold(ctx, models.Threshold{Username: "bob", SpeedThreshold: 700}); err != nil {
+		t.Fatal(err)
+	}
+	if rr := getPath(t, memEnv, "/v1/users/bob/threshold"); rr.Body.String() != `{"username":"bob","speed_threshold":700}` {
+		t.Errorf("unexpected threshold: %v %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Body of a ready /readyz response
+type readiness struct {
+	Status string `json:"status"`
+	// When the GeoIP database was built, from its metadata, and how long ago that was. Left
+	// out when the resolver doesn't say.
+	GeoBuildEpoch int64 `json:"geoip_build_epoch,omitempty"`
+	GeoAgeSeconds int64 `json:"geoip_age_seconds,omitempty"`
+	// The database is older than GeoMaxAge
+	GeoStale bool `json:"geoip_stale,omitempty"`
+}
+
+// A well-known public address the GeoIP database must be able to resolve to be ready
+var readinessProbeIP = net.ParseIP("8.8.8.8")
+
+func writeStatus(rw http.ResponseWriter, status string) {
+	body, _ := json.Marshal(map[string]string{"status": status})
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(body)
+}
+
+// Liveness check: the process is up and serving requests
+func (env *Env) HandleHealthz(rw http.ResponseWriter, request *http.Request) {
+	writeStatus(rw, "ok")
+}
+
+// Readiness check: the login database answers a ping and the GeoIP database can resolve
+// a known address. Responds 503 if either is unusable, or under the "unready" GeoStalePolicy
+// if the GeoIP database is older than GeoMaxAge.
+func (env *Env) HandleReadyz(rw http.ResponseWriter, request *http.Request) {
+	if err := env.store.Ping(request.Context()); err != nil {
+		env.logFor(request.Context()).Warn("readiness check failed", "error", err)
+		writeError(rw, http.StatusServiceUnavailable, codeUnavailable, "login database unavailable")
+		return
+	}
+	result, err := env.resolve(readinessProbeIP)
+	if err != nil || (result.Lat == 0 && result.Lon == 0) {
+		env.logFor(request.Context()).Warn("readiness check failed", "error", err)
+		writeError(rw, http.StatusServiceUnavailable, codeGeoUnavailable, "GeoIP database unavailable")
+		return
+	}
+
+	ready := readiness{Status: "ready"}
+	if built, ok := env.geoBuildTime(); ok {
+		ready.GeoBuildEpoch = built.Unix()
+		ready.GeoAgeSeconds = int64(env.now().Sub(built) / time.Second)
+		ready.GeoStale = env.geoStale(built)
+	}
+	// Under the "warn" policy the staleness was logged when the database was opened
+	if ready.GeoStale && env.GeoStalePolicy == geoStaleUnready {
+		env.logFor(request.Context()).Warn("readiness check failed", "error", "GeoIP database is stale", "built", ready.GeoBuildEpoch)
+		writeError(rw, http.StatusServiceUnavailable, codeGeoUnavailable, "GeoIP database is older than "+env.GeoMaxAge.String())
+		return
+	}
+	body, _ := json.Marshal(ready)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(body)
+}
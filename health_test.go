@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func getPath(t *testing.T, e *Env, path string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	e.routes().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestHealthz(t *testing.T) {
+	rr := getPath(t, newMemoryEnv(t), "/healthz")
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"status":"ok"}` {
+		t.Errorf("unexpected healthz response: %v %v", rr.Code, rr.Body.String())
+	}
+}
+
+// When the City database fixture was built, from its own metadata
+func fixtureBuildEpoch(t *testing.T) int64 {
+	reader, err := geoip2.Open("./geo/GeoLite2-City.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	return int64(reader.Metadata().BuildEpoch)
+}
+
+func TestReadyz(t *testing.T) {
+	built := fixtureBuildEpoch(t)
+	memEnv := newMemoryEnv(t)
+	memEnv.clock = newFakeClock(built + 3600)
+
+	rr := getPath(t, memEnv, "/readyz")
+	var ready readiness
+	if err := json.Unmarshal(rr.Body.Bytes(), &ready); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK || ready != (readiness{Status: "ready", GeoBuildEpoch: built, GeoAgeSeconds: 3600}) {
+		t.Errorf("unexpected readyz response: %v %v", rr.Code, rr.Body.String())
+	}
+
+	// Resolvers without a build time leave it out
+	memEnv.resolver = staticResolver{results: map[string]GeoResult{readinessProbeIP.String(): {Lat: 37.751, Lon: -97.822}}}
+	if rr := getPath(t, memEnv, "/readyz"); rr.Code != http.StatusOK || rr.Body.String() != `{"status":"ready"}` {
+		t.Errorf("unexpected readyz response without a build time: %v %v", rr.Code, rr.Body.String())
+	}
+}
+
+func TestReadyzStaleGeoIP(t *testing.T) {
+	built := fixtureBuildEpoch(t)
+	tests := []struct {
+		policy string
+		maxAge time.Duration
+		status int
+		body   string
+	}{
+		{geoStaleWarn, 2 * time.Hour, http.StatusOK, `"geoip_age_seconds":10800,"geoip_stale":true}`},
+		{geoStaleUnready, 2 * time.Hour, http.StatusServiceUnavailable, `{"error":{"code":"geo_unavailable","message":"GeoIP database is older than 2h0m0s"}}`},
+		{geoStaleUnready, 4 * time.Hour, http.StatusOK, `"geoip_age_seconds":10800}`},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		memEnv.clock = newFakeClock(built + 3*3600)
+		memEnv.GeoMaxAge, memEnv.GeoStalePolicy = tc.maxAge, tc.policy
+
+		rr := getPath(t, memEnv, "/readyz")
+		if rr.Code != tc.status || !strings.HasSuffix(rr.Body.String(), tc.body) {
+			t.Errorf("%s %v: got %v %s want %v ...%s", tc.policy, tc.maxAge, rr.Code, rr.Body.String(), tc.status, tc.body)
+		}
+	}
+}
+
+func TestGeoBuildMetric(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	registry := prometheus.NewRegistry()
+	memEnv.metrics = newMetrics(registry)
+	memEnv.recordGeoBuild()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "superman_geoip_build_timestamp_seconds" {
+			continue
+		}
+		if got := family.GetMetric()[0].GetGauge().GetValue(); got != float64(fixtureBuildEpoch(t)) {
+			t.Errorf("unexpected GeoIP build time: got %v want %v", got, fixtureBuildEpoch(t))
+		}
+		return
+	}
+	t.Errorf("expected a GeoIP build time gauge, got %v", families)
+}
+
+func TestReadyzNotReady(t *testing.T) {
+	closedDB := newMemoryEnv(t)
+	closedDB.store.Close()
+
+	noGeo := newMemoryEnv(t)
+	noGeo.resolver = nil
+
+	tests := []struct {
+		name     string
+		env      *Env
+		expected string
+	}{
+		{"closed login database", closedDB, `{"error":{"code":"unavailable","message":"login database unavailable"}}`},
+		{"missing GeoIP database", noGeo, `{"error":{"code":"geo_unavailable","message":"GeoIP database unavailable"}}`},
+	}
+	for _, tc := range tests {
+		rr := getPath(t, tc.env, "/readyz")
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.name, rr.Code, http.StatusServiceUnavailable)
+		}
+		if rr.Body.String() != tc.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v", tc.name, rr.Body.String(), tc.expected)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"detector/models"
+	"errors"
+	"math"
+	"net/http"
+)
+
+var errInvalidHome = errors.New("invalid home, lat must be within ±90, lon within ±180 and radius positive")
+
+// Whether login is further from the user's home than its radius, or nil when the user has
+// no home location set. A login outside it comes with the audit record to report.
+func (env *Env) outsideHome(ctx context.Context, login models.Login, opts evalOptions) (*bool, *models.Detection, error) {
+	home, err := env.store.HomeByUsername(ctx, login.Username)
+	if err != nil || home == nil {
+		return nil, nil, err
+	}
+	distance := opts.formula.Distance(home.Lat, home.Lon, login.Lat, login.Lon)
+	outside := distance > home.Radius*1000
+	if !outside {
+		return &outside, nil, nil
+	}
+	// There's no other login, so only the distance from home is recorded
+	d := env.newDetection("home", login, models.Login{}, 0, opts.unit.FromMeters(distance), opts)
+	return &outside, &d, nil
+}
+
+func validHome(home models.Home) bool {
+	return math.Abs(home.Lat) <= 90 && math.Abs(home.Lon) <= 180 && home.Radius > 0 && !math.IsInf(home.Radius, 0)
+}
+
+// Handles PUT /v1/users/{username}/home with a body of {"lat":..,"lon":..,"radius":..}
+// (radius in km), replacing any home the user already has
+func (env *Env) HandlePutHome(rw http.ResponseWriter, request *http.Request) {
+	var home models.Home
+	if err := env.decodeBody(request.Body, &home); err != nil {
+		writeError(rw, invalidStatus(err), errorCode(err), err.Error())
+		return
+	}
+	home.Username = env.usernameVar(request)
+	if !validHome(home) {
+		writeError(rw, http.StatusBadRequest, codeInvalidInput, errInvalidHome.Error())
+		return
+	}
+
+	if err := env.store.SetHome(request.Context(), home); err != nil {
+		env.logFor(request.Context()).Error("could not save home location", "user", hashUsername(home.Username), "error", err)
+		writeError(rw, http.StatusInternalServerError, codeInternal, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	env.writeJSON(rw, request, http.StatusOK, home)
+}
+
+// Handles GET /v1/users/{username}/home
+func (env *Env) HandleGetHome(rw http.ResponseWriter, request *http.Request) {
+	username := env.usernameVar(request)
+	home, err := env.store.HomeByUsername(request.Context(), username)
+	if err != nil {
+		env.logFor(request.Context()).Error("could not load home location", "user", hashUsername(username), "error", err)
+		writeError(rw, http.StatusInternalServerError, codeInternal, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	if home == nil {
+		writeError(rw, http.StatusNotFound, codeNotFound, "no home location set for user")
+		return
+	}
+
+	env.writeJSON(rw, request, http.StatusOK, home)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"detector/models"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Imported logins are saved this many at a time, each batch in its own transaction
+const importBatchSize = 500
+
+// Counts of the rows an import saved and passed over
+type importSummary struct {
+	Imported int64
+	// Malformed or invalid rows, plus events that were already saved
+	Skipped int64
+}
+
+// Loads historical logins from CSV rows of username, unix_timestamp, event_uuid, ip_address
+// (an optional header row is ignored). Each login is located like a POSTed one but not
+// checked for suspicious travel. Malformed rows are logged and skipped.
+func (env *Env) importCSV(ctx context.Context, r io.Reader) (importSummary, error) {
+	logger := env.logFor(ctx)
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var summary importSummary
+	batch := make([]models.Login, 0, importBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		inserted, err := env.store.InsertLogins(ctx, batch)
+		if err != nil {
+			return err
+		}
+		summary.Imported += inserted
+		summary.Skipped += int64(len(batch)) - inserted
+		trimmed := make(map[string]bool)
+		for _, login := range batch {
+			if !trimmed[login.Username] {
+				env.trimLogins(ctx, login.Username)
+				trimmed[login.Username] = true
+			}
+		}
+		batch = batch[:0]
+		logger.Info("import progress", "imported", summary.Imported, "skipped", summary.Skipped)
+		return nil
+	}
+
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if line == 1 && err == nil && len(record) > 0 && strings.EqualFold(record[0], "username") {
+			continue
+		}
+		if err == nil {
+			var login models.Login
+			if login, err = env.importRow(ctx, record); err == nil {
+				batch = append(batch, login)
+			}
+		}
+		if err != nil {
+			logger.Warn("skipping row", "line", line, "error", err)
+			summary.Skipped++
+			// A GeoIP failure would fail every row, so give up instead
+			if err == errGeoLookup {
+				return summary, err
+			}
+			continue
+		}
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return summary, err
+			}
+		}
+	}
+	return summary, flush()
+}
+
+// Validates and locates one CSV row
+func (env *Env) importRow(ctx context.Context, record []string) (models.Login, error) {
+	if len(record) != 4 {
+		return models.Login{}, fmt.Errorf("expected 4 fields, got %v", len(record))
+	}
+	ts, err := strconv.ParseInt(record[1], 10, 64)
+	if err != nil {
+		return models.Login{}, errInvalidTimestamp
+	}
+	lr := loginRecord{Username: env.normalizeUsername(record[0]), UnixTimestamp: ts, EventUUID: record[2], IPAddr: record[3]}
+	if err := env.validateRecord(lr); err != nil {
+		return models.Login{}, err
+	}
+
+	ip := net.ParseIP(lr.IPAddr)
+	cg, _, err := env.locate(ctx, ip)
+	if err != nil {
+		return models.Login{}, err
+	}
+	env.roundCoordinates(&cg)
+	return models.Login{
+		Username:      lr.Username,
+		UnixTimestamp: lr.UnixTimestamp,
+		EventUUID:     strings.ToLower(lr.EventUUID),
+		IPAddr:        ip.String(),
+		Lat:           cg.Lat,
+		Lon:           cg.Lon,
+		Radius:        cg.Radius,
+		TimeZone:      cg.TimeZone,
+		CountryISO:    cg.CountryISO,
+		City:          cg.City,
+		Country:       cg.Country,
+	}, nil
+}
+
+// Runs "detector import <file.csv>" against the configured databases, returning the exit code
+func runImport(cfg Config, logger *slog.Logger, args []string) int {
+	if len(args) != 1 {
+		logger.Error("usage: detector import <file.csv>")
+		return 2
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		logger.Error("could not open import file", "error", err)
+		return 1
+	}
+	defer file.Close()
+
+	env, err := openEnv(cfg, logger)
+	if err != nil {
+		logger.Error("could not start", "error", err)
+		return 1
+	}
+	defer env.close()
+
+	summary, err := env.importCSV(context.Background(), file)
+	logger.Info("import finished", "imported", summary.Imported, "skipped", summary.Skipped)
+	if err != nil {
+		logger.Error("import failed", "error", err)
+		return 1
+	}
+	return 0
+}
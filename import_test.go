@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"detector/models"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportCSV(t *testing.T) {
+	file, err := os.Open("testData/logins.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	memEnv := newMemoryEnv(t)
+	summary, err := memEnv.importCSV(context.Background(), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 5 good rows; a short row, bad timestamp, bad IP, missing username and a repeated event are skipped
+	if summary.Imported != 5 || summary.Skipped != 5 {
+		t.Errorf("unexpected summary: got %+v want 5 imported and 5 skipped", summary)
+	}
+
+	bobs, err := memEnv.store.LoginsByUsername(context.Background(), "bob", models.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bobs) != 3 {
+		t.Fatalf("expected 3 logins for bob, got %v", len(bobs))
+	}
+	if bobs[1].Lat != 39.2293 || bobs[1].Lon != -76.6907 || bobs[1].Radius == nil || *bobs[1].Radius != 10 {
+		t.Errorf("expected imported logins to be located, got %+v", bobs[1])
+	}
+
+	alices, err := memEnv.store.LoginsByUsername(context.Background(), "alice", models.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alices) != 2 || alices[0].HasLocation() || alices[1].IPAddr != "2001:db8::1" {
+		t.Errorf("expected private addresses to be saved without a location, got %+v %+v", alices[0], alices[1])
+	}
+
+	// Importing the same file again only skips
+	if _, err := file.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	summary, err = memEnv.importCSV(context.Background(), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Imported != 0 || summary.Skipped != 10 {
+		t.Errorf("unexpected summary for a repeated import: got %+v", summary)
+	}
+}
+
+func TestImportCSVGeoFailure(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.resolver = nil
+	_, err := memEnv.importCSV(context.Background(), strings.NewReader("bob,1514764800,85ad929a-db03-4bf4-9541-8f728fa12e42,206.81.252.6\n"))
+	if err != errGeoLookup {
+		t.Errorf("expected the import to stop on a GeoIP failure, got %v", err)
+	}
+}
+
+func TestRunImport(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.DBPath = filepath.Join(t.TempDir(), "data.db")
+	cfg.GeoPath = "./geo/GeoLite2-City.mmdb"
+
+	if code := runImport(cfg, env.logger, []string{"testData/logins.csv"}); code != 0 {
+		t.Errorf("unexpected exit code: got %v want 0", code)
+	}
+	if code := runImport(cfg, env.logger, nil); code != 2 {
+		t.Errorf("expected a usage error without a file, got exit code %v", code)
+	}
+	store, err := models.Open(cfg.DBPath, models.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	all, err := store.AllLogins(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 5 {
+		t.Errorf("expected 5 imported logins, got %v", len(all))
+	}
+}
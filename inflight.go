@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Middleware that lets at most MaxInFlight api requests be handled at once. Each one may
+// open a transaction and do a GeoIP lookup, so an unbounded burst would only thrash the
+// database; requests over the limit get a 503 straight away instead of queueing. Health
+// checks and metrics aren't limited, so probes still get an answer while the api is busy.
+func (env *Env) withConcurrencyLimit(next http.Handler) http.Handler {
+	if env.MaxInFlight <= 0 {
+		return next
+	}
+	slots := make(chan struct{}, env.MaxInFlight)
+	return http.HandlerFunc(func(rw http.ResponseWriter, request *http.Request) {
+		if !strings.HasPrefix(request.URL.Path, "/v1/") {
+			next.ServeHTTP(rw, request)
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			next.ServeHTTP(rw, request)
+		default:
+			env.logFor(request.Context()).Warn("too many requests in flight", "limit", env.MaxInFlight)
+			rw.Header().Set("Retry-After", "1")
+			writeError(rw, http.StatusServiceUnavailable, codeOverloaded, "too many requests in flight, please retry")
+		}
+	})
+}
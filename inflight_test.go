@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.MaxInFlight = 2
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	handler := memEnv.withConcurrencyLimit(http.HandlerFunc(func(rw http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/v1/" {
+			entered <- struct{}{}
+			<-release
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	const requests = 6
+	codes := make(chan *httptest.ResponseRecorder, requests)
+	var wg sync.WaitGroup
+	serve := func(path string) {
+		defer wg.Done()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", path, nil))
+		codes <- rr
+	}
+	// Fill the limit before sending the rest, so which ones are turned away is certain
+	for i := 0; i < memEnv.MaxInFlight; i++ {
+		wg.Add(1)
+		go serve("/v1/")
+		<-entered
+	}
+	for i := memEnv.MaxInFlight; i < requests; i++ {
+		wg.Add(1)
+		go serve("/v1/")
+	}
+	for i := memEnv.MaxInFlight; i < requests; i++ {
+		rr := <-codes
+		if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "1" || !strings.Contains(rr.Body.String(), `"code":"`+codeOverloaded+`"`) {
+			t.Errorf("expected a request over the limit to be turned away, got %v %v %s", rr.Code, rr.Header(), rr.Body.String())
+		}
+	}
+
+	// Health checks aren't limited
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected a health check to be answered while saturated, got %v", rr.Code)
+	}
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for rr := range codes {
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected the requests within the limit to be handled, got %v", rr.Code)
+		}
+	}
+
+	// Finished requests free their slots
+	go func() { <-entered }()
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected a request after the burst to be handled, got %v", rr.Code)
+	}
+}
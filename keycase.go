@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// Converts a snake_case key to camelCase, e.g. "preceding_ip_access" to "precedingIpAccess"
+func snakeToCamel(key string) string {
+	parts := strings.Split(key, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// Re-encodes a JSON document with every object key converted to camelCase, for clients that
+// ask for ?case=camel instead of the usual snake_case. Keys keep their order and values are
+// copied as they are.
+func camelCaseKeys(body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var out bytes.Buffer
+	// How many keys and values have been written to each open object or array
+	type container struct {
+		object bool
+		n      int
+	}
+	var open []container
+
+	// Writes the separator before the next token, and reports whether it's an object key
+	separate := func() bool {
+		if len(open) == 0 {
+			return false
+		}
+		c := &open[len(open)-1]
+		if c.object && c.n%2 == 1 {
+			out.WriteByte(':')
+			return false
+		}
+		if c.n > 0 {
+			out.WriteByte(',')
+		}
+		return c.object
+	}
+	written := func() {
+		if len(open) > 0 {
+			open[len(open)-1].n++
+		}
+	}
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return out.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case json.Delim:
+			if t == '{' || t == '[' {
+				separate()
+				out.WriteByte(byte(t))
+				open = append(open, container{object: t == '{'})
+				continue
+			}
+			out.WriteByte(byte(t))
+			open = open[:len(open)-1]
+		case string:
+			if separate() {
+				t = snakeToCamel(t)
+			}
+			b, _ := json.Marshal(t)
+			out.Write(b)
+		default:
+			separate()
+			b, _ := json.Marshal(t)
+			out.Write(b)
+		}
+		written()
+	}
+}
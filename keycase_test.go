@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The keys of a JSON object, in the order they were encoded
+func objectKeys(t *testing.T, body []byte) []string {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		t.Fatalf("expected an object, got %s", body)
+	}
+	var keys []string
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key.(string))
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+func TestResponseKeyCase(t *testing.T) {
+	const (
+		snakeKeys    = "current_geo,geo_unavailable,trusted_network,preceding_ip_access,subsequent_ip_access,travel_to_current_geo_suspicious,travel_from_current_geo_suspicious,fastest_window_ip_access,travel_within_window_suspicious,concurrent_distant_login,outside_home_geofence,evaluated,reason,suspicious,severity,unit"
+		snakeGeoKeys = "lat,lon,radius,city,subdivision,country,country_iso,time_zone,local_time"
+		camelKeys    = "currentGeo,geoUnavailable,trustedNetwork,precedingIpAccess,subsequentIpAccess,travelToCurrentGeoSuspicious,travelFromCurrentGeoSuspicious,fastestWindowIpAccess,travelWithinWindowSuspicious,concurrentDistantLogin,outsideHomeGeofence,evaluated,reason,suspicious,severity,unit"
+		camelGeoKeys = "lat,lon,radius,city,subdivision,country,countryIso,timeZone,localTime"
+	)
+	tests := []struct {
+		query string
+		keys  string
+		geo   string
+	}{
+		{"", snakeKeys, snakeGeoKeys},
+		{"?case=snake", snakeKeys, snakeGeoKeys},
+		{"?case=camel", camelKeys, camelGeoKeys},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		req, err := http.NewRequest("POST", "/v1/"+tc.query, bytes.NewBufferString(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		memEnv.routes().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%q: handler returned wrong status code: got %v want %v: %s", tc.query, rr.Code, http.StatusOK, rr.Body.String())
+		}
+
+		if got := strings.Join(objectKeys(t, rr.Body.Bytes()), ","); got != tc.keys {
+			t.Errorf("%q: got keys %v want %v", tc.query, got, tc.keys)
+		}
+		var result map[string]json.RawMessage
+		if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		geo := result["current_geo"]
+		if geo == nil {
+			geo = result["currentGeo"]
+		}
+		if got := strings.Join(objectKeys(t, geo), ","); got != tc.geo {
+			t.Errorf("%q: got location keys %v want %v", tc.query, got, tc.geo)
+		}
+	}
+}
+
+func TestResponseKeyCaseInvalid(t *testing.T) {
+	req, err := http.NewRequest("POST", "/v1/?case=kebab", bytes.NewBufferString(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	newMemoryEnv(t).routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), `"code":"`+codeInvalidQuery+`"`) {
+		t.Errorf("expected an unknown case to be rejected, got %v %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestCamelCaseKeys(t *testing.T) {
+	in := `[{"index":0,"result":{"preceding_ip_access":{"unix_timestamp":1514677279,"speed":55.00021047466064},"reason":"no_adjacent_logins","tags":["a_b",null,true]}},{}]`
+	want := `[{"index":0,"result":{"precedingIpAccess":{"unixTimestamp":1514677279,"speed":55.00021047466064},"reason":"no_adjacent_logins","tags":["a_b",null,true]}},{}]`
+	got, err := camelCaseKeys([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only keys change; values, including strings with underscores, are left alone
+	if string(got) != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+}
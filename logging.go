@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+)
+
+func newLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// Returns the logger for a request (tagged with its request ID), falling back to the Env's own
+func (env *Env) logFor(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	if env.logger != nil {
+		return env.logger
+	}
+	return slog.Default()
+}
+
+// Middleware that tags every request with an ID, taken from the X-Request-ID header or
+// generated, echoes it back in the response and adds it to each log line for the request.
+func (env *Env) withRequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		rw.Header().Set("X-Request-ID", id)
+
+		logger := env.logFor(request.Context()).With("request_id", id)
+		ctx := context.WithValue(request.Context(), loggerKey, logger)
+		next.ServeHTTP(rw, request.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Usernames are logged as a short hash so a user's requests can be correlated without
+// writing who they are to the logs
+func hashUsername(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Logs the outcome of evaluating a single login at info level
+func (env *Env) logOutcome(ctx context.Context, lr loginRecord, result loginResult, err error) {
+	logger := env.logFor(ctx).With("user", hashUsername(lr.Username), "ip", lr.IPAddr)
+	if err != nil {
+		logger.Info("login not evaluated", "outcome", "error", "error", err.Error())
+		return
+	}
+	logger.Info("login evaluated", "outcome", "ok", "suspicious", result.Suspicious)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLogging(t *testing.T) {
+	var logs bytes.Buffer
+	memEnv := newMemoryEnv(t)
+	memEnv.logger = newLogger(&logs, slog.LevelInfo)
+
+	bodies := []string{
+		`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "85ad929a-db03-4bf4-9541-8f728fa12e42", "ip_address": "206.81.252.6"}`,
+		`{"username": "bob", "unix_timestamp": 1514764800}`,
+	}
+	router := memEnv.routes()
+	for i, body := range bodies {
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Request-ID", []string{"req-ok", "req-invalid"}[i])
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Header().Get("X-Request-ID") != req.Header.Get("X-Request-ID") {
+			t.Errorf("expected the request ID to be echoed back, got %q", rr.Header().Get("X-Request-ID"))
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected one log line per request, got:\n%v", logs.String())
+	}
+	if strings.Contains(logs.String(), `"bob"`) {
+		t.Errorf("usernames should be hashed in the logs:\n%v", logs.String())
+	}
+
+	expected := []map[string]interface{}{
+		{"level": "INFO", "request_id": "req-ok", "outcome": "ok", "user": hashUsername("bob"), "ip": "206.81.252.6", "suspicious": false},
+		{"level": "INFO", "request_id": "req-invalid", "outcome": "invalid"},
+	}
+	for i, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range expected[i] {
+			if entry[key] != value {
+				t.Errorf("log line %v: got %v=%v want %v", i, key, entry[key], value)
+			}
+		}
+	}
+}
+
+func TestGeneratedRequestID(t *testing.T) {
+	req, err := http.NewRequest("GET", "/v1/logins/nobody", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	newMemoryEnv(t).routes().ServeHTTP(rr, req)
+
+	if len(rr.Header().Get("X-Request-ID")) != 16 {
+		t.Errorf("expected a generated request ID, got %q", rr.Header().Get("X-Request-ID"))
+	}
+}
+
+func TestDebugLogLevel(t *testing.T) {
+	var logs bytes.Buffer
+	logger := newLogger(&logs, slog.LevelInfo)
+	logger.Debug("hidden")
+	if logs.Len() != 0 {
+		t.Errorf("debug lines should be dropped at info level, got %v", logs.String())
+	}
+
+	logger = newLogger(&logs, slog.LevelDebug)
+	logger.Debug("shown")
+	if !strings.Contains(logs.String(), "shown") {
+		t.Errorf("debug lines should be written at debug level")
+	}
+}
+
+func TestGeoLookupDebugLogging(t *testing.T) {
+	tests := []struct {
+		name     string
+		resolver GeoResolver
+		message  string
+	}{
+		{"lookup error", staticResolver{err: errors.New("corrupt search tree")}, "GeoIP lookup failed"},
+		// What the resolver returned is logged too
+		{"empty record", staticResolver{results: map[string]GeoResult{"198.51.100.1": {Country: "United States", CountryISO: "US"}}}, "GeoIP record has no location"},
+	}
+
+	for _, tc := range tests {
+		for _, level := range []slog.Level{slog.LevelInfo, slog.LevelDebug} {
+			var logs bytes.Buffer
+			memEnv := newMemoryEnv(t)
+			memEnv.logger = newLogger(&logs, level)
+			memEnv.resolver = tc.resolver
+			memEnv.locate(context.Background(), net.ParseIP("198.51.100.1"))
+
+			var debug map[string]interface{}
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				var entry map[string]interface{}
+				if json.Unmarshal([]byte(line), &entry) == nil && entry["level"] == "DEBUG" {
+					debug = entry
+				}
+			}
+			if level == slog.LevelInfo {
+				if strings.Contains(logs.String(), "198.51.100.1") {
+					t.Errorf("%s: the address shouldn't be logged above debug level:\n%v", tc.name, logs.String())
+				}
+				continue
+			}
+			if debug == nil || debug["msg"] != tc.message || debug["ip"] != "198.51.100.1" {
+				t.Errorf("%s: expected a debug line with the address, got:\n%v", tc.name, logs.String())
+			} else if record, ok := debug["record"].(map[string]interface{}); tc.name == "empty record" && (!ok || record["CountryISO"] != "US") {
+				t.Errorf("%s: expected the record to be logged, got:\n%v", tc.name, logs.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus counters and gauges for the detector. A nil *metrics is valid and records nothing,
+// so metrics can be left out of an Env entirely.
+type metrics struct {
+	requests         prometheus.Counter
+	validationErrors prometheus.Counter
+	geoErrors        prometheus.Counter
+	suspicious       *prometheus.CounterVec
+	geoBuild         prometheus.Gauge
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		requests: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "superman_requests_total",
+			Help: "Login events received.",
+		}),
+		validationErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "superman_validation_failures_total",
+			Help: "Login events rejected as invalid.",
+		}),
+		geoErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "superman_geo_lookup_failures_total",
+			Help: "GeoIP lookups that returned an error.",
+		}),
+		suspicious: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "superman_suspicious_travel_total",
+			Help: "Suspicious travel detections, by direction relative to the current login (to or from).",
+		}, []string{"direction"}),
+		geoBuild: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "superman_geoip_build_timestamp_seconds",
+			Help: "When the loaded GeoIP database was built, as a unix timestamp.",
+		}),
+	}
+	reg.MustRegister(m.requests, m.validationErrors, m.geoErrors, m.suspicious, m.geoBuild)
+	return m
+}
+
+func (m *metrics) request() {
+	if m != nil {
+		m.requests.Inc()
+	}
+}
+
+func (m *metrics) validationError() {
+	if m != nil {
+		m.validationErrors.Inc()
+	}
+}
+
+func (m *metrics) geoError() {
+	if m != nil {
+		m.geoErrors.Inc()
+	}
+}
+
+// direction is "to" or "from" the current login's location
+func (m *metrics) suspiciousTravel(direction string) {
+	if m != nil {
+		m.suspicious.WithLabelValues(direction).Inc()
+	}
+}
+
+func (m *metrics) geoBuilt(at time.Time) {
+	if m != nil {
+		m.geoBuild.Set(float64(at.Unix()))
+	}
+}
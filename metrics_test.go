@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"detector/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	registry := prometheus.NewRegistry()
+	memEnv.metrics = newMetrics(registry)
+	seedLogins(t, memEnv,
+		models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)},
+		models.Login{Username: "bob", UnixTimestamp: 1514764801, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)},
+	)
+
+	router := memEnv.routes()
+	router.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{})).Methods("GET")
+
+	bodies := []string{
+		// Benign travel from the preceding login, impossible travel to the subsequent one
+		`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000c", "ip_address": "206.81.252.6"}`,
+		`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000d", "ip_address": "not an ip"}`,
+		`not json`,
+	}
+	for _, body := range bodies {
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	for _, expected := range []string{
+		"superman_requests_total 3",
+		"superman_validation_failures_total 2",
+		"superman_geo_lookup_failures_total 0",
+		`superman_suspicious_travel_total{direction="from"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("metrics output is missing %q:\n%v", expected, rr.Body.String())
+		}
+	}
+	if strings.Contains(rr.Body.String(), `direction="to"`) {
+		t.Errorf("expected no suspicious travel to the current geo:\n%v", rr.Body.String())
+	}
+}
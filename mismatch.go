@@ -0,0 +1,18 @@
+package main
+
+import (
+	"context"
+	"detector/travel"
+	"net"
+)
+
+// Reports whether ip's GeoIP location is more than MismatchDistance miles from the
+// coordinates the client gave for the login. The given coordinates are used either way;
+// an address with no GeoIP location, or whose lookup fails, isn't a mismatch.
+func (env *Env) coordinateMismatch(ctx context.Context, ip net.IP, given currentGeo, opts evalOptions) bool {
+	located, ok, err := env.locate(ctx, ip)
+	if err != nil || !ok {
+		return false
+	}
+	return travel.Miles.FromMeters(opts.formula.Distance(located.Lat, located.Lon, given.Lat, given.Lon)) > env.MismatchDistance
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+)
+
+// The last time a user was alerted about, which starts their alert cooldown
+type Alert struct {
+	Username string `json:"username"`
+	// Unix timestamp
+	At int64 `json:"at"`
+	// The event that was alerted about, or empty for alerts saved before it was recorded
+	EventUUID string `json:"event_uuid"`
+}
+
+func (s *sqlStore) LastAlert(ctx context.Context, username string) (*Alert, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	statement, err := s.stmt(ctx, "SELECT username, lastAlertAt, eventUuid FROM alerts WHERE username=?")
+	if err != nil {
+		return nil, err
+	}
+	alert := new(Alert)
+	err = statement.QueryRowContext(ctx, username).Scan(&alert.Username, &alert.At, &alert.EventUUID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return alert, nil
+}
+
+func (s *sqlStore) SetLastAlert(ctx context.Context, alert Alert) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	statement, err := s.stmt(ctx, "INSERT INTO alerts (username,lastAlertAt,eventUuid) VALUES (?,?,?) ON CONFLICT (username) DO UPDATE SET lastAlertAt=excluded.lastAlertAt, eventUuid=excluded.eventUuid")
+	if err != nil {
+		return err
+	}
+	_, err = statement.ExecContext(ctx, alert.Username, alert.At, alert.EventUUID)
+	return err
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+)
+
+// A suspicious determination, kept as an audit record
+type Detection struct {
+	Id       int    `json:"id"`
+	Username string `json:"username"`
+	// "to" the current login from the preceding one, "from" it to the subsequent one,
+	// "home" when it's outside the user's home geofence, or "concurrent" when it's far
+	// from another login at the same time
+	Direction     string `json:"direction"`
+	EventUUID     string `json:"event_uuid"`
+	IPAddr        string `json:"ip_address"`
+	UnixTimestamp int64  `json:"unix_timestamp"`
+	// The login the travel was measured against, empty for "home"
+	OtherEventUUID     string `json:"other_event_uuid"`
+	OtherIPAddr        string `json:"other_ip_address"`
+	OtherUnixTimestamp int64  `json:"other_unix_timestamp"`
+	// Zero for "home" and "concurrent", which don't depend on speed. Distance is from the
+	// home point for "home".
+	Speed    float64 `json:"speed"`
+	Distance float64 `json:"distance"`
+	Unit     string  `json:"unit"`
+	// When the detection was made, as a unix timestamp
+	DetectedAt int64 `json:"detected_at"`
+}
+
+const detectionColumns = "id, username, direction, uuid, ipAddr, tStamp, otherUuid, otherIpAddr, otherTStamp, speed, distance, unit, detectedAt"
+
+func scanDetections(rows *sql.Rows) ([]*Detection, error) {
+	defer rows.Close()
+
+	detections := make([]*Detection, 0)
+	for rows.Next() {
+		d := new(Detection)
+		err := rows.Scan(&d.Id, &d.Username, &d.Direction, &d.EventUUID, &d.IPAddr, &d.UnixTimestamp,
+			&d.OtherEventUUID, &d.OtherIPAddr, &d.OtherUnixTimestamp, &d.Speed, &d.Distance, &d.Unit, &d.DetectedAt)
+		if err != nil {
+			return nil, err
+		}
+		detections = append(detections, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return detections, nil
+}
+
+func (s *sqlStore) InsertDetection(ctx context.Context, d Detection) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	statement, err := s.stmt(ctx, "INSERT INTO detections (username,direction,uuid,ipAddr,tStamp,otherUuid,otherIpAddr,otherTStamp,speed,distance,unit,detectedAt) VALUES (?,?,?,?,?,?,?,?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	_, err = statement.ExecContext(ctx, d.Username, d.Direction, d.EventUUID, d.IPAddr, d.UnixTimestamp,
+		d.OtherEventUUID, d.OtherIPAddr, d.OtherUnixTimestamp, d.Speed, d.Distance, d.Unit, d.DetectedAt)
+	return err
+}
+
+func (s *sqlStore) DetectionsByUsername(ctx context.Context, username string) ([]*Detection, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	statement, err := s.stmt(ctx, "SELECT "+detectionColumns+" FROM detections WHERE username=? ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := statement.QueryContext(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	return scanDetections(rows)
+}
+
+func (s *sqlStore) DeleteDetectionsOlderThan(ctx context.Context, cutoff int64) (int64, error) {
+	var deleted int64
+	for {
+		n, err := s.deleteBatch(ctx, "DELETE FROM detections WHERE id IN (SELECT id FROM detections WHERE tStamp<? LIMIT ?)", cutoff)
+		deleted += n
+		if err != nil || n < deleteBatchSize {
+			return deleted, err
+		}
+	}
+}
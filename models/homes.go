@@ -0,0 +1,47 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Where a user is expected to log in from. Logins further than Radius from the point are
+// outside their home geofence.
+type Home struct {
+	Username string  `json:"username"`
+	Lat      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+	// In km
+	Radius float64 `json:"radius"`
+}
+
+func (s *sqlStore) SetHome(ctx context.Context, home Home) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	statement, err := s.stmt(ctx, "INSERT INTO homes (username,lat,lon,radius) VALUES (?,?,?,?) ON CONFLICT (username) DO UPDATE SET lat=excluded.lat, lon=excluded.lon, radius=excluded.radius")
+	if err != nil {
+		return err
+	}
+	_, err = statement.ExecContext(ctx, home.Username, home.Lat, home.Lon, home.Radius)
+	return err
+}
+
+func (s *sqlStore) HomeByUsername(ctx context.Context, username string) (*Home, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	statement, err := s.stmt(ctx, "SELECT username, lat, lon, radius FROM homes WHERE username=?")
+	if err != nil {
+		return nil, err
+	}
+	home := new(Home)
+	err = statement.QueryRowContext(ctx, username).Scan(&home.Username, &home.Lat, &home.Lon, &home.Radius)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return home, nil
+}
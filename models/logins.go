@@ -1,27 +1,58 @@
 package models
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"math"
 	"sort"
 )
 
+// Returned by InsertLogin when a login with the same event_uuid has already been saved
+var ErrDuplicateLogin = errors.New("a login with this event_uuid already exists")
+
 type Login struct {
-	Id			  int    `json:id`
-	Username      string `json:"username"`
-	UnixTimestamp int64  `json:"unix_timestamp"`
-	EventUUID     string `json:"event_uuid"`
-	IPAddr        string `json:"ip_address"`
-	Lat 		  float64 `json:"lat"`
-	Lon 		  float64 `json:"lon"`
-	Radius		  uint16 `json:"radius"`
+	Id            int     `json:"id"`
+	Username      string  `json:"username"`
+	UnixTimestamp int64   `json:"unix_timestamp"`
+	EventUUID     string  `json:"event_uuid"`
+	IPAddr        string  `json:"ip_address"`
+	Lat           float64 `json:"lat"`
+	Lon           float64 `json:"lon"`
+	// Accuracy radius of the location in km, or nil when it isn't known
+	Radius *uint16 `json:"radius"`
+	// IANA time zone of the location, e.g. "America/New_York", or empty when it isn't known
+	TimeZone string `json:"time_zone"`
+	// ISO code of the location's country, e.g. "US", or empty when it isn't known
+	CountryISO string `json:"country_iso"`
+	// English names of the location's city and country, empty when they aren't known
+	City    string `json:"city"`
+	Country string `json:"country"`
 }
 
-func AllLogins(db *sql.DB) ([]*Login, error) {
-	rows, err := db.Query("SELECT * FROM logins")
+// Logins from private or unknown addresses are saved with a zero location
+func (l *Login) HasLocation() bool {
+	return l.Lat != 0 || l.Lon != 0
+}
 
-	if err != nil {
-		return nil, err
-	}
+// Narrows the logins LoginsByUsername returns. The zero value returns them all.
+type ListOptions struct {
+	// Only logins at or after this unix timestamp
+	Since int64
+	// Only logins at or before this unix timestamp, or any when zero
+	Until int64
+	// At most this many logins, or all of them when zero
+	Limit int
+	// Skip this many logins
+	Offset int
+	// Skip the logins at exactly Since up to and including the one with this id, so a listing
+	// can be resumed after the last login of the previous page. Zero skips none.
+	AfterID int
+}
+
+const loginColumns = "id, username, tStamp, uuid, ipAddr, lat, lon, radius, timezone, country, city, countryName"
+
+func scanLogins(rows *sql.Rows) ([]*Login, error) {
 	defer rows.Close()
 
 	logins := make([]*Login, 0)
@@ -29,7 +60,7 @@ func AllLogins(db *sql.DB) ([]*Login, error) {
 
 		//Grab each login and add it to slice
 		login := new(Login)
-		err := rows.Scan(&login.Id, &login.Username, &login.UnixTimestamp, &login.EventUUID, &login.IPAddr, &login.Lat, &login.Lon, &login.Radius)
+		err := rows.Scan(&login.Id, &login.Username, &login.UnixTimestamp, &login.EventUUID, &login.IPAddr, &login.Lat, &login.Lon, &login.Radius, &login.TimeZone, &login.CountryISO, &login.City, &login.Country)
 
 		if err != nil {
 			return nil, err
@@ -37,60 +68,255 @@ func AllLogins(db *sql.DB) ([]*Login, error) {
 		logins = append(logins, login)
 	}
 
-	if err = rows.Err(); err != nil {
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return logins, nil
+}
+
+func (s *sqlStore) AllLogins(ctx context.Context) ([]*Login, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT "+loginColumns+" FROM logins")
+
+	if err != nil {
+		return nil, err
+	}
+	logins, err := scanLogins(rows)
+	if err != nil {
 		return nil, err
 	}
 
 	// Sort logins in descending (most recent to oldest) time
-	sort.Slice(logins, func(i, j int) bool { return logins[i].UnixTimestamp > logins[j].UnixTimestamp})
+	sort.Slice(logins, func(i, j int) bool { return logins[i].UnixTimestamp > logins[j].UnixTimestamp })
 	return logins, nil
 }
 
-func LoginsByUsername(db *sql.DB, username string) ([]*Login, error) {
-	rows, err := db.Query("SELECT * FROM logins WHERE username=?", username)
+func (s *sqlStore) LoginsByUsername(ctx context.Context, username string, opts ListOptions) ([]*Login, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
 
+	limit := int64(opts.Limit)
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+	until := opts.Until
+	if until <= 0 {
+		until = math.MaxInt64
+	}
+	ts := s.dialect.timestamp
+	statement, err := s.stmt(ctx, "SELECT "+loginColumns+" FROM logins WHERE username=? AND "+ts+">=? AND "+ts+"<=? AND NOT ("+ts+"=? AND id<=?) ORDER BY "+ts+", id LIMIT ? OFFSET ?")
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	rows, err := statement.QueryContext(ctx, username, opts.Since, until, opts.Since, opts.AfterID, limit, opts.Offset)
 
-	logins := make([]*Login, 0)
-	for rows.Next() {
+	if err != nil {
+		return nil, err
+	}
+	return scanLogins(rows)
+}
 
-		//Grab each login and add it to slice
-		login := new(Login)
-		err := rows.Scan(&login.Id, &login.Username, &login.UnixTimestamp, &login.EventUUID, &login.IPAddr, &login.Lat, &login.Lon, &login.Radius)
+func (s *sqlStore) LoginByEventUUID(ctx context.Context, eventUUID string) (*Login, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
 
+	statement, err := s.stmt(ctx, "SELECT "+loginColumns+" FROM logins WHERE uuid=?")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := statement.QueryContext(ctx, eventUUID)
+	if err != nil {
+		return nil, err
+	}
+	logins, err := scanLogins(rows)
+	if err != nil || len(logins) == 0 {
+		return nil, err
+	}
+	return logins[0], nil
+}
+
+func (s *sqlStore) InsertLogin(ctx context.Context, row Login) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	statement, err := s.stmt(ctx, "INSERT INTO logins (username,tStamp,uuid,ipAddr,lat,lon,radius,timezone,country,city,countryName) VALUES (?,?,?,?,?,?,?,?,?,?,?)")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = statement.ExecContext(ctx, row.Username, row.UnixTimestamp, row.EventUUID, row.IPAddr, row.Lat, row.Lon, row.Radius, row.TimeZone, row.CountryISO, row.City, row.Country)
+	if err != nil && s.dialect.isUniqueViolation(err) {
+		return ErrDuplicateLogin
+	}
+	return err
+}
+
+func (s *sqlStore) InsertLogins(ctx context.Context, rows []Login) (int64, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	statement, err := s.stmt(ctx, "INSERT INTO logins (username,tStamp,uuid,ipAddr,lat,lon,radius,timezone,country,city,countryName) VALUES (?,?,?,?,?,?,?,?,?,?,?) ON CONFLICT (uuid) DO NOTHING")
+	if err != nil {
+		return 0, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	txStatement := tx.StmtContext(ctx, statement)
+	var inserted int64
+	for _, row := range rows {
+		result, err := txStatement.ExecContext(ctx, row.Username, row.UnixTimestamp, row.EventUUID, row.IPAddr, row.Lat, row.Lon, row.Radius, row.TimeZone, row.CountryISO, row.City, row.Country)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
-		logins = append(logins, login)
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		inserted += n
 	}
+	return inserted, tx.Commit()
+}
 
-	if err = rows.Err(); err != nil {
-		return nil, err
+func (s *sqlStore) TrimLogins(ctx context.Context, username string, keep int) (int64, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	// The user's newest logins are read off the (username, timestamp) index
+	ts := s.dialect.timestamp
+	statement, err := s.stmt(ctx, "DELETE FROM logins WHERE username=? AND id NOT IN (SELECT id FROM logins WHERE username=? ORDER BY "+ts+" DESC, id DESC LIMIT ?)")
+	if err != nil {
+		return 0, err
+	}
+	result, err := statement.ExecContext(ctx, username, username, keep)
+	if err != nil {
+		return 0, err
 	}
+	return result.RowsAffected()
+}
 
-	// Sort logins in descending (most recent to oldest) time
-	sort.Slice(logins, func(i, j int) bool { return logins[i].UnixTimestamp < logins[j].UnixTimestamp})
-	return logins, nil
+// How many logins DeleteLoginsOlderThan removes per statement
+const deleteBatchSize = 1000
+
+func (s *sqlStore) DeleteLoginsOlderThan(ctx context.Context, cutoff int64) (int64, error) {
+	ts := s.dialect.indexedTimestamp
+	var deleted int64
+	for {
+		n, err := s.deleteBatch(ctx, "DELETE FROM logins WHERE id IN (SELECT id FROM logins WHERE "+ts+"<? LIMIT ?)", cutoff)
+		deleted += n
+		if err != nil || n < deleteBatchSize {
+			return deleted, err
+		}
+	}
+}
+
+// Each batch is its own statement, and so its own transaction with its own timeout
+func (s *sqlStore) deleteBatch(ctx context.Context, query string, cutoff int64) (int64, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	statement, err := s.stmt(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	result, err := statement.ExecContext(ctx, cutoff, deleteBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
 
+// Returned by AdjacentLogins when the login on one side of cLogin couldn't be loaded, along
+// with the other side's login as usual
+type AdjacentError struct {
+	// "preceding" or "subsequent"
+	Side string
+	Err  error
+}
 
-func InsertLogin(db *sql.DB, row Login) {
-	statement, err := db.Prepare("INSERT INTO logins (username,tStamp,uuid,ipAddr,lat,lon,radius) VALUES (?,?,?,?,?,?,?)")
+func (e *AdjacentError) Error() string {
+	return "could not load the " + e.Side + " login: " + e.Err.Error()
+}
 
+func (e *AdjacentError) Unwrap() error {
+	return e.Err
+}
+
+func (s *sqlStore) AdjacentLogins(ctx context.Context, cLogin Login) (Login, Login, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	// Each side is loaded on its own, so one that can't be read doesn't lose the other
+	before, beforeErr := s.neighbors(ctx, cLogin, 1, false)
+	after, afterErr := s.neighbors(ctx, cLogin, 1, true)
+	if beforeErr != nil && afterErr != nil {
+		return Login{}, Login{}, beforeErr
+	}
+	var prevLogin, postLogin Login
+	if len(before) > 0 {
+		prevLogin = *before[0]
+	}
+	if len(after) > 0 {
+		postLogin = *after[0]
+	}
+	if beforeErr != nil {
+		return prevLogin, postLogin, &AdjacentError{Side: "preceding", Err: beforeErr}
+	}
+	if afterErr != nil {
+		return prevLogin, postLogin, &AdjacentError{Side: "subsequent", Err: afterErr}
+	}
+	return prevLogin, postLogin, nil
+}
+
+func (s *sqlStore) NeighborLogins(ctx context.Context, cLogin Login, n int) ([]*Login, []*Login, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	before, err := s.neighbors(ctx, cLogin, n, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	after, err := s.neighbors(ctx, cLogin, n, true)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
+	return before, after, nil
+}
 
-	_, err = statement.Exec(row.Username, row.UnixTimestamp, row.EventUUID, row.IPAddr, row.Lat, row.Lon, row.Radius)
+// Up to n of the user's located logins before cLogin's timestamp (at it, for ties) or, when
+// later is set, after it, nearest first
+func (s *sqlStore) neighbors(ctx context.Context, cLogin Login, n int, later bool) ([]*Login, error) {
+	// Logins saved without a location have nothing to measure travel against. The casts
+	// let SQLite compare its TEXT columns as numbers.
+	ts := s.dialect.timestamp
+	where := " FROM logins WHERE username=? AND uuid<>? AND (CAST(lat AS DOUBLE PRECISION)<>0 OR CAST(lon AS DOUBLE PRECISION)<>0) AND "
+	if later {
+		return s.queryLogins(ctx, "SELECT "+loginColumns+where+ts+">? ORDER BY "+ts+", id LIMIT ?",
+			cLogin.Username, cLogin.EventUUID, cLogin.UnixTimestamp, n)
+	}
+	return s.queryLogins(ctx, "SELECT "+loginColumns+where+ts+"<=? ORDER BY "+ts+" DESC, id DESC LIMIT ?",
+		cLogin.Username, cLogin.EventUUID, cLogin.UnixTimestamp, n)
+}
 
+func (s *sqlStore) queryLogins(ctx context.Context, query string, args ...interface{}) ([]*Login, error) {
+	statement, err := s.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := statement.QueryContext(ctx, args...)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	return scanLogins(rows)
 }
 
+// Finds the logins either side of cLogin in a slice sorted oldest first
 func GetAdjacentLogins(allLogins []*Login, cLogin Login) (Login, Login) {
 	// Find the login entries before and after the current one so we can calcucate
 	var prevIndx, postIndx = -1, -1
@@ -99,10 +325,10 @@ func GetAdjacentLogins(allLogins []*Login, cLogin Login) (Login, Login) {
 	for i, login := range allLogins {
 		if cLogin.EventUUID == login.EventUUID {
 			if i > 0 {
-				prevIndx = i -1
+				prevIndx = i - 1
 			}
 
-			if i < len(allLogins) - 1 {
+			if i < len(allLogins)-1 {
 				postIndx = i + 1
 			}
 		}
@@ -114,4 +340,4 @@ func GetAdjacentLogins(allLogins []*Login, cLogin Login) (Login, Login) {
 		postLogin = *allLogins[postIndx]
 	}
 	return prevLogin, postLogin
-}
\ No newline at end of file
+}
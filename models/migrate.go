@@ -0,0 +1,92 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// One step in the schema's history. Each dialect lists its migrations oldest first, and a
+// database's schema version is how many of them have been applied to it.
+type migration struct {
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+// Brings the database up to the dialect's latest schema, applying each migration it hasn't
+// had yet in its own transaction and recording it in schema_version. Databases created
+// before schema_version existed start at version 0; the first migrations only create what
+// isn't there, so their data is kept.
+func migrate(db *sql.DB, d dialect) error {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY, description TEXT, appliedAt BIGINT)"); err != nil {
+		return err
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	// A database migrated by a newer build is left as it is; its migrations only add to the schema
+	for i := version; i < len(d.migrations); i++ {
+		m := d.migrations[i]
+		if err := applyMigration(db, d, i+1, m); err != nil {
+			return fmt.Errorf("migrating to schema version %d (%s): %w", i+1, m.description, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, d dialect, version int, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := m.up(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	// The primary key stops two processes starting at once both applying it
+	_, err = tx.Exec(d.rebind("INSERT INTO schema_version (version, description, appliedAt) VALUES (?, ?, ?)"), version, m.description, time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// How many migrations have been applied to db
+func schemaVersion(db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// A migration that runs statements in order
+func execAll(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// A migration that adds a column to a SQLite table unless it already has it, as databases
+// from before schema versioning may. SQLite has no ADD COLUMN IF NOT EXISTS.
+func sqliteAddColumn(table, column, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		var exists int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?", table, column).Scan(&exists); err != nil {
+			return err
+		}
+		if exists > 0 {
+			return nil
+		}
+		_, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+		return err
+	}
+}
@@ -0,0 +1,32 @@
+//go:build postgres
+// +build postgres
+
+package models
+
+import (
+	"os"
+	"testing"
+)
+
+// Runs the store tests against a real Postgres database:
+//
+//	SUPERMAN_TEST_POSTGRES_DSN=postgres://localhost/detector_test?sslmode=disable go test -tags postgres ./models
+//
+// The logins table in that database is emptied first.
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("SUPERMAN_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("SUPERMAN_TEST_POSTGRES_DSN is not set")
+	}
+
+	store, err := Open(dsn, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if _, err := store.(*sqlStore).db.Exec("DELETE FROM logins"); err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+}
@@ -0,0 +1,34 @@
+package models
+
+import "context"
+
+// A summary of a user's logins
+type UserStats struct {
+	Logins      int64 `json:"logins"`
+	DistinctIPs int64 `json:"distinct_ips"`
+	// Logins whose country isn't known aren't counted
+	DistinctCountries int64 `json:"distinct_countries"`
+	// Logins with at least one audit record, whichever direction the travel was flagged in
+	SuspiciousLogins int64 `json:"suspicious_logins"`
+}
+
+func (s *sqlStore) UserStats(ctx context.Context, username string) (UserStats, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	var stats UserStats
+	statement, err := s.stmt(ctx, "SELECT COUNT(*), COUNT(DISTINCT ipAddr), COUNT(DISTINCT NULLIF(country, '')) FROM logins WHERE username=?")
+	if err != nil {
+		return stats, err
+	}
+	if err := statement.QueryRowContext(ctx, username).Scan(&stats.Logins, &stats.DistinctIPs, &stats.DistinctCountries); err != nil {
+		return stats, err
+	}
+
+	statement, err = s.stmt(ctx, "SELECT COUNT(DISTINCT uuid) FROM detections WHERE username=?")
+	if err != nil {
+		return stats, err
+	}
+	err = statement.QueryRowContext(ctx, username).Scan(&stats.SuspiciousLogins)
+	return stats, err
+}
@@ -0,0 +1,164 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store is the login datastore used by the detector. NewSQLiteStore and NewPostgresStore
+// provide implementations on top of database/sql.
+//
+// Every method takes a context, so a client disconnecting or the server shutting down
+// cancels the database work it started.
+type Store interface {
+	// Saves a login, returning ErrDuplicateLogin if its event_uuid has already been saved
+	InsertLogin(ctx context.Context, row Login) error
+	// Saves logins in a single transaction, skipping any whose event_uuid has already been
+	// saved, and returns how many were inserted
+	InsertLogins(ctx context.Context, rows []Login) (int64, error)
+	// Every login, most recent first
+	AllLogins(ctx context.Context) ([]*Login, error)
+	// A user's logins, oldest first
+	LoginsByUsername(ctx context.Context, username string, opts ListOptions) ([]*Login, error)
+	// The login saved for an event, or nil if there isn't one
+	LoginByEventUUID(ctx context.Context, eventUUID string) (*Login, error)
+	// The user's logins immediately before and after cLogin's timestamp, skipping any saved
+	// without a location. A zero Login is returned for a side with no neighbour, and an
+	// *AdjacentError when only one side's login couldn't be loaded.
+	AdjacentLogins(ctx context.Context, cLogin Login) (Login, Login, error)
+	// Up to n of the user's located logins either side of cLogin's timestamp, nearest first
+	NeighborLogins(ctx context.Context, cLogin Login, n int) ([]*Login, []*Login, error)
+	// Removes everything stored for a user (their logins, audit records, home, last alert
+	// and threshold) in a single transaction, returning how many rows each table lost
+	DeleteUser(ctx context.Context, username string) (DeletedUser, error)
+	// Removes all but the user's keep newest logins by timestamp, returning how many were deleted
+	TrimLogins(ctx context.Context, username string, keep int) (int64, error)
+	// Removes every login from before the cutoff unix timestamp, returning how many were
+	// deleted. Logins are deleted in batches, so other writes aren't locked out for long.
+	DeleteLoginsOlderThan(ctx context.Context, cutoff int64) (int64, error)
+	// Saves an audit record of a suspicious travel determination
+	InsertDetection(ctx context.Context, d Detection) error
+	// A user's audit records, oldest first
+	DetectionsByUsername(ctx context.Context, username string) ([]*Detection, error)
+	// Removes every audit record of a login from before the cutoff unix timestamp, in
+	// batches like DeleteLoginsOlderThan, returning how many were deleted
+	DeleteDetectionsOlderThan(ctx context.Context, cutoff int64) (int64, error)
+	// Every user with a login in opts' time range, ordered by username and paged by its
+	// Limit and Offset
+	DistinctUsernames(ctx context.Context, opts ListOptions) ([]UserActivity, error)
+	// Counts of a user's logins and what they came from
+	UserStats(ctx context.Context, username string) (UserStats, error)
+	// The user's last alert, or nil if they've never been alerted about
+	LastAlert(ctx context.Context, username string) (*Alert, error)
+	// Records an alert about the user, replacing their last one
+	SetLastAlert(ctx context.Context, alert Alert) error
+	// Sets (or replaces) a user's home location
+	SetHome(ctx context.Context, home Home) error
+	// A user's home location, or nil if they don't have one
+	HomeByUsername(ctx context.Context, username string) (*Home, error)
+	// Sets (or replaces) a user's own speed threshold
+	SetThreshold(ctx context.Context, threshold Threshold) error
+	// A user's own speed threshold, or nil if they use the global one
+	ThresholdByUsername(ctx context.Context, username string) (*Threshold, error)
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// Settings for a Store
+type Options struct {
+	// Upper bound on how long each query may run. Zero means no limit beyond the caller's context.
+	QueryTimeout time.Duration
+	// How long a SQLite connection waits for another one's lock before failing with
+	// SQLITE_BUSY. Defaults to DefaultBusyTimeout.
+	BusyTimeout time.Duration
+	// SQLite journal mode, e.g. WAL or DELETE. Defaults to WAL, which lets reads carry on
+	// while a write is in progress.
+	JournalMode string
+	// Connection pool limits. Zero uses the database's defaults: one connection that's never
+	// closed for SQLite, whose writes are serialized anyway, and for Postgres up to 10 open,
+	// 5 of them idle, each replaced after 30 minutes.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// Opens the store for a connection string. postgres:// and postgresql:// URLs connect to
+// Postgres, anything else is treated as a SQLite file path.
+func Open(dataSourceName string, opts Options) (Store, error) {
+	if strings.HasPrefix(dataSourceName, "postgres://") || strings.HasPrefix(dataSourceName, "postgresql://") {
+		db, err := newPostgresDB(dataSourceName, opts)
+		if err != nil {
+			return nil, err
+		}
+		return NewPostgresStore(db, opts), nil
+	}
+
+	db, err := newSQLiteDB(dataSourceName, opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewSQLiteStore(db, opts), nil
+}
+
+// A Store backed by a SQL database. Queries are written with ? placeholders and
+// rewritten for the dialect when it needs something else.
+type sqlStore struct {
+	db      *sql.DB
+	dialect dialect
+	opts    Options
+
+	// Prepared statements, keyed by their query before rebinding
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func NewSQLiteStore(db *sql.DB, opts Options) Store {
+	return &sqlStore{db: db, dialect: sqliteDialect, opts: opts, stmts: make(map[string]*sql.Stmt)}
+}
+
+func NewPostgresStore(db *sql.DB, opts Options) Store {
+	return &sqlStore{db: db, dialect: postgresDialect, opts: opts, stmts: make(map[string]*sql.Stmt)}
+}
+
+// Returns query as a prepared statement, preparing it the first time it is used
+func (s *sqlStore) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if statement, ok := s.stmts[query]; ok {
+		return statement, nil
+	}
+	statement, err := s.db.PrepareContext(ctx, s.dialect.rebind(query))
+	if err != nil {
+		return nil, err
+	}
+	s.stmts[query] = statement
+	return statement, nil
+}
+
+// Bounds ctx by the configured query timeout
+func (s *sqlStore) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.opts.QueryTimeout > 0 {
+		return context.WithTimeout(ctx, s.opts.QueryTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) Close() error {
+	s.mu.Lock()
+	for query, statement := range s.stmts {
+		statement.Close()
+		delete(s.stmts, query)
+	}
+	s.mu.Unlock()
+	return s.db.Close()
+}
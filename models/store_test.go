@@ -0,0 +1,719 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func radius(km uint16) *uint16 {
+	return &km
+}
+
+func newMemoryStore(t *testing.T) Store {
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: gets its own database, so keep to a single one
+	db.SetMaxOpenConns(1)
+	return NewSQLiteStore(db, Options{})
+}
+
+// Exercises a Store implementation. The store must start out empty.
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+	logins := []Login{
+		{Username: "bob", UnixTimestamp: 1514764801, EventUUID: "15ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: radius(200), CountryISO: "US"},
+		{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "25ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: radius(5)},
+		{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "35ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: radius(10), TimeZone: "America/New_York", CountryISO: "US", City: "Halethorpe", Country: "United States"},
+		{Username: "bob", UnixTimestamp: 1514700000, EventUUID: "45ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "10.0.0.1"},
+		{Username: "alice", UnixTimestamp: 1514764800, EventUUID: "55ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: radius(10)},
+	}
+	for _, login := range logins {
+		assert.NoError(t, store.InsertLogin(ctx, login))
+	}
+	assert.Equal(t, ErrDuplicateLogin, store.InsertLogin(ctx, logins[0]), "event_uuid should be unique")
+
+	bobs, err := store.LoginsByUsername(ctx, "bob", ListOptions{})
+	assert.NoError(t, err)
+	if assert.Len(t, bobs, 4) {
+		assert.Equal(t, logins[1].EventUUID, bobs[0].EventUUID, "should be oldest first")
+		assert.Equal(t, logins[3].EventUUID, bobs[1].EventUUID)
+		assert.Equal(t, logins[2].EventUUID, bobs[2].EventUUID)
+		assert.Equal(t, logins[0].EventUUID, bobs[3].EventUUID)
+		assert.Equal(t, logins[2].Lat, bobs[2].Lat)
+		assert.Equal(t, logins[2].Radius, bobs[2].Radius)
+		assert.Equal(t, logins[2].TimeZone, bobs[2].TimeZone)
+		assert.Equal(t, "", bobs[1].TimeZone)
+		assert.Equal(t, logins[2].CountryISO, bobs[2].CountryISO)
+		assert.Equal(t, logins[2].City, bobs[2].City)
+		assert.Equal(t, logins[2].Country, bobs[2].Country)
+	}
+
+	page, err := store.LoginsByUsername(ctx, "bob", ListOptions{Since: 1514700000, Limit: 2, Offset: 1})
+	assert.NoError(t, err)
+	if assert.Len(t, page, 2) {
+		assert.Equal(t, logins[2].EventUUID, page[0].EventUUID)
+		assert.Equal(t, logins[0].EventUUID, page[1].EventUUID)
+	}
+
+	// Resuming after the Baltimore login skips it but not the later one
+	resumed, err := store.LoginsByUsername(ctx, "bob", ListOptions{Since: 1514764800, AfterID: page[0].Id})
+	assert.NoError(t, err)
+	if assert.Len(t, resumed, 1) {
+		assert.Equal(t, logins[0].EventUUID, resumed[0].EventUUID)
+	}
+
+	between, err := store.LoginsByUsername(ctx, "bob", ListOptions{Since: 1514700000, Until: 1514764800})
+	assert.NoError(t, err)
+	if assert.Len(t, between, 2) {
+		assert.Equal(t, logins[3].EventUUID, between[0].EventUUID)
+		assert.Equal(t, logins[2].EventUUID, between[1].EventUUID)
+	}
+
+	all, err := store.AllLogins(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, all, 5)
+
+	users, err := store.DistinctUsernames(ctx, ListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []UserActivity{{Username: "alice", LastSeen: 1514764800}, {Username: "bob", LastSeen: 1514764801}}, users, "should be ordered by username")
+	users, err = store.DistinctUsernames(ctx, ListOptions{Limit: 1, Offset: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []UserActivity{{Username: "bob", LastSeen: 1514764801}}, users)
+	users, err = store.DistinctUsernames(ctx, ListOptions{Since: 1514764801})
+	assert.NoError(t, err)
+	assert.Equal(t, []UserActivity{{Username: "bob", LastSeen: 1514764801}}, users)
+
+	byEvent, err := store.LoginByEventUUID(ctx, logins[2].EventUUID)
+	assert.NoError(t, err)
+	if assert.NotNil(t, byEvent) {
+		byEvent.Id = 0
+		assert.Equal(t, logins[2], *byEvent)
+	}
+	byEvent, err = store.LoginByEventUUID(ctx, "f5ad929a-db03-4bf4-9541-8f728fa12e42")
+	assert.NoError(t, err)
+	assert.Nil(t, byEvent)
+
+	// The unlocated login between the first two is skipped
+	prev, post, err := store.AdjacentLogins(ctx, logins[2])
+	assert.NoError(t, err)
+	assert.Equal(t, logins[1].EventUUID, prev.EventUUID)
+	assert.Equal(t, logins[0].EventUUID, post.EventUUID)
+
+	prev, post, err = store.AdjacentLogins(ctx, logins[4])
+	assert.NoError(t, err)
+	assert.Empty(t, prev.Username)
+	assert.Empty(t, post.Username)
+
+	before, after, err := store.NeighborLogins(ctx, logins[0], 2)
+	assert.NoError(t, err)
+	assert.Empty(t, after)
+	if assert.Len(t, before, 2, "the unlocated login isn't a neighbour") {
+		assert.Equal(t, logins[2].EventUUID, before[0].EventUUID, "should be nearest first")
+		assert.Equal(t, logins[1].EventUUID, before[1].EventUUID)
+	}
+	before, after, err = store.NeighborLogins(ctx, logins[1], 1)
+	assert.NoError(t, err)
+	assert.Empty(t, before)
+	if assert.Len(t, after, 1) {
+		assert.Equal(t, logins[2].EventUUID, after[0].EventUUID)
+	}
+
+	detection := Detection{Username: "bob", Direction: "from", EventUUID: logins[2].EventUUID, IPAddr: logins[2].IPAddr, UnixTimestamp: logins[2].UnixTimestamp,
+		OtherEventUUID: logins[0].EventUUID, OtherIPAddr: logins[0].IPAddr, OtherUnixTimestamp: logins[0].UnixTimestamp,
+		Speed: 8330887, Distance: 2314.1353294357455, Unit: "mi", DetectedAt: 1514764802}
+	assert.NoError(t, store.InsertDetection(ctx, detection))
+	detections, err := store.DetectionsByUsername(ctx, "bob")
+	assert.NoError(t, err)
+	if assert.Len(t, detections, 1) {
+		detection.Id = detections[0].Id
+		assert.Equal(t, detection, *detections[0])
+	}
+
+	// Flagged in both directions, but it's the one login
+	detection.Direction = "to"
+	assert.NoError(t, store.InsertDetection(ctx, detection))
+	stats, err := store.UserStats(ctx, "bob")
+	assert.NoError(t, err)
+	assert.Equal(t, UserStats{Logins: 4, DistinctIPs: 4, DistinctCountries: 1, SuspiciousLogins: 1}, stats)
+	stats, err = store.UserStats(ctx, "nobody")
+	assert.NoError(t, err)
+	assert.Equal(t, UserStats{}, stats)
+
+	// Erasing a user takes everything stored for them
+	assert.NoError(t, store.SetHome(ctx, Home{Username: "bob", Lat: 39.2293, Lon: -76.6907, Radius: 25}))
+	assert.NoError(t, store.SetLastAlert(ctx, Alert{Username: "bob", At: 1514764800}))
+	assert.NoError(t, store.SetThreshold(ctx, Threshold{Username: "bob", SpeedThreshold: 700}))
+	assert.NoError(t, store.InsertDetection(ctx, Detection{Username: "alice", Direction: "home", UnixTimestamp: 1514764800}))
+	user, err := store.DeleteUser(ctx, "bob")
+	assert.NoError(t, err)
+	assert.Equal(t, DeletedUser{Logins: 4, Detections: 2, Homes: 1, Alerts: 1, Thresholds: 1}, user)
+	user, err = store.DeleteUser(ctx, "bob")
+	assert.NoError(t, err)
+	assert.Equal(t, DeletedUser{}, user, "deleting again should be a no-op")
+	bobs, err = store.LoginsByUsername(ctx, "bob", ListOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, bobs)
+	bobDetections, err := store.DetectionsByUsername(ctx, "bob")
+	assert.NoError(t, err)
+	assert.Empty(t, bobDetections)
+	bobHome, err := store.HomeByUsername(ctx, "bob")
+	assert.NoError(t, err)
+	assert.Nil(t, bobHome)
+	alices, err := store.LoginsByUsername(ctx, "alice", ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, alices, 1, "other users' logins should be kept")
+	aliceDetections, err := store.DetectionsByUsername(ctx, "alice")
+	assert.NoError(t, err)
+	assert.Len(t, aliceDetections, 1, "other users' audit records should be kept")
+
+	assert.NoError(t, store.InsertLogin(ctx, Login{Username: "erin", UnixTimestamp: 1514000000, EventUUID: "95ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "206.81.252.6"}))
+	assert.NoError(t, store.InsertLogin(ctx, Login{Username: "erin", UnixTimestamp: 1514764799, EventUUID: "a5ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "206.81.252.6"}))
+	deleted, err := store.DeleteLoginsOlderThan(ctx, 1514764800)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+	alices, err = store.LoginsByUsername(ctx, "alice", ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, alices, 1, "logins at the cutoff should be kept")
+	erins, err := store.LoginsByUsername(ctx, "erin", ListOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, erins)
+
+	// Audit records are expired by the timestamp of the login they're about
+	assert.NoError(t, store.InsertDetection(ctx, Detection{Username: "erin", Direction: "to", UnixTimestamp: 1514764799}))
+	assert.NoError(t, store.InsertDetection(ctx, Detection{Username: "erin", Direction: "to", UnixTimestamp: 1514764800}))
+	deleted, err = store.DeleteDetectionsOlderThan(ctx, 1514764800)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	erinDetections, err := store.DetectionsByUsername(ctx, "erin")
+	assert.NoError(t, err)
+	if assert.Len(t, erinDetections, 1) {
+		assert.Equal(t, int64(1514764800), erinDetections[0].UnixTimestamp)
+	}
+
+	// Trimming keeps the newest logins, by timestamp rather than when they were saved
+	assert.NoError(t, store.InsertLogin(ctx, Login{Username: "frank", UnixTimestamp: 1514764802, EventUUID: "b5ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "206.81.252.6"}))
+	assert.NoError(t, store.InsertLogin(ctx, Login{Username: "frank", UnixTimestamp: 1514764800, EventUUID: "c5ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "206.81.252.6"}))
+	assert.NoError(t, store.InsertLogin(ctx, Login{Username: "frank", UnixTimestamp: 1514764801, EventUUID: "d5ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "206.81.252.6"}))
+	deleted, err = store.TrimLogins(ctx, "frank", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	franks, err := store.LoginsByUsername(ctx, "frank", ListOptions{})
+	assert.NoError(t, err)
+	if assert.Len(t, franks, 2) {
+		assert.Equal(t, "d5ad929a-db03-4bf4-9541-8f728fa12e42", franks[0].EventUUID)
+		assert.Equal(t, "b5ad929a-db03-4bf4-9541-8f728fa12e42", franks[1].EventUUID)
+	}
+	deleted, err = store.TrimLogins(ctx, "frank", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), deleted, "trimming again should be a no-op")
+
+	// An unknown accuracy radius is kept distinct from a radius of zero
+	assert.NoError(t, store.InsertLogin(ctx, Login{Username: "carol", UnixTimestamp: 1514764800, EventUUID: "65ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907}))
+	assert.NoError(t, store.InsertLogin(ctx, Login{Username: "carol", UnixTimestamp: 1514764801, EventUUID: "75ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: radius(0)}))
+	carols, err := store.LoginsByUsername(ctx, "carol", ListOptions{})
+	assert.NoError(t, err)
+	if assert.Len(t, carols, 2) {
+		assert.Nil(t, carols[0].Radius)
+		if assert.NotNil(t, carols[1].Radius) {
+			assert.Equal(t, uint16(0), *carols[1].Radius)
+		}
+	}
+
+	// Bulk inserts skip events that are already saved
+	inserted, err := store.InsertLogins(ctx, []Login{
+		{Username: "dave", UnixTimestamp: 1514764800, EventUUID: "85ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: radius(10)},
+		{Username: "carol", UnixTimestamp: 1514764802, EventUUID: "65ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "206.81.252.6"},
+		{Username: "dave", UnixTimestamp: 1514764900, EventUUID: "95ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "10.0.0.1"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), inserted)
+	daves, err := store.LoginsByUsername(ctx, "dave", ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, daves, 2)
+
+	// Homes are replaced rather than duplicated
+	home, err := store.HomeByUsername(ctx, "dave")
+	assert.NoError(t, err)
+	assert.Nil(t, home)
+	assert.NoError(t, store.SetHome(ctx, Home{Username: "dave", Lat: 30.3773, Lon: -97.71, Radius: 50}))
+	assert.NoError(t, store.SetHome(ctx, Home{Username: "dave", Lat: 39.2293, Lon: -76.6907, Radius: 25}))
+	home, err = store.HomeByUsername(ctx, "dave")
+	assert.NoError(t, err)
+	assert.Equal(t, &Home{Username: "dave", Lat: 39.2293, Lon: -76.6907, Radius: 25}, home)
+
+	// So are thresholds
+	threshold, err := store.ThresholdByUsername(ctx, "dave")
+	assert.NoError(t, err)
+	assert.Nil(t, threshold)
+	assert.NoError(t, store.SetThreshold(ctx, Threshold{Username: "dave", SpeedThreshold: 700}))
+	assert.NoError(t, store.SetThreshold(ctx, Threshold{Username: "dave", SpeedThreshold: 900}))
+	threshold, err = store.ThresholdByUsername(ctx, "dave")
+	assert.NoError(t, err)
+	assert.Equal(t, &Threshold{Username: "dave", SpeedThreshold: 900}, threshold)
+
+	// Likewise the last alert
+	alert, err := store.LastAlert(ctx, "dave")
+	assert.NoError(t, err)
+	assert.Nil(t, alert)
+	assert.NoError(t, store.SetLastAlert(ctx, Alert{Username: "dave", At: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000a"}))
+	assert.NoError(t, store.SetLastAlert(ctx, Alert{Username: "dave", At: 1514764900, EventUUID: "00000000-0000-4000-8000-00000000000b"}))
+	alert, err = store.LastAlert(ctx, "dave")
+	assert.NoError(t, err)
+	assert.Equal(t, &Alert{Username: "dave", At: 1514764900, EventUUID: "00000000-0000-4000-8000-00000000000b"}, alert)
+
+	assert.NoError(t, store.Ping(ctx))
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testStore(t, newMemoryStore(t))
+}
+
+func TestStoreHonoursContext(t *testing.T) {
+	store := newMemoryStore(t)
+	defer store.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	_, err := store.LoginsByUsername(ctx, "bob", ListOptions{})
+	assert.True(t, errors.Is(err, context.Canceled), "expected context.Canceled, got %v", err)
+	assert.Error(t, store.InsertLogin(ctx, Login{Username: "bob", EventUUID: "15ad929a-db03-4bf4-9541-8f728fa12e42"}))
+	assert.True(t, time.Since(start) < time.Second, "cancelled queries should return promptly")
+
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timed := NewSQLiteStore(db, Options{QueryTimeout: time.Nanosecond})
+	defer timed.Close()
+	time.Sleep(time.Millisecond)
+	_, err = timed.AllLogins(context.Background())
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "expected context.DeadlineExceeded, got %v", err)
+}
+
+func TestOpenSelectsDialect(t *testing.T) {
+	store, err := Open(":memory:", Options{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "sqlite", store.(*sqlStore).dialect.name)
+		store.Close()
+	}
+}
+
+func TestPostgresRebind(t *testing.T) {
+	assert.Equal(t, "SELECT a FROM logins WHERE username=$1 AND tStamp>$2",
+		postgresDialect.rebind("SELECT a FROM logins WHERE username=? AND tStamp>?"))
+	assert.Equal(t, "SELECT 1", postgresDialect.rebind("SELECT 1"))
+}
+
+// The SQL lookup should agree with searching the user's located logins in memory
+func TestAdjacentLoginsMatchesInMemory(t *testing.T) {
+	store := newMemoryStore(t)
+	defer store.Close()
+
+	ctx := context.Background()
+	timestamps := []int64{1514764800, 1514677279, 1514851200, 1514700000, 9, 1514764801, 100}
+	for i, ts := range timestamps {
+		login := Login{Username: "bob", UnixTimestamp: ts, EventUUID: fmt.Sprintf("uuid-%d", i), IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: radius(10)}
+		if i == 3 {
+			login.Lat, login.Lon = 0, 0
+		}
+		assert.NoError(t, store.InsertLogin(ctx, login))
+	}
+
+	logins, err := store.LoginsByUsername(ctx, "bob", ListOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	located := make([]*Login, 0, len(logins))
+	for _, login := range logins {
+		if login.HasLocation() {
+			located = append(located, login)
+		}
+	}
+	for _, login := range located {
+		wantPrev, wantPost := GetAdjacentLogins(located, *login)
+		prev, post, err := store.AdjacentLogins(ctx, *login)
+		assert.NoError(t, err)
+		assert.Equal(t, wantPrev, prev, "preceding login of %v", login.EventUUID)
+		assert.Equal(t, wantPost, post, "subsequent login of %v", login.EventUUID)
+	}
+}
+
+func TestStatementsArePrepared(t *testing.T) {
+	store := newMemoryStore(t)
+	defer store.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := store.LoginsByUsername(ctx, "bob", ListOptions{})
+		assert.NoError(t, err)
+	}
+	assert.Len(t, store.(*sqlStore).stmts, 1, "repeated queries should reuse one statement")
+}
+
+// Compares LoginsByUsername with and without the username index over 100k logins
+// spread across 1000 users
+func BenchmarkLoginsByUsername(b *testing.B) {
+	db, err := NewDB(":memory:")
+	if err != nil {
+		b.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	store := NewSQLiteStore(db, Options{})
+	defer store.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 100000; i++ {
+		_, err := tx.Exec("INSERT INTO logins (username,tStamp,uuid,ipAddr,lat,lon,radius) VALUES (?,?,?,?,?,?,?)",
+			fmt.Sprintf("user%d", i%1000), 1514764800+i, fmt.Sprintf("uuid-%d", i), "206.81.252.6", 39.2293, -76.6907, 10)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		b.Fatal(err)
+	}
+
+	ctx := context.Background()
+	query := func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if _, err := store.LoginsByUsername(ctx, fmt.Sprintf("user%d", n%1000), ListOptions{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("indexed", query)
+
+	if _, err := db.Exec("DROP INDEX logins_username_tstamp"); err != nil {
+		b.Fatal(err)
+	}
+	// The cached statement was planned with the index
+	for _, statement := range store.(*sqlStore).stmts {
+		statement.Close()
+	}
+	store.(*sqlStore).stmts = make(map[string]*sql.Stmt)
+	b.Run("unindexed", query)
+}
+
+func TestConcurrentSQLiteInserts(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "logins.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var mode string
+	assert.NoError(t, store.(*sqlStore).db.QueryRow("PRAGMA journal_mode").Scan(&mode))
+	assert.Equal(t, "wal", mode)
+
+	const writers, each = 20, 25
+	errs := make(chan error, writers*each)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				errs <- store.InsertLogin(context.Background(), Login{Username: fmt.Sprintf("user%d", w), UnixTimestamp: int64(1514764800 + i), EventUUID: fmt.Sprintf("%d-%d", w, i), IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907})
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	all, err := store.AllLogins(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, all, writers*each)
+}
+
+func TestWithDSNParam(t *testing.T) {
+	assert.Equal(t, "data.db?_busy_timeout=5000", withDSNParam("data.db", "_busy_timeout", "5000"))
+	assert.Equal(t, "data.db?cache=shared&_busy_timeout=5000", withDSNParam("data.db?cache=shared", "_busy_timeout", "5000"))
+	assert.Equal(t, "data.db?_busy_timeout=100", withDSNParam("data.db?_busy_timeout=100", "_busy_timeout", "5000"))
+}
+
+func TestNewDBMigratesExistingDatabase(t *testing.T) {
+	// Databases from before schema versioning, with and without the timezone column
+	fixtures := map[string]string{
+		"original":      "CREATE TABLE logins (id INTEGER PRIMARY KEY, username TEXT, tStamp TEXT, uuid TEXT, ipAddr TEXT, lat TEXT, lon TEXT, radius TEXT)",
+		"with timezone": "CREATE TABLE logins (id INTEGER PRIMARY KEY, username TEXT, tStamp TEXT, uuid TEXT, ipAddr TEXT, lat TEXT, lon TEXT, radius TEXT, timezone TEXT NOT NULL DEFAULT '')",
+	}
+
+	for name, schema := range fixtures {
+		path := filepath.Join(t.TempDir(), "logins.db")
+		old, err := sql.Open("sqlite3", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = old.Exec(schema)
+		assert.NoError(t, err, name)
+		_, err = old.Exec("INSERT INTO logins (username, tStamp, uuid, ipAddr, lat, lon, radius) VALUES ('bob', '1514764800', 'a', '206.81.252.6', '39.2293', '-76.6907', '10')")
+		assert.NoError(t, err, name)
+		old.Close()
+
+		// Opening again applies nothing more
+		for i := 0; i < 2; i++ {
+			db, err := NewDB(path)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			version, err := schemaVersion(db)
+			assert.NoError(t, err, name)
+			assert.Equal(t, len(sqliteDialect.migrations), version, name)
+			var applied int
+			assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM schema_version").Scan(&applied), name)
+			assert.Equal(t, len(sqliteDialect.migrations), applied, name)
+
+			store := NewSQLiteStore(db, Options{})
+			logins, err := store.LoginsByUsername(context.Background(), "bob", ListOptions{})
+			assert.NoError(t, err, name)
+			if assert.Len(t, logins, 1, name) {
+				assert.Equal(t, "", logins[0].TimeZone, name)
+			}
+			store.Close()
+		}
+	}
+}
+
+func TestNewDBDedupesExistingDatabase(t *testing.T) {
+	// Before event_uuids were unique, a retried event was saved again each time
+	path := filepath.Join(t.TempDir(), "logins.db")
+	old, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec("CREATE TABLE logins (id INTEGER PRIMARY KEY, username TEXT, tStamp TEXT, uuid TEXT, ipAddr TEXT, lat TEXT, lon TEXT, radius TEXT)")
+	assert.NoError(t, err)
+	for _, values := range []string{
+		"('bob', '1514764800', 'a', '206.81.252.6', '39.2293', '-76.6907', '10')",
+		"('bob', '1514764801', 'b', '91.207.175.104', '34.0549', '-118.2578', '200')",
+		"('bob', '1514764800', 'a', '24.242.71.20', '30.3773', '-97.71', '5')",
+		"('bob', '1514764800', 'a', '206.81.252.6', '39.2293', '-76.6907', '10')",
+	} {
+		_, err = old.Exec("INSERT INTO logins (username, tStamp, uuid, ipAddr, lat, lon, radius) VALUES " + values)
+		assert.NoError(t, err)
+	}
+	old.Close()
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewSQLiteStore(db, Options{})
+	defer store.Close()
+	logins, err := store.LoginsByUsername(context.Background(), "bob", ListOptions{})
+	assert.NoError(t, err)
+	if assert.Len(t, logins, 2) {
+		assert.Equal(t, "a", logins[0].EventUUID)
+		assert.Equal(t, "206.81.252.6", logins[0].IPAddr, "the first copy should be kept")
+		assert.Equal(t, "b", logins[1].EventUUID)
+	}
+	assert.Equal(t, ErrDuplicateLogin, store.InsertLogin(context.Background(), Login{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "a", IPAddr: "206.81.252.6"}))
+}
+
+func TestNewDBNullsUnknownRadii(t *testing.T) {
+	// Before the radius was nullable an unknown one was saved as 0
+	path := filepath.Join(t.TempDir(), "logins.db")
+	old, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec("CREATE TABLE logins (id INTEGER PRIMARY KEY, username TEXT, tStamp TEXT, uuid TEXT, ipAddr TEXT, lat TEXT, lon TEXT, radius TEXT)")
+	assert.NoError(t, err)
+	_, err = old.Exec("INSERT INTO logins (username, tStamp, uuid, ipAddr, lat, lon, radius) VALUES ('bob', '1514764800', 'a', '206.81.252.6', '39.2293', '-76.6907', 0), ('bob', '1514764801', 'b', '206.81.252.6', '39.2293', '-76.6907', 10)")
+	assert.NoError(t, err)
+	old.Close()
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewSQLiteStore(db, Options{})
+	defer store.Close()
+	logins, err := store.LoginsByUsername(context.Background(), "bob", ListOptions{})
+	assert.NoError(t, err)
+	if assert.Len(t, logins, 2) {
+		assert.Nil(t, logins[0].Radius, "an old 0 should read back as unknown")
+		assert.Equal(t, radius(10), logins[1].Radius)
+	}
+}
+
+func TestNewDBRebuildsUsernameIndex(t *testing.T) {
+	// Databases from before schema versioning indexed the TEXT timestamp itself
+	path := filepath.Join(t.TempDir(), "logins.db")
+	old, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec("CREATE TABLE logins (id INTEGER PRIMARY KEY, username TEXT, tStamp TEXT, uuid TEXT, ipAddr TEXT, lat TEXT, lon TEXT, radius TEXT)")
+	assert.NoError(t, err)
+	_, err = old.Exec("CREATE INDEX logins_username_tstamp ON logins (username, tStamp)")
+	assert.NoError(t, err)
+	old.Close()
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The user's logins are read off the index in order, rather than sorted afresh
+	ts := sqliteDialect.timestamp
+	rows, err := db.Query("EXPLAIN QUERY PLAN SELECT id FROM logins WHERE username=? AND "+ts+"<=? ORDER BY "+ts+" DESC, id DESC LIMIT ?", "bob", 1514764800, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var plan []string
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		assert.NoError(t, rows.Scan(&id, &parent, &notUsed, &detail))
+		plan = append(plan, detail)
+	}
+	assert.NoError(t, rows.Err())
+	assert.Contains(t, strings.Join(plan, "\n"), "logins_username_tstamp")
+	assert.NotContains(t, strings.Join(plan, "\n"), "TEMP B-TREE", "the neighbour queries shouldn't sort")
+}
+
+func TestMigrateFailureRollsBack(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	d := sqliteDialect
+	d.migrations = []migration{
+		{"create a table", execAll("CREATE TABLE a (id INTEGER)")},
+		{"half done", execAll("CREATE TABLE b (id INTEGER)", "NOT SQL")},
+	}
+	err = migrate(db, d)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "schema version 2 (half done)")
+	}
+
+	// The first migration stays applied, the second leaves nothing behind to retry over
+	version, err := schemaVersion(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version)
+	var tables int
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='b'").Scan(&tables))
+	assert.Equal(t, 0, tables)
+}
+
+func TestDeleteLoginsOlderThanInBatches(t *testing.T) {
+	store := newMemoryStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	var rows []Login
+	for i := 0; i < 2*deleteBatchSize+10; i++ {
+		rows = append(rows, Login{Username: "bob", UnixTimestamp: int64(1514000000 + i), EventUUID: fmt.Sprintf("old-%d", i), IPAddr: "206.81.252.6"})
+	}
+	rows = append(rows, Login{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "new", IPAddr: "206.81.252.6"})
+	_, err := store.InsertLogins(ctx, rows)
+	assert.NoError(t, err)
+
+	deleted, err := store.DeleteLoginsOlderThan(ctx, 1514764800)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2*deleteBatchSize+10), deleted)
+	left, err := store.AllLogins(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, left, 1) {
+		assert.Equal(t, "new", left[0].EventUUID)
+	}
+
+	// The cutoff is looked up through the timestamp index, not a scan of every login
+	var id, parent, notUsed int
+	var detail string
+	err = store.(*sqlStore).db.QueryRow("EXPLAIN QUERY PLAN SELECT id FROM logins WHERE "+sqliteDialect.indexedTimestamp+"<? LIMIT ?", 1514764800, deleteBatchSize).Scan(&id, &parent, &notUsed, &detail)
+	assert.NoError(t, err)
+	assert.Contains(t, detail, "logins_tstamp")
+}
+
+func TestAdjacentLoginsOneSideUnreadable(t *testing.T) {
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	store := NewSQLiteStore(db, Options{})
+	defer store.Close()
+	ctx := context.Background()
+
+	austin := Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "25ad929a-db03-4bf4-9541-8f728fa12e42", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: radius(5)}
+	assert.NoError(t, store.InsertLogin(ctx, austin))
+	// A lat that sorts as a number but can't be scanned as one
+	_, err = db.Exec("INSERT INTO logins (username,tStamp,uuid,ipAddr,lat,lon,radius) VALUES ('bob','1514851200','15ad929a-db03-4bf4-9541-8f728fa12e42','91.207.175.104','34.0549°','-118.2578','200')")
+	assert.NoError(t, err)
+
+	prev, post, err := store.AdjacentLogins(ctx, Login{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "35ad929a-db03-4bf4-9541-8f728fa12e42"})
+	var sideErr *AdjacentError
+	if assert.True(t, errors.As(err, &sideErr), "expected an AdjacentError, got %v", err) {
+		assert.Equal(t, "subsequent", sideErr.Side)
+	}
+	assert.Equal(t, austin.EventUUID, prev.EventUUID, "the preceding login should still be returned")
+	assert.Empty(t, post.Username)
+}
+
+func TestPoolSettings(t *testing.T) {
+	ctx := context.Background()
+	// Checks out n connections at once and puts them back
+	useConns := func(db *sql.DB, n int) {
+		var conns []*sql.Conn
+		for i := 0; i < n; i++ {
+			conn, err := db.Conn(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conns = append(conns, conn)
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+
+	// SQLite keeps to a single connection by default
+	db, err := newSQLiteDB(filepath.Join(t.TempDir(), "default.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	useConns(db, 1)
+	assert.Equal(t, 1, db.Stats().MaxOpenConnections)
+	assert.Equal(t, 1, db.Stats().Idle)
+
+	db, err = newSQLiteDB(filepath.Join(t.TempDir(), "tuned.db"), Options{MaxOpenConns: 3, MaxIdleConns: 2, ConnMaxLifetime: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	useConns(db, 3)
+	assert.Equal(t, 3, db.Stats().MaxOpenConnections)
+	assert.Equal(t, 2, db.Stats().Idle)
+	assert.Equal(t, int64(1), db.Stats().MaxIdleClosed, "the third connection shouldn't be kept")
+
+	// Connections past their lifetime are replaced when they're next used
+	time.Sleep(300 * time.Millisecond)
+	useConns(db, 1)
+	assert.NotZero(t, db.Stats().MaxLifetimeClosed)
+}
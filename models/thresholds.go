@@ -0,0 +1,45 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+)
+
+// A user's own speed threshold, for someone whose travel would flag under the global one
+// (a pilot, say). It replaces SpeedThreshold and the directional thresholds for their logins.
+type Threshold struct {
+	Username string `json:"username"`
+	// In mph
+	SpeedThreshold int `json:"speed_threshold"`
+}
+
+func (s *sqlStore) SetThreshold(ctx context.Context, threshold Threshold) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	statement, err := s.stmt(ctx, "INSERT INTO thresholds (username,speed) VALUES (?,?) ON CONFLICT (username) DO UPDATE SET speed=excluded.speed")
+	if err != nil {
+		return err
+	}
+	_, err = statement.ExecContext(ctx, threshold.Username, threshold.SpeedThreshold)
+	return err
+}
+
+func (s *sqlStore) ThresholdByUsername(ctx context.Context, username string) (*Threshold, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	statement, err := s.stmt(ctx, "SELECT username, speed FROM thresholds WHERE username=?")
+	if err != nil {
+		return nil, err
+	}
+	threshold := new(Threshold)
+	err = statement.QueryRowContext(ctx, username).Scan(&threshold.Username, &threshold.SpeedThreshold)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return threshold, nil
+}
@@ -0,0 +1,99 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"math"
+)
+
+// A user with stored logins and when they last logged in
+type UserActivity struct {
+	Username string `json:"username"`
+	// Unix timestamp of the user's newest login within the listed range
+	LastSeen int64 `json:"last_seen"`
+}
+
+func (s *sqlStore) DistinctUsernames(ctx context.Context, opts ListOptions) ([]UserActivity, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	limit := int64(opts.Limit)
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+	until := opts.Until
+	if until <= 0 {
+		until = math.MaxInt64
+	}
+	ts := s.dialect.timestamp
+	statement, err := s.stmt(ctx, "SELECT username, MAX("+ts+") FROM logins WHERE "+ts+">=? AND "+ts+"<=? GROUP BY username ORDER BY username LIMIT ? OFFSET ?")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := statement.QueryContext(ctx, opts.Since, until, limit, opts.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]UserActivity, 0)
+	for rows.Next() {
+		var user UserActivity
+		if err := rows.Scan(&user.Username, &user.LastSeen); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// How many rows DeleteUser removed from each table holding the user's data
+type DeletedUser struct {
+	Logins     int64 `json:"logins"`
+	Detections int64 `json:"detections"`
+	Homes      int64 `json:"homes"`
+	Alerts     int64 `json:"alerts"`
+	Thresholds int64 `json:"thresholds"`
+}
+
+func (s *sqlStore) DeleteUser(ctx context.Context, username string) (DeletedUser, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	var deleted DeletedUser
+	tables := []struct {
+		name  string
+		count *int64
+	}{
+		{"logins", &deleted.Logins},
+		{"detections", &deleted.Detections},
+		{"homes", &deleted.Homes},
+		{"alerts", &deleted.Alerts},
+		{"thresholds", &deleted.Thresholds},
+	}
+	// Prepared before the transaction takes what may be the only connection
+	statements := make([]*sql.Stmt, len(tables))
+	for i, table := range tables {
+		statement, err := s.stmt(ctx, "DELETE FROM "+table.name+" WHERE username=?")
+		if err != nil {
+			return DeletedUser{}, err
+		}
+		statements[i] = statement
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return DeletedUser{}, err
+	}
+	defer tx.Rollback()
+	for i, table := range tables {
+		result, err := tx.StmtContext(ctx, statements[i]).ExecContext(ctx, username)
+		if err != nil {
+			return DeletedUser{}, err
+		}
+		if *table.count, err = result.RowsAffected(); err != nil {
+			return DeletedUser{}, err
+		}
+	}
+	return deleted, tx.Commit()
+}
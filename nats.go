@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Longest wait between attempts to reconnect to NATS
+const natsMaxReconnectWait = 30 * time.Second
+
+// A messageQueue over a NATS connection. The client answers the server's keepalive PINGs and
+// reconnects, resubscribing, whenever the connection drops.
+type natsConn struct {
+	conn *nats.Conn
+}
+
+// Connects to a nats:// or tls:// URL, with any credentials in it. Lost connections are
+// retried forever, backing off exponentially up to natsMaxReconnectWait, so a NATS outage
+// stalls consumption rather than stopping it. opts override the defaults.
+func dialNATS(url string, logger *slog.Logger, opts ...nats.Option) (*natsConn, error) {
+	defaults := []nats.Option{
+		nats.Name("superman-detector"),
+		nats.MaxReconnects(-1),
+		nats.CustomReconnectDelay(func(attempts int) time.Duration {
+			return min(time.Second<<min(attempts, 5), natsMaxReconnectWait)
+		}),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			logger.Warn("disconnected from NATS", "error", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			logger.Info("reconnected to NATS", "server", nc.ConnectedUrlRedacted())
+		}),
+	}
+	conn, err := nats.Connect(url, append(defaults, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	return &natsConn{conn: conn}, nil
+}
+
+func (nc *natsConn) subscribe(ctx context.Context, subject string, handle func(data []byte)) error {
+	sub, err := nc.conn.SubscribeSync(subject)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		handle(msg.Data)
+	}
+}
+
+func (nc *natsConn) publish(subject string, data []byte) error {
+	return nc.conn.Publish(subject, data)
+}
+
+func (nc *natsConn) close() error {
+	// Sends anything still buffered, such as the last results, before closing
+	err := nc.conn.FlushTimeout(5 * time.Second)
+	nc.conn.Close()
+	return err
+}
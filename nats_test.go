@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Plays a NATS server for the client's connections in turn, one per list of messages: greets
+// it, answers its PINGs and checks it answers one, sends it the messages once it has
+// subscribed and passes what it publishes on to published. Every connection but the last
+// is dropped once a result has been published for each of its messages.
+func fakeNATSServer(t *testing.T, connections [][]string, published chan<- string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for i, messages := range connections {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			serveNATS(conn, messages, published, i < len(connections)-1)
+			conn.Close()
+		}
+	}()
+	return "nats://" + listener.Addr().String()
+}
+
+// Serves one connection until the client closes it or, with drop set, until every message
+// has its result
+func serveNATS(conn net.Conn, messages []string, published chan<- string, drop bool) {
+	reader := bufio.NewReader(conn)
+	readLine := func() (string, error) {
+		line, err := reader.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err
+	}
+
+	conn.Write([]byte(`INFO {"server_id":"test","proto":1,"max_payload":1048576}` + "\r\n"))
+	var sid string
+	remaining := len(messages)
+	for !drop || remaining > 0 {
+		line, err := readLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			conn.Write([]byte("PONG\r\n"))
+		case "SUB":
+			// Clients must answer the server's pings to stay connected
+			sid = fields[len(fields)-1]
+			conn.Write([]byte("PING\r\n"))
+		case "PONG":
+			for _, m := range messages {
+				conn.Write([]byte("MSG logins " + sid + " " + strconv.Itoa(len(m)) + "\r\n" + m + "\r\n"))
+			}
+		case "PUB":
+			payload, _ := readLine()
+			published <- line + " " + payload
+			remaining--
+		}
+	}
+}
+
+func TestNATSConsumer(t *testing.T) {
+	published := make(chan string, 1)
+	url := fakeNATSServer(t, [][]string{{`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`}}, published)
+
+	nc, err := dialNATS(url, env.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- newMemoryEnv(t).consume(ctx, nc, "logins", "logins.results")
+	}()
+
+	select {
+	case line := <-published:
+		if !strings.HasPrefix(line, "PUB logins.results ") || !strings.Contains(line, `"event_uuid":"00000000-0000-4000-8000-00000000000b","result":{`) {
+			t.Errorf("unexpected publish: got %v", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a result to be published")
+	}
+
+	// Cancelling stops the consumer cleanly
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the consumer to stop without an error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the consumer to stop")
+	}
+}
+
+func TestNATSConsumerReconnects(t *testing.T) {
+	published := make(chan string, 2)
+	url := fakeNATSServer(t, [][]string{
+		{`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`},
+		// Sent once the client has reconnected and subscribed again
+		{`{"username": "bob", "unix_timestamp": 1514764801, "event_uuid": "00000000-0000-4000-8000-00000000000c", "ip_address": "91.207.175.104"}`},
+	}, published)
+
+	nc, err := dialNATS(url, env.logger, nats.CustomReconnectDelay(func(int) time.Duration { return 10 * time.Millisecond }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go newMemoryEnv(t).consume(ctx, nc, "logins", "logins.results")
+
+	for _, uuid := range []string{"00000000-0000-4000-8000-00000000000b", "00000000-0000-4000-8000-00000000000c"} {
+		select {
+		case line := <-published:
+			if !strings.Contains(line, `"event_uuid":"`+uuid+`"`) {
+				t.Errorf("expected the result for %v, got %v", uuid, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the result for %v", uuid)
+		}
+	}
+}
+
+func TestDialNATSRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("INFO {}\r\n"))
+		bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte("-ERR 'Authorization Violation'\r\n"))
+	}()
+
+	if _, err := dialNATS("nats://"+listener.Addr().String(), env.logger); err == nil {
+		t.Errorf("expected a rejected CONNECT to fail")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"detector/models"
+	"errors"
+	"time"
+)
+
+// Values of Config.OutOfOrderPolicy
+const (
+	outOfOrderAccept = "accept"
+	outOfOrderReject = "reject"
+)
+
+var errOutOfOrder = errors.New("event is older than the user's newest login by more than the out-of-order tolerance")
+
+// Checks whether login is older than one of the user's stored logins by more than
+// OutOfOrderGrace, as replays and clients with a skewed clock send. An accepted one is
+// checked against the logins either side of its timestamp, like any other. Returns the
+// policy that handled it, or "" when it's in order; under the reject policy the error is
+// errOutOfOrder.
+func (env *Env) checkOrder(ctx context.Context, login models.Login) (string, error) {
+	tolerance := int64(env.OutOfOrderGrace / time.Second)
+	later, err := env.store.LoginsByUsername(ctx, login.Username, models.ListOptions{Since: login.UnixTimestamp + tolerance + 1, Limit: 1})
+	if err != nil {
+		return "", err
+	}
+	if len(later) == 0 {
+		return "", nil
+	}
+	if env.OutOfOrderPolicy != outOfOrderReject {
+		return outOfOrderAccept, nil
+	}
+	// A retry of an event that was let in before is answered as it was the first time
+	stored, err := env.store.LoginByEventUUID(ctx, login.EventUUID)
+	if err != nil {
+		return "", err
+	}
+	if stored != nil && stored.Username == login.Username {
+		return "", nil
+	}
+	return outOfOrderReject, errOutOfOrder
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"detector/models"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestOutOfOrderPolicy(t *testing.T) {
+	austin := models.Login{Username: "bob", UnixTimestamp: 1514600000, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)}
+	// The newest stored login
+	losAngeles := models.Login{Username: "bob", UnixTimestamp: 1514764801, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)}
+
+	tests := []struct {
+		name      string
+		policy    string
+		timestamp int64
+		// The out_of_order field, or the error code
+		outOfOrder string
+		code       string
+	}{
+		{"accepted", outOfOrderAccept, 1514764000, outOfOrderAccept, ""},
+		{"rejected", outOfOrderReject, 1514764000, "", codeOutOfOrder},
+		{"within the grace period", outOfOrderReject, 1514764700, "", ""},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		memEnv.OutOfOrderPolicy = tc.policy
+		seedLogins(t, memEnv, austin, losAngeles)
+
+		rr := postBatch(t, memEnv, fmt.Sprintf(`[{"username": "bob", "unix_timestamp": %d, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}]`, tc.timestamp))
+		var results []batchResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || len(results) != 1 {
+			t.Fatalf("%s: unexpected response %v %s", tc.name, rr.Code, rr.Body.String())
+		}
+		stored, err := memEnv.store.LoginByEventUUID(context.Background(), "00000000-0000-4000-8000-00000000000b")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tc.code != "" {
+			if results[0].Error == nil || results[0].Error.Code != tc.code || stored != nil {
+				t.Errorf("%s: expected a %v error and nothing saved, got %s, %+v", tc.name, tc.code, rr.Body.String(), stored)
+			}
+			continue
+		}
+		result := results[0].Result
+		if result == nil || result.OutOfOrder != tc.outOfOrder || stored == nil {
+			t.Fatalf("%s: expected out_of_order %q and the login saved, got %s", tc.name, tc.outOfOrder, rr.Body.String())
+		}
+		// Whenever it arrived, the login sits between its neighbours in time
+		if result.PrecedingIpAccess == nil || result.PrecedingIpAccess.IP != austin.IPAddr || result.SubsequentIpAccess == nil || result.SubsequentIpAccess.IP != losAngeles.IPAddr {
+			t.Errorf("%s: expected the login to be between Austin and Los Angeles, got %+v", tc.name, result)
+		}
+	}
+}
+
+func TestOutOfOrderRetry(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.OutOfOrderPolicy = outOfOrderReject
+	seedLogins(t, memEnv,
+		models.Login{Username: "bob", UnixTimestamp: 1514764000, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: accuracyRadius(10)},
+		models.Login{Username: "bob", UnixTimestamp: 1514764801, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)},
+	)
+
+	// Saved before the newer login arrived, so a retry isn't turned away
+	rr := postBatch(t, memEnv, `[{"username": "bob", "unix_timestamp": 1514764000, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}]`)
+	var results []batchResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || len(results) != 1 || results[0].Result == nil {
+		t.Errorf("expected a retried event to be answered, got %v %s", rr.Code, rr.Body.String())
+	}
+}
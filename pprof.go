@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// The net/http/pprof profiling handlers under /debug/pprof/. They're served on their own
+// listener, never alongside the api, since profiles expose the process's internals.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// Serves the profiling handlers on listener until ctx is cancelled
+func (env *Env) servePprof(ctx context.Context, listener net.Listener) {
+	server := &http.Server{Handler: pprofHandler()}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		env.logFor(ctx).Error("profiling server stopped", "error", err)
+	}
+}
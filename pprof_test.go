@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPprofNotOnAPI(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline"} {
+		rr := httptest.NewRecorder()
+		memEnv.handler().ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("%s: expected the api not to serve profiles, got %v", path, rr.Code)
+		}
+	}
+}
+
+func TestServePprof(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		newMemoryEnv(t).servePprof(ctx, listener)
+		close(done)
+	}()
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/heap"} {
+		resp, err := http.Get("http://" + listener.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: got %v want %v", path, resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the profiling server to stop")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Returns the client address carried by the proxy headers, or "" if there isn't a usable one.
+// X-Forwarded-For is a comma separated list appended to by each hop ("client, proxy1, proxy2"),
+// but anything left of the hops our own proxies appended is whatever the client sent. So the
+// list is read from the right, skipping TrustedProxies, and the first other hop is the client.
+// When that isn't a public address the connection's is used. X-Real-IP, which our proxy sets
+// outright, is used when X-Forwarded-For is absent.
+func (env *Env) proxyClientIP(request *http.Request) string {
+	if xff := request.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := parseHostIP(hops[i])
+			if ip != nil && env.isTrustedProxy(ip) {
+				continue
+			}
+			if ip != nil && isPublicIP(ip) {
+				return ip.String()
+			}
+			break
+		}
+		return remoteIP(request)
+	}
+	if ip := parseHostIP(request.Header.Get("X-Real-IP")); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// Returns the peer address of the connection with the port removed
+func remoteIP(request *http.Request) string {
+	if ip := parseHostIP(request.RemoteAddr); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// Parses an address that may carry a port, e.g. "1.2.3.4:80" or "[2001:db8::1]:443"
+func parseHostIP(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+// Whether ip is in one of the configured TrustedNetworks
+func (env *Env) isTrustedIP(ip net.IP) bool {
+	for _, network := range env.TrustedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether ip is one of the configured TrustedProxies
+func (env *Env) isTrustedProxy(ip net.IP) bool {
+	for _, network := range env.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsUnspecified() && !ip.IsMulticast()
+}
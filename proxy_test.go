@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"detector/models"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyClientIP(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_TRUSTED_PROXIES": "10.0.0.0/8"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	memEnv := newMemoryEnv(t)
+	memEnv.TrustedProxies = cfg.TrustedProxies
+
+	tests := []struct {
+		name     string
+		xff      string
+		realIP   string
+		expected string
+	}{
+		{"no headers", "", "", ""},
+		{"single hop", "206.81.252.6", "", "206.81.252.6"},
+		{"multi hop", "206.81.252.6, 24.242.71.20, 10.0.0.1", "", "24.242.71.20"},
+		{"trusted proxies skipped", "206.81.252.6, 10.0.0.7, 10.0.0.1", "", "206.81.252.6"},
+		{"spoofed hops before client", "10.0.0.7, 91.207.175.104, 206.81.252.6", "", "206.81.252.6"},
+		{"ports stripped", "206.81.252.6:5123, 10.0.0.1:80", "", "206.81.252.6"},
+		{"ipv6 with port", "[2001:4860:4860::8888]:443", "", "2001:4860:4860::8888"},
+		{"ipv6 without port", "2001:4860:4860::8888", "", "2001:4860:4860::8888"},
+		{"untrusted private hop", "206.81.252.6, 192.168.1.1", "", "192.0.2.10"},
+		{"only trusted proxies", "10.0.0.7, 10.0.0.1", "", "192.0.2.10"},
+		{"spoofed garbage", "127.0.0.1, not-an-ip", "", "192.0.2.10"},
+		{"x-real-ip", "", "24.242.71.20", "24.242.71.20"},
+		{"x-forwarded-for wins", "206.81.252.6", "24.242.71.20", "206.81.252.6"},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest("POST", "/v1/", nil)
+		req.RemoteAddr = "192.0.2.10:41000"
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if tc.realIP != "" {
+			req.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if got := memEnv.proxyClientIP(req); got != tc.expected {
+			t.Errorf("%s: proxyClientIP() = %q, want %q", tc.name, got, tc.expected)
+		}
+	}
+
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_TRUSTED_PROXIES": "10.0.0.1"})); err == nil {
+		t.Errorf("expected a proxy address without a prefix length to be rejected")
+	}
+}
+
+func TestHandlePostTrustProxyHeaders(t *testing.T) {
+	body := `{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "85ad929a-db03-4bf4-9541-8f728fa12e42", "ip_address": "91.207.175.104"}`
+	bodyNoIP := `{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "85ad929a-db03-4bf4-9541-8f728fa12e42"}`
+
+	tests := []struct {
+		name     string
+		trust    bool
+		body     string
+		xff      string
+		expected string
+	}{
+		{"header ignored when not trusted", false, body, "206.81.252.6", `{"current_geo":{"lat":34.0549,"lon":-118.2578,"radius":200,"city":"Los Angeles","subdivision":"California","country":"United States","country_iso":"US","time_zone":"America/Los_Angeles","local_time":"2017-12-31T16:00:00-08:00"},"geo_unavailable":false,"trusted_network":false,"preceding_ip_access":null,"subsequent_ip_access":null,"travel_to_current_geo_suspicious":null,"travel_from_current_geo_suspicious":null,"fastest_window_ip_access":null,"travel_within_window_suspicious":null,"concurrent_distant_login":null,"outside_home_geofence":null,"evaluated":false,"reason":"no_adjacent_logins","suspicious":false,"severity":"none","unit":"mi"}`},
+		{"header used when trusted", true, body, "206.81.252.6", `{"current_geo":{"lat":39.2293,"lon":-76.6907,"radius":10,"city":"Halethorpe","subdivision":"Maryland","country":"United States","country_iso":"US","time_zone":"America/New_York","local_time":"2017-12-31T19:00:00-05:00"},"geo_unavailable":false,"trusted_network":false,"preceding_ip_access":null,"subsequent_ip_access":null,"travel_to_current_geo_suspicious":null,"travel_from_current_geo_suspicious":null,"fastest_window_ip_access":null,"travel_within_window_suspicious":null,"concurrent_distant_login":null,"outside_home_geofence":null,"evaluated":false,"reason":"no_adjacent_logins","suspicious":false,"severity":"none","unit":"mi"}`},
+		{"body used without header", true, body, "", `{"current_geo":{"lat":34.0549,"lon":-118.2578,"radius":200,"city":"Los Angeles","subdivision":"California","country":"United States","country_iso":"US","time_zone":"America/Los_Angeles","local_time":"2017-12-31T16:00:00-08:00"},"geo_unavailable":false,"trusted_network":false,"preceding_ip_access":null,"subsequent_ip_access":null,"travel_to_current_geo_suspicious":null,"travel_from_current_geo_suspicious":null,"fastest_window_ip_access":null,"travel_within_window_suspicious":null,"concurrent_distant_login":null,"outside_home_geofence":null,"evaluated":false,"reason":"no_adjacent_logins","suspicious":false,"severity":"none","unit":"mi"}`},
+		{"remote addr used without header or body ip", true, bodyNoIP, "", `{"current_geo":{"lat":30.3773,"lon":-97.71,"radius":5,"city":"Austin","subdivision":"Texas","country":"United States","country_iso":"US","time_zone":"America/Chicago","local_time":"2017-12-31T18:00:00-06:00"},"geo_unavailable":false,"trusted_network":false,"preceding_ip_access":null,"subsequent_ip_access":null,"travel_to_current_geo_suspicious":null,"travel_from_current_geo_suspicious":null,"fastest_window_ip_access":null,"travel_within_window_suspicious":null,"concurrent_distant_login":null,"outside_home_geofence":null,"evaluated":false,"reason":"no_adjacent_logins","suspicious":false,"severity":"none","unit":"mi"}`},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		memEnv.TrustProxyHeaders = tc.trust
+
+		req := httptest.NewRequest("POST", "/v1/", bytes.NewBufferString(tc.body))
+		req.RemoteAddr = "24.242.71.20:41000"
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memEnv.HandlePost).ServeHTTP(rr, req)
+
+		if rr.Body.String() != tc.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v", tc.name, rr.Body.String(), tc.expected)
+		}
+	}
+}
+
+func TestTrustedNetworks(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_TRUSTED_CIDRS": "206.81.252.0/24, 2001:db8::/32"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	memEnv := newMemoryEnv(t)
+	memEnv.TrustedNetworks = cfg.TrustedNetworks
+
+	for ip, trusted := range map[string]bool{
+		"206.81.252.6":   true,
+		"206.81.253.6":   false,
+		"2001:db8::1":    true,
+		"2001:db9::1":    false,
+		"91.207.175.104": false,
+	} {
+		if memEnv.isTrustedIP(net.ParseIP(ip)) != trusted {
+			t.Errorf("%v: expected trusted to be %v", ip, trusted)
+		}
+	}
+
+	// A login from the VPN a second after one from Los Angeles is saved but not flagged
+	seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514764799, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)})
+	result, err := memEnv.Evaluate(context.Background(), loginRecord{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6"}, evalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.TrustedNetwork || result.Suspicious || result.Evaluated || result.Reason != reasonTrustedNetwork || result.CurrentGeo == nil {
+		t.Errorf("expected a located, trusted and unchecked login, got %+v", result)
+	}
+	logins, err := memEnv.store.LoginsByUsername(context.Background(), "bob", models.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 2 {
+		t.Errorf("expected the trusted login to be saved, got %v logins", len(logins))
+	}
+
+	// Outside the trusted ranges the same trip is suspicious
+	memEnv.TrustedNetworks = nil
+	seedLogins(t, memEnv, models.Login{Username: "alice", UnixTimestamp: 1514764799, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)})
+	result, err = memEnv.Evaluate(context.Background(), loginRecord{Username: "alice", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000d", IPAddr: "206.81.252.6"}, evalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TrustedNetwork || !result.Suspicious {
+		t.Errorf("expected an untrusted login to be checked, got %+v", result)
+	}
+
+	if _, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_TRUSTED_CIDRS": "206.81.252.6"})); err == nil {
+		t.Errorf("expected an address without a prefix length to be rejected")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A token bucket per client address. Each client can make burst requests at once, and
+// gets rate more tokens back every second.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	clock Clock
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int, clock Clock) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		clock:   clock,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// How long an idle bucket takes to fill back up. A full bucket is the same as no bucket,
+// so clients idle for longer than this can be forgotten.
+func (l *rateLimiter) refillTime() time.Duration {
+	return time.Duration(l.burst / l.rate * float64(time.Second))
+}
+
+// Takes a token for client. If there are none left it returns false and how long until
+// the next one.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	if now.Sub(l.lastSweep) > l.refillTime() {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Drops the buckets of clients that have been idle long enough to be full again
+func (l *rateLimiter) sweep(now time.Time) {
+	idle := l.refillTime()
+	for client, b := range l.buckets {
+		if now.Sub(b.last) > idle {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Middleware that answers 429 Too Many Requests, with a Retry-After header, once a client
+// has used up its tokens. Clients are told apart by address, taken from the proxy headers
+// when they're trusted. That's the hop our proxies report, never one the client wrote into
+// X-Forwarded-For, so a client can't get a fresh bucket by making up addresses. Does nothing
+// when rate limiting isn't configured.
+func (env *Env) withRateLimit(next http.HandlerFunc) http.HandlerFunc {
+	if env.limiter == nil {
+		return next
+	}
+	return func(rw http.ResponseWriter, request *http.Request) {
+		client := remoteIP(request)
+		if env.TrustProxyHeaders {
+			if ip := env.proxyClientIP(request); ip != "" {
+				client = ip
+			}
+		}
+
+		if ok, wait := env.limiter.allow(client); !ok {
+			env.logFor(request.Context()).Warn("rate limit exceeded", "client", client)
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(rw, http.StatusTooManyRequests, codeRateLimited, "rate limit exceeded, please slow down")
+			return
+		}
+		next(rw, request)
+	}
+}
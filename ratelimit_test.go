@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitBurst(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	clock := newFakeClock(1514764800)
+	memEnv.limiter = newRateLimiter(1, 3, clock)
+	router := memEnv.routes()
+
+	post := func(remoteAddr string, n int) *httptest.ResponseRecorder {
+		jsonBody := fmt.Sprintf(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-%012d", "ip_address": "10.0.0.1"}`, n)
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBufferString(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i := 0; i < 3; i++ {
+		if rr := post("198.51.100.7:5000", i); rr.Code != http.StatusOK {
+			t.Errorf("request %d within the burst: got status %v want %v", i, rr.Code, http.StatusOK)
+		}
+	}
+	rr := post("198.51.100.7:5001", 3)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("request over the burst: got status %v want %v", rr.Code, http.StatusTooManyRequests)
+	}
+	if rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("unexpected Retry-After: got %q want %q", rr.Header().Get("Retry-After"), "1")
+	}
+
+	// Other clients have their own bucket
+	if rr := post("198.51.100.8:5000", 4); rr.Code != http.StatusOK {
+		t.Errorf("another client: got status %v want %v", rr.Code, http.StatusOK)
+	}
+
+	clock.advance(time.Second)
+	if rr := post("198.51.100.7:5000", 5); rr.Code != http.StatusOK {
+		t.Errorf("after waiting for a token: got status %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := post("198.51.100.7:5000", 6); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("with the new token spent: got status %v want %v", rr.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestRateLimitBehindProxy(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.TrustProxyHeaders = true
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	memEnv.TrustedProxies = []*net.IPNet{proxies}
+	memEnv.limiter = newRateLimiter(1, 3, newFakeClock(1514764800))
+	router := memEnv.routes()
+
+	post := func(xff string, n int) *httptest.ResponseRecorder {
+		jsonBody := fmt.Sprintf(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-%012d"}`, n)
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBufferString(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "10.0.0.1:5000"
+		req.Header.Set("X-Forwarded-For", xff)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Whatever the client puts in front, our proxy appends the address it connected from
+	for i := 0; i < 3; i++ {
+		if rr := post(fmt.Sprintf("203.0.113.%d, 206.81.252.6, 10.0.0.7", i), i); rr.Code != http.StatusOK {
+			t.Errorf("request %d within the burst: got status %v want %v", i, rr.Code, http.StatusOK)
+		}
+	}
+	if rr := post("203.0.113.99, 206.81.252.6, 10.0.0.7", 3); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("request over the burst with a made up hop: got status %v want %v", rr.Code, http.StatusTooManyRequests)
+	}
+
+	// Another client behind the same proxy has its own bucket
+	if rr := post("206.81.252.6, 24.242.71.20, 10.0.0.7", 4); rr.Code != http.StatusOK {
+		t.Errorf("another client: got status %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestRateLimiterEvictsIdleClients(t *testing.T) {
+	clock := newFakeClock(1514764800)
+	limiter := newRateLimiter(2, 4, clock)
+
+	for i := 0; i < 100; i++ {
+		limiter.allow(fmt.Sprintf("198.51.100.%d", i))
+	}
+	if len(limiter.buckets) != 100 {
+		t.Fatalf("expected a bucket per client, got %v", len(limiter.buckets))
+	}
+
+	// Long enough for every bucket to have filled back up
+	clock.advance(3 * time.Second)
+	limiter.allow("198.51.100.200")
+	if len(limiter.buckets) != 1 {
+		t.Errorf("idle clients should be evicted: got %v buckets want %v", len(limiter.buckets), 1)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Deletes logins older than Retention when started and every RetentionInterval after that,
+// until ctx is done
+func (env *Env) runRetention(ctx context.Context) {
+	ticker := time.NewTicker(env.RetentionInterval)
+	defer ticker.Stop()
+	for {
+		env.expireLogins(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Deletes the logins from before now minus Retention, and the audit records of them,
+// returning how many logins there were
+func (env *Env) expireLogins(ctx context.Context) int64 {
+	cutoff := env.now().Add(-env.Retention).Unix()
+	logger := env.logFor(ctx)
+	// Whatever was deleted before an error stays deleted; the rest is tried next time
+	if detections, err := env.store.DeleteDetectionsOlderThan(ctx, cutoff); err != nil {
+		if ctx.Err() == nil {
+			logger.Error("could not delete expired audit records", "cutoff", cutoff, "deleted", detections, "error", err)
+		}
+	} else if detections > 0 {
+		logger.Info("deleted expired audit records", "cutoff", cutoff, "deleted", detections)
+	}
+	deleted, err := env.store.DeleteLoginsOlderThan(ctx, cutoff)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Error("could not delete expired logins", "cutoff", cutoff, "deleted", deleted, "error", err)
+		}
+		return deleted
+	}
+	logger.Info("deleted expired logins", "cutoff", cutoff, "deleted", deleted)
+	return deleted
+}
+
+// Deletes the user's oldest logins beyond MaxUserLogins, after one of theirs is saved. A
+// failure is only logged: the login is saved, and the next one trims the excess.
+func (env *Env) trimLogins(ctx context.Context, username string) {
+	if env.MaxUserLogins <= 0 {
+		return
+	}
+	deleted, err := env.store.TrimLogins(ctx, username, env.MaxUserLogins)
+	if err != nil {
+		env.logFor(ctx).Error("could not trim logins", "user", hashUsername(username), "error", err)
+		return
+	}
+	if deleted > 0 {
+		env.logFor(ctx).Debug("trimmed logins", "user", hashUsername(username), "deleted", deleted)
+	}
+}
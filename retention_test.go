@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"detector/models"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpireLogins(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.Retention = 7 * 24 * time.Hour
+	clock := newFakeClock(1514764800)
+	memEnv.clock = clock
+	now := clock.Now().Unix()
+	seedLogins(t, memEnv,
+		models.Login{Username: "bob", UnixTimestamp: now - 30*24*3600, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)},
+		models.Login{Username: "alice", UnixTimestamp: now - 8*24*3600, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: accuracyRadius(10)},
+		models.Login{Username: "bob", UnixTimestamp: now - 3600, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)},
+	)
+
+	for _, d := range []models.Detection{
+		{Username: "bob", Direction: "to", EventUUID: "00000000-0000-4000-8000-00000000000a", UnixTimestamp: now - 30*24*3600},
+		{Username: "bob", Direction: "to", EventUUID: "00000000-0000-4000-8000-00000000000c", UnixTimestamp: now - 3600},
+	} {
+		if err := memEnv.store.InsertDetection(context.Background(), d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if deleted := memEnv.expireLogins(context.Background()); deleted != 2 {
+		t.Errorf("expected the two logins older than a week to be deleted, got %v", deleted)
+	}
+	// Their audit records go with them
+	detections, err := memEnv.store.DetectionsByUsername(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detections) != 1 || detections[0].EventUUID != "00000000-0000-4000-8000-00000000000c" {
+		t.Errorf("expected only the recent login's audit record to be kept, got %+v", detections)
+	}
+	left, err := memEnv.store.AllLogins(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 || left[0].EventUUID != "00000000-0000-4000-8000-00000000000c" {
+		t.Errorf("expected only the recent login to be kept, got %+v", left)
+	}
+
+	// A week on, the last one has expired too
+	clock.advance(7 * 24 * time.Hour)
+	if deleted := memEnv.expireLogins(context.Background()); deleted != 1 {
+		t.Errorf("expected the remaining login to be deleted a week later, got %v", deleted)
+	}
+}
+
+func TestRunRetention(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.Retention = time.Hour
+	memEnv.RetentionInterval = time.Millisecond
+	// So closing the Env doesn't close the GeoIP database shared with the other tests
+	memEnv.resolver = nil
+	seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: time.Now().Unix() - 7200, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "206.81.252.6"})
+
+	memEnv.goBackground(context.Background(), memEnv.runRetention)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		left, err := memEnv.store.AllLogins(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(left) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the expired login to be deleted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Closing stops the job even though its context was never cancelled
+	closed := make(chan struct{})
+	go func() {
+		memEnv.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the retention job to stop")
+	}
+}
+
+func TestMaxUserLogins(t *testing.T) {
+	const max = 10
+	memEnv := newMemoryEnv(t)
+	memEnv.MaxUserLogins = max
+	seedLogins(t, memEnv, models.Login{Username: "alice", UnixTimestamp: 1514000000, EventUUID: "00000000-0000-4000-8000-0000000000aa", IPAddr: "206.81.252.6", Lat: 39.2293, Lon: -76.6907, Radius: accuracyRadius(10)})
+
+	var records []string
+	for i := 0; i < max+5; i++ {
+		records = append(records, fmt.Sprintf(`{"username": "bob", "unix_timestamp": %d, "event_uuid": "00000000-0000-4000-8000-%012d", "ip_address": "206.81.252.6"}`, 1514764800+i*60, i))
+	}
+	if rr := postBatch(t, memEnv, "["+strings.Join(records, ",")+"]"); rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	bobs, err := memEnv.store.LoginsByUsername(context.Background(), "bob", models.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bobs) != max {
+		t.Fatalf("expected only the newest %v logins to be kept, got %v", max, len(bobs))
+	}
+	// The five oldest are gone
+	if bobs[0].EventUUID != "00000000-0000-4000-8000-000000000005" || bobs[max-1].EventUUID != "00000000-0000-4000-8000-000000000014" {
+		t.Errorf("expected logins 5 to 14 to be kept, got %v to %v", bobs[0].EventUUID, bobs[max-1].EventUUID)
+	}
+	if alices, err := memEnv.store.LoginsByUsername(context.Background(), "alice", models.ListOptions{}); err != nil || len(alices) != 1 {
+		t.Errorf("expected other users' logins to be kept, got %+v %v", alices, err)
+	}
+
+	// Imports are held to the cap as well
+	memEnv.MaxUserLogins = 2
+	if _, err := memEnv.importCSV(context.Background(), strings.NewReader("alice,1514000001,00000000-0000-4000-8000-0000000000ab,206.81.252.6\nalice,1514000002,00000000-0000-4000-8000-0000000000ac,206.81.252.6\n")); err != nil {
+		t.Fatal(err)
+	}
+	alices, err := memEnv.store.LoginsByUsername(context.Background(), "alice", models.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alices) != 2 || alices[0].EventUUID != "00000000-0000-4000-8000-0000000000ab" {
+		t.Errorf("expected alice's oldest login to be evicted by the import, got %+v", alices)
+	}
+}
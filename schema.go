@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// A JSON Schema (draft 2020-12) for the body POST /v1/ takes and the result it answers
+// with, generated from the structs themselves so it can't drift from them. Fields left out
+// when empty are optional; responses always carry the rest, null when they're pointers.
+func apiSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   "superman-detector login api",
+		"$defs": map[string]interface{}{
+			"login_request": typeSchema(reflect.TypeOf(loginRecord{})),
+			"login_result":  typeSchema(reflect.TypeOf(loginResult{})),
+		},
+	}
+}
+
+// The schema of values of type t as encoding/json writes them
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := typeSchema(t.Elem())
+		s["type"] = []interface{}{s["type"], "null"}
+		return s
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": []interface{}{"array", "null"}, "items": typeSchema(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		required := []interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if field.PkgPath != "" || tag == "-" {
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = typeSchema(field.Type)
+			if options != "omitempty" {
+				required = append(required, name)
+			}
+		}
+		return map[string]interface{}{"type": "object", "properties": properties, "required": required, "additionalProperties": false}
+	}
+	return map[string]interface{}{"type": "string"}
+}
+
+// Handles GET /v1/schema
+func (env *Env) HandleSchema(rw http.ResponseWriter, request *http.Request) {
+	env.writeJSON(rw, request, http.StatusOK, apiSchema())
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Checks value against the parts of JSON Schema apiSchema uses
+func validateSchema(schema map[string]interface{}, value interface{}, path string) error {
+	types := []interface{}{schema["type"]}
+	if list, ok := schema["type"].([]interface{}); ok {
+		types = list
+	}
+	matched := false
+	for _, ty := range types {
+		switch ty {
+		case "null":
+			matched = matched || value == nil
+		case "boolean":
+			_, ok := value.(bool)
+			matched = matched || ok
+		case "string":
+			_, ok := value.(string)
+			matched = matched || ok
+		case "number":
+			_, ok := value.(float64)
+			matched = matched || ok
+		case "integer":
+			n, ok := value.(float64)
+			matched = matched || ok && n == math.Trunc(n)
+		case "array":
+			_, ok := value.([]interface{})
+			matched = matched || ok
+		case "object":
+			_, ok := value.(map[string]interface{})
+			matched = matched || ok
+		}
+	}
+	if !matched {
+		return fmt.Errorf("%s: %v is not of type %v", path, value, schema["type"])
+	}
+	if min, ok := schema["minimum"].(float64); ok && value.(float64) < min {
+		return fmt.Errorf("%s: %v is under %v", path, value, min)
+	}
+
+	switch v := value.(type) {
+	case []interface{}:
+		for i, item := range v {
+			if err := validateSchema(schema["items"].(map[string]interface{}), item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := v[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing required %v", path, name)
+			}
+		}
+		for name, item := range v {
+			property, ok := properties[name].(map[string]interface{})
+			if !ok {
+				if schema["additionalProperties"] == false {
+					return fmt.Errorf("%s: unexpected property %v", path, name)
+				}
+				continue
+			}
+			if err := validateSchema(property, item, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func servedSchema(t *testing.T, e *Env) map[string]interface{} {
+	req, err := http.NewRequest("GET", "/v1/schema", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	e.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &schema); err != nil {
+		t.Fatal(err)
+	}
+	return schema
+}
+
+func decodeJSON(t *testing.T, body []byte) interface{} {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestSchemaValidatesTraffic(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	schema := servedSchema(t, memEnv)
+	defs := schema["$defs"].(map[string]interface{})
+	request := defs["login_request"].(map[string]interface{})
+	response := defs["login_result"].(map[string]interface{})
+
+	valid := []string{
+		`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`,
+		`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6", "lat": 39.2, "lon": -76.7, "radius": 10}`,
+	}
+	for _, body := range valid {
+		if err := validateSchema(request, decodeJSON(t, []byte(body)), "request"); err != nil {
+			t.Errorf("%s: %v", body, err)
+		}
+	}
+	invalid := []string{
+		`{"username": "bob", "unix_timestamp": 1514764800, "ip_address": "206.81.252.6"}`,
+		`{"username": "bob", "unix_timestamp": "now", "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`,
+		`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6", "radius": -1}`,
+		`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6", "ip": "206.81.252.6"}`,
+	}
+	for _, body := range invalid {
+		if err := validateSchema(request, decodeJSON(t, []byte(body)), "request"); err == nil {
+			t.Errorf("%s: expected the schema to reject it", body)
+		}
+	}
+
+	rr := postBetweenNeighbours(t, memEnv)
+	if err := validateSchema(response, decodeJSON(t, rr.Body.Bytes()), "response"); err != nil {
+		t.Errorf("%s: %v", rr.Body.String(), err)
+	}
+	// A first login has no neighbours, so they're null
+	rr = postBatch(t, newMemoryEnv(t), `[{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}]`)
+	var results []batchResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || len(results) != 1 || results[0].Result == nil {
+		t.Fatalf("unexpected batch response: %s", rr.Body.String())
+	}
+	body, _ := json.Marshal(results[0].Result)
+	if err := validateSchema(response, decodeJSON(t, body), "response"); err != nil {
+		t.Errorf("%s: %v", body, err)
+	}
+}
+
+// The fields a zero value always encodes are the required ones
+func TestSchemaMatchesStructs(t *testing.T) {
+	defs := servedSchema(t, newMemoryEnv(t))["$defs"].(map[string]interface{})
+	tests := []struct {
+		def   string
+		value interface{}
+	}{
+		{"login_request", loginRecord{}},
+		{"login_result", loginResult{}},
+	}
+
+	for _, tc := range tests {
+		var got []string
+		for _, name := range defs[tc.def].(map[string]interface{})["required"].([]interface{}) {
+			got = append(got, name.(string))
+		}
+		sort.Strings(got)
+		body, err := json.Marshal(tc.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := objectKeys(t, body)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got required %v want %v", tc.def, got, want)
+		}
+	}
+}
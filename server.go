@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"detector/models"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Opens the configured login and GeoIP databases and builds the Env around them
+func openEnv(cfg Config, logger *slog.Logger) (*Env, error) {
+	store, err := models.Open(cfg.DBPath, models.Options{
+		QueryTimeout:    cfg.QueryTimeout,
+		BusyTimeout:     cfg.SQLiteBusyTimeout,
+		JournalMode:     cfg.SQLiteJournalMode,
+		MaxOpenConns:    cfg.DBMaxOpenConns,
+		MaxIdleConns:    cfg.DBMaxIdleConns,
+		ConnMaxLifetime: cfg.DBConnMaxLifetime,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not open login database: %v", err)
+	}
+	if cfg.UsernameHashKey != "" {
+		store = hashedStore{Store: store, key: []byte(cfg.UsernameHashKey)}
+	}
+	resolver, err := newMaxMindResolver(cfg.GeoPath, cfg.ASNPath, logger)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	env := &Env{Config: cfg, store: store, resolver: resolver, logger: logger, clock: realClock{}}
+	if cfg.RateLimit > 0 {
+		env.limiter = newRateLimiter(cfg.RateLimit, cfg.RateBurst, env.clock)
+	}
+	if env.audit, err = env.openAuditor(); err != nil {
+		env.close()
+		return nil, fmt.Errorf("could not open audit log: %v", err)
+	}
+	if cfg.WebhookURL != "" {
+		env.webhook = newWebhookNotifier(cfg.WebhookURL, cfg.WebhookSecret, cfg.WebhookMaxAttempts, logger)
+	}
+	env.traceProvider = noop.NewTracerProvider()
+	if cfg.OTLPEndpoint != "" {
+		provider, err := newTraceProvider(cfg.OTLPEndpoint)
+		if err != nil {
+			env.close()
+			return nil, fmt.Errorf("could not set up tracing: %v", err)
+		}
+		env.traceProvider = provider
+	}
+	return env, nil
+}
+
+// Binds the configured listen address
+func listen(cfg Config) (net.Listener, error) {
+	return net.Listen("tcp", cfg.ListenAddr)
+}
+
+// The api routes plus the Prometheus /metrics endpoint
+func (env *Env) handler() http.Handler {
+	router := env.routes()
+	router.Handle("/metrics", env.withAuth(env.AuthHealth, promhttp.Handler().ServeHTTP)).Methods("GET")
+	return router
+}
+
+// An http.Server for handler with the configured read, write and idle timeouts, so slow or
+// stalled clients can't hold connections open indefinitely
+func (env *Env) newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:      handler,
+		ReadTimeout:  env.ReadTimeout,
+		WriteTimeout: env.WriteTimeout,
+		IdleTimeout:  env.IdleTimeout,
+	}
+}
+
+// Serves handler on listener until ctx is cancelled (e.g. by SIGINT/SIGTERM), then stops
+// accepting connections, waits up to ShutdownTimeout for in-flight requests to finish and
+// closes the login and GeoIP databases.
+func run(ctx context.Context, env *Env, listener net.Listener, handler http.Handler) error {
+	server := env.newServer(handler)
+	defer env.close()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	env.logFor(ctx).Info("shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), env.ShutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// Runs fn in a goroutine with a context that's cancelled when ctx is, or when the Env is
+// closed, which waits for fn to return. Only called while starting up.
+func (env *Env) goBackground(ctx context.Context, fn func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(ctx)
+	env.stopBackground = append(env.stopBackground, cancel)
+	env.background.Add(1)
+	go func() {
+		defer env.background.Done()
+		defer cancel()
+		fn(ctx)
+	}()
+}
+
+// Stops the background jobs, flushes the audit log, webhook queue and pending spans, and
+// releases the login database and the GeoIP resolver. The resolver unmaps its databases on
+// close, so it's dropped from the Env to stop anything looking addresses up afterwards.
+func (env *Env) close() {
+	for _, stop := range env.stopBackground {
+		stop()
+	}
+	env.background.Wait()
+	// Queued audit records may still need the store
+	if err := env.audit.close(); err != nil {
+		env.logFor(context.Background()).Error("could not close audit log", "error", err)
+	}
+	env.webhook.close(env.ShutdownTimeout)
+	tracingCtx, cancel := context.WithTimeout(context.Background(), env.ShutdownTimeout)
+	if err := env.closeTracing(tracingCtx); err != nil {
+		env.logFor(context.Background()).Error("could not export spans", "error", err)
+	}
+	cancel()
+	if env.store != nil {
+		if err := env.store.Close(); err != nil {
+			env.logFor(context.Background()).Error("could not close login database", "error", err)
+		}
+	}
+	env.geoMu.Lock()
+	defer env.geoMu.Unlock()
+	if env.resolver != nil {
+		if err := env.resolver.Close(); err != nil {
+			env.logFor(context.Background()).Error("could not close GeoIP database", "error", err)
+		}
+		env.resolver = nil
+	}
+}
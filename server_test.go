@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunShutsDownAndClosesResources(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	resolver, err := newMaxMindResolver("./geo/GeoLite2-City.mmdb", "", memEnv.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memEnv.resolver = resolver
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A request that is still in flight when shutdown starts should be allowed to finish
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, request *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, memEnv, listener, handler)
+	}()
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/")
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("run returned an error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return after the context was cancelled")
+	}
+
+	if code := <-status; code != http.StatusOK {
+		t.Errorf("in-flight request was not completed: got status %v", code)
+	}
+	if err := memEnv.store.Ping(context.Background()); err == nil {
+		t.Errorf("expected the login database to be closed")
+	}
+	if memEnv.resolver != nil {
+		t.Errorf("expected the GeoIP database to be closed")
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	server := memEnv.newServer(http.NotFoundHandler())
+	if server.ReadTimeout != 10*time.Second || server.WriteTimeout != time.Minute || server.IdleTimeout != 2*time.Minute {
+		t.Errorf("unexpected default timeouts: got read %v write %v idle %v", server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+	}
+
+	// A client that connects and never sends its request is disconnected
+	memEnv.ReadTimeout = 50 * time.Millisecond
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = memEnv.newServer(http.NotFoundHandler())
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Errorf("expected the server to close a stalled connection, got %v", err)
+	}
+}
+
+func TestListenUsesConfiguredAddr(t *testing.T) {
+	cfg, err := loadConfig(fakeEnv(map[string]string{"SUPERMAN_LISTEN_ADDR": "127.0.0.1:0"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := listen(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	host, _, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "127.0.0.1" {
+		t.Errorf("listener bound to the wrong interface: got %v want %v", host, "127.0.0.1")
+	}
+}
+
+func TestOpenEnvUsesConfiguredPaths(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "logins.db")
+	cfg, err := loadConfig(fakeEnv(map[string]string{
+		"SUPERMAN_DB_PATH":  dbPath,
+		"SUPERMAN_GEO_PATH": "./geo/GeoLite2-City.mmdb",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	openedEnv, err := openEnv(cfg, env.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer openedEnv.close()
+
+	if _, err := os.Stat(dbPath); err != nil {
+		t.Errorf("expected the login database to be created at %v: %v", dbPath, err)
+	}
+	if openedEnv.resolver == nil {
+		t.Errorf("expected the GeoIP database to be opened")
+	}
+}
+
+func TestOpenEnvMissingGeoDatabase(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.DBPath = filepath.Join(t.TempDir(), "logins.db")
+	cfg.GeoPath = filepath.Join(t.TempDir(), "missing.mmdb")
+
+	_, err := openEnv(cfg, env.logger)
+	if err == nil {
+		t.Fatal("expected a missing GeoIP database to fail")
+	}
+	if !strings.Contains(err.Error(), cfg.GeoPath) || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected the error to name the missing file, got %v", err)
+	}
+}
+
+func TestOpenEnvGeoSelfTest(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty.mmdb")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		geoPath string
+		ok      bool
+	}{
+		{"City database", "./geo/GeoLite2-City.mmdb", true},
+		{"empty file", empty, false},
+		// A valid database, but one without locations
+		{"ASN database", testASNPath, false},
+	}
+
+	for _, tc := range tests {
+		cfg := defaultConfig()
+		cfg.DBPath = filepath.Join(t.TempDir(), "logins.db")
+		cfg.GeoPath = tc.geoPath
+		e, err := openEnv(cfg, env.logger)
+		if tc.ok {
+			if err != nil {
+				t.Errorf("%s: expected the self-test to pass, got %v", tc.name, err)
+				continue
+			}
+			e.close()
+			continue
+		}
+		if err == nil {
+			e.close()
+			t.Errorf("%s: expected the self-test to fail", tc.name)
+		} else if !strings.Contains(err.Error(), tc.geoPath) {
+			t.Errorf("%s: expected the error to name the file, got %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"detector/models"
+	"net"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Resolves addresses with env's current GeoIP resolver, so a reload can swap it out from
+// under a simulation safely. Closing it leaves env's resolver open.
+type envResolver struct {
+	env *Env
+}
+
+func (r envResolver) Resolve(ip net.IP) (GeoResult, error) {
+	return r.env.resolve(ip)
+}
+
+func (r envResolver) Close() error {
+	return nil
+}
+
+// An Env with env's config and GeoIP data but an empty in-memory login database of its
+// own, and no audit log, webhook or metrics, so nothing it evaluates is kept or reported.
+// Its store must be closed when it's done with.
+func (env *Env) simulationEnv() (*Env, error) {
+	db, err := models.NewDB(":memory:")
+	if err != nil {
+		return nil, err
+	}
+	return &Env{
+		Config:        env.Config,
+		store:         models.NewSQLiteStore(db, models.Options{QueryTimeout: env.QueryTimeout}),
+		resolver:      envResolver{env},
+		logger:        env.logger,
+		clock:         env.clock,
+		traceProvider: env.traceProvider,
+	}, nil
+}
+
+// Handles POST /v1/simulate. Takes a JSON array of login records, like a batch, and runs
+// them through the detector in order against a throwaway login database, so each is checked
+// against the ones before it in the array and none of the stored logins. The response is an
+// array of per-record results, sent as a 207 if any of the records failed. Nothing is saved,
+// audited or sent to the webhook.
+func (env *Env) HandleSimulate(rw http.ResponseWriter, request *http.Request) {
+	records, ok := env.decodeRecords(rw, request)
+	if !ok {
+		return
+	}
+	opts, err := parseEvalOptions(request)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+	// Each record has to be saved for the next to be checked against it
+	opts.dryRun = false
+
+	sim, err := env.simulationEnv()
+	if err != nil {
+		env.logFor(request.Context()).Error("could not open simulation database", "error", err)
+		writeError(rw, http.StatusInternalServerError, codeInternal, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	defer sim.store.Close()
+
+	status := http.StatusOK
+	results := make([]batchResult, len(records))
+	for i, raw := range records {
+		results[i].Index = i
+		ctx, s := env.startSpan(request.Context(), "evaluate", trace.WithAttributes(attribute.Int("index", i)))
+		_, result, err := sim.evaluateJSON(ctx, raw, opts)
+		setSpanError(s, err)
+		s.SetAttributes(attribute.Bool("suspicious", result.Suspicious))
+		s.End()
+		if err != nil {
+			results[i].Error = newAPIError(err)
+			status = http.StatusMultiStatus
+			continue
+		}
+		results[i].Result = &result
+	}
+
+	env.writeJSON(rw, request, status, results)
+}
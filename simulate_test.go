@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"detector/models"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSimulate(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	// A stored login a second before the Baltimore one would make it suspicious if the
+	// simulation were checked against it
+	losAngeles := models.Login{Username: "bob", UnixTimestamp: 1514764799, EventUUID: "00000000-0000-4000-8000-00000000000f", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)}
+	seedLogins(t, memEnv, losAngeles)
+
+	req, err := http.NewRequest("POST", "/v1/simulate", bytes.NewBufferString(`[
+		{"username": "bob", "unix_timestamp": 1514677279, "event_uuid": "00000000-0000-4000-8000-00000000000a", "ip_address": "24.242.71.20"},
+		{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"},
+		{"username": "bob", "unix_timestamp": 1514764860, "event_uuid": "00000000-0000-4000-8000-00000000000c", "ip_address": "91.207.175.104"},
+		{"username": "bob", "unix_timestamp": 1514764900, "event_uuid": "00000000-0000-4000-8000-00000000000d", "ip_address": "91.207.175"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	memEnv.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusMultiStatus {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusMultiStatus, rr.Body.String())
+	}
+	var results []batchResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("expected a result per record, got %+v", results)
+	}
+
+	if r := results[0].Result; r == nil || r.Evaluated || r.Suspicious {
+		t.Errorf("expected the first login to have nothing to compare with, got %+v", results[0])
+	}
+	if r := results[1].Result; r == nil || r.Suspicious || r.PrecedingIpAccess == nil || r.PrecedingIpAccess.IP != "24.242.71.20" {
+		t.Errorf("expected Baltimore a day after Austin not to be suspicious, got %+v", results[1])
+	}
+	if r := results[2].Result; r == nil || !r.Suspicious || r.PrecedingIpAccess == nil || r.PrecedingIpAccess.IP != "206.81.252.6" {
+		t.Errorf("expected Los Angeles a minute after Baltimore to be flagged, got %+v", results[2])
+	}
+	if e := results[3].Error; e == nil || e.Code != codeInvalidIP {
+		t.Errorf("expected an invalid ip error, got %+v", results[3])
+	}
+
+	logins, err := memEnv.store.AllLogins(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 1 {
+		t.Errorf("expected nothing simulated to be saved, got %+v", logins)
+	}
+}
+
+func TestSimulateInvalid(t *testing.T) {
+	req, err := http.NewRequest("POST", "/v1/simulate", bytes.NewBufferString(`{"username": "bob"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	newMemoryEnv(t).routes().ServeHTTP(rr, req)
+	if expected := `{"error":{"code":"invalid_json","message":"invalid JSON body, expected an array of login records"}}`; rr.Code != http.StatusBadRequest || rr.Body.String() != expected {
+		t.Errorf("got %v %s want 400 %s", rr.Code, rr.Body.String(), expected)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import "net/http"
+
+// Body of GET /v1/stats/{username}
+type userStats struct {
+	Username          string `json:"username"`
+	Logins            int64  `json:"logins"`
+	DistinctIPs       int64  `json:"distinct_ips"`
+	DistinctCountries int64  `json:"distinct_countries"`
+	// Counted from the audit records, so null unless they're kept in the login database
+	SuspiciousLogins *int64 `json:"suspicious_logins"`
+}
+
+// Handles GET /v1/stats/{username}, summarising the user's stored logins
+func (env *Env) HandleStats(rw http.ResponseWriter, request *http.Request) {
+	username := env.usernameVar(request)
+	stats, err := env.store.UserStats(request.Context(), username)
+	if err != nil {
+		env.logFor(request.Context()).Error("could not load stats", "user", hashUsername(username), "error", err)
+		writeError(rw, http.StatusInternalServerError, codeInternal, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	if stats.Logins == 0 {
+		writeError(rw, http.StatusNotFound, codeNotFound, "no logins found for user")
+		return
+	}
+
+	body := userStats{
+		Username:          username,
+		Logins:            stats.Logins,
+		DistinctIPs:       stats.DistinctIPs,
+		DistinctCountries: stats.DistinctCountries,
+	}
+	if env.AuditSink == "db" {
+		body.SuspiciousLogins = &stats.SuspiciousLogins
+	}
+	env.writeJSON(rw, request, http.StatusOK, body)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.AuditSink = "db"
+	audit, err := memEnv.openAuditor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	memEnv.audit = audit
+
+	// Austin and Los Angeles are seeded without a country; Baltimore is looked up
+	postBetweenNeighbours(t, memEnv)
+	postBatch(t, memEnv, `[
+		{"username": "bob", "unix_timestamp": 1514764900, "event_uuid": "00000000-0000-4000-8000-00000000000d", "ip_address": "206.81.252.6"},
+		{"username": "bob", "unix_timestamp": 1514851200, "event_uuid": "00000000-0000-4000-8000-00000000000e", "ip_address": "10.0.0.1"},
+		{"username": "alice", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000f", "ip_address": "91.207.175.104"}
+	]`)
+	memEnv.audit.close()
+
+	rr := getPath(t, memEnv, "/v1/stats/bob")
+	expected := `{"username":"bob","logins":5,"distinct_ips":4,"distinct_countries":1,"suspicious_logins":2}`
+	if rr.Code != http.StatusOK || rr.Body.String() != expected {
+		t.Errorf("unexpected stats: got %v %v want %v", rr.Code, rr.Body.String(), expected)
+	}
+}
+
+func TestStatsWithoutStoredAudit(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	postBetweenNeighbours(t, memEnv)
+
+	// Nothing to count suspicious logins from, which isn't the same as there being none
+	rr := getPath(t, memEnv, "/v1/stats/bob")
+	expected := `{"username":"bob","logins":3,"distinct_ips":3,"distinct_countries":1,"suspicious_logins":null}`
+	if rr.Code != http.StatusOK || rr.Body.String() != expected {
+		t.Errorf("unexpected stats: got %v %v want %v", rr.Code, rr.Body.String(), expected)
+	}
+
+	if rr := getPath(t, memEnv, "/v1/stats/alice"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected a user without logins to be a 404, got %v %v", rr.Code, rr.Body.String())
+	}
+}
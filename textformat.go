@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Reports whether an Accept header prefers text/plain to JSON. JSON wins ties and is the
+// default, so only clients that ask for text (e.g. curl -H "Accept: text/plain") get it.
+func prefersText(header string) bool {
+	var textQ, jsonQ float64
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "text/plain":
+			textQ = q
+		case "application/json":
+			jsonQ = q
+		}
+	}
+	return textQ > jsonQ
+}
+
+// Writes a login's result as JSON, or as a one line summary for clients that prefer text
+func (env *Env) writeResult(rw http.ResponseWriter, request *http.Request, result loginResult) {
+	rw.Header().Add("Vary", "Accept")
+	if !prefersText(request.Header.Get("Accept")) {
+		env.writeJSON(rw, request, http.StatusOK, result)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	if _, err := io.WriteString(rw, summarize(result)+"\n"); err != nil {
+		env.logFor(request.Context()).Warn("could not write response", "error", err)
+	}
+}
+
+// A human readable summary of a result, e.g.
+// "SUSPICIOUS (impossible): 8330887 mph from Halethorpe, United States to Los Angeles, United States"
+func summarize(r loginResult) string {
+	if !r.Evaluated {
+		return "NOT EVALUATED: " + strings.Replace(r.Reason, "_", " ", -1)
+	}
+	var findings []string
+	if travel := describeTravel(r); travel != "" {
+		findings = append(findings, travel)
+	}
+	if r.OutsideHomeGeofence != nil && *r.OutsideHomeGeofence {
+		findings = append(findings, "outside the home geofence")
+	}
+	if r.ConcurrentDistantLogin != nil && *r.ConcurrentDistantLogin {
+		findings = append(findings, "a concurrent login far away")
+	}
+
+	var status string
+	switch {
+	case r.Suspicious:
+		status = "SUSPICIOUS (" + r.Severity + ")"
+	case r.AlertSuppressed:
+		status = "SUPPRESSED"
+	default:
+		status = "OK"
+	}
+	if len(findings) == 0 {
+		return status
+	}
+	return status + ": " + strings.Join(findings, ", ")
+}
+
+// The travel that decided the result: the fastest suspicious leg if there is one,
+// otherwise the fastest that was checked
+func describeTravel(r loginResult) string {
+	here := placeName(r.CurrentGeo.Lat, r.CurrentGeo.Lon, r.CurrentGeo.City, r.CurrentGeo.Country)
+	type leg struct {
+		access     *ipAccess
+		suspicious *bool
+		from, to   string
+	}
+	var legs []leg
+	if a := r.PrecedingIpAccess; a != nil {
+		legs = append(legs, leg{a, r.TravelToCurrentGeoSuspicious, "from " + placeName(a.Lat, a.Lon, a.City, a.Country), "to " + here})
+	}
+	if a := r.SubsequentIpAccess; a != nil {
+		legs = append(legs, leg{a, r.TravelFromCurrentGeoSuspicious, "from " + here, "to " + placeName(a.Lat, a.Lon, a.City, a.Country)})
+	}
+	if a := r.FastestWindowIpAccess; a != nil {
+		legs = append(legs, leg{a, r.TravelWithinWindowSuspicious, "between " + here, "and " + placeName(a.Lat, a.Lon, a.City, a.Country)})
+	}
+
+	var best *leg
+	for i := range legs {
+		l := &legs[i]
+		flagged := l.suspicious != nil && *l.suspicious
+		bestFlagged := best != nil && *best.suspicious
+		if best == nil || (flagged && !bestFlagged) || (flagged == bestFlagged && l.access.Speed > best.access.Speed) {
+			best = l
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	speedUnit := "mph"
+	if r.Unit == "km" {
+		speedUnit = "km/h"
+	}
+	return fmt.Sprintf("%.0f %s %s %s", best.access.Speed, speedUnit, best.from, best.to)
+}
+
+// "City, Country", whichever of them is known, or the coordinates when neither is
+func placeName(lat, lon float64, city, country string) string {
+	switch {
+	case city != "" && country != "":
+		return city + ", " + country
+	case city != "":
+		return city
+	case country != "":
+		return country
+	}
+	return fmt.Sprintf("%.4f,%.4f", lat, lon)
+}
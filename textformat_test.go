@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"detector/models"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTextResponse(t *testing.T) {
+	const summary = "SUSPICIOUS (impossible): 8330887 mph from Halethorpe, United States to Los Angeles, United States\n"
+	tests := []struct {
+		accept string
+		text   bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{"*/*", false},
+		{"text/plain", true},
+		{"application/json;q=0.5, text/plain", true},
+		{"text/plain;q=0.5, application/json", false},
+	}
+
+	for _, tc := range tests {
+		memEnv := newMemoryEnv(t)
+		seedLogins(t, memEnv,
+			models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)},
+			models.Login{Username: "bob", UnixTimestamp: 1514764801, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200), City: "Los Angeles", Country: "United States"},
+		)
+		req, err := http.NewRequest("POST", "/v1/", bytes.NewBufferString(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		rr := httptest.NewRecorder()
+		memEnv.routes().ServeHTTP(rr, req)
+
+		if !tc.text {
+			var result loginResult
+			if rr.Header().Get("Content-Type") != "application/json" || json.Unmarshal(rr.Body.Bytes(), &result) != nil || !result.Suspicious {
+				t.Errorf("%q: expected the JSON result, got %v %s", tc.accept, rr.Header(), rr.Body.String())
+			}
+			continue
+		}
+		if rr.Header().Get("Content-Type") != "text/plain; charset=utf-8" || rr.Body.String() != summary {
+			t.Errorf("%q: got %v %q want %q", tc.accept, rr.Header().Get("Content-Type"), rr.Body.String(), summary)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	yes, no := true, false
+	here := &currentGeo{Lat: 39.2293, Lon: -76.6907, City: "Halethorpe", Country: "United States"}
+	austin := &ipAccess{Speed: 55.0002, Lat: 30.3773, Lon: -97.71}
+
+	tests := []struct {
+		result loginResult
+		want   string
+	}{
+		{loginResult{Reason: reasonNoAdjacentLogins}, "NOT EVALUATED: no adjacent logins"},
+		// Neighbours without names are given by their coordinates
+		{loginResult{Evaluated: true, CurrentGeo: here, PrecedingIpAccess: austin, TravelToCurrentGeoSuspicious: &no, Unit: "mi"},
+			"OK: 55 mph from 30.3773,-97.7100 to Halethorpe, United States"},
+		{loginResult{Evaluated: true, Suspicious: true, Severity: severitySuspicious, CurrentGeo: here, OutsideHomeGeofence: &yes},
+			"SUSPICIOUS (suspicious): outside the home geofence"},
+		{loginResult{Evaluated: true, AlertSuppressed: true, CurrentGeo: here, PrecedingIpAccess: &ipAccess{Speed: 1200, City: "London", Country: "United Kingdom"}, TravelToCurrentGeoSuspicious: &yes, Unit: "km"},
+			"SUPPRESSED: 1200 km/h from London, United Kingdom to Halethorpe, United States"},
+	}
+
+	for _, tc := range tests {
+		if got := summarize(tc.result); got != tc.want {
+			t.Errorf("got %q want %q", got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"detector/models"
+	"errors"
+	"net/http"
+)
+
+var errInvalidThreshold = errors.New("invalid threshold, speed_threshold must be a positive number of mph")
+
+// The user's own speed threshold (mph), or zero when they use the configured ones
+func (env *Env) userThreshold(ctx context.Context, username string) (int, error) {
+	threshold, err := env.store.ThresholdByUsername(ctx, username)
+	if err != nil || threshold == nil {
+		return 0, err
+	}
+	return threshold.SpeedThreshold, nil
+}
+
+// Handles PUT /v1/users/{username}/threshold with a body of {"speed_threshold":..} (mph),
+// replacing any threshold the user already has
+func (env *Env) HandlePutThreshold(rw http.ResponseWriter, request *http.Request) {
+	var threshold models.Threshold
+	if err := env.decodeBody(request.Body, &threshold); err != nil {
+		writeError(rw, invalidStatus(err), errorCode(err), err.Error())
+		return
+	}
+	threshold.Username = env.usernameVar(request)
+	if threshold.SpeedThreshold <= 0 {
+		writeError(rw, http.StatusBadRequest, codeInvalidInput, errInvalidThreshold.Error())
+		return
+	}
+
+	if err := env.store.SetThreshold(request.Context(), threshold); err != nil {
+		env.logFor(request.Context()).Error("could not save speed threshold", "user", hashUsername(threshold.Username), "error", err)
+		writeError(rw, http.StatusInternalServerError, codeInternal, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	env.writeJSON(rw, request, http.StatusOK, threshold)
+}
+
+// Handles GET /v1/users/{username}/threshold
+func (env *Env) HandleGetThreshold(rw http.ResponseWriter, request *http.Request) {
+	username := env.usernameVar(request)
+	threshold, err := env.store.ThresholdByUsername(request.Context(), username)
+	if err != nil {
+		env.logFor(request.Context()).Error("could not load speed threshold", "user", hashUsername(username), "error", err)
+		writeError(rw, http.StatusInternalServerError, codeInternal, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	if threshold == nil {
+		writeError(rw, http.StatusNotFound, codeNotFound, "no speed threshold set for user")
+		return
+	}
+
+	env.writeJSON(rw, request, http.StatusOK, threshold)
+}
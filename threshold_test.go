@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"detector/models"
+	"detector/travel"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func putThreshold(t *testing.T, e *Env, username, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("PUT", "/v1/users/"+username+"/threshold", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	e.routes().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestThresholdEndpoints(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	for _, body := range []string{`{"speed_threshold": 0}`, `{"speed_threshold": -100}`, `{}`, `{"speed_threshold":`} {
+		if rr := putThreshold(t, memEnv, "bob", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+	if rr := getPath(t, memEnv, "/v1/users/bob/threshold"); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if rr := putThreshold(t, memEnv, "bob", `{"speed_threshold": 700}`); rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	rr := getPath(t, memEnv, "/v1/users/bob/threshold")
+	if expected := `{"username":"bob","speed_threshold":700}`; rr.Code != http.StatusOK || rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v %v want %v", rr.Code, rr.Body.String(), expected)
+	}
+}
+
+func TestUserThreshold(t *testing.T) {
+	// Los Angeles two hours after Austin is about 615 mph: over the global 500 but under the
+	// pilot's own 700
+	memEnv := newMemoryEnv(t)
+	for _, username := range []string{"bob", "pilot"} {
+		seedLogins(t, memEnv, models.Login{Username: username, UnixTimestamp: 1514757600, EventUUID: newUUID(), IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)})
+	}
+	if rr := putThreshold(t, memEnv, "pilot", `{"speed_threshold": 700}`); rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	memEnv.SpeedThresholdTo = 400
+
+	tests := []struct {
+		username   string
+		suspicious bool
+	}{
+		{"bob", true},
+		// The user's threshold replaces the directional one too
+		{"pilot", false},
+	}
+	for _, tc := range tests {
+		lr := loginRecord{Username: tc.username, UnixTimestamp: 1514764800, EventUUID: newUUID(), IPAddr: "91.207.175.104"}
+		result, err := memEnv.Evaluate(context.Background(), lr, evalOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Suspicious != tc.suspicious || result.PrecedingIpAccess == nil || int(result.PrecedingIpAccess.Speed) < 600 || int(result.PrecedingIpAccess.Speed) > 630 {
+			t.Errorf("%s: expected suspicious %v at about 615 mph, got %+v (preceding %+v)", tc.username, tc.suspicious, result, result.PrecedingIpAccess)
+		}
+	}
+
+	// Reported in km/h, the threshold is converted like the global one
+	lr := loginRecord{Username: "pilot", UnixTimestamp: 1514764800, EventUUID: newUUID(), IPAddr: "91.207.175.104"}
+	result, err := memEnv.Evaluate(context.Background(), lr, evalOptions{unit: travel.Kilometers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Suspicious {
+		t.Errorf("expected the pilot not to be suspicious in km/h either, got %+v", result)
+	}
+}
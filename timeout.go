@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Middleware that gives each request RequestTimeout to be answered. The request's context
+// is cancelled at the deadline, which stops the database work it started, and the client gets
+// a 503 instead of whatever the handler wrote.
+func (env *Env) withTimeout(next http.Handler) http.Handler {
+	if env.RequestTimeout <= 0 {
+		return next
+	}
+	body, _ := json.Marshal(map[string]apiError{"error": {Code: codeTimeout, Message: "request timed out"}})
+	timeout := http.TimeoutHandler(next, env.RequestTimeout, string(body))
+	return http.HandlerFunc(func(rw http.ResponseWriter, request *http.Request) {
+		// Exports are streamed, which the timeout handler's buffering would defeat, and
+		// large ones can rightly take longer than any one request should
+		if strings.HasPrefix(request.URL.Path, "/v1/export/") {
+			next.ServeHTTP(rw, request)
+			return
+		}
+		// Replaced by the handler's own headers unless it times out
+		rw.Header().Set("Content-Type", "application/json")
+		timeout.ServeHTTP(rw, request)
+	})
+}
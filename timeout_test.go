@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"detector/models"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A store whose adjacency query blocks until the request is cancelled, reporting why
+type slowStore struct {
+	models.Store
+	cancelled chan error
+}
+
+func (s *slowStore) AdjacentLogins(ctx context.Context, cLogin models.Login) (models.Login, models.Login, error) {
+	<-ctx.Done()
+	s.cancelled <- ctx.Err()
+	return models.Login{}, models.Login{}, ctx.Err()
+}
+
+func TestRequestTimeout(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	store := &slowStore{Store: memEnv.store, cancelled: make(chan error, 1)}
+	memEnv.store = store
+	memEnv.RequestTimeout = 50 * time.Millisecond
+
+	jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`)
+	req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	memEnv.routes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the request to be abandoned after the timeout, took %v", elapsed)
+	}
+	var resp struct {
+		Error apiError `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Error.Code != codeTimeout {
+		t.Errorf("expected a timeout error, got %v", rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected content type: got %v", ct)
+	}
+
+	// The blocked query saw the deadline
+	select {
+	case err := <-store.cancelled:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the query's context to pass its deadline, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the blocked query was never cancelled")
+	}
+}
+
+func TestRequestWithinTimeout(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.RequestTimeout = 5 * time.Second
+	rr := getPath(t, memEnv, "/healthz")
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"status":"ok"}` {
+		t.Errorf("unexpected response to a quick request: got %v %v", rr.Code, rr.Body.String())
+	}
+}
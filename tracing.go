@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Instrumentation scope the detector's spans are recorded under
+const tracerName = "detector"
+
+// Reads the caller's W3C traceparent header, so its trace is continued
+var tracePropagator = propagation.TraceContext{}
+
+// A provider exporting spans in batches to the OpenTelemetry collector at endpoint, its base
+// URL, e.g. http://localhost:4318, with OTLP over HTTP
+func newTraceProvider(endpoint string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(strings.TrimSuffix(endpoint, "/")+"/v1/traces"))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "superman-detector"))),
+	), nil
+}
+
+// Starts a span as a child of the one in ctx, if any, returning a context carrying it. With
+// tracing off the span records nothing.
+func (env *Env) startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	provider := env.traceProvider
+	if provider == nil {
+		provider = noop.NewTracerProvider()
+	}
+	return provider.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// Marks a span as failed, if err is set
+func setSpanError(s trace.Span, err error) {
+	if err != nil {
+		s.RecordError(err)
+		s.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// Exports any pending spans and stops the provider, if it's ours to stop
+func (env *Env) closeTracing(ctx context.Context) error {
+	if provider, ok := env.traceProvider.(*sdktrace.TracerProvider); ok {
+		return provider.Shutdown(ctx)
+	}
+	return nil
+}
+
+// Records the status code a handler wrote
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Middleware that wraps a request in a server span named name, continuing the caller's
+// trace when the request has a valid traceparent header
+func (env *Env) withTracing(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, request *http.Request) {
+		ctx := tracePropagator.Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+		ctx, s := env.startSpan(ctx, name, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.method", request.Method), attribute.String("http.route", request.URL.Path)))
+		defer s.End()
+
+		sw := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+		next(sw, request.WithContext(ctx))
+		s.SetAttributes(attribute.Int("http.status_code", sw.status))
+	}
+}
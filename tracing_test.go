@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"detector/models"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Records e's spans in memory as they end, for tests to inspect
+func recordSpans(e *Env) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	e.traceProvider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	return exporter
+}
+
+// The value of a span's attribute, or an empty one if it isn't set
+func spanAttribute(s tracetest.SpanStub, key string) attribute.Value {
+	for _, kv := range s.Attributes {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func postTraced(t *testing.T, e *Env, traceparent string) *httptest.ResponseRecorder {
+	jsonBody := []byte(`{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "206.81.252.6"}`)
+	req, err := http.NewRequest("POST", "/v1/", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if traceparent != "" {
+		req.Header.Set("traceparent", traceparent)
+	}
+	rr := httptest.NewRecorder()
+	e.routes().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRequestSpans(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	exporter := recordSpans(memEnv)
+	seedLogins(t, memEnv, models.Login{Username: "bob", UnixTimestamp: 1514764801, EventUUID: "00000000-0000-4000-8000-00000000000c", IPAddr: "91.207.175.104", Lat: 34.0549, Lon: -118.2578, Radius: accuracyRadius(200)})
+
+	rr := postTraced(t, memEnv, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	spans := exporter.GetSpans()
+	if len(spans) != 4 {
+		t.Fatalf("expected a request span and three children, got %v spans", len(spans))
+	}
+
+	// Children end, and so are exported, before their parent
+	root := spans[3]
+	if root.Name != "POST /v1/" || root.SpanKind != trace.SpanKindServer {
+		t.Errorf("unexpected root span: got %v (kind %v)", root.Name, root.SpanKind)
+	}
+	if root.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || root.Parent.SpanID().String() != "00f067aa0ba902b7" || !root.Parent.IsRemote() {
+		t.Errorf("expected the caller's trace to be continued, got trace %v parent %v", root.SpanContext.TraceID(), root.Parent.SpanID())
+	}
+	if !spanAttribute(root, "suspicious").AsBool() || spanAttribute(root, "http.status_code").AsInt64() != http.StatusOK {
+		t.Errorf("unexpected root attributes: got %v", root.Attributes)
+	}
+	for i, name := range []string{"geoip.lookup", "db.insert_login", "db.adjacent_logins"} {
+		child := spans[i]
+		if child.Name != name || child.SpanContext.TraceID() != root.SpanContext.TraceID() || child.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("span %v: expected %v as a child of the request span, got %v (parent %v)", i, name, child.Name, child.Parent.SpanID())
+		}
+	}
+}
+
+func TestInvalidTraceparent(t *testing.T) {
+	for _, header := range []string{
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+	} {
+		memEnv := newMemoryEnv(t)
+		exporter := recordSpans(memEnv)
+		postTraced(t, memEnv, header)
+
+		// The request starts a trace of its own instead
+		spans := exporter.GetSpans()
+		if len(spans) == 0 {
+			t.Fatalf("%q: expected the request to be traced", header)
+		}
+		root := spans[len(spans)-1]
+		if root.Parent.IsValid() || root.SpanContext.TraceID().String() == "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("%q: expected a new trace, got trace %v parent %v", header, root.SpanContext.TraceID(), root.Parent.SpanID())
+		}
+	}
+}
+
+func TestBatchSpans(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	exporter := recordSpans(memEnv)
+
+	postBatch(t, memEnv, `[
+		{"username": "bob", "unix_timestamp": 1514764800, "event_uuid": "00000000-0000-4000-8000-00000000000a", "ip_address": "206.81.252.6"},
+		{"username": "bob", "unix_timestamp": 1514764801, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "91.207.175.104"}
+	]`)
+
+	var evaluated []tracetest.SpanStub
+	for _, s := range exporter.GetSpans() {
+		if s.Name == "evaluate" {
+			evaluated = append(evaluated, s)
+		}
+	}
+	if len(evaluated) != 2 || spanAttribute(evaluated[0], "suspicious").AsBool() || !spanAttribute(evaluated[1], "suspicious").AsBool() ||
+		spanAttribute(evaluated[1], "index").AsInt64() != 1 {
+		t.Errorf("expected an evaluate span per login with its outcome, got %v", evaluated)
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, request *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, request.URL.Path)
+	}))
+	defer collector.Close()
+
+	provider, err := newTraceProvider(collector.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, s := provider.Tracer(tracerName).Start(context.Background(), "geoip.lookup")
+	s.End()
+	// Flushes the batch
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(paths) != 1 || paths[0] != "/v1/traces" {
+		t.Errorf("expected the span to be sent to the collector's /v1/traces, got %v", paths)
+	}
+}
+
+func TestTracingOff(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	rr := postBetweenNeighbours(t, memEnv)
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if err := memEnv.closeTracing(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
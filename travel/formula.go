@@ -0,0 +1,51 @@
+package travel
+
+import (
+	"fmt"
+)
+
+// Formula selects how the distance between two points is calculated
+type Formula int
+
+const (
+	// Great-circle distance on a spherical earth (Distance). The default.
+	Haversine Formula = iota
+	// Geodesic distance on the WGS-84 ellipsoid (Vincenty)
+	VincentyFormula
+	// Constant-bearing distance on a spherical earth (Rhumb)
+	RhumbFormula
+)
+
+// Parses the formula names accepted on the api. An empty string is Haversine.
+func ParseFormula(name string) (Formula, error) {
+	switch name {
+	case "", "haversine":
+		return Haversine, nil
+	case "vincenty":
+		return VincentyFormula, nil
+	case "rhumb":
+		return RhumbFormula, nil
+	}
+	return Haversine, fmt.Errorf("unknown distance formula %q, expected haversine, vincenty or rhumb", name)
+}
+
+func (f Formula) String() string {
+	switch f {
+	case VincentyFormula:
+		return "vincenty"
+	case RhumbFormula:
+		return "rhumb"
+	}
+	return "haversine"
+}
+
+// Distance in meters between two points using this formula
+func (f Formula) Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	switch f {
+	case VincentyFormula:
+		return Vincenty(lat1, lon1, lat2, lon2)
+	case RhumbFormula:
+		return Rhumb(lat1, lon1, lat2, lon2)
+	}
+	return Distance(lat1, lon1, lat2, lon2)
+}
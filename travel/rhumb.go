@@ -0,0 +1,32 @@
+package travel
+
+import (
+	"math"
+)
+
+// Rhumb returns the distance (in meters) between two points along the rhumb line joining
+// them: the path that keeps a constant compass bearing, on the same sphere as Distance.
+//
+// It's never shorter than the great-circle Distance. The two agree along the equator and
+// along meridians, and diverge the further east-west travel is from the equator. It suits
+// routes actually flown or sailed on a fixed heading; for how far apart two logins are,
+// which is what travel speed is about, the great circle is the shortest way between them.
+// The route crosses the antimeridian when that's shorter.
+// https://en.wikipedia.org/wiki/Rhumb_line
+func Rhumb(lat1, lon1, lat2, lon2 float64) float64 {
+	const r = 6378100 // Earth radius in meters, as for Distance
+
+	la1 := lat1 * math.Pi / 180
+	la2 := lat2 * math.Pi / 180
+	dLat := la2 - la1
+	dLon := wrapLon((lon2 - lon1) * math.Pi / 180)
+
+	// Stretch of the latitude difference on a Mercator projection, on which rhumb lines are straight
+	dPsi := math.Log(math.Tan(math.Pi/4+la2/2) / math.Tan(math.Pi/4+la1/2))
+	q := math.Cos(la1)
+	if math.Abs(dPsi) > 1e-12 {
+		q = dLat / dPsi
+	}
+
+	return r * math.Sqrt(dLat*dLat+q*q*dLon*dLon)
+}
@@ -0,0 +1,43 @@
+package travel
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRhumb(t *testing.T) {
+	const r = 6378100
+
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+	}{
+		{"along the equator", 0, 0, 0, 90},
+		{"along a meridian", -30, 10, 50, 10},
+		{"same point", 51.47, -0.4543, 51.47, -0.4543},
+	}
+	// Where the constant bearing is also the great circle, the two agree
+	for _, tc := range tests {
+		assert.InDelta(t, Distance(tc.lat1, tc.lon1, tc.lat2, tc.lon2), Rhumb(tc.lat1, tc.lon1, tc.lat2, tc.lon2), 0.001, tc.name)
+	}
+	assert.InDelta(t, math.Pi/2*r, Rhumb(0, 0, 0, 90), 0.001)
+
+	// Due east along the 60th parallel is a quarter of a circle half the equator's length,
+	// while the great circle cuts across towards the pole
+	assert.InDelta(t, math.Pi/4*r, Rhumb(60, 0, 60, 90), 0.001)
+	assert.InDelta(t, 4609000, Distance(60, 0, 60, 90), 1000)
+
+	// JFK to LHR, where a constant bearing is a few percent longer
+	rhumb, greatCircle := Rhumb(40.6413, -73.7781, 51.4700, -0.4543), Distance(40.6413, -73.7781, 51.4700, -0.4543)
+	assert.True(t, rhumb > greatCircle, "the rhumb line should be longer, got %v and %v", rhumb, greatCircle)
+	assert.InDelta(t, 5765000, rhumb, 1000)
+
+	// Across the antimeridian rather than the long way round
+	assert.InDelta(t, Rhumb(0, 170, 0, 190), Rhumb(0, 170, 0, -170), 0.001)
+	assert.InDelta(t, math.Pi/9*r, Rhumb(0, 170, 0, -170), 0.001)
+
+	// Either direction is the same distance
+	assert.InDelta(t, Rhumb(-33.9461, 151.1772, 33.9425, -118.4081), Rhumb(33.9425, -118.4081, -33.9461, 151.1772), 0.001)
+}
@@ -5,16 +5,34 @@ import (
 	"time"
 )
 
-// Used to calculate the speed in mph of traveling a certain distance in a certain time
+// Reported for covering any distance with no time elapsed, i.e. logging in from two places
+// at once. It's larger than any real speed, so it's always over the threshold.
+const InstantSpeed = math.MaxInt32
+
+// Used to calculate the speed in mph of traveling a certain distance (in meters) in a certain time
+//
+// The timestamps can be in either order. If they're equal the speed is InstantSpeed for a
+// nonzero distance and 0 when the logins are in the same place.
 func Speed(distance float64, startT, endT int64) int {
-	distInMiles := distance *  0.00062137
-	startTime := time.Unix(startT, 0)
-	endTime := time.Unix(endT, 0)
-	speed := distInMiles/math.Abs(endTime.Sub(startTime).Hours())
+	return SpeedIn(Miles, distance, startT, endT)
+}
 
-	//fmt.Println("Distance in Miles: ", distInMiles)
-	//fmt.Println("Time Difference: ", math.Abs(endTime.Sub(startTime).Hours()) )
-	//fmt.Println("Speed: ", int(speed), " miles per hour")
+// Same as Speed but reports the result in the given unit per hour (mph or km/h)
+func SpeedIn(unit Unit, distance float64, startT, endT int64) int {
+	return int(FractionalSpeedIn(unit, distance, startT, endT))
+}
 
-	return int(speed)
-}
\ No newline at end of file
+// Same as SpeedIn without truncating to a whole number, so slow travel isn't reported as 0
+func FractionalSpeedIn(unit Unit, distance float64, startT, endT int64) float64 {
+	dist := unit.FromMeters(distance)
+	startTime := time.Unix(startT, 0)
+	endTime := time.Unix(endT, 0)
+	hours := math.Abs(endTime.Sub(startTime).Hours())
+	if hours == 0 {
+		if dist == 0 {
+			return 0
+		}
+		return InstantSpeed
+	}
+	return dist / hours
+}
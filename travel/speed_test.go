@@ -16,4 +16,50 @@ func TestSpeed(t *testing.T) {
 	speed := Speed(distance, startTime.Unix(), endTime.Unix())
 
 	assert.Equal(t, 100, speed, "they should be equal")
-}
\ No newline at end of file
+}
+
+func TestSpeedIn(t *testing.T) {
+	startTime := time.Unix(1514851200, 0)
+	endTime := startTime.Add(time.Hour * 10)
+	//1000 km
+	distance := 1000000.0
+
+	assert.Equal(t, 100, SpeedIn(Kilometers, distance, startTime.Unix(), endTime.Unix()), "they should be equal")
+	assert.Equal(t, 62, SpeedIn(Miles, distance, startTime.Unix(), endTime.Unix()), "they should be equal")
+}
+
+func TestSpeedEqualTimestamps(t *testing.T) {
+	ts := time.Unix(1514851200, 0).Unix()
+
+	assert.Equal(t, InstantSpeed, Speed(1000000, ts, ts), "being in two places at once should be maximally suspicious")
+	assert.Equal(t, InstantSpeed, SpeedIn(Kilometers, 1, ts, ts))
+	assert.Equal(t, 0, Speed(0, ts, ts), "two logins from the same place at once are not suspicious")
+}
+
+func TestSpeedOutOfOrder(t *testing.T) {
+	startTime := time.Unix(1514851200, 0)
+	endTime := startTime.Add(time.Hour * 10)
+	distance := 1000000.0
+
+	assert.Equal(t, 100, SpeedIn(Kilometers, distance, endTime.Unix(), startTime.Unix()), "order of the timestamps shouldn't matter")
+}
+
+func TestSpeedSamePairEitherOrder(t *testing.T) {
+	for _, pair := range [][2]int64{{1514677279, 1514764800}, {1514764800, 1514764801}, {1514764800, 1514851200}} {
+		forward := Speed(2151908.69, pair[0], pair[1])
+		backward := Speed(2151908.69, pair[1], pair[0])
+		assert.True(t, forward > 0, "speed should be positive, got %v", forward)
+		assert.Equal(t, forward, backward, "order of the timestamps shouldn't matter")
+	}
+}
+
+func TestFractionalSpeedIn(t *testing.T) {
+	startTime := time.Unix(1514851200, 0)
+	endTime := startTime.Add(time.Hour * 4)
+	//1 km
+	distance := 1000.0
+
+	assert.Equal(t, 0.25, FractionalSpeedIn(Kilometers, distance, startTime.Unix(), endTime.Unix()))
+	assert.Equal(t, 0, SpeedIn(Kilometers, distance, startTime.Unix(), endTime.Unix()), "SpeedIn still truncates")
+	assert.Equal(t, float64(InstantSpeed), FractionalSpeedIn(Kilometers, 1, startTime.Unix(), startTime.Unix()))
+}
@@ -33,7 +33,23 @@ func Distance(lat1, lon1, lat2, lon2 float64) float64 {
 	r = 6378100 // Earth radius in METERS
 
 	// calculate
-	h := hsin(la2-la1) + math.Cos(la1)*math.Cos(la2)*hsin(lo2-lo1)
+	h := hsin(la2-la1) + math.Cos(la1)*math.Cos(la2)*hsin(wrapLon(lo2-lo1))
+	// Rounding can take nearly antipodal points just past 1, where Asin is NaN
+	h = math.Min(1, math.Max(0, h))
 
 	return 2 * r * math.Asin(math.Sqrt(h))
 }
+
+// Wraps a longitude difference in radians into [-pi, pi], the short way round, so points
+// either side of the antimeridian (179 and -179) are 2 degrees apart rather than 358
+func wrapLon(d float64) float64 {
+	if math.Abs(d) <= math.Pi {
+		return d
+	}
+	return math.Remainder(d, 2*math.Pi)
+}
+
+// Same as Distance but returns the result in the given unit instead of meters
+func DistanceIn(unit Unit, lat1, lon1, lat2, lon2 float64) float64 {
+	return unit.FromMeters(Distance(lat1, lon1, lat2, lon2))
+}
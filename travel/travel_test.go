@@ -12,4 +12,59 @@ func TestDistance(t *testing.T) {
 
 	distance := Distance(lat1, lon1, lat2, lon2)
 	assert.Equal(t, 1226, int(distance * 0.000621371), "they should be equal")
-}
\ No newline at end of file
+}
+
+func TestDistanceIn(t *testing.T) {
+	// New York (JFK) to London (LHR), roughly 5540 km / 3443 mi
+	lat1, lon1 := 40.6413, -73.7781
+	lat2, lon2 := 51.4700, -0.4543
+
+	assert.InDelta(t, 5540, DistanceIn(Kilometers, lat1, lon1, lat2, lon2), 15, "JFK to LHR in km")
+	assert.InDelta(t, 3443, DistanceIn(Miles, lat1, lon1, lat2, lon2), 10, "JFK to LHR in miles")
+
+	// Austin to Los Angeles, roughly 1973 km / 1226 mi
+	lat1, lon1 = 30.3773, -97.71
+	lat2, lon2 = 34.0549, -118.2578
+
+	assert.InDelta(t, 1973, DistanceIn(Kilometers, lat1, lon1, lat2, lon2), 5, "Austin to LA in km")
+	assert.InDelta(t, 1226, DistanceIn(Miles, lat1, lon1, lat2, lon2), 3, "Austin to LA in miles")
+}
+
+func TestParseUnit(t *testing.T) {
+	for name, expected := range map[string]Unit{"": Miles, "mi": Miles, "km": Kilometers} {
+		unit, err := ParseUnit(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, unit)
+	}
+
+	_, err := ParseUnit("furlongs")
+	assert.Error(t, err)
+}
+
+func TestDistanceAntimeridian(t *testing.T) {
+	// A degree either side of the antimeridian on the equator is 2 degrees, about 222.6 km, apart
+	assert.InDelta(t, 222.6, DistanceIn(Kilometers, 0, 179, 0, -179), 0.5, "across the antimeridian")
+	assert.InDelta(t, 222.6, DistanceIn(Kilometers, 0, -179, 0, 179), 0.5, "back across the antimeridian")
+	// Fiji (Suva) to Samoa (Apia), roughly 1150 km
+	assert.InDelta(t, 1150, DistanceIn(Kilometers, -18.1416, 178.4419, -13.8333, -171.7667), 20, "Suva to Apia")
+
+	// Longitudes written past 180 are the same places
+	assert.InDelta(t, Distance(0, 179, 0, -179), Distance(0, 179, 0, 181), 1e-6, "lon 181 is lon -179")
+
+	for _, f := range []Formula{Haversine, VincentyFormula, RhumbFormula} {
+		assert.InDelta(t, 222.6, Kilometers.FromMeters(f.Distance(0, 179, 0, -179)), 0.5, f.String())
+	}
+}
+
+func TestDistancePoles(t *testing.T) {
+	// Opposite sides of the north pole, 0.1 degrees from it: 0.2 degrees, about 22.3 km, over the top
+	assert.InDelta(t, 22.26, DistanceIn(Kilometers, 89.9, 0, 89.9, 180), 0.05, "over the north pole")
+	assert.InDelta(t, 2.226, DistanceIn(Kilometers, -89.99, 45, -89.99, -135), 0.005, "over the south pole")
+	// At the pole the longitude doesn't matter
+	assert.InDelta(t, 0, Distance(90, 0, 90, 123), 1e-6, "the same pole")
+	assert.InDelta(t, 111.3, DistanceIn(Kilometers, -90, 0, -89, 10), 0.5, "a degree from the south pole")
+
+	// Antipodes are half the circumference apart, never NaN
+	assert.InDelta(t, 20037.4, DistanceIn(Kilometers, 90, 0, -90, 0), 0.5, "pole to pole")
+	assert.InDelta(t, 20037.4, DistanceIn(Kilometers, 10, 20, -10, -160), 0.5, "antipodes")
+}
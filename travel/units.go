@@ -0,0 +1,49 @@
+package travel
+
+import (
+	"fmt"
+)
+
+// Unit selects whether distances and speeds are reported in miles (mph) or kilometers (km/h)
+type Unit int
+
+const (
+	Miles Unit = iota
+	Kilometers
+)
+
+const (
+	milesPerMeter      = 0.00062137
+	kilometersPerMeter = 0.001
+)
+
+// Parses the unit names accepted on the api ("mi" or "km"). An empty string is Miles.
+func ParseUnit(name string) (Unit, error) {
+	switch name {
+	case "", "mi":
+		return Miles, nil
+	case "km":
+		return Kilometers, nil
+	}
+	return Miles, fmt.Errorf("unknown unit %q, expected km or mi", name)
+}
+
+func (u Unit) String() string {
+	if u == Kilometers {
+		return "km"
+	}
+	return "mi"
+}
+
+// Converts a distance in meters to this unit
+func (u Unit) FromMeters(meters float64) float64 {
+	if u == Kilometers {
+		return meters * kilometersPerMeter
+	}
+	return meters * milesPerMeter
+}
+
+// Converts a distance (or speed) in miles to this unit
+func (u Unit) FromMiles(miles float64) float64 {
+	return u.FromMeters(miles / milesPerMeter)
+}
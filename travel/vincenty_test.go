@@ -0,0 +1,51 @@
+package travel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVincenty(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		// Published WGS-84 distance in meters
+		expected float64
+		delta    float64
+	}{
+		// Geoscience Australia's worked example of Vincenty's formula
+		{"Flinders Peak to Buninyong", -37.95103342, 144.42486789, -37.65282114, 143.92649554, 54972.271, 0.001},
+		{"JFK to LHR", 40.6413, -73.7781, 51.4700, -0.4543, 5555000, 1000},
+		{"SYD to LAX", -33.9461, 151.1772, 33.9425, -118.4081, 12051000, 1000},
+		// A quarter of the equator is pi/2 times the semi-major axis
+		{"along the equator", 0, 0, 0, 90, 10018754.171, 0.001},
+		{"same point", 51.47, -0.4543, 51.47, -0.4543, 0, 0},
+	}
+	for _, tc := range tests {
+		assert.InDelta(t, tc.expected, Vincenty(tc.lat1, tc.lon1, tc.lat2, tc.lon2), tc.delta, tc.name)
+	}
+
+	// The sphere is noticeably off over the long routes
+	assert.InDelta(t, 12051000, Distance(-33.9461, 151.1772, 33.9425, -118.4081), 30000)
+	assert.True(t, Distance(-33.9461, 151.1772, 33.9425, -118.4081)-12051000 > 20000, "haversine should overshoot SYD to LAX")
+}
+
+func TestVincentyNearlyAntipodal(t *testing.T) {
+	// Vincenty's iteration doesn't converge here, so the haversine distance is used
+	lat1, lon1 := 0.0, 0.0
+	lat2, lon2 := 0.5, 179.7
+
+	assert.Equal(t, Distance(lat1, lon1, lat2, lon2), Vincenty(lat1, lon1, lat2, lon2))
+}
+
+func TestParseFormula(t *testing.T) {
+	for name, expected := range map[string]Formula{"": Haversine, "haversine": Haversine, "vincenty": VincentyFormula, "rhumb": RhumbFormula} {
+		formula, err := ParseFormula(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, formula)
+	}
+
+	_, err := ParseFormula("flat-earth")
+	assert.Error(t, err)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Steps SUPERMAN_USERNAME_NORMALIZE can apply to usernames
+const (
+	normalizeTrim  = "trim"
+	normalizeLower = "lower"
+)
+
+// Applies the configured normalization steps, so e.g. "Alice " and "alice" are one user.
+// With none configured usernames are compared exactly as sent.
+func (env *Env) normalizeUsername(username string) string {
+	for _, step := range env.NormalizeUsernames {
+		switch step {
+		case normalizeTrim:
+			username = strings.TrimSpace(username)
+		case normalizeLower:
+			username = strings.ToLower(username)
+		}
+	}
+	return username
+}
+
+// The {username} path variable, normalized like usernames in login records
+func (env *Env) usernameVar(request *http.Request) string {
+	return env.normalizeUsername(mux.Vars(request)["username"])
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"detector/models"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeUsername(t *testing.T) {
+	tests := []struct {
+		steps    []string
+		username string
+		want     string
+	}{
+		{nil, " Alice ", " Alice "},
+		{[]string{normalizeTrim}, " Alice\t", "Alice"},
+		{[]string{normalizeLower}, "ÅLICE", "ålice"},
+		{[]string{normalizeTrim, normalizeLower}, "  Alice ", "alice"},
+	}
+
+	for _, tc := range tests {
+		env := &Env{Config: defaultConfig()}
+		env.NormalizeUsernames = tc.steps
+		if got := env.normalizeUsername(tc.username); got != tc.want {
+			t.Errorf("%q with %v: got %q want %q", tc.username, tc.steps, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizedUsernamesShareHistory(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.NormalizeUsernames = []string{normalizeTrim, normalizeLower}
+	seedLogins(t, memEnv, models.Login{Username: "alice", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)})
+
+	// A second later from Los Angeles, under a differently written username
+	req, err := http.NewRequest("POST", "/v1/", bytes.NewBufferString(`{"username": " Alice ", "unix_timestamp": 1514764801, "event_uuid": "00000000-0000-4000-8000-00000000000b", "ip_address": "91.207.175.104"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	memEnv.routes().ServeHTTP(rr, req)
+	var result loginResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if !result.Suspicious || result.PrecedingIpAccess == nil || result.PrecedingIpAccess.IP != "24.242.71.20" {
+		t.Errorf("expected the login to be checked against alice's, got %s", rr.Body.String())
+	}
+
+	logins, err := memEnv.store.LoginsByUsername(context.Background(), "alice", models.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 2 {
+		t.Errorf("expected the login to be saved as alice, got %+v", logins)
+	}
+	if rr := getPath(t, memEnv, "/v1/logins/ALICE"); rr.Code != http.StatusOK {
+		t.Errorf("expected looking up ALICE to find alice's logins, got %v %s", rr.Code, rr.Body.String())
+	}
+
+	// Usernames that are only whitespace are still rejected
+	if _, err := memEnv.parsePostBody(httptest.NewRequest("POST", "/v1/", bytes.NewBufferString(`{"username": "  ", "unix_timestamp": 1514764801, "event_uuid": "00000000-0000-4000-8000-00000000000c", "ip_address": "91.207.175.104"}`))); err != errInvalidInputs {
+		t.Errorf("expected a blank username to be invalid, got %v", err)
+	}
+}
+
+// Without normalization configured, differently cased usernames are different users
+func TestUsernamesCaseSensitiveByDefault(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	seedLogins(t, memEnv, models.Login{Username: "alice", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "24.242.71.20", Lat: 30.3773, Lon: -97.71, Radius: accuracyRadius(5)})
+	if rr := getPath(t, memEnv, "/v1/logins/Alice"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected Alice to have no logins, got %v %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import "net/http"
+
+// Handles GET /v1/users, listing every user with a login since ?since= and when they were
+// last seen, ordered by username and paged with ?limit= and ?offset=. Usernames are
+// personal data, so an API key is needed whenever keys are configured.
+func (env *Env) HandleUsers(rw http.ResponseWriter, request *http.Request) {
+	opts, err := parseListOptions(request)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+
+	users, err := env.store.DistinctUsernames(request.Context(), opts)
+	if err != nil {
+		env.logFor(request.Context()).Error("could not list users", "error", err)
+		writeError(rw, http.StatusInternalServerError, codeInternal, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	env.writeJSON(rw, request, http.StatusOK, users)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"detector/models"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestUsers(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	seedLogins(t, memEnv,
+		models.Login{Username: "carol", UnixTimestamp: 1514000000, EventUUID: "00000000-0000-4000-8000-000000000001", IPAddr: "24.242.71.20"},
+		models.Login{Username: "bob", UnixTimestamp: 1514677279, EventUUID: "00000000-0000-4000-8000-000000000002", IPAddr: "24.242.71.20"},
+		models.Login{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-000000000003", IPAddr: "206.81.252.6"},
+		models.Login{Username: "alice", UnixTimestamp: 1514764801, EventUUID: "00000000-0000-4000-8000-000000000004", IPAddr: "91.207.175.104"},
+		models.Login{Username: "dave", UnixTimestamp: 1514764900, EventUUID: "00000000-0000-4000-8000-000000000005", IPAddr: "91.207.175.104"},
+	)
+
+	tests := []struct {
+		path string
+		want []models.UserActivity
+	}{
+		{"/v1/users", []models.UserActivity{{Username: "alice", LastSeen: 1514764801}, {Username: "bob", LastSeen: 1514764800}, {Username: "carol", LastSeen: 1514000000}, {Username: "dave", LastSeen: 1514764900}}},
+		// carol hasn't logged in since
+		{"/v1/users?since=1514677279", []models.UserActivity{{Username: "alice", LastSeen: 1514764801}, {Username: "bob", LastSeen: 1514764800}, {Username: "dave", LastSeen: 1514764900}}},
+		{"/v1/users?since=1514677279&limit=2", []models.UserActivity{{Username: "alice", LastSeen: 1514764801}, {Username: "bob", LastSeen: 1514764800}}},
+		{"/v1/users?since=1514677279&limit=2&offset=2", []models.UserActivity{{Username: "dave", LastSeen: 1514764900}}},
+		{"/v1/users?since=1514764901", []models.UserActivity{}},
+	}
+
+	for _, tc := range tests {
+		rr := getPath(t, memEnv, tc.path)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v: %s", tc.path, rr.Code, http.StatusOK, rr.Body.String())
+		}
+		var got []models.UserActivity
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v want %+v", tc.path, got, tc.want)
+		}
+	}
+
+	if rr := getPath(t, memEnv, "/v1/users?limit=0"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a zero limit to be rejected, got %v %s", rr.Code, rr.Body.String())
+	}
+}
+
+// Usernames are personal data, so listing them needs a key even when reads don't
+func TestUsersNeedsAPIKey(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	memEnv.APIKeys = []string{"first-key"}
+
+	if rr := getPath(t, memEnv, "/v1/users"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected a request without a key to be refused, got %v", rr.Code)
+	}
+
+	req, err := http.NewRequest("GET", "/v1/users", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer first-key")
+	rr := httptest.NewRecorder()
+	memEnv.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected a request with a key to succeed, got %v %s", rr.Code, rr.Body.String())
+	}
+}
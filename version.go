@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Build info, set at build time with e.g.
+// go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// Body of GET /v1/version
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	// When the loaded GeoIP database was built, left out when the resolver doesn't say
+	GeoBuildEpoch int64 `json:"geoip_build_epoch,omitempty"`
+}
+
+// Handles GET /v1/version, so behaviour can be matched up with what's deployed
+func (env *Env) HandleVersion(rw http.ResponseWriter, request *http.Request) {
+	info := versionInfo{Version: version, Commit: commit, BuildDate: buildDate}
+	if built, ok := env.geoBuildTime(); ok {
+		info.GeoBuildEpoch = built.Unix()
+	}
+	env.writeJSON(rw, request, http.StatusOK, info)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.2.0", "0123abc", "2018-01-01T00:00:00Z"
+
+	rr := getPath(t, newMemoryEnv(t), "/v1/version")
+	var info versionInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	want := versionInfo{Version: "1.2.0", Commit: "0123abc", BuildDate: "2018-01-01T00:00:00Z", GeoBuildEpoch: fixtureBuildEpoch(t)}
+	if rr.Code != http.StatusOK || info != want {
+		t.Errorf("unexpected version response: %v %v", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"detector/models"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Header carrying the hex HMAC-SHA256 of the webhook body, keyed with WebhookSecret
+const webhookSignatureHeader = "X-Superman-Signature"
+
+// How many detections can wait to be delivered before new ones are dropped
+const webhookQueueSize = 1024
+
+// POSTs each detection to a webhook in the background, retrying failed deliveries with
+// exponential backoff. Like the auditor, a slow or broken receiver never holds up a response.
+type webhookNotifier struct {
+	url         string
+	secret      string
+	maxAttempts int
+	// Wait before the first retry; doubled for each one after
+	backoff time.Duration
+	client  *http.Client
+	entries chan models.Detection
+	done    chan struct{}
+	// Cancelled when close gives up waiting, which abandons the delivery in progress and
+	// drops the rest of the queue. Only run counts the drops, so close reads them once it's done.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	dropped int
+	logger  *slog.Logger
+	// Guards entries being closed, as the auditor's does
+	mu     sync.Mutex
+	closed bool
+}
+
+func newWebhookNotifier(url, secret string, maxAttempts int, logger *slog.Logger) *webhookNotifier {
+	w := &webhookNotifier{
+		url:         url,
+		secret:      secret,
+		maxAttempts: maxAttempts,
+		backoff:     500 * time.Millisecond,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		entries:     make(chan models.Detection, webhookQueueSize),
+		done:        make(chan struct{}),
+		logger:      logger,
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	go w.run()
+	return w
+}
+
+func (w *webhookNotifier) run() {
+	defer close(w.done)
+	for d := range w.entries {
+		if w.ctx.Err() != nil {
+			w.dropped++
+			continue
+		}
+		if err := w.deliver(d); w.ctx.Err() != nil {
+			w.dropped++
+		} else if err != nil {
+			w.logger.Error("could not deliver webhook", "user", hashUsername(d.Username), "event_uuid", d.EventUUID, "error", err)
+		}
+	}
+}
+
+// Sends one detection, retrying until it's accepted or maxAttempts is reached
+func (w *webhookNotifier) deliver(d models.Detection) error {
+	body, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	wait := w.backoff
+	for attempt := 1; ; attempt++ {
+		err = w.post(body)
+		if err == nil || attempt >= w.maxAttempts {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-w.ctx.Done():
+			return w.ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+func (w *webhookNotifier) post(body []byte) error {
+	req, err := http.NewRequestWithContext(w.ctx, "POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.secret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhook(w.secret, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %v", resp.Status)
+	}
+	return nil
+}
+
+// The signature receivers should compare (in constant time) with the X-Superman-Signature header
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Queues a detection to be delivered. Safe to call on a nil notifier, which discards it.
+func (w *webhookNotifier) notify(d models.Detection) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		w.logger.Error("webhook closed, dropping notification", "user", hashUsername(d.Username), "event_uuid", d.EventUUID)
+		return
+	}
+	select {
+	case w.entries <- d:
+	default:
+		w.logger.Error("webhook queue full, dropping notification", "user", hashUsername(d.Username), "event_uuid", d.EventUUID)
+	}
+}
+
+// Delivers any queued detections and stops the notifier. Whatever is still queued after
+// timeout is dropped, so a slow or broken receiver can't hold up shutdown, as is anything
+// notified afterwards.
+func (w *webhookNotifier) close(timeout time.Duration) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.closed = true
+	close(w.entries)
+	w.mu.Unlock()
+	select {
+	case <-w.done:
+	case <-time.After(timeout):
+		w.cancel()
+		<-w.done
+	}
+	w.cancel()
+	if w.dropped > 0 {
+		w.logger.Error("webhook notifications dropped on shutdown", "count", w.dropped)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"detector/models"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A webhook receiver that fails the first failures deliveries and records the rest
+type webhookReceiver struct {
+	mu         sync.Mutex
+	failures   int
+	attempts   int
+	bodies     [][]byte
+	signatures []string
+}
+
+func (r *webhookReceiver) ServeHTTP(rw http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts++
+	if r.attempts <= r.failures {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	r.bodies = append(r.bodies, body)
+	r.signatures = append(r.signatures, request.Header.Get(webhookSignatureHeader))
+}
+
+func newTestWebhook(t *testing.T, receiver *webhookReceiver, maxAttempts int) *webhookNotifier {
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+	w := newWebhookNotifier(server.URL, "s3cret", maxAttempts, env.logger)
+	w.backoff = time.Millisecond
+	return w
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	receiver := &webhookReceiver{failures: 2}
+	memEnv := newMemoryEnv(t)
+	memEnv.webhook = newTestWebhook(t, receiver, 3)
+
+	rr := postBetweenNeighbours(t, memEnv)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	memEnv.webhook.close(time.Minute)
+
+	if receiver.attempts != 3 {
+		t.Errorf("expected two failed deliveries and one retry, got %v attempts", receiver.attempts)
+	}
+	if len(receiver.bodies) != 1 {
+		t.Fatalf("expected one delivered notification, got %v", len(receiver.bodies))
+	}
+	if expected := signWebhook("s3cret", receiver.bodies[0]); !hmac.Equal([]byte(receiver.signatures[0]), []byte(expected)) {
+		t.Errorf("unexpected signature: got %v want %v", receiver.signatures[0], expected)
+	}
+	var d models.Detection
+	if err := json.Unmarshal(receiver.bodies[0], &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Direction != "from" || d.EventUUID != "00000000-0000-4000-8000-00000000000b" || d.OtherEventUUID != "00000000-0000-4000-8000-00000000000c" || int(d.Speed) != 8330887 {
+		t.Errorf("unexpected payload: got %+v", d)
+	}
+}
+
+func TestWebhookConcurrentLogin(t *testing.T) {
+	receiver := &webhookReceiver{}
+	memEnv := newMemoryEnv(t)
+	memEnv.webhook = newTestWebhook(t, receiver, 3)
+	memEnv.ConcurrentWindow = time.Minute
+	// High enough that only the concurrent check can flag the login
+	memEnv.SpeedThreshold = 1000000
+	// Thirty seconds before the Baltimore login the user logged in from London
+	london := models.Login{Username: "bob", UnixTimestamp: 1514764770, EventUUID: "00000000-0000-4000-8000-00000000000a", IPAddr: "81.2.69.142", Lat: 51.5142, Lon: -0.0931, Radius: accuracyRadius(10)}
+	seedLogins(t, memEnv, london)
+
+	lr := loginRecord{Username: "bob", UnixTimestamp: 1514764800, EventUUID: "00000000-0000-4000-8000-00000000000b", IPAddr: "206.81.252.6"}
+	result, err := memEnv.Evaluate(context.Background(), lr, evalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	memEnv.webhook.close(time.Minute)
+	if !result.Suspicious {
+		t.Fatalf("expected the concurrent login to be suspicious, got %+v", result)
+	}
+
+	if len(receiver.bodies) != 1 {
+		t.Fatalf("expected one delivered notification, got %v", len(receiver.bodies))
+	}
+	var d models.Detection
+	if err := json.Unmarshal(receiver.bodies[0], &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Direction != "concurrent" || d.EventUUID != lr.EventUUID || d.OtherEventUUID != london.EventUUID || d.Speed != 0 || d.Distance < 3000 {
+		t.Errorf("unexpected payload: got %+v", d)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	receiver := &webhookReceiver{failures: 10}
+	w := newTestWebhook(t, receiver, 3)
+	w.notify(models.Detection{Username: "bob", EventUUID: "00000000-0000-4000-8000-00000000000b"})
+	w.close(time.Minute)
+
+	if receiver.attempts != 3 {
+		t.Errorf("expected delivery to stop after 3 attempts, got %v", receiver.attempts)
+	}
+}
+
+func TestWebhookOff(t *testing.T) {
+	memEnv := newMemoryEnv(t)
+	rr := postBetweenNeighbours(t, memEnv)
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	memEnv.webhook.close(time.Minute)
+}
+
+func TestWebhookCloseTimeout(t *testing.T) {
+	receiver := &webhookReceiver{failures: 100}
+	w := newTestWebhook(t, receiver, 5)
+	// Long enough that waiting out the retries would hang the test
+	w.backoff = time.Hour
+	for i := 0; i < 3; i++ {
+		w.notify(models.Detection{Username: "bob", EventUUID: "00000000-0000-4000-8000-00000000000b"})
+	}
+
+	start := time.Now()
+	w.close(50 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected close to give up after its timeout, took %v", elapsed)
+	}
+	if w.dropped != 3 {
+		t.Errorf("expected the backed off delivery and the queued ones to be dropped, got %v", w.dropped)
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if receiver.attempts != 1 {
+		t.Errorf("expected a single attempt before the backoff, got %v", receiver.attempts)
+	}
+}
+
+func TestWebhookNotifyAfterClose(t *testing.T) {
+	receiver := &webhookReceiver{}
+	w := newTestWebhook(t, receiver, 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				w.notify(models.Detection{Username: "bob", EventUUID: "00000000-0000-4000-8000-00000000000b"})
+			}
+		}()
+	}
+	w.close(time.Minute)
+	wg.Wait()
+	w.notify(models.Detection{Username: "bob", EventUUID: "00000000-0000-4000-8000-00000000000c"})
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	for _, body := range receiver.bodies {
+		var d models.Detection
+		if err := json.Unmarshal(body, &d); err != nil || d.EventUUID != "00000000-0000-4000-8000-00000000000b" {
+			t.Errorf("expected nothing notified after close to be delivered, got %s", body)
+		}
+	}
+}